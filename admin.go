@@ -0,0 +1,276 @@
+package rdv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A client waiting in the lobby, see AdminHandler.
+type AdminLobbyEntry struct {
+	// Hash of the token, see AdminTokenHash. Tokens aren't exposed, since they are secrets.
+	TokenHash string    `json:"token_hash"`
+	Namespace string    `json:"namespace,omitempty"`
+	Joined    time.Time `json:"joined"`
+
+	// Observed addr and its space.
+	Addr  *netip.AddrPort `json:"addr,omitempty"`
+	Space string          `json:"space"`
+
+	// Method of the client, "dial", "accept" or "symmetric".
+	Method string `json:"method"`
+
+	// Number of clients in the group, see Client.JoinGroup.
+	GroupSize int `json:"group_size,omitempty"`
+}
+
+// An active relay, see AdminHandler.
+type AdminRelay struct {
+	TokenHash string    `json:"token_hash"`
+	Namespace string    `json:"namespace,omitempty"`
+	Started   time.Time `json:"started"`
+
+	// Observed addrs of the dialer and the acceptor.
+	DialAddr   *netip.AddrPort `json:"dial_addr,omitempty"`
+	AcceptAddr *netip.AddrPort `json:"accept_addr,omitempty"`
+
+	// Number of bytes read from the dialer and the acceptor so far, like Event.DialBytes.
+	DialBytes   int64 `json:"dial_bytes"`
+	AcceptBytes int64 `json:"accept_bytes"`
+}
+
+// Returns the hash of a token that the admin views show instead of the token: the first 16 hex
+// digits of its SHA-256.
+func AdminTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// The active relays of a server, by pair.
+type relayRegistry struct {
+	mu     sync.Mutex
+	relays map[*Conn]*relayEntry // by dialer conn
+}
+
+type relayEntry struct {
+	dc, ac  *Conn
+	started time.Time
+}
+
+// Registers a relay, and returns a func that unregisters it.
+func (r *relayRegistry) add(e *relayEntry) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.relays == nil {
+		r.relays = make(map[*Conn]*relayEntry)
+	}
+	r.relays[e.dc] = e
+	return func() { r.remove(e.dc) }
+}
+
+// Unregisters a relay, e.g. once it's kicked, before its ServeFunc has returned.
+func (r *relayRegistry) remove(dc *Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.relays, dc)
+}
+
+func (r *relayRegistry) list() []*relayEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make([]*relayEntry, 0, len(r.relays))
+	for _, e := range r.relays {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *relayEntry) int { return a.started.Compare(b.started) })
+	return entries
+}
+
+// Returns the relays that are still active.
+func (l *Server) Relays() []AdminRelay {
+	relays := []AdminRelay{}
+	for _, e := range l.relays.list() {
+		relays = append(relays, AdminRelay{
+			TokenHash:   AdminTokenHash(e.dc.meta.Token),
+			Namespace:   e.dc.meta.Namespace,
+			Started:     e.started,
+			DialAddr:    e.dc.meta.ObservedAddr,
+			AcceptAddr:  e.ac.meta.ObservedAddr,
+			DialBytes:   e.dc.read.Load(),
+			AcceptBytes: e.ac.read.Load(),
+		})
+	}
+	return relays
+}
+
+// Returns the clients in the lobby, including group members, by join time. Requires that Serve
+// is running.
+func (l *Server) Lobby(ctx context.Context) ([]AdminLobbyEntry, error) {
+	entries := []AdminLobbyEntry{}
+	err := l.inLoop(ctx, func() {
+		for _, w := range l.idle {
+			entries = append(entries, newAdminLobbyEntry(w))
+		}
+		for _, g := range l.groups {
+			for _, w := range g.members {
+				entries = append(entries, newAdminLobbyEntry(w))
+			}
+		}
+	})
+	slices.SortFunc(entries, func(a, b AdminLobbyEntry) int { return a.Joined.Compare(b.Joined) })
+	return entries, err
+}
+
+func newAdminLobbyEntry(w *idleWatch) AdminLobbyEntry {
+	m := w.conn.meta
+	e := AdminLobbyEntry{
+		TokenHash: AdminTokenHash(m.Token),
+		Namespace: m.Namespace,
+		Joined:    w.joined,
+		Addr:      m.ObservedAddr,
+		Method:    "accept",
+		GroupSize: m.GroupSize,
+	}
+	if m.ObservedAddr != nil {
+		e.Space = GetAddrSpace(m.ObservedAddr.Addr()).String()
+	}
+	switch {
+	case m.Symmetric:
+		e.Method = "symmetric"
+	case m.IsDialer:
+		e.Method = "dial"
+	}
+	return e
+}
+
+// Kicks the clients with the token hash (see AdminTokenHash) in the namespace: clients in the lobby
+// are rejected with 410 Gone, and relays are closed. Returns the number of lobby clients and
+// relays that were kicked. Requires that Serve is running.
+func (l *Server) Kick(ctx context.Context, namespace, tokenHash string) (lobby, relays int, err error) {
+	match := func(m *Meta) bool {
+		return m.Namespace == namespace && AdminTokenHash(m.Token) == tokenHash
+	}
+	var kicked []*Conn
+	err = l.inLoop(ctx, func() {
+		var keys []string
+		var members []*idleWatch
+		for key, w := range l.idle {
+			if match(w.conn.meta) {
+				keys = append(keys, key)
+			}
+		}
+		for _, g := range l.groups {
+			for _, w := range g.members {
+				if match(w.conn.meta) {
+					members = append(members, w)
+				}
+			}
+		}
+		// Clients may be kicked out by the lobby while interrupting others
+		for _, key := range keys {
+			if conn := l.interruptAndGetIdle(key); conn != nil {
+				l.release(key)
+				kicked = append(kicked, conn)
+			}
+		}
+		for _, w := range members {
+			if l.interrupt(w) {
+				l.leaveGroup(w)
+				kicked = append(kicked, w.conn)
+			}
+		}
+	})
+	for _, conn := range kicked { // outside the loop, since responses are written to the network
+		l.kick(conn)
+	}
+	for _, e := range l.relays.list() {
+		if match(e.dc.meta) {
+			e.dc.Close()
+			e.ac.Close()
+			l.relays.remove(e.dc) // no longer active, even if the ServeFunc hasn't returned yet
+			relays++
+		}
+	}
+	return len(kicked), relays, err
+}
+
+func (l *Server) kick(conn *Conn) {
+	writeResponseErr(conn, http.StatusGone, "kicked by server operator")
+	l.cfg.Logger.Debug("rdv server: kicked", "token_hash", AdminTokenHash(conn.meta.Token), "addr", conn.meta.ObservedAddr)
+	l.emitConn(PeerTimedOut, conn, ErrKicked)
+}
+
+// Runs fn in the Serve loop, which owns the lobby.
+func (l *Server) inLoop(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	select {
+	case l.adminCh <- func() { fn(); close(done) }:
+	case <-l.done:
+		return ErrServerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// Returns a handler of JSON views for operators:
+//
+//	GET  /lobby  lists the clients in the lobby, see Lobby
+//	GET  /relays lists the active relays, see Relays
+//	POST /kick   kicks the clients of a token, with the query params token_hash (or token) and
+//	             namespace, see Kick
+//
+// The handler doesn't authenticate requests, so it must not be exposed to clients. Serve it on an
+// internal listener, or behind auth middleware, and mount it under a prefix with
+// http.StripPrefix.
+func (l *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /lobby", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := l.Lobby(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	})
+	mux.HandleFunc("GET /relays", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, l.Relays())
+	})
+	mux.HandleFunc("POST /kick", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		hash := q.Get("token_hash")
+		if token := q.Get("token"); token != "" {
+			hash = AdminTokenHash(token)
+		}
+		if hash == "" {
+			http.Error(w, "missing token_hash or token", http.StatusBadRequest)
+			return
+		}
+		lobby, relays, err := l.Kick(r.Context(), q.Get("namespace"), hash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		status := http.StatusOK
+		if lobby+relays == 0 {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, map[string]int{"lobby": lobby, "relays": relays})
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
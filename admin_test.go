@@ -0,0 +1,167 @@
+package rdv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Requests the admin handler, and decodes its JSON response into v, if not nil.
+func adminRequest(t *testing.T, h http.Handler, method, path string, v any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminLobby(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, nil)
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces, Namespace: "ns"})
+	go client.Accept(ctx, hs.URL, "accept", nil)
+	awaitLobby(t, server, 1)
+	go client.JoinGroup(ctx, hs.URL, "group", 3, nil)
+	awaitLobby(t, server, 2)
+	go client.Connect(ctx, hs.URL, "connect", nil)
+	awaitLobby(t, server, 3)
+
+	var entries []AdminLobbyEntry
+	if code := adminRequest(t, server.AdminHandler(), "GET", "/lobby", &entries); code != http.StatusOK {
+		t.Fatalf("expected %v, got %v", http.StatusOK, code)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, want := range []AdminLobbyEntry{
+		{TokenHash: AdminTokenHash("accept"), Namespace: "ns", Method: "accept", Space: "loopback"},
+		{TokenHash: AdminTokenHash("group"), Namespace: "ns", Method: "accept", Space: "loopback", GroupSize: 3},
+		{TokenHash: AdminTokenHash("connect"), Namespace: "ns", Method: "symmetric", Space: "loopback"},
+	} {
+		e := entries[i]
+		if e.TokenHash != want.TokenHash || e.Namespace != want.Namespace || e.Method != want.Method || e.Space != want.Space || e.GroupSize != want.GroupSize || e.Addr == nil {
+			t.Fatalf("expected %+v, got %+v", want, e)
+		}
+	}
+}
+
+func TestAdminRelays(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, nil)
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := client.Accept(ctx, hs.URL, "relay", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dc, _, err := client.Dial(ctx, hs.URL, "relay", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	ac := <-accepted
+	if ac == nil {
+		t.FailNow()
+	}
+	defer ac.Close()
+	go io.WriteString(dc, "hello")
+	if _, err := io.ReadFull(ac, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	var relays []AdminRelay
+	if code := adminRequest(t, server.AdminHandler(), "GET", "/relays", &relays); code != http.StatusOK {
+		t.Fatalf("expected %v, got %v", http.StatusOK, code)
+	}
+	if len(relays) != 1 {
+		t.Fatalf("expected 1 relay, got %d", len(relays))
+	}
+	r := relays[0]
+	if r.TokenHash != AdminTokenHash("relay") || r.DialAddr == nil || r.AcceptAddr == nil || r.DialBytes < 5 {
+		t.Fatalf("unexpected relay %+v", r)
+	}
+}
+
+func TestAdminKick(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var events []Event
+	server, hs := startServer(t, &ServerConfig{EventFunc: func(ev Event) {
+		if ev.Err == ErrKicked {
+			events = append(events, ev)
+		}
+	}})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces, Namespace: "ns"})
+
+	// A relay and a client in the lobby with the same token
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, _ := client.Accept(ctx, hs.URL, "token", nil)
+		accepted <- conn
+	}()
+	dc, _, err := client.Dial(ctx, hs.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	if ac := <-accepted; ac != nil {
+		defer ac.Close()
+	}
+	kicked := make(chan *http.Response, 1)
+	go func() {
+		_, resp, _ := client.Accept(ctx, hs.URL, "token", nil)
+		kicked <- resp
+	}()
+	awaitLobby(t, server, 1)
+
+	h := server.AdminHandler()
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+		want   map[string]int
+	}{
+		{name: "missing", query: url.Values{"namespace": {"ns"}}, status: http.StatusBadRequest},
+		{name: "other_namespace", query: url.Values{"token": {"token"}}, status: http.StatusNotFound, want: map[string]int{"lobby": 0, "relays": 0}},
+		{name: "token", query: url.Values{"token": {"token"}, "namespace": {"ns"}}, status: http.StatusOK, want: map[string]int{"lobby": 1, "relays": 1}},
+		{name: "again", query: url.Values{"token_hash": {AdminTokenHash("token")}, "namespace": {"ns"}}, status: http.StatusNotFound, want: map[string]int{"lobby": 0, "relays": 0}},
+	}
+	for _, tc := range tests { // in order, since they kick
+		t.Run(tc.name, func(t *testing.T) {
+			var got map[string]int
+			var v any
+			if tc.want != nil {
+				v = &got
+			}
+			if code := adminRequest(t, h, "POST", "/kick?"+tc.query.Encode(), v); code != tc.status {
+				t.Fatalf("expected %v, got %v", tc.status, code)
+			}
+			if tc.want != nil && (got["lobby"] != tc.want["lobby"] || got["relays"] != tc.want["relays"]) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+	if resp := <-kicked; resp == nil || resp.StatusCode != http.StatusGone {
+		t.Fatalf("expected %v, got %v", http.StatusGone, resp)
+	}
+	if _, err := dc.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the relay to be closed")
+	}
+	if len(events) != 1 || events[0].Namespace != "ns" {
+		t.Fatalf("expected 1 kick event, got %v", events)
+	}
+}
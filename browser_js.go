@@ -0,0 +1,186 @@
+//go:build js
+
+package rdv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"syscall/js"
+	"time"
+)
+
+// Whether the client runs in a browser (GOOS=js), where only the relay can be used.
+const browser = true
+
+// Sockets can't share ports in the browser, or be used for anything but the relay.
+var reuseControl func(network, address string, c syscall.RawConn) error
+
+var errBrowserWebSocket = errors.New("rdv: browser websocket failed")
+
+// Dials a WebSocket with the browser's WebSocket API, using the rdv subprotocol. Data is received
+// as binary messages, which are read as a stream.
+func dialBrowserWebSocket(ctx context.Context, url string) (net.Conn, error) {
+	c := &browserConn{
+		ws:       js.Global().Get("WebSocket").New(url, wsProtocol),
+		url:      url,
+		opened:   make(chan error, 1),
+		readable: make(chan struct{}, 1),
+	}
+	c.ws.Set("binaryType", "arraybuffer")
+	c.on("open", func(js.Value) {
+		c.open(nil)
+	})
+	c.on("message", func(ev js.Value) {
+		arr := js.Global().Get("Uint8Array").New(ev.Get("data"))
+		data := make([]byte, arr.Length())
+		js.CopyBytesToGo(data, arr)
+		c.receive(data, nil)
+	})
+	c.on("error", func(js.Value) {
+		c.open(errBrowserWebSocket) // the browser doesn't expose the reason
+	})
+	c.on("close", func(js.Value) {
+		c.open(errBrowserWebSocket)
+		c.receive(nil, io.EOF)
+		for _, fn := range c.funcs {
+			fn.Release()
+		}
+	})
+	select {
+	case err := <-c.opened:
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+	return c, nil
+}
+
+// A conn over a browser WebSocket. Writes never block, since the browser buffers them.
+type browserConn struct {
+	ws     js.Value
+	url    string
+	funcs  []js.Func // event listeners, released once closed
+	opened chan error
+
+	mu           sync.Mutex
+	buf          []byte // received data not yet read
+	err          error  // set once closed
+	readDeadline time.Time
+	readable     chan struct{} // signaled on changes, with capacity 1
+}
+
+func (c *browserConn) on(event string, fn func(ev js.Value)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) any {
+		fn(args[0])
+		return nil
+	})
+	c.funcs = append(c.funcs, f)
+	c.ws.Call("addEventListener", event, f)
+}
+
+func (c *browserConn) open(err error) {
+	select {
+	case c.opened <- err:
+	default:
+	}
+}
+
+func (c *browserConn) receive(data []byte, err error) {
+	c.mu.Lock()
+	c.buf = append(c.buf, data...)
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.notify()
+}
+
+func (c *browserConn) notify() {
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+func (c *browserConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		buf, err, deadline := c.buf, c.err, c.readDeadline
+		if len(buf) > 0 {
+			n := copy(p, buf)
+			c.buf = buf[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if deadline.IsZero() {
+			<-c.readable
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-c.readable:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *browserConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return 0, net.ErrClosed
+	}
+	arr := js.Global().Get("Uint8Array").New(len(p))
+	js.CopyBytesToJS(arr, p)
+	c.ws.Call("send", arr)
+	return len(p), nil
+}
+
+func (c *browserConn) Close() error {
+	c.receive(nil, net.ErrClosed)
+	c.ws.Call("close")
+	return nil
+}
+
+func (c *browserConn) LocalAddr() net.Addr  { return browserAddr("") }
+func (c *browserConn) RemoteAddr() net.Addr { return browserAddr(c.url) }
+
+func (c *browserConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *browserConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.notify()
+	return nil
+}
+
+func (c *browserConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type browserAddr string
+
+func (a browserAddr) Network() string { return "websocket" }
+func (a browserAddr) String() string  { return string(a) }
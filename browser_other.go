@@ -0,0 +1,22 @@
+//go:build !js
+
+package rdv
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/libp2p/go-reuseport"
+)
+
+// Whether the client runs in a browser (GOOS=js), where only the relay can be used.
+const browser = false
+
+// Allows sockets to share the local port, which is what makes hole punching possible.
+var reuseControl = reuseport.Control
+
+// The browser's WebSocket API is only available with GOOS=js.
+func dialBrowserWebSocket(ctx context.Context, url string) (net.Conn, error) {
+	return nil, errors.ErrUnsupported
+}
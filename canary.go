@@ -0,0 +1,172 @@
+package rdv
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Periodically connects two clients through an rdv server, typically from the server's own host
+// through its public URL, to monitor the service end-to-end like users see it. Catches broken
+// deployments that local health checks miss, e.g. load balancers that drop upgrades or report the
+// wrong observed addrs. Results are available from Last, ResultFunc (e.g. for metrics), and
+// ServeHTTP (e.g. for health checks). The zero value is not usable, Addr must be set.
+type Canary struct {
+	// Public URL of the rdv server. Required.
+	Addr string
+
+	// Config of the clients. Defaults to clients that only use the relay, so that each check
+	// covers the upgrade, the lobby and the relay. Use TlsConfig for servers with private CAs.
+	Config *ClientConfig
+
+	// Request headers of the clients, e.g. for authentication. May be nil.
+	Header http.Header
+
+	// Interval between checks. Defaults to 1m.
+	Interval time.Duration
+
+	// Max duration of each check. Defaults to 10s.
+	Timeout time.Duration
+
+	// Called with the result of each check. Optional.
+	ResultFunc func(CanaryResult)
+
+	once   sync.Once
+	client *Client
+	mu     sync.Mutex
+	last   CanaryResult
+}
+
+// The result of a canary check.
+type CanaryResult struct {
+	Time time.Time
+
+	// Duration from the start of the check until data was received through the conn. Zero if
+	// the check failed.
+	Latency time.Duration
+
+	// Whether the clients connected through the relay.
+	IsRelay bool
+
+	// Observed addrs of the dialer and the acceptor, as reported by the server.
+	DialAddr, AcceptAddr *netip.AddrPort
+
+	// Why the check failed, or nil if it succeeded.
+	Err error
+}
+
+// Runs checks until ctx is canceled, starting with one right away.
+func (c *Canary) Run(ctx context.Context) error {
+	ticker := time.NewTicker(cmp.Or(c.Interval, time.Minute))
+	defer ticker.Stop()
+	for {
+		c.Check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Connects two clients on a random token, and sends data from the acceptor to the dialer.
+func (c *Canary) Check(ctx context.Context) CanaryResult {
+	c.once.Do(func() {
+		cfg := ClientConfig{AddrSpaces: NoSpaces}
+		if c.Config != nil {
+			cfg = *c.Config
+		}
+		c.client = NewClient(&cfg)
+	})
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(c.Timeout, 10*time.Second))
+	defer cancel()
+	start := time.Now()
+	res := CanaryResult{Time: start}
+	res.Err = c.check(ctx, &res)
+	if res.Err == nil {
+		res.Latency = time.Since(start)
+	}
+	c.mu.Lock()
+	c.last = res
+	c.mu.Unlock()
+	if c.ResultFunc != nil {
+		c.ResultFunc(res)
+	}
+	return res
+}
+
+func (c *Canary) check(ctx context.Context, res *CanaryResult) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	token, msg := "rdv-canary-"+newSessionID(), []byte(newSessionID())
+	type acceptResult struct {
+		addr *netip.AddrPort
+		err  error
+	}
+	accepted := make(chan acceptResult, 1)
+	go func() {
+		conn, _, err := c.client.Accept(ctx, c.Addr, token, c.Header.Clone())
+		if err != nil {
+			accepted <- acceptResult{nil, fmt.Errorf("accept: %w", err)}
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write(msg)
+		accepted <- acceptResult{conn.Meta().ObservedAddr, err}
+	}()
+	conn, _, err := c.client.Dial(ctx, c.Addr, token, c.Header.Clone())
+	if err != nil {
+		cancel()
+		<-accepted
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	res.IsRelay, res.DialAddr = conn.IsRelay(), conn.Meta().ObservedAddr
+	reset := ctxIO(ctx, conn)
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, got)
+	reset()
+	ar := <-accepted
+	res.AcceptAddr = ar.addr
+	switch {
+	case ar.err != nil:
+		return ar.err
+	case err != nil:
+		return fmt.Errorf("read: %w", err)
+	case !bytes.Equal(got, msg):
+		return errors.New("rdv canary: received wrong data")
+	case res.DialAddr == nil || res.AcceptAddr == nil:
+		return errors.New("rdv canary: missing observed addr")
+	case *res.DialAddr == *res.AcceptAddr:
+		return fmt.Errorf("rdv canary: both clients observed as %v", res.DialAddr)
+	}
+	return nil
+}
+
+// Returns the result of the last check, or the zero value before the first.
+func (c *Canary) Last() CanaryResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// Responds with the last result, with status 200 OK if the check succeeded and 503 Service
+// Unavailable otherwise, e.g. for health checks of the server.
+func (c *Canary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res := c.Last()
+	switch {
+	case res.Time.IsZero():
+		http.Error(w, "rdv canary: no check yet", http.StatusServiceUnavailable)
+	case res.Err != nil:
+		http.Error(w, fmt.Sprintf("%v (at %v)", res.Err, res.Time.Format(time.RFC3339)), http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintf(w, "ok: latency %v, relay %v (at %v)\n", res.Latency, res.IsRelay, res.Time.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,97 @@
+package rdv_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/betamos/rdv/rdvtest"
+)
+
+func TestCanary(t *testing.T) {
+	forbid := func(*http.Request, *rdv.Meta) error { return &rdv.StatusError{Code: http.StatusForbidden} }
+	tests := map[string]struct {
+		cfg  *rdv.ServerConfig
+		addr string
+		ok   bool
+	}{
+		"ok":        {ok: true},
+		"forbidden": {cfg: &rdv.ServerConfig{AuthFunc: forbid}},
+		"down":      {addr: "http://down.test/"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := rdvtest.NewServer(t, tc.cfg)
+			var results []rdv.CanaryResult
+			c := &rdv.Canary{
+				Addr:       s.URL,
+				Config:     &rdv.ClientConfig{AddrSpaces: rdv.NoSpaces, DialServer: s.Network.Dial},
+				Timeout:    2 * time.Second,
+				ResultFunc: func(res rdv.CanaryResult) { results = append(results, res) },
+			}
+			if tc.addr != "" {
+				c.Addr = tc.addr
+			}
+			rec := httptest.NewRecorder()
+			c.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Fatalf("expected %v before the first check, got %v", http.StatusServiceUnavailable, rec.Code)
+			}
+
+			res := c.Check(context.Background())
+			if (res.Err == nil) != tc.ok {
+				t.Fatalf("expected ok %v, got %v", tc.ok, res.Err)
+			}
+			if len(results) != 1 || results[0].Time != res.Time || c.Last().Time != res.Time {
+				t.Fatalf("expected the result to be reported once, got %d results", len(results))
+			}
+			if tc.ok && (!res.IsRelay || res.Latency <= 0 || res.DialAddr == nil || res.AcceptAddr == nil) {
+				t.Fatalf("expected a relay with latency and observed addrs, got %+v", res)
+			}
+			if !tc.ok && res.Latency != 0 {
+				t.Fatalf("expected no latency, got %v", res.Latency)
+			}
+			status := http.StatusOK
+			if !tc.ok {
+				status = http.StatusServiceUnavailable
+			}
+			rec = httptest.NewRecorder()
+			c.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != status {
+				t.Fatalf("expected %v, got %v", status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestCanaryRun(t *testing.T) {
+	s := rdvtest.NewServer(t, nil)
+	results := make(chan rdv.CanaryResult, 10)
+	c := &rdv.Canary{
+		Addr:       s.URL,
+		Config:     &rdv.ClientConfig{AddrSpaces: rdv.NoSpaces, DialServer: s.Network.Dial},
+		Interval:   10 * time.Millisecond,
+		ResultFunc: func(res rdv.CanaryResult) { results <- res },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+	for range 2 {
+		select {
+		case res := <-results:
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
@@ -1,12 +1,19 @@
 package rdv
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
+	"io"
+	"iter"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,15 +25,216 @@ type ClientConfig struct {
 	// Strategy for choosing the conn to use. If nil, defaults to RelayPenalty(time.Second)
 	DialChooser Chooser
 
+	// Like DialChooser, but with access to the attempt, for policy-aware choosers. Takes
+	// precedence over DialChooser.
+	DialChooserFunc ChooserFunc
+
 	// Can be used to allow only a certain set of spaces, such as public IPs only. Defaults to
 	// DefaultSpaces which optimal for both local and global peering.
 	AddrSpaces AddrSpace
 
+	// Conditions for dialing peer addrs by their addr space, so that hopeless candidates are
+	// skipped. Defaults to DefaultPairing.
+	Pairing PairingMatrix
+
+	// Custom transports for dialing peer addrs, by their addr space, e.g. ProxyTransport for
+	// public addrs. Addrs in other spaces are dialed from the socket, which shares its port with
+	// the listener. Accepted conns are not affected.
+	Transports map[AddrSpace]Transport
+
 	// Defaults to using all available interface addresses. The list is automatically filtered by
 	// AddrSpaces. This is called on each Dial or Accept, so it should be quick (ideally < 100ms).
 	// Can be overridden if port mapping protocols are needed.
 	SelfAddrFunc func(ctx context.Context, socket *Socket) []netip.AddrPort
 
+	// If set, only a salted hash of the token is sent to the server (see HashToken), which keeps
+	// the token secret from relay operators. The token itself is still used in direct peer handshakes.
+	// Both peers must use the same setting and salt.
+	HashToken bool
+
+	// Salt for HashToken. Defaults to "rdv". Using an app-specific salt is recommended.
+	TokenSalt string
+
+	// Namespace of the tokens on the rdv server, for servers that host multiple applications.
+	// Both peers must use the same namespace.
+	Namespace string
+
+	// Max number of bytes read from error response bodies of the rdv server, which are returned
+	// to the caller for debugging. Defaults to 1024.
+	MaxErrorBody int64
+
+	// Use WebSocket to connect to the rdv server, for proxies and CDNs that block custom http
+	// upgrades. Relayed data is then framed, which adds some overhead. Server urls with a ws or
+	// wss scheme always use WebSocket.
+	WebSocket bool
+
+	// Network used to connect to the rdv server: "tcp4", "tcp6", or "tcp" for either, preferring
+	// ipv4. Defaults to "tcp4", since the observed ipv4 addr is what makes NAT traversal possible.
+	// Use "tcp6" for ipv6-only servers or networks, where peers connect over ipv6 (see AddrSpaces).
+	ServerNetwork string
+
+	// Returns the proxy for the conn to the rdv server, e.g. http.ProxyFromEnvironment, for
+	// networks that only allow outbound conns through an http CONNECT or socks5 proxy. Direct
+	// conns to peers bypass the proxy, so only the relay is used if they're blocked. The server
+	// then observes the proxy's addr, which is ignored.
+	ProxyFunc func(*http.Request) (*url.URL, error)
+
+	// Additional rdv servers, which Dial, Accept, Connect and Listen try in turn when signaling
+	// through the server fails transiently, e.g. when it's down. Both peers must use the same
+	// servers in the same order, and be able to reach the same ones.
+	FallbackServers []string
+
+	// If set, Dial, Accept and Listen signal through the server and all FallbackServers at once,
+	// and use the first that matches the peers, instead of trying them in turn. Saves the wait for
+	// servers that are down or unreachable by one of the peers, at the cost of a request to each
+	// server. Both peers must set it. Connect tries the servers in turn, since the servers could
+	// assign different roles.
+	RaceServers bool
+
+	// Dials the host:port of the rdv server instead of the network, e.g. to reach an in-process
+	// server in tests (see the rdvtest package). TLS and the SignalWrapper still apply. Optional.
+	DialServer func(ctx context.Context, addr string) (net.Conn, error)
+
+	// Highest protocol version proposed to rdv servers, which negotiate the version with the peer
+	// (see Meta.Version). Defaults to the latest version. Servers that only support version 1
+	// reject the proposal, and are retried with version 1, which is remembered per server.
+	ProtocolVersion int
+
+	// Wraps the conn to the rdv server, e.g. to obfuscate signaling. See SignalWrapper.
+	SignalWrapper SignalWrapper
+
+	// Enables TCP Fast Open on the socket, if supported by the system, which can save a round-trip
+	// when establishing direct conns to peers that support it. See Socket.EnableFastOpen.
+	FastOpen bool
+
+	// If set, peers include timestamps in the rdv header lines to estimate their clock offset and
+	// RTT, which are set on the conn's Meta, without extra round-trips. The acceptor estimates
+	// them from its HELLO and the dialer's CONFIRM. The dialer only receives the HELLO, so it
+	// estimates them from the PONG if it pinged the chosen conn (see LatencyChooser), i.e. not
+	// for relayed conns. Requires protocol version 2, and both peers must use the same setting.
+	ClockSync bool
+
+	// Downgrades that fail Dial and Accept with ErrDowngrade, e.g. DowngradeInsecure to require
+	// end-to-end encryption when the peer supports it. Downgrades are reported regardless, see
+	// Meta.Downgrades.
+	RefuseDowngrades Downgrade
+
+	// If set, a trace of the connection attempt is written as JSON lines (see TraceEvent), including
+	// all candidate dials, their results and handshake bytes with the token redacted.
+	// Useful for debugging connectivity issues. Use ReadTrace to read it back.
+	Trace io.Writer
+
+	// Optional features that the client supports, which are exchanged with the peer through the
+	// rdv server. See Capability and Conn.Capabilities.
+	Capabilities Capability
+
+	// Small key/value metadata of the client, e.g. its device name or app version, which the rdv
+	// server forwards to the peer as echo headers (see EchoHeaderPrefix), so that the peers know
+	// each other before any data is sent. The peer's metadata is in Meta.PeerHeader. Keys are
+	// without the prefix, and echo headers of the request header take precedence.
+	EchoHeader http.Header
+
+	// A small blob (at most 1 KiB) that the rdv server delivers to the peer along with the match,
+	// e.g. a protocol banner of an acceptor, so that dialers can identify the protocol or check
+	// its version before any data is sent. The peer's banner is in Meta.PeerBanner.
+	Banner []byte
+
+	// Called with the events of each connection attempt, like Trace, as candidates are dialed,
+	// accepted, handshaken, chosen or discarded, e.g. to show progress in a UI. Called serially
+	// for each attempt, so it must return quickly.
+	ObserverFunc func(CandidateEvent)
+
+	// If positive, writes to the chosen conn are buffered up to this many bytes, so that protocols
+	// with many tiny writes don't cost a syscall and a packet per message, especially through the
+	// relay. The buffer is flushed when full, after FlushDelay, and on Conn.Flush and Close.
+	WriteBuffer int
+
+	// Max delay of buffered writes, see WriteBuffer. Defaults to 1ms. Negative means that writes
+	// are only flushed when the buffer is full, or on Conn.Flush and Close.
+	FlushDelay time.Duration
+
+	// Max number of dials to each peer addr, since hole punching with TCP simultaneous open often
+	// fails with a reset until both NATs have a mapping for the other peer. Defaults to 5. Use 1 to
+	// dial only once.
+	DialAttempts int
+
+	// Preference of addr spaces when dialing peer addrs. Addrs are dialed in this order, and addrs
+	// in other spaces last. Defaults to DefaultDialOrder.
+	DialOrder []AddrSpace
+
+	// Delay between starting the dials to successive peer addrs (see DialOrder), unless the previous
+	// dial failed before. Avoids bursts of SYNs that trip some NATs and firewalls, and gives better
+	// paths a head start. Defaults to 100ms. Negative means all addrs are dialed at once.
+	DialStagger time.Duration
+
+	// Average spacing between the dials to a peer addr, which is jittered by up to half so that the
+	// peers' dials interleave. Defaults to 200ms.
+	DialSpacing time.Duration
+
+	// Max duration of each connection attempt, from the request to the rdv server until the chosen
+	// conn is finalized, including the wait for the peer. Listeners re-register when it's reached.
+	// Zero means no timeout, other than the context's.
+	ConnTimeout time.Duration
+
+	// Max duration from dialing the rdv server until it responds, or confirms that the client has
+	// joined its lobby (see ContextWithReadyFunc). Detects unresponsive servers quickly, without
+	// limiting the wait for the peer. With servers that don't confirm, the wait in the lobby
+	// counts too. Fails with ErrServerTimeout. Zero means no timeout.
+	ServerResponseTimeout time.Duration
+
+	// Max duration of each handshake with the peer over the chosen conn, i.e. of Secure and
+	// DialSecure. Defaults to 10s.
+	HandshakeTimeout time.Duration
+
+	// If set, when the relay is chosen, the punch goes on in the background for this duration,
+	// without switching to a direct conn. The dialer then reports whether a direct conn would have
+	// succeeded (see TraceHoldDown), e.g. to tune the RelayPenalty with data from real users,
+	// without delaying them. Both peers should set it, since the acceptor's socket must stay open
+	// for the dialer's punch to succeed. Still limited by MaxPunchWindow. Note that trace events
+	// are written after Dial returns, so the hold-down isn't part of Meta.Report.
+	RelayHoldDown time.Duration
+
+	// Max duration of the connection phase after signaling, during which the socket is open and
+	// candidates are dialed and accepted. When it ends, the attempt is finalized with the conns
+	// that are available, regardless of the chooser and context. Defaults to 30s.
+	MaxPunchWindow time.Duration
+
+	// If set, the chosen conn is encrypted end-to-end, including through the relay. Adds a
+	// round-trip to Dial and Accept. Both peers must use the same config.
+	Secure *SecureConfig
+
+	// Replaces the rdv handshake on direct conns, e.g. to connect to peers that don't use rdv.
+	// See Handshaker. If nil, the rdv handshake is used.
+	Handshaker Handshaker
+
+	// Max duration that resolved IPs of rdv servers are cached across calls, which saves a DNS
+	// round-trip on each connection attempt. Entries expire earlier if the TTL of the DNS records
+	// is shorter. Defaults to 5 minutes. Negative disables caching.
+	DNSCacheTTL time.Duration
+
+	// Path of a file where the outcomes of connection attempts are stored per network (see
+	// NetworkHistory), which are used to adapt to the network: the punch is skipped on networks
+	// where direct conns never succeed, and the relay penalty is lengthened where they usually
+	// succeed, but slowly. Disabled if empty.
+	HistoryFile string
+
+	// URLs of rdv servers to resolve in the background in NewClient, so that the first
+	// connection attempt doesn't wait for DNS either.
+	PreResolve []string
+
+	// If set, Dial, Accept and Connect retry with backoff when signaling fails transiently, until
+	// the attempts are exhausted or the context's deadline would be exceeded.
+	Retry *RetryConfig
+
+	// If set, listeners watch for changes of the interface addrs, e.g. when switching between
+	// Wi-Fi and cellular, and re-register with fresh self addrs. Changes can also be reported
+	// with Client.NetworkChanged, e.g. from the network callbacks of mobile platforms.
+	WatchNetwork bool
+
+	// Max duration that resumable conns try to reattach after their conn fails, before they fail
+	// too. See Client.DialResumable. Defaults to 30s.
+	ResumeTimeout time.Duration
+
 	// Logger, by default slog.Default()
 	Logger *slog.Logger
 }
@@ -38,16 +246,79 @@ func (c *ClientConfig) setDefaults() {
 	if c.AddrSpaces == 0 {
 		c.AddrSpaces = DefaultSpaces
 	}
+	if c.Pairing == nil {
+		c.Pairing = DefaultPairing
+	}
 	if c.SelfAddrFunc == nil {
 		c.SelfAddrFunc = DefaultSelfAddrs
 	}
+	if c.MaxErrorBody == 0 {
+		c.MaxErrorBody = 1024
+	}
+	if c.TokenSalt == "" {
+		c.TokenSalt = "rdv"
+	}
+	if c.DialAttempts == 0 {
+		c.DialAttempts = 5
+	}
+	if c.DialSpacing == 0 {
+		c.DialSpacing = 200 * time.Millisecond
+	}
+	if c.DialOrder == nil {
+		c.DialOrder = DefaultDialOrder
+	}
+	if c.DialStagger == 0 {
+		c.DialStagger = 100 * time.Millisecond
+	}
+	if c.MaxPunchWindow == 0 {
+		c.MaxPunchWindow = defaultMaxPunchWindow
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = 10 * time.Second
+	}
+	if c.ProtocolVersion == 0 {
+		c.ProtocolVersion = maxProtocolVersion
+	}
+	if c.ServerNetwork == "" {
+		c.ServerNetwork = "tcp4"
+	}
+	if c.FlushDelay == 0 {
+		c.FlushDelay = time.Millisecond
+	}
+	if c.ResumeTimeout == 0 {
+		c.ResumeTimeout = 30 * time.Second
+	}
+	if c.DNSCacheTTL == 0 {
+		c.DNSCacheTTL = defaultDNSCacheTTL
+	}
+	if c.Retry != nil {
+		retry := *c.Retry
+		retry.setDefaults()
+		c.Retry = &retry
+	}
+	if browser {
+		c.AddrSpaces = NoSpaces // sockets are unavailable, only the relay can be used
+	}
 	if c.Logger == nil {
 		c.Logger = slog.Default()
 	}
 }
 
+// Hard limit for the connection phase, in case the chooser or context never end it
+const defaultMaxPunchWindow = 30 * time.Second
+
+// The default dial order: loopback for peers on the same host, then public ipv6, which needs no
+// NAT traversal, then local networks, and then public ipv4. Don't modify it, but copy it to
+// customize.
+var DefaultDialOrder = []AddrSpace{SpaceLoopback, SpacePublic6, SpacePrivate4, SpacePrivate6, SpacePublic4, SpaceCGNAT, SpaceLink4, SpaceLink6}
+
 type Client struct {
-	cfg ClientConfig
+	cfg       ClientConfig
+	dns       *dnsCache
+	history   *history
+	v1Servers sync.Map // addrs of servers that only support protocol version 1
+	netmon    netmon
+	err       error // invalid config, which fails all connection attempts
 }
 
 func NewClient(cfg *ClientConfig) *Client {
@@ -56,14 +327,34 @@ func NewClient(cfg *ClientConfig) *Client {
 	if cfg != nil {
 		c.cfg = *cfg
 	}
+	var warnings []*ConfigError
+	c.err = c.cfg.Validate(func(w *ConfigError) { warnings = append(warnings, w) })
 	c.cfg.setDefaults()
+	for _, w := range warnings {
+		c.cfg.Logger.Warn("rdv: questionable config", "err", w)
+	}
+	if c.err != nil {
+		c.cfg.Logger.Error("rdv: invalid config", "err", c.err)
+	}
+	c.dns = newDNSCache(c.cfg.DNSCacheTTL)
+	c.history = openHistory(c.cfg.HistoryFile, c.cfg.Logger)
+	c.netmon.log = c.cfg.Logger
+	for _, addr := range c.cfg.PreResolve {
+		c.dns.preResolve(c.cfg.ServerNetwork, addr, c.cfg.Logger)
+	}
 	return c
 }
 
+// Reports that the network has changed, so that listeners re-register with fresh self addrs.
+// Pending Dial and Accept calls are not affected. See ClientConfig.WatchNetwork.
+func (c *Client) NetworkChanged() {
+	c.netmon.notify()
+}
+
 // Chooser is called once a direct connection is started.
 // All conns on lobby are ready to go
 // The chan is closed when either:
-// - The parents timeout is reached
+// - The ConnTimeout or MaxPunchWindow is reached (see ClientConfig)
 // - The parents context is canceled
 // - The picker calls the cancel function (optional)
 // The picker must drain the lobby channel.
@@ -71,11 +362,19 @@ func NewClient(cfg *ClientConfig) *Client {
 // Chosen may be nil
 type Chooser func(cancel func(), candidates chan *Conn) (chosen *Conn, unchosen []*Conn)
 
-// A chooser which gives the relay some penalty
+// Like Chooser, but also gets the context of the attempt, whose deadline is that of Dial (or of
+// ConnTimeout) and which is done once cancel is called, and the meta of the attempt, e.g. with the
+// token, the peer addrs and the hints from the server. The meta must not be modified. Choosers
+// can delegate to a Chooser, e.g. RelayPenalty, with cancel and candidates.
+type ChooserFunc func(ctx context.Context, meta *Meta, cancel func(), candidates chan *Conn) (chosen *Conn, unchosen []*Conn)
+
+// A chooser which gives the relay some penalty, adjusted by hints from the server (see Hint) and
+// the history of the network (see ClientConfig.HistoryFile).
 // How long the dialer waits for a p2p connection, before falling back on using the relay.
 // If zero, the relay is used as soon as available, but p2p can still be faster.
 // A larger value increases the chances of p2p, at the cost of delaying the connection.
-// If exceeding ConnTimeout, the relay will not be used.
+// If exceeding ClientConfig.ConnTimeout, the relay will not be used, since the attempt fails first.
+// Of the direct conns that are ready at once, inbound ones are preferred (see Conn.IsInbound).
 func RelayPenalty(penalty time.Duration) Chooser {
 	return func(cancel func(), candidates chan *Conn) (chosen *Conn, unchosen []*Conn) {
 		return withRelayPenalty(cancel, candidates, penalty)
@@ -89,7 +388,7 @@ func withRelayPenalty(cancel func(), candidates chan *Conn, penalty time.Duratio
 		if !nc.IsRelay() {
 			cancel()
 		} else {
-			timer.Reset(penalty)
+			timer.Reset(hintedPenalty(penalty, nc.meta))
 		}
 		if chosen == nil {
 			chosen = nc
@@ -97,6 +396,10 @@ func withRelayPenalty(cancel func(), candidates chan *Conn, penalty time.Duratio
 			// Unchoose the relay conn in favor of the direct conn
 			unchosen = append(unchosen, chosen)
 			chosen = nc
+		} else if nc.IsInbound() && !chosen.IsInbound() {
+			// Both are ready, so prefer the inbound conn, since the NAT mapping toward us works
+			unchosen = append(unchosen, chosen)
+			chosen = nc
 		} else {
 			unchosen = append(unchosen, nc)
 		}
@@ -104,6 +407,36 @@ func withRelayPenalty(cancel func(), candidates chan *Conn, penalty time.Duratio
 	return
 }
 
+// Adjusts the relay penalty based on hints from the server, and the history of the network
+func hintedPenalty(penalty time.Duration, meta *Meta) time.Duration {
+	if meta.Hints.Has(HintPeerRelayOnly) || meta.Hints.Has(HintRelayOnly) {
+		return 0 // no direct conns will come
+	}
+	if meta.Hints.Has(HintSameObservedIP) {
+		return 2 * penalty // local conns are very likely
+	}
+	return meta.History.penalty(penalty)
+}
+
+// Closes the candidates that weren't received, e.g. by a chooser that returned early or panicked,
+// so that their handshake goroutines end. Returns once the attempt is over.
+func discardRest(candidates chan *Conn) {
+	for conn := range candidates {
+		conn.Close()
+	}
+}
+
+// Runs the chooser of the attempt, which is DialChooserFunc or DialChooser for dialers.
+func (c *Client) choose(ctx context.Context, meta *Meta, cancel func(), candidates chan *Conn) (chosen *Conn, unchosen []*Conn) {
+	switch {
+	case !meta.IsDialer:
+		return lnChoose(cancel, candidates)
+	case c.cfg.DialChooserFunc != nil:
+		return c.cfg.DialChooserFunc(ctx, meta, cancel, candidates)
+	}
+	return c.cfg.DialChooser(cancel, candidates)
+}
+
 // Chooser for listener, which always returns the first
 func lnChoose(cancel func(), candidates chan *Conn) (chosen *Conn, unchosen []*Conn) {
 	chosen = <-candidates
@@ -115,93 +448,378 @@ func lnChoose(cancel func(), candidates chan *Conn) (chosen *Conn, unchosen []*C
 }
 
 func (c *Client) Dial(ctx context.Context, addr string, token string, reqHeader http.Header) (*Conn, *http.Response, error) {
-	return c.do(ctx, newMeta(true, addr, token), reqHeader)
+	return c.doHTTP(ctx, func() *Meta { return newMeta(true, addr, token) }, addr, reqHeader)
 }
 
 func (c *Client) Accept(ctx context.Context, addr string, token string, reqHeader http.Header) (*Conn, *http.Response, error) {
-	return c.do(ctx, newMeta(false, addr, token), reqHeader)
+	return c.doHTTP(ctx, func() *Meta { return newMeta(false, addr, token) }, addr, reqHeader)
+}
+
+// Connects to a peer which also calls Connect with the same token, without having to decide who
+// dials and who accepts. The server assigns the roles, which are available in the conn's Meta.
+func (c *Client) Connect(ctx context.Context, addr string, token string, reqHeader http.Header) (*Conn, *http.Response, error) {
+	return c.doHTTP(ctx, func() *Meta {
+		meta := newMeta(false, addr, token)
+		meta.Symmetric = true
+		return meta
+	}, addr, reqHeader)
 }
 
-func (c *Client) do(ctx context.Context, meta *Meta, reqHeader http.Header) (*Conn, *http.Response, error) {
-	log := c.cfg.Logger.With("token", meta.Token)
+// Like Dial, but exchanges candidates using the signaler instead of an rdv server.
+func (c *Client) DialVia(ctx context.Context, sig Signaler, token string) (*Conn, error) {
+	return c.do(ctx, newMeta(true, "", token), sig)
+}
+
+// Like Accept, but exchanges candidates using the signaler instead of an rdv server.
+func (c *Client) AcceptVia(ctx context.Context, sig Signaler, token string) (*Conn, error) {
+	return c.do(ctx, newMeta(false, "", token), sig)
+}
+
+// Returns a signaler for the rdv server at addr. Addrs with a ws or wss scheme use WebSocket (see
+// ClientConfig.WebSocket), e.g. relay servers that peers are redirected to (see RedirectRelay).
+func (c *Client) httpSignaler(addr string, reqHeader http.Header) *HTTPSignaler {
+	ws := c.cfg.WebSocket
+	scheme, rest, _ := strings.Cut(addr, "://")
+	if plain, ok := map[string]string{"ws": "http", "wss": "https"}[scheme]; ok {
+		addr, ws = plain+"://"+rest, true
+	}
+	return &HTTPSignaler{Addr: addr, Header: reqHeader, MaxErrorBody: c.cfg.MaxErrorBody, WebSocket: ws, Wrap: c.cfg.SignalWrapper, Network: c.cfg.ServerNetwork, Proxy: c.cfg.ProxyFunc, Dial: c.cfg.DialServer, ResponseTimeout: c.cfg.ServerResponseTimeout, dns: c.dns, v1Servers: &c.v1Servers}
+}
+
+func (c *Client) do(ctx context.Context, meta *Meta, sig Signaler) (*Conn, error) {
+	if c.cfg.ConnTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.ConnTimeout)
+		defer cancel()
+	}
+	log, tr := c.prepare(meta)
+	parentCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	socket, err := NewSocket(ctx, 0, c.cfg.TlsConfig)
+	punchCtx := ctx
+	var hold *holdDown
+	if c.cfg.RelayHoldDown > 0 {
+		hold = newHoldDown(parentCtx, c.cfg.RelayHoldDown)
+		punchCtx = hold.ctx
+	}
+	candidates, err := c.start(punchCtx, log, tr, meta, sig)
 	if err != nil {
-		return nil, nil, err
+		if hold != nil {
+			hold.release(nil)
+		}
+		return nil, err
+	}
+	if hold != nil {
+		candidates = hold.forward(ctx, log, tr, meta, candidates)
+	}
+	defer func() { go discardRest(candidates) }() // in case the chooser didn't drain them
+	chosen, unchosen := c.choose(ctx, meta, cancel, candidates)
+	if hold != nil {
+		cancel() // ends the forwarding
+		hold.release(chosen)
+	}
+	for _, conn := range unchosen {
+		log.Debug("rdv: discard", "addr", conn.RemoteAddr())
+		tr.connEvent(TraceDiscard, conn, nil)
+		conn.Close()
+	}
+	if chosen == nil {
+		return nil, cmp.Or(parentCtx.Err(), ErrNotChosen)
+	}
+	if err := parentCtx.Err(); err != nil {
+		chosen.Close()
+		return nil, err
+	}
+	if err = c.finish(parentCtx, log, tr, chosen); err != nil {
+		return nil, err
+	}
+	return chosen, nil
+}
+
+// Streams the candidate conns of a connection attempt, i.e. conns which completed the candidate
+// handshake, including the relay. Candidates arrive until the attempt is canceled through ctx or
+// the punch window ends (see MaxPunchWindow), and the loop body chooses a conn by breaking out of
+// the loop with it. The chosen conn is then confirmed with the peer, and all other candidates are
+// closed. Candidates may be inspected inside the loop (e.g. using IsRelay or Meta), but must not
+// be read or written until the loop is done. If the attempt fails, or no conn is chosen, the last
+// element is an error and a nil conn.
+//
+// Since nothing can be yielded once the loop body breaks, a chosen conn that can't be confirmed
+// (e.g. because the peer left) is closed, and its Read and Write return the error.
+//
+// This is an alternative to a Chooser, and is equivalent to DialVia and AcceptVia otherwise.
+func (c *Client) Candidates(ctx context.Context, sig Signaler, isDialer bool, token string) iter.Seq2[*Conn, error] {
+	return func(yield func(*Conn, error) bool) {
+		meta := newMeta(isDialer, "", token)
+		log, tr := c.prepare(meta)
+		attemptCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		candidates, err := c.start(attemptCtx, log, tr, meta, sig)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer func() { go discardRest(candidates) }() // in case yield panics
+		var (
+			chosen  *Conn
+			yielded []*Conn
+		)
+		for conn := range candidates {
+			if chosen != nil {
+				conn.Close() // drain
+				continue
+			}
+			yielded = append(yielded, conn)
+			if !yield(conn, nil) {
+				chosen = conn
+				cancel()
+			}
+		}
+		for _, conn := range yielded {
+			if conn != chosen {
+				log.Debug("rdv: discard", "addr", conn.RemoteAddr())
+				tr.connEvent(TraceDiscard, conn, nil)
+				conn.Close()
+			}
+		}
+		if chosen == nil {
+			yield(nil, cmp.Or(ctx.Err(), ErrNotChosen))
+			return
+		}
+		if err := c.finish(ctx, log, tr, chosen); err != nil {
+			log.Debug("rdv: finish err", "addr", chosen.RemoteAddr(), "err", err)
+			chosen.failed = err
+		}
+	}
+}
+
+// Returns the token that is sent to the server, see HashToken.
+func (c *Client) serverToken(token string) string {
+	if c.cfg.HashToken {
+		return HashToken(c.cfg.TokenSalt, token)
+	}
+	return token
+}
+
+// Sets up the meta from the config, and returns the logger and tracer of the attempt.
+func (c *Client) prepare(meta *Meta) (*slog.Logger, *tracer) {
+	meta.Namespace = c.cfg.Namespace
+	meta.maxVersion = c.cfg.ProtocolVersion
+	meta.Capabilities = c.cfg.Capabilities
+	meta.Header = c.cfg.EchoHeader.Clone()
+	meta.Banner = c.cfg.Banner
+	meta.clockSync = c.cfg.ClockSync
+	if token := c.serverToken(meta.Token); token != meta.Token {
+		meta.serverToken = token
+	}
+	if c.cfg.AddrSpaces == NoSpaces {
+		meta.Hints |= HintRelayOnly
+	}
+	return c.cfg.Logger.With("token", meta.Token), newTracer(c.cfg.Trace, c.cfg.ObserverFunc, meta.Token, meta.serverToken)
+}
+
+// Opens a socket, signals and starts connecting to the peer. Returns the candidates chan, which
+// is closed once ctx is canceled or the punch window ends, and all pending candidates are delivered.
+func (c *Client) start(ctx context.Context, log *slog.Logger, tr *tracer, meta *Meta, sig Signaler) (chan *Conn, error) {
+	socket, err := c.newSocket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.FastOpen {
+		if err := socket.EnableFastOpen(); err != nil {
+			log.Debug("rdv: fast open unavailable", "err", err)
+		}
 	}
-	defer socket.Close()
 
 	var (
-		ncs                = make(chan *Conn)
-		candidates         = make(chan *Conn)
-		chooser    Chooser = lnChoose
+		ncs        = make(chan *Conn)
+		candidates = make(chan *Conn)
 	)
+	c.setSelfAddrs(ctx, socket, meta)
+
+	tr.data(TraceServerDial, netip.AddrPort{}, meta.ServerAddr)
+	relay, req, err := c.signal(ctx, sig, socket, meta)
+	if err != nil {
+		tr.event(TraceServerResp, netip.AddrPort{}, err)
+		socket.Close()
+		return nil, err
+	}
+
+	log.Debug("rdv: dial", "is_dialer", meta.IsDialer, "observed", meta.ObservedAddr, "self_addrs", meta.SelfAddrs)
+	spaces := c.cfg.AddrSpaces
+	if meta.History = c.history.lookup(meta); meta.History.neverDirect() {
+		log.Debug("rdv: skip punch, direct conns never succeed on this network")
+		spaces = NoSpaces
+	}
+	punchCtx, punchCancel := context.WithTimeout(ctx, c.cfg.MaxPunchWindow)
+	relayDone := make(chan struct{})
+	go func() {
+		defer punchCancel()
+		dialAndListen(punchCtx, log, tr, &c.cfg, spaces, meta, req, socket, ncs) // closes the socket
+		<-relayDone
+		close(ncs)
+	}()
+	go peerShake(log, tr, c.cfg.Handshaker, ncs, candidates)
+	var relays sync.WaitGroup
+	if relay != nil && len(meta.RelayAddrs) > 0 {
+		tr.event(TraceServerResp, netip.AddrPort{}, nil)
+		relays.Add(1)
+		go func() {
+			defer relays.Done()
+			if relay := c.redirectRelay(ctx, log, tr, socket, relay); relay != nil {
+				ncs <- relay
+			}
+		}()
+	} else if relay != nil {
+		tr.event(TraceServerResp, connAddr(relay), nil)
+		ncs <- relay // add relay conn here to prevent deadlock
+	}
+	if meta.lateRelays != nil {
+		relays.Add(1)
+		go func() {
+			defer relays.Done()
+			for {
+				select {
+				case relay, ok := <-meta.lateRelays:
+					if !ok {
+						return
+					}
+					if len(relay.meta.RelayAddrs) > 0 {
+						relay.Close() // redirected, which is only followed for the first server
+						continue
+					}
+					log.Debug("rdv: late relay", "server", relay.meta.ServerAddr)
+					tr.event(TraceServerResp, connAddr(relay), nil)
+					ncs <- relay
+				case <-punchCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		relays.Wait()
+		close(relayDone)
+	}()
+	return candidates, nil
+}
+
+// Returns a socket for an attempt. Relay-only clients don't bind a port, since no peer can connect
+// to them directly.
+func (c *Client) newSocket(ctx context.Context) (*Socket, error) {
+	if c.cfg.AddrSpaces == NoSpaces {
+		return newRelaySocket(c.cfg.TlsConfig), nil
+	}
+	return NewSocket(ctx, 0, c.cfg.TlsConfig)
+}
+
+// Sets the valid self addrs of the socket that are in the allowed addr spaces, and the NAT info.
+func (c *Client) setSelfAddrs(ctx context.Context, socket *Socket, meta *Meta) {
 	selfAddrs := c.cfg.SelfAddrFunc(ctx, socket)
-	meta.SelfAddrs = filter(selfAddrs, func(addr netip.AddrPort) bool {
+	meta.NAT = socket.NAT
+	meta.SelfAddrs = filter(SanitizeAddrs(selfAddrs), func(addr netip.AddrPort) bool {
 		return c.cfg.AddrSpaces.Includes(GetAddrSpace(addr.Addr()))
 	})
+}
 
-	relay, resp, err := dialRdvServer(ctx, socket, meta, reqHeader)
+// Finalizes the chosen conn, after all candidates are done. Closes the conn on error.
+func (c *Client) finish(ctx context.Context, log *slog.Logger, tr *tracer, chosen *Conn) error {
+	tr.connEvent(TraceChosen, chosen, nil)
+	chosen.SetDeadline(verySoon())
+	err := chosen.shake(c.cfg.Handshaker)
 	if err != nil {
-		return nil, resp, err
+		chosen.Close()
+		return err
 	}
-	if meta.IsDialer {
-		chooser = c.cfg.DialChooser
+	chosen.SetDeadline(time.Time{})
+	if c.cfg.Secure != nil {
+		secureCtx, secureCancel := context.WithTimeout(ctx, c.cfg.HandshakeTimeout)
+		reset := ctxIO(secureCtx, chosen)
+		err = chosen.secure(c.cfg.Secure)
+		reset()
+		secureCancel()
+		if err != nil {
+			chosen.Close()
+			return err
+		}
 	}
-
-	log.Debug("rdv: dial", "is_dialer", meta.IsDialer, "observed", meta.ObservedAddr, "self_addrs", meta.SelfAddrs)
-	go dialAndListen(log, c.cfg.AddrSpaces, relay, socket, ncs)
-	go peerShake(log, ncs, candidates)
-	ncs <- relay // add relay conn here to prevent deadlock
-
-	chosen, unchosen := chooser(cancel, candidates)
-	for _, conn := range unchosen {
-		log.Debug("rdv: discard", "addr", conn.RemoteAddr())
-		conn.Close()
+	if err = c.checkDowngrades(log, tr, chosen); err != nil {
+		chosen.Close()
+		return err
 	}
-	if chosen == nil {
-		return nil, nil, ErrNotChosen
+	if offset, rtt, ok := chosen.clockEstimate(); ok {
+		chosen.meta.ClockOffset, chosen.meta.RTT = offset, rtt
+		log.Debug("rdv: clock sync", "offset", offset, "rtt", rtt)
 	}
-	chosen.SetDeadline(verySoon())
-	err = chosen.clientShake()
+	chosen.SetWriteDeadline(verySoon())
+	err = chosen.flush()
+	chosen.SetWriteDeadline(time.Time{})
 	if err != nil {
 		chosen.Close()
+		return err
+	}
+	chosen.meta.Report = tr.snapshot()
+	chosen.markReady()
+	if c.cfg.WriteBuffer > 0 {
+		chosen.wbuf = newWriteBuffer(chosen.write, c.cfg.WriteBuffer, c.cfg.FlushDelay)
+	}
+	c.history.record(chosen.meta)
+	return nil
+}
+
+// Runs the signaler, and returns the relay conn if any. The request is nil unless signaling
+// happened over http.
+func (c *Client) signal(ctx context.Context, sig Signaler, socket *Socket, meta *Meta) (relay *Conn, req *http.Request, err error) {
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+	nc, err := sig.Signal(ctx, socket, meta)
+	if err != nil {
 		return nil, nil, err
 	}
-	chosen.SetDeadline(time.Time{})
-	return chosen, nil, nil
+	if relay, ok := nc.(*Conn); ok {
+		return relay, relay.req, nil
+	}
+	if nc != nil {
+		relay = newRelayConn(nc, nc, meta, nil)
+	}
+	return relay, nil, nil
 }
 
-func dialAndListen(log *slog.Logger, spaces AddrSpace, relay *Conn, s *Socket, ncs chan *Conn) {
+func dialAndListen(ctx context.Context, log *slog.Logger, tr *tracer, cfg *ClientConfig, spaces AddrSpace, meta *Meta, req *http.Request, s *Socket, ncs chan *Conn) {
 	var (
 		wg sync.WaitGroup
 	)
-	ctx := relay.req.Context()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		<-ctx.Done()
 		s.Close()
 	}()
-	for _, addr := range relay.meta.PeerAddrs {
+	var addrs []netip.AddrPort
+	for _, addr := range meta.PeerAddrs {
 		space := GetAddrSpace(addr.Addr())
 		if !spaces.Includes(space) { // TODO: Perhaps log the addr space
 			log.Debug("rdv: skip", "addr", addr, "space", space)
+			tr.event(TraceSkip, addr, nil)
 			continue
 		}
-		wg.Add(1)
-		go func(addr netip.AddrPort) {
-			defer wg.Done()
-			nc, err := s.DialIPContext(ctx, addr)
-			if err != nil {
-				log.Debug("rdv: dial err", "addr", addr, "err", unwrapOp(err))
-				return
-			}
-			ncs <- newDirectConn(nc, relay.meta, relay.req)
-		}(addr)
+		if !cfg.Pairing.Dialable(meta, addr) {
+			log.Debug("rdv: skip hopeless", "addr", addr, "space", space)
+			tr.event(TraceSkip, addr, nil)
+			continue
+		}
+		addrs = append(addrs, addr)
 	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dialStaggered(ctx, log, tr, cfg, orderAddrs(addrs, cfg.DialOrder), s, func(nc net.Conn) {
+			ncs <- newDirectConn(nc, false, meta, req)
+		})
+	}()
 	for {
 		nc, err := s.Accept()
 		if err != nil {
@@ -210,43 +828,145 @@ func dialAndListen(log *slog.Logger, spaces AddrSpace, relay *Conn, s *Socket, n
 		addr, space := FromNetAddr(nc.RemoteAddr())
 		if !spaces.Includes(space) {
 			log.Debug("rdv: reject", "addr", addr, "space", space)
+			tr.write(TraceEvent{Kind: TraceReject, Inbound: true}, addr, nil)
 			nc.Close()
 			continue // Log error
 		}
-		ncs <- newDirectConn(nc, relay.meta, relay.req)
+		tr.write(TraceEvent{Kind: TraceAccept, Inbound: true}, addr, nil)
+		ncs <- newDirectConn(nc, true, meta, req)
 	}
 	wg.Wait()
-	close(ncs)
 	// success, otherwise relay
 }
 
-func peerShake(log *slog.Logger, in chan *Conn, out chan *Conn) {
+// Dials the addrs concurrently, but starts each dial DialStagger after the previous one, or as soon
+// as the previous one fails. Returns once all dials are done.
+func dialStaggered(ctx context.Context, log *slog.Logger, tr *tracer, cfg *ClientConfig, addrs []netip.AddrPort, s *Socket, onConn func(net.Conn)) {
 	var (
-		cArr = []net.Conn{}
 		wg   sync.WaitGroup
+		prev chan struct{} // closed when the previous dial fails
+	)
+	defer wg.Wait()
+	for _, addr := range addrs {
+		if prev != nil && cfg.DialStagger > 0 {
+			timer := time.NewTimer(cfg.DialStagger)
+			select {
+			case <-timer.C:
+			case <-prev:
+			case <-ctx.Done():
+			}
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		dial := s.DialIPContext
+		if transport := cfg.Transports[GetAddrSpace(addr.Addr())]; transport != nil {
+			dial = func(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+				return transport(ctx, s, addr)
+			}
+		}
+		failed := make(chan struct{})
+		prev = failed
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nc, err := dialRetry(ctx, log, tr, dial, addr, cfg.DialAttempts, cfg.DialSpacing, sync.OnceFunc(func() { close(failed) }))
+			if err != nil {
+				return
+			}
+			onConn(nc)
+		}()
+	}
+}
+
+// Returns the addrs sorted by the order of their addr spaces, see ClientConfig.DialOrder. Addrs in
+// other spaces are last, and addrs in the same space keep their order.
+func orderAddrs(addrs []netip.AddrPort, order []AddrSpace) []netip.AddrPort {
+	rank := func(addr netip.AddrPort) int {
+		if i := slices.Index(order, GetAddrSpace(addr.Addr())); i >= 0 {
+			return i
+		}
+		return len(order)
+	}
+	addrs = slices.Clone(addrs)
+	slices.SortStableFunc(addrs, func(a, b netip.AddrPort) int {
+		return cmp.Compare(rank(a), rank(b))
+	})
+	return addrs
+}
+
+// Dials the peer addr until it succeeds, the attempts are exhausted or ctx is canceled.
+// Calls failed after each failed attempt.
+func dialRetry(ctx context.Context, log *slog.Logger, tr *tracer, dial func(context.Context, netip.AddrPort) (net.Conn, error), addr netip.AddrPort, attempts int, spacing time.Duration, failed func()) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		tr.event(TraceDial, addr, nil)
+		nc, err := dial(ctx, addr)
+		if err == nil {
+			tr.event(TraceDialOk, addr, nil)
+			return nc, nil
+		}
+		log.Debug("rdv: dial err", "addr", addr, "attempt", attempt, "err", unwrapOp(err))
+		tr.event(TraceDialErr, addr, err)
+		failed()
+		if attempt >= attempts || ctx.Err() != nil {
+			return nil, err
+		}
+		wait := spacing / 2
+		if spacing > 0 {
+			wait += rand.N(spacing)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func peerShake(log *slog.Logger, tr *tracer, hs Handshaker, in chan *Conn, out chan *Conn) {
+	var (
+		mu      sync.Mutex
+		shaking = make(map[net.Conn]bool) // conns in the handshake, which may outlive the attempt (see RelayHoldDown)
+		wg      sync.WaitGroup
 	)
 	for conn := range in {
-		cArr = append(cArr, conn)
+		nc := conn.Conn // the handshaker may replace conn.Conn
+		mu.Lock()
+		shaking[nc] = true
+		mu.Unlock()
 		wg.Add(1)
 		go func(conn *Conn) {
 			defer wg.Done()
-			err := conn.clientHand()
+			err := conn.hand(hs)
+			mu.Lock()
+			delete(shaking, nc)
+			mu.Unlock()
 			if err != nil {
 				log.Debug("rdv: shake err", "addr", conn.RemoteAddr(), "err", unwrapOp(err))
+				tr.connEvent(TraceShakeErr, conn, err)
 				conn.Close()
 				return
 			}
 			log.Debug("rdv: shake ok", "addr", conn.RemoteAddr())
+			if hs == nil || conn.IsRelay() {
+				_, peer := conn.headers()
+				tr.connData(TraceShakeOk, conn, peer)
+			} else {
+				tr.connEvent(TraceShakeOk, conn, nil)
+			}
 
 			out <- conn
 		}(conn)
 	}
 
-	// Expire all deadlines to trigger a
+	// Expire the deadlines of pending handshakes to abort them
 	t := past()
-	for _, c := range cArr {
-		c.SetDeadline(t)
+	mu.Lock()
+	for nc := range shaking {
+		nc.SetDeadline(t)
 	}
+	mu.Unlock()
 	wg.Wait()
 	close(out)
 }
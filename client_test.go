@@ -0,0 +1,666 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Chooser which never cancels the attempt, and picks the first conn
+func greedyChoose(cancel func(), candidates chan *Conn) (chosen *Conn, unchosen []*Conn) {
+	for nc := range candidates {
+		if chosen == nil {
+			chosen = nc
+		} else {
+			unchosen = append(unchosen, nc)
+		}
+	}
+	return
+}
+
+func TestMaxPunchWindow(t *testing.T) {
+	// The punch window should end the attempt long before ctx
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, hs := startServer(t, nil)
+
+	var (
+		mu     sync.Mutex
+		events []CandidateEvent
+	)
+	observe := func(ev CandidateEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	}
+	dialer := NewClient(&ClientConfig{AddrSpaces: SpaceLoopback, DialChooser: greedyChoose, MaxPunchWindow: 200 * time.Millisecond, ObserverFunc: observe})
+	acceptor := NewClient(&ClientConfig{AddrSpaces: SpaceLoopback})
+	go func() {
+		if conn, _, err := acceptor.Accept(ctx, hs.URL, "token", nil); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, _, err := dialer.Dial(ctx, hs.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if ctx.Err() != nil {
+		t.Fatal("expected the punch window to end the attempt before ctx")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var shaken, chosen int
+	for _, ev := range events {
+		switch ev.Kind {
+		case TraceShakeOk:
+			shaken++
+		case TraceChosen:
+			chosen++
+		}
+	}
+	if shaken == 0 || chosen != 1 {
+		t.Fatalf("expected candidates and 1 chosen, got %d candidates and %d chosen", shaken, chosen)
+	}
+}
+
+// Returns the stacks of all goroutines by their id, except the calling one.
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	n := runtime.Stack(buf, true)
+	for n == len(buf) {
+		buf = make([]byte, 2*len(buf))
+		n = runtime.Stack(buf, true)
+	}
+	stacks := make(map[string]string)
+	for i, g := range strings.Split(strings.TrimSpace(string(buf[:n])), "\n\n") {
+		if i == 0 {
+			continue // the current goroutine comes first
+		}
+		id, _, _ := strings.Cut(strings.TrimPrefix(g, "goroutine "), " ")
+		stacks[id] = g
+	}
+	return stacks
+}
+
+// Fails unless the goroutines that weren't running before have ended within a while.
+func checkGoroutines(t *testing.T, before map[string]string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var leaked []string
+		for id, stack := range goroutines() {
+			if _, ok := before[id]; !ok {
+				leaked = append(leaked, stack)
+			}
+		}
+		if len(leaked) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked %d goroutines:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Runs many rendezvous cycles, direct and relayed, with a chooser that doesn't drain its
+// candidates, and shuts the server down with clients in the lobby and clients that were never
+// served. No goroutines of the client or server should outlive them.
+func TestGoroutineLifetimes(t *testing.T) {
+	before := goroutines()
+	func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		server := NewServer(nil)
+		var arrived atomic.Int32
+		hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrived.Add(1)
+			server.ServeHTTP(w, r)
+		}))
+		defer hs.Close()
+
+		// Clients that arrive before Serve, more than the server buffers
+		lazy := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+		for i := range 10 {
+			go lazy.Dial(ctx, hs.URL, fmt.Sprint("early", i), nil)
+		}
+		for arrived.Load() < 10 {
+			time.Sleep(time.Millisecond)
+		}
+		done := make(chan struct{})
+		go func() {
+			server.Serve(ctx)
+			close(done)
+		}()
+
+		impatient := func(cancel func(), candidates chan *Conn) (*Conn, []*Conn) {
+			return <-candidates, nil
+		}
+		for _, cfg := range []ClientConfig{
+			{AddrSpaces: SpaceLoopback},
+			{AddrSpaces: SpaceLoopback, DialChooser: impatient},
+			{AddrSpaces: NoSpaces},
+		} {
+			dialer, acceptor := NewClient(&cfg), NewClient(&ClientConfig{AddrSpaces: cfg.AddrSpaces})
+			for range 10 {
+				go func() {
+					if conn, _, err := acceptor.Accept(ctx, hs.URL, "token", nil); err == nil {
+						conn.Close()
+					}
+				}()
+				conn, _, err := dialer.Dial(ctx, hs.URL, "token", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+			}
+		}
+		go lazy.Dial(ctx, hs.URL, "lonely", nil)
+		awaitLobby(t, server, 11) // with the early clients
+		cancel()
+		<-done
+	}()
+	checkGoroutines(t, before)
+}
+
+// Handshaker with trivial hands, whose shakes fail with err, if set.
+type shakeHandshaker struct{ err error }
+
+func (h shakeHandshaker) Hand(nc net.Conn, meta *Meta) (net.Conn, error) { return nc, nil }
+func (h shakeHandshaker) Shake(nc net.Conn, meta *Meta) error            { return h.err }
+
+func TestCandidatesConfirmErr(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, nil)
+	errShake := errors.New("shake failed")
+	dialer := NewClient(&ClientConfig{AddrSpaces: SpaceLoopback, Handshaker: shakeHandshaker{errShake}})
+	acceptor := NewClient(&ClientConfig{AddrSpaces: SpaceLoopback, Handshaker: shakeHandshaker{}})
+	go func() {
+		if conn, _, err := acceptor.Accept(ctx, hs.URL, "token", nil); err == nil {
+			conn.Close()
+		}
+	}()
+	var chosen *Conn
+	for conn, err := range dialer.Candidates(ctx, dialer.httpSignaler(hs.URL, nil), true, "token") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !conn.IsRelay() {
+			chosen = conn
+			break
+		}
+	}
+	if chosen == nil {
+		t.Fatal("expected a direct conn")
+	}
+	if _, err := chosen.Read(make([]byte, 1)); !errors.Is(err, errShake) {
+		t.Fatalf("expected the shake err from Read, got %v", err)
+	}
+	if _, err := chosen.Write([]byte("x")); !errors.Is(err, errShake) {
+		t.Fatalf("expected the shake err from Write, got %v", err)
+	}
+}
+
+// Simulates an ipv6-only deployment on the loopback interface
+func TestIPv6Only(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback unavailable:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server := NewServer(nil)
+	go server.Serve(ctx)
+	hs := httptest.NewUnstartedServer(server)
+	hs.Listener = ln
+	hs.Start()
+	defer hs.Close()
+
+	selfAddrs := func(ctx context.Context, socket *Socket) []netip.AddrPort {
+		return []netip.AddrPort{netip.AddrPortFrom(netip.IPv6Loopback(), socket.Port)}
+	}
+	client := NewClient(&ClientConfig{AddrSpaces: SpaceLoopback, ServerNetwork: "tcp6", SelfAddrFunc: selfAddrs})
+	go func() {
+		if conn, _, err := client.Accept(ctx, hs.URL, "token", nil); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, _, err := client.Dial(ctx, hs.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.IsRelay() {
+		t.Fatal("expected a direct conn")
+	}
+	meta := conn.Meta()
+	if meta.ObservedAddr == nil || !meta.ObservedAddr.Addr().Is6() {
+		t.Fatalf("expected an ipv6 observed addr, got %v", meta.ObservedAddr)
+	}
+	for _, addr := range meta.PeerAddrs {
+		if !addr.Addr().Is6() {
+			t.Fatalf("expected only ipv6 peer addrs, got %v", meta.PeerAddrs)
+		}
+	}
+}
+
+// Starts a server, which is stopped when the test ends.
+func startServer(t *testing.T, cfg *ServerConfig) (*Server, *httptest.Server) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewServer(cfg)
+	done := make(chan struct{})
+	go func() {
+		server.Serve(ctx)
+		close(done)
+	}()
+	hs := httptest.NewServer(server)
+	t.Cleanup(func() {
+		hs.Close()
+		cancel()
+		<-done
+	})
+	return server, hs
+}
+
+// Returns the number of conns in the lobby of a running server.
+func lobbySize(t *testing.T, server *Server) int {
+	t.Helper()
+	entries, err := server.Lobby(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// Waits until the server has n conns in its lobby.
+func awaitLobby(t *testing.T, server *Server, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); lobbySize(t, server) != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d conns in the lobby, got %d", n, lobbySize(t, server))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestExpectHeaderErr(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go io.WriteString(b, "rdv/1 BOGUS token\r\n")
+	conn := newDirectConn(a, false, newMeta(false, "", "token"), nil)
+	if err := conn.expectHeader(rdvHeader("CONFIRM", "token")); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected %v, got %v", ErrProtocol, err)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		err    error
+		want   bool
+	}{
+		"unavailable": {status: http.StatusServiceUnavailable, want: true},
+		"too_many":    {status: http.StatusTooManyRequests, want: true},
+		"replaced":    {status: http.StatusConflict, want: false},
+		"forbidden":   {status: http.StatusForbidden, want: false},
+		"timeout":     {err: ErrServerTimeout, want: true},
+		"eof":         {err: io.ErrUnexpectedEOF, want: true},
+		"protocol":    {err: ErrProtocol, want: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var resp *http.Response
+			if tc.status != 0 {
+				resp = &http.Response{StatusCode: tc.status}
+			}
+			if got := isTransient(resp, tc.err); got != tc.want {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, nil)
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	server.SetMaintenance("upgrading", until)
+	_, resp, err := client.Dial(ctx, hs.URL, "token", nil)
+	var merr *MaintenanceError
+	if !errors.As(err, &merr) || !errors.Is(err, ErrMaintenance) {
+		t.Fatalf("expected a maintenance error, got %v", err)
+	}
+	if merr.Message != "upgrading" || !merr.Until.Equal(until) {
+		t.Fatalf("expected upgrading until %v, got %q until %v", until, merr.Message, merr.Until)
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %v", resp)
+	}
+
+	// Ending maintenance lets clients in again
+	server.SetMaintenance("", time.Time{})
+	go client.Accept(ctx, hs.URL, "token", nil)
+	awaitLobby(t, server, 1)
+}
+
+func TestMaintenanceErr(t *testing.T) {
+	errFallback := errors.New("fallback")
+	until := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := map[string]struct {
+		status int
+		until  string
+		want   error
+	}{
+		"maintenance": {status: http.StatusServiceUnavailable, until: until.Format(time.RFC3339), want: &MaintenanceError{Message: "msg", Until: until}},
+		"overloaded":  {status: http.StatusServiceUnavailable, want: errFallback},
+		"bad_until":   {status: http.StatusServiceUnavailable, until: "tomorrow", want: errFallback},
+		"other":       {status: http.StatusForbidden, until: until.Format(time.RFC3339), want: errFallback},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tc.status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("msg\n"))}
+			if tc.until != "" {
+				resp.Header.Set(hMaintenanceUntil, tc.until)
+			}
+			err := maintenanceErr(resp, errFallback)
+			if err.Error() != tc.want.Error() {
+				t.Fatalf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestReadyFunc(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, nil)
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+
+	ready := make(chan struct{})
+	accepted := make(chan error, 1)
+	go func() {
+		conn, _, err := client.Accept(ContextWithReadyFunc(ctx, func() { close(ready) }), hs.URL, "token", nil)
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		t.Fatal("expected the acceptor to be ready")
+	}
+	if n := lobbySize(t, server); n != 1 {
+		t.Fatalf("expected the acceptor in the lobby once ready, got %d conns", n)
+	}
+	dc, _, err := client.Dial(ctx, hs.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.Close()
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+
+	// Listeners are ready once registered
+	ln := client.Listen(ctx, hs.URL, "listener", nil)
+	defer ln.Close()
+	select {
+	case <-ln.Ready():
+	case <-ctx.Done():
+		t.Fatal("expected the listener to be ready")
+	}
+}
+
+func TestRelayPenaltyChoice(t *testing.T) {
+	meta := newMeta(true, "", "token")
+	kinds := map[string]func() *Conn{
+		"relay":    func() *Conn { return newRelayConn(nil, nil, meta, nil) },
+		"outbound": func() *Conn { return newDirectConn(nil, false, meta, nil) },
+		"inbound":  func() *Conn { return newDirectConn(nil, true, meta, nil) },
+	}
+	tests := map[string]struct {
+		candidates []string
+		chosen     string
+	}{
+		"relay_only":       {candidates: []string{"relay"}, chosen: "relay"},
+		"direct_wins":      {candidates: []string{"relay", "outbound"}, chosen: "outbound"},
+		"inbound_tie":      {candidates: []string{"outbound", "inbound"}, chosen: "inbound"},
+		"inbound_first":    {candidates: []string{"inbound", "outbound"}, chosen: "inbound"},
+		"relay_then_tie":   {candidates: []string{"relay", "outbound", "inbound"}, chosen: "inbound"},
+		"first_of_inbound": {candidates: []string{"inbound", "inbound"}, chosen: "inbound"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			candidates := make(chan *Conn, len(tc.candidates))
+			var first *Conn
+			for _, kind := range tc.candidates {
+				conn := kinds[kind]()
+				if first == nil && kind == tc.chosen {
+					first = conn
+				}
+				candidates <- conn
+			}
+			close(candidates)
+			chosen, unchosen := withRelayPenalty(func() {}, candidates, time.Hour)
+			if chosen != first {
+				t.Fatalf("expected the first %s conn", tc.chosen)
+			}
+			if len(unchosen) != len(tc.candidates)-1 {
+				t.Fatalf("expected %d unchosen, got %d", len(tc.candidates)-1, len(unchosen))
+			}
+		})
+	}
+}
+
+func TestOrderAddrs(t *testing.T) {
+	addrs := func(strs ...string) (addrs []netip.AddrPort) {
+		for _, s := range strs {
+			addrs = append(addrs, netip.MustParseAddrPort(s))
+		}
+		return addrs
+	}
+	tests := map[string]struct {
+		addrs, want []netip.AddrPort
+		order       []AddrSpace
+	}{
+		"default": {
+			addrs: addrs("203.0.113.1:1", "192.168.1.2:1", "[2001:db8::1]:1", "127.0.0.1:1"),
+			want:  addrs("127.0.0.1:1", "[2001:db8::1]:1", "192.168.1.2:1", "203.0.113.1:1"),
+			order: DefaultDialOrder,
+		},
+		"stable": {
+			addrs: addrs("192.168.1.2:1", "10.0.0.1:1", "192.168.1.3:1"),
+			want:  addrs("192.168.1.2:1", "10.0.0.1:1", "192.168.1.3:1"),
+			order: DefaultDialOrder,
+		},
+		"others_last": {
+			addrs: addrs("127.0.0.1:1", "203.0.113.1:1", "192.168.1.2:1"),
+			want:  addrs("203.0.113.1:1", "127.0.0.1:1", "192.168.1.2:1"),
+			order: []AddrSpace{SpacePublic4},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := orderAddrs(tc.addrs, tc.order); !slices.Equal(got, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDialStaggered(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var (
+		mu     sync.Mutex
+		starts = make(map[netip.AddrPort]time.Time)
+	)
+	failing, hanging, last := netip.MustParseAddrPort("127.0.0.1:1"), netip.MustParseAddrPort("[2001:db8::1]:1"), netip.MustParseAddrPort("203.0.113.1:1")
+	transport := func(ctx context.Context, socket *Socket, addr netip.AddrPort) (net.Conn, error) {
+		mu.Lock()
+		starts[addr] = time.Now()
+		mu.Unlock()
+		switch addr {
+		case failing:
+			return nil, errors.New("refused")
+		case hanging:
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		a, _ := net.Pipe()
+		return a, nil
+	}
+	cfg := &ClientConfig{
+		DialOrder:    DefaultDialOrder,
+		DialStagger:  100 * time.Millisecond,
+		DialAttempts: 1,
+		Transports:   map[AddrSpace]Transport{SpaceLoopback: transport, SpacePublic6: transport, SpacePublic4: transport},
+	}
+	conns := make(chan net.Conn, 1)
+	go func() {
+		dialStaggered(ctx, slog.Default(), newTracer(nil, nil), cfg, []netip.AddrPort{failing, hanging, last}, nil, func(nc net.Conn) {
+			conns <- nc
+			cancel()
+		})
+	}()
+	nc := <-conns
+	defer nc.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if d := starts[hanging].Sub(starts[failing]); d >= cfg.DialStagger {
+		t.Fatalf("expected the next dial right after a failure, got %v", d)
+	}
+	if d := starts[last].Sub(starts[hanging]); d < cfg.DialStagger {
+		t.Fatalf("expected the next dial after %v, got %v", cfg.DialStagger, d)
+	}
+}
+
+func TestCapsExchange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, nil)
+	dialer := NewClient(&ClientConfig{AddrSpaces: NoSpaces, Capabilities: CapMux | CapSecure | CapApp})
+	acceptor := NewClient(&ClientConfig{AddrSpaces: NoSpaces, Capabilities: CapMux | CapApp<<1})
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := acceptor.Accept(ctx, hs.URL, "caps", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dc, _, err := dialer.Dial(ctx, hs.URL, "caps", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	ac := <-accepted
+	if ac == nil {
+		t.FailNow()
+	}
+	defer ac.Close()
+	if peer := dc.Meta().PeerCapabilities; peer != CapMux|CapApp<<1 {
+		t.Fatalf("expected %v, got %v", CapMux|CapApp<<1, peer)
+	}
+	if peer := ac.Meta().PeerCapabilities; peer != CapMux|CapSecure|CapApp {
+		t.Fatalf("expected %v, got %v", CapMux|CapSecure|CapApp, peer)
+	}
+	if dc.Capabilities() != CapMux || ac.Capabilities() != CapMux {
+		t.Fatalf("expected %v, got %v and %v", CapMux, dc.Capabilities(), ac.Capabilities())
+	}
+}
+
+func TestEchoHeader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, nil)
+	echo := http.Header{"Name": {"alice"}}
+	dialer := NewClient(&ClientConfig{AddrSpaces: NoSpaces, EchoHeader: echo})
+	acceptor := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := acceptor.Accept(ctx, hs.URL, "echo", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dc, _, err := dialer.Dial(ctx, hs.URL, "echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	ac := <-accepted
+	if ac == nil {
+		t.FailNow()
+	}
+	defer ac.Close()
+	if name := ac.Meta().PeerHeader.Get("Name"); name != "alice" {
+		t.Fatalf("expected alice, got %q", name)
+	}
+
+	// The meta of the conn doesn't share the config header
+	dc.Meta().Header.Set("Name", "bob")
+	if name := echo.Get("Name"); name != "alice" {
+		t.Fatalf("expected alice, got %q", name)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, nil)
+	dialer := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	acceptor := NewClient(&ClientConfig{AddrSpaces: NoSpaces, Banner: []byte("proto/1")})
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := acceptor.Accept(ctx, hs.URL, "banner", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dc, _, err := dialer.Dial(ctx, hs.URL, "banner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	ac := <-accepted
+	if ac == nil {
+		t.FailNow()
+	}
+	defer ac.Close()
+	if banner := dc.Meta().PeerBanner; string(banner) != "proto/1" {
+		t.Fatalf("expected proto/1, got %q", banner)
+	}
+	if banner := ac.Meta().PeerBanner; banner != nil {
+		t.Fatalf("expected no banner, got %q", banner)
+	}
+}
@@ -0,0 +1,115 @@
+package rdv
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max length of the timestamps in a header or PONG line, including the line ending
+const maxLineTimes = 3*21 + 2
+
+// Timestamps of a round trip with the peer, in unix nanoseconds: when we sent (Sent) and when we
+// received the response (Done) on our clock, and when the peer received (Recv) and responded (T)
+// on its clock. See ClientConfig.ClockSync.
+type clockSample struct {
+	Sent, Recv, T, Done int64
+}
+
+// Estimates the offset of the peer clock relative to ours and the round-trip time. Same as NTP.
+func (s clockSample) estimate() (offset, rtt time.Duration) {
+	offset = time.Duration(((s.Recv - s.Sent) + (s.T - s.Done)) / 2)
+	rtt = time.Duration((s.Done - s.Sent) - (s.T - s.Recv))
+	return
+}
+
+// Returns the line with timestamps appended, before the line ending.
+func withTimes(line string, times ...int64) string {
+	var b strings.Builder
+	b.WriteString(strings.TrimSuffix(line, "\r\n"))
+	for _, t := range times {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(t, 10))
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// Returns the timestamps that follow the expected line in a received line, if any. The line
+// ending of either is ignored.
+func parseTimes(line, expected string) ([]int64, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(line, "\r\n"), strings.TrimSuffix(expected, "\r\n"))
+	if !ok || (rest != "" && rest[0] != ' ') {
+		return nil, fmt.Errorf("%w: invalid peer handshake", ErrProtocol)
+	}
+	if rest == "" {
+		return nil, nil
+	}
+	fields := strings.Split(rest[1:], " ")
+	if len(fields) > 3 {
+		return nil, fmt.Errorf("%w: invalid peer handshake", ErrProtocol)
+	}
+	times := make([]int64, len(fields))
+	for i, field := range fields {
+		var err error
+		if times[i], err = strconv.ParseInt(field, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: invalid peer handshake", ErrProtocol)
+		}
+	}
+	return times, nil
+}
+
+// Reads the rdv header line of the peer, which may carry timestamps (see ClientConfig.ClockSync),
+// and returns them. Also returns what was read, including on error.
+func readHeader(r io.Reader, header string) (line []byte, times []int64, err error) {
+	line = make([]byte, len(header)-2, len(header)+maxLineTimes) // up to the line ending
+	n, err := io.ReadFull(r, line)
+	if err != nil {
+		return line[:n], nil, err
+	}
+	rest, err := readRawLine(r, maxLineTimes)
+	line = append(line, rest...)
+	if err != nil {
+		return line, nil, err
+	}
+	times, err = parseTimes(string(line), header)
+	return line, times, err
+}
+
+// Returns the estimate of the peer's clock from the handshake, if any. See ClientConfig.ClockSync.
+func (c *Conn) clockEstimate() (offset, rtt time.Duration, ok bool) {
+	if c.clock.Done == 0 {
+		return 0, 0, false
+	}
+	offset, rtt = c.clock.estimate()
+	return offset, rtt, true
+}
+
+// Reads a line ending with LF, without reading beyond it. The line ending is trimmed.
+func readLine(r io.Reader, max int) (string, error) {
+	line, err := readRawLine(r, max)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// Like readLine, but returns the line with its ending, and what was read on error.
+func readRawLine(r io.Reader, max int) ([]byte, error) {
+	var (
+		line []byte
+		b    [1]byte
+	)
+	for len(line) < max {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return line, err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			return line, nil
+		}
+	}
+	return line, fmt.Errorf("%w: line too long", ErrProtocol)
+}
@@ -0,0 +1,107 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseTimes(t *testing.T) {
+	const hello = "rdv/2 HELLO token\r\n"
+	tests := map[string]struct {
+		line  string
+		times []int64
+		err   error
+	}{
+		"none":       {line: hello},
+		"one":        {line: withTimes(hello, 1), times: []int64{1}},
+		"three":      {line: withTimes(hello, 1, -2, 3), times: []int64{1, -2, 3}},
+		"no_ending":  {line: "rdv/2 HELLO token 5", times: []int64{5}},
+		"too_many":   {line: withTimes(hello, 1, 2, 3, 4), err: ErrProtocol},
+		"not_an_int": {line: "rdv/2 HELLO token x\r\n", err: ErrProtocol},
+		"empty":      {line: "rdv/2 HELLO token \r\n", err: ErrProtocol},
+		"other":      {line: "rdv/2 HELLO tokens 1\r\n", err: ErrProtocol},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			times, err := parseTimes(tc.line, hello)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if !slices.Equal(times, tc.times) {
+				t.Fatalf("expected %v, got %v", tc.times, times)
+			}
+		})
+	}
+}
+
+// The dialer's estimate comes from PONGs, and the acceptor's from the HELLO and CONFIRM.
+func TestClockSyncDirect(t *testing.T) {
+	dnc, anc := tcpPair(t)
+	dmeta, ameta := newMeta(true, "", "token"), newMeta(false, "", "token")
+	for _, m := range []*Meta{dmeta, ameta} {
+		m.Version, m.clockSync = 2, true
+	}
+	dc, ac := newDirectConn(dnc, false, dmeta, nil), newDirectConn(anc, true, ameta, nil)
+
+	accepted := make(chan error, 1)
+	go func() { accepted <- ac.clientHand() }()
+	if err := dc.clientHand(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dc.ping(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.clientShake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+
+	for name, conn := range map[string]*Conn{"dialer": dc, "acceptor": ac} {
+		offset, rtt, ok := conn.clockEstimate()
+		if !ok || rtt <= 0 || offset.Abs() > time.Second {
+			t.Fatalf("expected an estimate for the %s, got %v, %v, %v", name, offset, rtt, ok)
+		}
+	}
+}
+
+// Over a relay, only the acceptor gets an estimate, since relay conns aren't pinged.
+func TestClockSyncRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, nil)
+
+	cfg := &ClientConfig{AddrSpaces: NoSpaces, ClockSync: true}
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := NewClient(cfg).Accept(ctx, hs.URL, "token", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dc, _, err := NewClient(cfg).Dial(ctx, hs.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	ac := <-accepted
+	if ac == nil {
+		return
+	}
+	defer ac.Close()
+
+	if m := ac.Meta(); m.RTT <= 0 || m.ClockOffset.Abs() > time.Second {
+		t.Fatalf("expected an acceptor estimate, got %v, %v", m.ClockOffset, m.RTT)
+	}
+	if m := dc.Meta(); m.RTT != 0 || m.ClockOffset != 0 {
+		t.Fatalf("expected no dialer estimate, got %v, %v", m.ClockOffset, m.RTT)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/betamos/rdv/mux"
+)
+
+// Port forwarding over a single rdv conn, like ssh -L and -R. The dialer has the forwards, and the
+// acceptor connects and listens on its behalf. Each forwarded conn is a mux stream, which starts
+// with a request line and a reply line (OK or ERR):
+//
+//	CONNECT HOST:PORT  dialer to acceptor, for a conn to the target of a local forward
+//	LISTEN BIND:PORT   dialer to acceptor, for the listener of a remote forward, open with the stream
+//	FORWARD BIND:PORT  acceptor to dialer, for a conn to the listener of a remote forward
+//
+// The acceptor connects and listens on any addr that the dialer asks for, like proxy-exit.
+
+// A forward from a listening addr to a target addr, both host:port
+type forward struct {
+	listen, target string
+}
+
+// Repeatable flag of forwards
+type forwardList []forward
+
+func (l *forwardList) String() string {
+	var s []string
+	for _, f := range *l {
+		s = append(s, f.listen+"->"+f.target)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *forwardList) Set(s string) error {
+	f, err := parseForward(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, f)
+	return nil
+}
+
+// Parses a forward like ssh, i.e. [BIND:]PORT:HOST:HOSTPORT, where IPv6 addrs are in brackets.
+// The listener binds to localhost by default.
+func parseForward(s string) (forward, error) {
+	var parts []string
+	for rest := s; ; {
+		var part string
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return forward{}, fmt.Errorf("bad forward %q", s)
+			}
+			part, rest = rest[1:end], rest[end+1:]
+			if rest != "" && !strings.HasPrefix(rest, ":") {
+				return forward{}, fmt.Errorf("bad forward %q", s)
+			}
+			rest = strings.TrimPrefix(rest, ":")
+		} else {
+			part, rest, _ = strings.Cut(rest, ":")
+		}
+		parts = append(parts, part)
+		if rest == "" {
+			break
+		}
+	}
+	if len(parts) == 3 {
+		parts = append([]string{"localhost"}, parts...)
+	}
+	if len(parts) != 4 || parts[2] == "" {
+		return forward{}, fmt.Errorf("bad forward %q, expected [BIND:]PORT:HOST:HOSTPORT", s)
+	}
+	for _, port := range []string{parts[1], parts[3]} {
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return forward{}, fmt.Errorf("bad port %q in forward %q", port, s)
+		}
+	}
+	return forward{net.JoinHostPort(parts[0], parts[1]), net.JoinHostPort(parts[2], parts[3])}, nil
+}
+
+// Forwards ports to and from a peer. With any -L or -R, the peer is dialed, otherwise peers are
+// accepted and their forwards are served.
+func fwd() error {
+	var locals, remotes forwardList
+	fs := flag.NewFlagSet("fwd", flag.ExitOnError)
+	fs.Var(&locals, "L", "forward `[BIND:]PORT:HOST:HOSTPORT` locally to HOST:HOSTPORT of the peer (repeatable)")
+	fs.Var(&remotes, "R", "forward `[BIND:]PORT:HOST:HOSTPORT` of the peer to HOST:HOSTPORT locally (repeatable)")
+	fs.Parse(flag.Args()[1:])
+	addr, token := fs.Arg(0), fs.Arg(1)
+	if token == "" {
+		usage()
+		os.Exit(2)
+	}
+	client, closeFn, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if len(locals)+len(remotes) == 0 {
+		err = fwdAccept(ctx, client, addr, token)
+	} else {
+		err = fwdDial(ctx, client, addr, token, locals, remotes)
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Dials the peer, and forwards ports until ctx is canceled or the conn fails.
+func fwdDial(ctx context.Context, client *rdv.Client, addr, token string, locals, remotes []forward) error {
+	conn, _, err := client.Dial(ctx, addr, token, nil)
+	if err != nil {
+		return err
+	}
+	slog.Info("fwd: peer connected", "is_relay", conn.IsRelay(), "addr", conn.RemoteAddr())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sess := mux.New(conn)
+	defer sess.Close()
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+
+	for _, f := range locals {
+		ln, err := net.Listen("tcp", f.listen)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		slog.Info("fwd: listening", "addr", ln.Addr(), "target", f.target)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwardConns(&wg, sess, ln, "CONNECT", f.target)
+		}()
+	}
+	targets := make(map[string]string)
+	for _, f := range remotes {
+		st, err := sess.Open()
+		if err != nil {
+			return err
+		}
+		if err := fwdRequest(st, "LISTEN", f.listen); err != nil {
+			return fmt.Errorf("remote forward %s: %w", f.listen, err)
+		}
+		slog.Info("fwd: peer listening", "addr", f.listen, "target", f.target)
+		targets[f.listen] = f.target
+	}
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			return cmp.Or(ctx.Err(), err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			method, listen, err := readFwdRequest(st)
+			if target, ok := targets[listen]; err == nil && method == "FORWARD" && ok {
+				fwdConnect(st, target)
+				return
+			}
+			st.Close()
+		}()
+	}
+}
+
+// Accepts peers until ctx is canceled, and serves their forwards.
+func fwdAccept(ctx context.Context, client *rdv.Client, addr, token string) error {
+	ln := client.Listen(ctx, addr, token, nil)
+	defer ln.Close()
+	slog.Info("fwd: accepting", "token", token)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.AcceptConn()
+		if err != nil {
+			return cmp.Or(ctx.Err(), err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveFwd(ctx, conn)
+		}()
+	}
+}
+
+// Serves the forwards of a peer until ctx is canceled or the conn fails.
+func serveFwd(ctx context.Context, conn *rdv.Conn) {
+	log := slog.With("addr", conn.RemoteAddr())
+	log.Info("fwd: peer connected", "is_relay", conn.IsRelay())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sess := mux.New(conn)
+	defer sess.Close()
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			log.Info("fwd: peer disconnected", "err", err)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			method, arg, err := readFwdRequest(st)
+			switch {
+			case err != nil:
+				st.Close()
+			case method == "CONNECT":
+				fwdConnect(st, arg)
+			case method == "LISTEN":
+				serveRemoteForward(&wg, sess, st, arg)
+			default:
+				writeFwdReply(st, fmt.Errorf("bad method %q", method))
+				st.Close()
+			}
+		}()
+	}
+}
+
+// Listens on behalf of the peer, and forwards conns to it until the stream is closed.
+func serveRemoteForward(wg *sync.WaitGroup, sess *mux.Session, st *mux.Stream, listen string) {
+	defer st.Close()
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		writeFwdReply(st, err)
+		return
+	}
+	defer ln.Close()
+	if err := writeFwdReply(st, nil); err != nil {
+		return
+	}
+	slog.Info("fwd: listening for peer", "addr", ln.Addr())
+	go func() {
+		io.Copy(io.Discard, st) // until the peer or the session closes the stream
+		ln.Close()
+	}()
+	forwardConns(wg, sess, ln, "FORWARD", listen)
+}
+
+// Opens a stream for each conn from ln, with the request, and pipes the two until they're done.
+func forwardConns(wg *sync.WaitGroup, sess *mux.Session, ln net.Listener, method, arg string) {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer nc.Close()
+			st, err := sess.Open()
+			if err != nil {
+				return
+			}
+			defer st.Close()
+			if err := fwdRequest(st, method, arg); err != nil {
+				slog.Warn("fwd: forward failed", "addr", arg, "err", err)
+				return
+			}
+			pipe(nc, st)
+		}()
+	}
+}
+
+// Connects the stream to the target, and replies with the outcome.
+func fwdConnect(st *mux.Stream, target string) {
+	defer st.Close()
+	nc, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		slog.Warn("fwd: connect failed", "target", target, "err", err)
+		writeFwdReply(st, err)
+		return
+	}
+	defer nc.Close()
+	if err := writeFwdReply(st, nil); err != nil {
+		return
+	}
+	pipe(nc, st)
+}
+
+// Sends a request on the stream, and waits for the reply.
+func fwdRequest(st *mux.Stream, method, arg string) error {
+	if _, err := io.WriteString(st, method+" "+arg+"\n"); err != nil {
+		return err
+	}
+	line, err := readFwdLine(st)
+	if err != nil {
+		return err
+	}
+	if msg, ok := strings.CutPrefix(line, "ERR "); ok {
+		return errors.New(msg)
+	} else if line != "OK" {
+		return fmt.Errorf("bad reply %q", line)
+	}
+	return nil
+}
+
+func readFwdRequest(st *mux.Stream) (method, arg string, err error) {
+	line, err := readFwdLine(st)
+	if err != nil {
+		return "", "", err
+	}
+	method, arg, _ = strings.Cut(line, " ")
+	return method, arg, nil
+}
+
+func writeFwdReply(st *mux.Stream, err error) error {
+	line := "OK\n"
+	if err != nil {
+		line = "ERR " + strings.ReplaceAll(err.Error(), "\n", " ") + "\n"
+	}
+	_, err = io.WriteString(st, line)
+	return err
+}
+
+// Reads a line without buffering, so that the data after it is left on the stream.
+func readFwdLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxTransferLine {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("peer sent a line that is too long")
+}
+
+// Copies data both ways until both directions are done. Directions end with a half-close, or
+// close both conns if they fail, e.g. when the session is closed.
+func pipe(nc net.Conn, st *mux.Stream) {
+	done := make(chan struct{})
+	go func() {
+		if _, err := io.Copy(st, nc); err != nil {
+			st.Close()
+		} else {
+			st.CloseWrite()
+		}
+		close(done)
+	}()
+	_, err := io.Copy(nc, st)
+	if tc, ok := nc.(*net.TCPConn); ok && err == nil {
+		tc.CloseWrite()
+	} else {
+		nc.Close()
+	}
+	<-done
+}
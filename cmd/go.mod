@@ -0,0 +1,19 @@
+module github.com/betamos/rdv/cmd
+
+go 1.23
+
+require (
+	github.com/betamos/rdv v0.0.0
+	golang.org/x/crypto v0.19.0
+)
+
+require (
+	github.com/libp2p/go-reuseport v0.4.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sync v0.6.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
+
+// The CLI is built from the same tree as the library
+replace github.com/betamos/rdv => ../
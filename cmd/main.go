@@ -2,13 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/betamos/rdv"
@@ -18,20 +24,24 @@ var (
 	flagVerbose bool
 	flagRelay   bool
 	flagLAddr   string
+	flagTrace   string
+	flagWS      bool
 
 	spaces = rdv.DefaultSpaces
 )
 
 func usage() {
-	fmt.Fprintf(flag.CommandLine.Output(), "usage:\n\trdv [ flags ] serve\n\trdv [ flags ] <dial|accept> ADDR TOKEN:\n\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "usage:\n\trdv [ flags ] serve [ -tls-cert FILE -tls-key FILE | -acme DOMAINS ] [ -redirect ADDR ]\n\trdv [ flags ] <dial|accept> ADDR TOKEN\n\trdv [ flags ] proxy ADDR TOKEN\n\trdv [ flags ] proxy-exit -allow TARGETS ADDR TOKEN\n\trdv [ flags ] probe ADDR TOKEN\n\trdv [ flags ] send ADDR TOKEN FILE\n\trdv [ flags ] recv ADDR TOKEN [DIR]\n\trdv [ flags ] fwd [ -L|-R [BIND:]PORT:HOST:HOSTPORT ]... ADDR TOKEN\n\trdv trace view FILE:\n\n")
 	flag.PrintDefaults()
 }
 
 func init() {
 	flag.Usage = usage
-	flag.StringVar(&flagLAddr, "l", ":8080", "listening addr for serve")
+	flag.StringVar(&flagLAddr, "l", ":8080", "listening addr for serve, and for the socks5/http proxy")
 	flag.BoolVar(&flagVerbose, "v", false, "print verbose logs")
 	flag.BoolVar(&flagRelay, "r", false, "client: force using the relay even if p2p is possible")
+	flag.BoolVar(&flagWS, "ws", false, "client: connect to the server over websocket")
+	flag.StringVar(&flagTrace, "trace", "", "client: write a trace of the connection attempt to a file")
 }
 
 func main() {
@@ -54,6 +64,24 @@ func main() {
 		err = client(true)
 	case "a", "accept":
 		err = client(false)
+	case "proxy":
+		err = proxy(false)
+	case "proxy-exit":
+		err = proxy(true)
+	case "probe":
+		err = probe()
+	case "send":
+		err = send()
+	case "recv":
+		err = recv()
+	case "fwd":
+		err = fwd()
+	case "trace":
+		if flag.Arg(1) != "view" {
+			usage()
+			os.Exit(2)
+		}
+		err = traceView(flag.Arg(2))
 	default:
 		usage()
 		os.Exit(2)
@@ -63,14 +91,45 @@ func main() {
 	}
 }
 
+// Serves rdv, over https if a certificate is given or obtained with ACME (see serverTLS).
 func server() error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	certFile := fs.String("tls-cert", "", "serve https with the certificate `FILE` (PEM), which is reloaded when it changes")
+	keyFile := fs.String("tls-key", "", "private key `FILE` (PEM) of -tls-cert")
+	domains := fs.String("acme", "", "serve https with certificates from Let's Encrypt for the comma-separated `DOMAINS`, which are renewed automatically")
+	acmeDir := fs.String("acme-dir", "", "cache `DIR` of the -acme certificates (default: rdv/acme in the user cache dir)")
+	acmeEmail := fs.String("acme-email", "", "contact `EMAIL` for -acme, e.g. for problems with renewals")
+	redirect := fs.String("redirect", ":80", "with https, listening `ADDR` that redirects http to https and answers ACME challenges, or empty to disable")
+	fs.Parse(flag.Args()[1:])
+	tlsConfig, httpHandler, err := serverTLS(flagLAddr, *certFile, *keyFile, *domains, *acmeDir, *acmeEmail)
+	if err != nil {
+		return err
+	}
+
 	server := rdv.NewServer(&rdv.ServerConfig{
-		ServeFunc: handler,
+		ServeFunc:       handler,
+		ShutdownTimeout: 30 * time.Second,
 	})
-	http.Handle("/", server)
-	go server.Serve(context.Background())
-	slog.Info("listening", "addr", flagLAddr)
-	return http.ListenAndServe(flagLAddr, nil)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if httpHandler != nil && *redirect != "" {
+		rs := &http.Server{Addr: *redirect, Handler: httpHandler}
+		defer rs.Close()
+		go func() {
+			slog.Info("redirecting http", "addr", *redirect)
+			if err := rs.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("redirect failed", "err", err)
+			}
+		}()
+	}
+	slog.Info("listening", "addr", flagLAddr, "tls", tlsConfig != nil)
+	hs := &http.Server{Addr: flagLAddr, Handler: server, TLSConfig: tlsConfig}
+	hs.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler)) // rdv conns are hijacked, which requires http/1.1
+	err = rdv.Serve(ctx, hs, server)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
 }
 
 func handler(ctx context.Context, dc, ac *rdv.Conn) {
@@ -82,10 +141,65 @@ func handler(ctx context.Context, dc, ac *rdv.Conn) {
 	slog.Info("finished", "token", dc.Meta().Token, "dial_bytes", dn, "accept_bytes", an, "err", err)
 }
 
-func client(dialer bool) error {
-	client := rdv.NewClient(&rdv.ClientConfig{
+func newClient() (*rdv.Client, func(), error) {
+	cfg := &rdv.ClientConfig{
 		AddrSpaces: spaces,
-	})
+		WebSocket:  flagWS,
+	}
+	closeFn := func() {}
+	if flagTrace != "" {
+		f, err := os.Create(flagTrace)
+		if err != nil {
+			return nil, nil, err
+		}
+		closeFn = func() { f.Close() }
+		cfg.Trace = f
+	}
+	return rdv.NewClient(cfg), closeFn, nil
+}
+
+// Serves a local proxy through the peer, or the exit of the peer's proxy
+func proxy(exit bool) error {
+	client, closeFn, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	addr, token := flag.Arg(1), flag.Arg(2)
+	if exit {
+		fs := flag.NewFlagSet("proxy-exit", flag.ExitOnError)
+		allow := fs.String("allow", "", "comma-separated `TARGETS` (host:port) that the peer may connect to")
+		fs.Parse(flag.Args()[1:])
+		if *allow == "" {
+			return errors.New("proxy-exit requires -allow")
+		}
+		addr, token = fs.Arg(0), fs.Arg(1)
+		ln := client.Listen(ctx, addr, token, nil)
+		defer ln.Close()
+		slog.Info("proxy exit: listening", "token", token, "allow", *allow)
+		err = rdv.ServeProxyExit(ln, rdv.AllowProxyTargets(strings.Split(*allow, ",")...))
+	} else {
+		ln, listenErr := net.Listen("tcp", flagLAddr)
+		if listenErr != nil {
+			return listenErr
+		}
+		slog.Info("proxy: listening", "addr", ln.Addr())
+		err = client.ServeProxy(ctx, ln, addr, token, nil)
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func client(dialer bool) error {
+	client, closeFn, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
 	addr := flag.Arg(1)
 	token := flag.Arg(2)
 	fn := client.Accept
@@ -124,3 +238,52 @@ func client(dialer bool) error {
 	slog.Info("client: peer disconnected", "tx", tx, "rx", rx, "dur", time.Since(tConnected))
 	return nil
 }
+
+// Exchanges candidates with a peer that also probes, and prints what was learned
+func probe() error {
+	client, closeFn, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	meta, _, err := client.Probe(context.Background(), flag.Arg(1), flag.Arg(2), nil)
+	if err != nil {
+		return err
+	}
+	slog.Info("probe: peer found", "is_dialer", meta.IsDialer, "observed", meta.ObservedAddr, "hints", meta.Hints)
+	slog.Info("probe: self", "addrs", meta.SelfAddrs)
+	slog.Info("probe: peer", "addrs", meta.PeerAddrs)
+	return nil
+}
+
+// Renders a trace file as a timeline
+func traceView(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	events, err := rdv.ReadTrace(f)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	tStart := events[0].Time
+	for _, ev := range events {
+		addr := "-"
+		if ev.Addr != nil {
+			addr = fmt.Sprintf("%v (%v)", ev.Addr, ev.Space)
+		}
+		line := fmt.Sprintf("%+8.1fms  %-11s %s", float64(ev.Time.Sub(tStart).Microseconds())/1000, ev.Kind, addr)
+		if ev.Data != "" {
+			line += fmt.Sprintf("  %q", ev.Data)
+		}
+		if ev.Err != "" {
+			line += "  err: " + ev.Err
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
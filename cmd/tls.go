@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// How often the certificate files of -tls-cert are checked for changes
+const certCheckInterval = time.Minute
+
+// Returns the TLS config of the serve flags, and the handler of the http listener, which
+// redirects to https and answers ACME challenges. Both are nil without TLS.
+func serverTLS(addr, certFile, keyFile, domains, dir, email string) (*tls.Config, http.Handler, error) {
+	switch {
+	case domains != "":
+		if certFile != "" || keyFile != "" {
+			return nil, nil, errors.New("-acme conflicts with -tls-cert and -tls-key")
+		}
+		if dir == "" {
+			cache, err := os.UserCacheDir()
+			if err != nil {
+				return nil, nil, err
+			}
+			dir = filepath.Join(cache, "rdv", "acme")
+		}
+		// Certificates are obtained on the first handshake of each domain, and renewed before
+		// they expire
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(domains, ",")...),
+			Cache:      autocert.DirCache(dir),
+			Email:      email,
+		}
+		cfg := m.TLSConfig()
+		// The server doesn't speak h2, since rdv conns are hijacked from http/1.1
+		cfg.NextProtos = []string{"http/1.1", acme.ALPNProto}
+		return cfg, m.HTTPHandler(redirectHTTPS(addr)), nil
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, nil, errors.New("-tls-cert and -tls-key must be set together")
+		}
+		files := &certFiles{cert: certFile, key: keyFile}
+		if _, err := files.get(nil); err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: files.get}, redirectHTTPS(addr), nil
+	}
+	return nil, nil, nil
+}
+
+// Redirects http requests to the https server at addr, on the same host.
+func redirectHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host // no port
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// A certificate and key from files, which are reloaded when the certificate changes, e.g. when
+// it's renewed by certbot.
+type certFiles struct {
+	cert, key string
+
+	mu      sync.Mutex
+	loaded  *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (c *certFiles) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded != nil && time.Since(c.checked) < certCheckInterval {
+		return c.loaded, nil
+	}
+	c.checked = time.Now()
+	fi, err := os.Stat(c.cert)
+	if err == nil && c.loaded != nil && fi.ModTime().Equal(c.modTime) {
+		return c.loaded, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(c.cert, c.key); err == nil {
+			c.loaded, c.modTime = &cert, fi.ModTime()
+			slog.Info("loaded certificate", "file", c.cert)
+			return c.loaded, nil
+		}
+	}
+	if c.loaded == nil {
+		return nil, err
+	}
+	slog.Warn("could not reload certificate, using the old one", "err", err)
+	return c.loaded, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Sent by the sender before any data
+type fileHeader struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Sent by the receiver in reply to the header, with the number of bytes it already has
+type resumeReply struct {
+	Offset int64  `json:"offset"`
+	Err    string `json:"err,omitempty"`
+}
+
+// Sent by the receiver once the file is complete
+type doneReply struct {
+	Err string `json:"err,omitempty"`
+}
+
+// Max length of the JSON lines of a transfer
+const maxTransferLine = 4096
+
+// Sends a file to a peer that runs recv
+func send() error {
+	addr, token, name := flag.Arg(1), flag.Arg(2), flag.Arg(3)
+	if name == "" {
+		usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", name)
+	}
+	slog.Info("send: hashing", "file", name, "size", formatBytes(info.Size()))
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	header := fileHeader{Name: filepath.Base(name), Size: info.Size(), SHA256: hex.EncodeToString(h.Sum(nil))}
+
+	client, closeFn, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	conn, _, err := client.Dial(ctx, addr, token, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	context.AfterFunc(ctx, func() { conn.Close() })
+	slog.Info("send: peer connected", "is_relay", conn.IsRelay(), "addr", conn.RemoteAddr())
+
+	br := bufio.NewReader(conn)
+	if err := writeJSON(conn, header); err != nil {
+		return err
+	}
+	var resume resumeReply
+	if err := readJSON(br, &resume); err != nil {
+		return err
+	}
+	if resume.Err != "" {
+		return fmt.Errorf("peer refused the file: %s", resume.Err)
+	}
+	if resume.Offset < 0 || resume.Offset > header.Size {
+		return fmt.Errorf("peer requested a bad offset %d", resume.Offset)
+	}
+	if resume.Offset > 0 {
+		slog.Info("send: resuming", "offset", formatBytes(resume.Offset))
+	}
+	if _, err := f.Seek(resume.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	bar := newProgressBar(header.Name, header.Size, resume.Offset)
+	_, err = io.Copy(io.MultiWriter(conn, bar), io.LimitReader(f, header.Size-resume.Offset))
+	bar.stop()
+	if err != nil {
+		return err
+	}
+	var done doneReply
+	if err := readJSON(br, &done); err != nil {
+		return err
+	}
+	if done.Err != "" {
+		return fmt.Errorf("peer failed to receive the file: %s", done.Err)
+	}
+	slog.Info("send: done", "file", name, "sha256", header.SHA256)
+	return nil
+}
+
+// Receives a file from a peer that runs send, into a dir (by default the current one). Partial
+// files are kept next to the destination, and resumed if the same file is sent again.
+func recv() error {
+	addr, token, dir := flag.Arg(1), flag.Arg(2), flag.Arg(3)
+	if dir == "" {
+		dir = "."
+	}
+	client, closeFn, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	conn, _, err := client.Accept(ctx, addr, token, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	context.AfterFunc(ctx, func() { conn.Close() })
+	slog.Info("recv: peer connected", "is_relay", conn.IsRelay(), "addr", conn.RemoteAddr())
+
+	br := bufio.NewReader(conn)
+	var header fileHeader
+	if err := readJSON(br, &header); err != nil {
+		return err
+	}
+	dest, part, err := recvPaths(dir, header)
+	if err != nil {
+		writeJSON(conn, resumeReply{Err: err.Error()})
+		return err
+	}
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		writeJSON(conn, resumeReply{Err: "can't create file"})
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err == nil && offset > header.Size {
+		offset, err = 0, f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		writeJSON(conn, resumeReply{Err: "can't write file"})
+		return err
+	}
+	if offset > 0 {
+		slog.Info("recv: resuming", "file", part, "offset", formatBytes(offset))
+	}
+	if err := writeJSON(conn, resumeReply{Offset: offset}); err != nil {
+		return err
+	}
+	bar := newProgressBar(header.Name, header.Size, offset)
+	_, err = io.CopyN(io.MultiWriter(f, bar), br, header.Size-offset)
+	bar.stop()
+	if err != nil {
+		return fmt.Errorf("transfer interrupted, run recv again to resume: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != header.SHA256 {
+		os.Remove(part)
+		writeJSON(conn, doneReply{Err: "checksum mismatch"})
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", header.SHA256, sum)
+	}
+	f.Close()
+	if err := os.Rename(part, dest); err != nil {
+		writeJSON(conn, doneReply{Err: "can't write file"})
+		return err
+	}
+	if err := writeJSON(conn, doneReply{}); err != nil {
+		return err
+	}
+	// Wait for the sender to close, so that the reply isn't lost when the relay is torn down
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, br)
+	slog.Info("recv: done", "file", dest, "sha256", header.SHA256)
+	return nil
+}
+
+// Returns the destination of the file, and the path of its partial file, which is specific to the
+// checksum so that only the same file is resumed.
+func recvPaths(dir string, header fileHeader) (dest, part string, err error) {
+	name := header.Name
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || name != filepath.Base(name) {
+		return "", "", fmt.Errorf("bad file name %q", name)
+	}
+	if header.Size < 0 || len(header.SHA256) != 2*sha256.Size {
+		return "", "", errors.New("bad file header")
+	}
+	dest = filepath.Join(dir, name)
+	if _, err := os.Stat(dest); err == nil {
+		return "", "", fmt.Errorf("%s already exists", name)
+	}
+	return dest, filepath.Join(dir, "."+name+"."+header.SHA256[:12]+".part"), nil
+}
+
+func writeJSON(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func readJSON(br *bufio.Reader, v any) error {
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || len(line) > maxTransferLine {
+		return errors.New("peer sent a line that is too long")
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// Prints the progress and rate of a transfer to stderr, which is updated periodically.
+type progressBar struct {
+	name          string
+	total, offset int64
+	n             atomic.Int64
+	start         time.Time
+	done          chan struct{}
+	stopped       chan struct{}
+}
+
+func newProgressBar(name string, total, offset int64) *progressBar {
+	p := &progressBar{name: name, total: total, offset: offset, start: time.Now(), done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-p.done:
+				p.print()
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.n.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func (p *progressBar) stop() {
+	close(p.done)
+	<-p.stopped
+}
+
+func (p *progressBar) print() {
+	const width = 30
+	n := p.n.Load()
+	done := p.offset + n
+	frac := 1.0
+	if p.total > 0 {
+		frac = float64(done) / float64(p.total)
+	}
+	rate := float64(n) / max(time.Since(p.start).Seconds(), 0.001)
+	bar := strings.Repeat("=", int(frac*width)) + strings.Repeat(" ", width-int(frac*width))
+	fmt.Fprintf(os.Stderr, "\r%s %3.0f%% [%s] %s / %s  %s/s ", p.name, 100*frac, bar, formatBytes(done), formatBytes(p.total), formatBytes(int64(rate)))
+}
+
+// Formats a number of bytes with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -3,15 +3,28 @@ package rdv
 import (
 	"context"
 	"errors"
+	"fmt"
+	"iter"
 	"net"
 	"net/netip"
+	"slices"
 )
 
 const (
 	maxAddrs = 10
 
+	// Max size of a banner, see ClientConfig.Banner
+	maxBannerSize = 1024
+
+	// Max size of response headers from the rdv server
+	maxRespHeaderBytes = 64 << 10
+
+	// Name and version 1 of the protocol, used in rdv lines that aren't versioned
 	protocolName = "rdv/1"
 
+	// Latest protocol version, which clients propose along with older ones (see Meta.Version)
+	maxProtocolVersion = 2
+
 	// Token for this rdv conn, chosen by a client. Request and response.
 	hToken = "Rdv-Token"
 
@@ -21,11 +34,60 @@ const (
 	// A comma-separate list of observed and self-reported ip:port addrs of the peer. Response only.
 	hPeerAddrs = "Rdv-Peer-Addrs"
 
+	// Role assigned to a symmetric client, "dial" or "accept". Response only.
+	hRole = "Rdv-Role"
+
+	// The rdv method (e.g. DIAL) of WebSocket requests, which use GET. Request only.
+	hMethod = "Rdv-Method"
+
+	// The proposed protocol versions of WebSocket requests, like the Upgrade header of other
+	// requests. Request only.
+	hUpgrade = "Rdv-Upgrade"
+
+	// Observed addr of a client that was forwarded by another server instance. Request only.
+	hForwardedAddr = "Rdv-Forwarded-Addr"
+
+	// Signature of a forwarded client by the forwarding instance, as unix seconds and a hex
+	// HMAC of the forwarded addr and token with the instance key. Request only.
+	hForwardedSig = "Rdv-Forwarded-Sig"
+
+	// Namespace of the token, see Meta.Namespace. Request only.
+	hNamespace = "Rdv-Namespace"
+
+	// Comma-separated list of hints, see Hint. Request and response.
+	hHints = "Rdv-Hints"
+
+	// Capabilities of the client as a hex bitmask, see Capability. Request, and in responses the
+	// capabilities of the peer.
+	hCaps = "Rdv-Caps"
+
+	// Banner of the client in base64, see ClientConfig.Banner. Request, and in responses the
+	// banner of the peer.
+	hBanner = "Rdv-Banner"
+
+	// Remaining time of the client in the lobby in (fractional) seconds, see ContextWithExpiryFunc. Interim
+	// responses only.
+	hExpiresIn = "Rdv-Expires-In"
+
 	// Observed public ipv4:port addr of the requesting client, from the server's point of view.
 	// Response only.
 	hObservedAddr = "Rdv-Observed-Addr"
+
+	// Number of clients in a group, see Client.JoinGroup. Request only.
+	hGroupSize = "Rdv-Group-Size"
+
+	// Index of the client in its group. Response only.
+	hGroupIndex = "Rdv-Group-Index"
+
+	// Addrs of each member of the group by index, separated by semicolons. Response only.
+	hGroupAddrs = "Rdv-Group-Addrs"
 )
 
+// Request headers with this prefix are echoed by the server to the other peer, in its response
+// when the peers are matched. Peers can use them to exchange application-level info (e.g.
+// capabilities) before any data. The peer's headers are available in Meta.PeerHeader.
+const EchoHeaderPrefix = "Rdv-Echo-"
+
 var (
 	ErrHijackFailed   = errors.New("failed hijacking http conn")
 	ErrBadHandshake   = errors.New("bad http handshake")
@@ -36,23 +98,98 @@ var (
 	ErrPrivilegedPort = errors.New("bad addr: expected port >=1024")
 	ErrInvalidAddr    = errors.New("bad addr: invalid addr")
 	ErrDontUse        = errors.New("bad addr: not helpful for connectivity")
+	ErrHeaderTooLarge = errors.New("rdv response header too large")
+	ErrRelayDenied    = errors.New("rdv relay denied")
+	ErrUnauthorized   = errors.New("rdv client unauthorized")
+	ErrQuotaExceeded  = errors.New("rdv lobby quota exceeded")
+	ErrRelayQuota     = errors.New("rdv relay quota exceeded")
+	ErrNotDirect      = errors.New("rdv conn is not a direct tcp conn")
+	ErrMaintenance    = errors.New("rdv server under maintenance")
+	ErrUntrustedPeer  = errors.New("rdv peer key not trusted")
+	ErrServerTimeout  = errors.New("rdv server response timed out")
+	ErrPoolClosed     = errors.New("rdv pool closed")
+	ErrProxyHeader    = errors.New("bad proxy protocol header")
+	ErrInvalidConfig  = errors.New("invalid rdv config")
+	ErrBadTicket      = errors.New("bad rdv ticket")
+	ErrKicked         = errors.New("rdv client kicked by operator")
+	ErrDowngrade      = errors.New("rdv conn downgraded")
+	ErrHandedOff      = errors.New("rdv relay handed off")
+	ErrProxyDenied    = errors.New("rdv proxy destination denied")
+
+	ErrFastOpenUnsupported = errors.New("tcp fast open not supported")
 )
 
 // TODO: Ipv4-mapped v6-addrs
 func DefaultSelfAddrs(ctx context.Context, socket *Socket) []netip.AddrPort {
-	netAddrs, _ := net.InterfaceAddrs()
+	ifs, _ := SystemInterfaces()
 	var addrs []netip.AddrPort
-	for _, netAddr := range netAddrs {
+	for _, ip := range ifs.All() {
 		if len(addrs) > maxAddrs-1 { // save one addr for observed addr
 			break
 		}
-		prefixAddr := netip.MustParsePrefix(netAddr.String())
-		addr := netip.AddrPortFrom(prefixAddr.Addr(), socket.Port)
-		addrs = append(addrs, addr)
+		addrs = append(addrs, netip.AddrPortFrom(ip, socket.Port))
 	}
 	return addrs
 }
 
+// A list of network interfaces, e.g. for custom SelfAddrFuncs.
+type Interfaces []net.Interface
+
+// Returns the interfaces of the system.
+func SystemInterfaces() (Interfaces, error) {
+	return net.Interfaces()
+}
+
+// Yields each interface together with each of its addrs.
+func (ifs Interfaces) All() iter.Seq2[net.Interface, netip.Addr] {
+	return func(yield func(net.Interface, netip.Addr) bool) {
+		for _, ifi := range ifs {
+			netAddrs, _ := ifi.Addrs()
+			for _, netAddr := range netAddrs {
+				prefix, err := netip.ParsePrefix(netAddr.String())
+				if err != nil {
+					continue
+				}
+				if !yield(ifi, prefix.Addr()) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Wraps a SelfAddrFunc, keeping only addrs whose IP can be bound locally. This drops addrs that
+// would only waste the peer's dial attempts, such as addrs of interfaces that just went down, or
+// ipv6 addrs that are still tentative. Only addrs of local interfaces are verified, so addrs from
+// other sources, such as port mappings and STUN, are kept.
+func VerifySelfAddrs(fn func(ctx context.Context, socket *Socket) []netip.AddrPort) func(ctx context.Context, socket *Socket) []netip.AddrPort {
+	return func(ctx context.Context, socket *Socket) []netip.AddrPort {
+		ifs, _ := SystemInterfaces()
+		local := make(map[netip.Addr]bool)
+		for _, ip := range ifs.All() {
+			local[ip.WithZone("")] = true
+		}
+		return verifyAddrs(fn(ctx, socket), local, canBind)
+	}
+}
+
+// Keeps the addrs that are either not local, or local and bindable.
+func verifyAddrs(addrs []netip.AddrPort, local map[netip.Addr]bool, canBind func(addr netip.AddrPort) bool) []netip.AddrPort {
+	return filter(addrs, func(addr netip.AddrPort) bool {
+		return !local[addr.Addr().WithZone("")] || canBind(addr)
+	})
+}
+
+// Returns true if a TCP listener can be bound to the IP of the addr, with any port
+func canBind(addr netip.AddrPort) bool {
+	ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr.Addr(), 0)))
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
 // An IP address space is derived from an IP address. These are used for connectivity in rdv, and
 // thus don't include multicast etc. order to differentiate between meaningful addrs.
 type AddrSpace uint32
@@ -82,6 +219,12 @@ const (
 
 	// Loopback addresses are mostly useful for testing.
 	SpaceLoopback
+
+	// Shared addrs of carrier-grade NAT (100.64.0.0/10), which are also used by overlay networks
+	// such as Tailscale. Useful when both peers are in the same carrier or overlay network.
+	// Previously classified as SpacePublic4, so custom AddrSpaces and PairingMatrix entries that
+	// relied on that need to add SpaceCGNAT.
+	SpaceCGNAT
 )
 
 const (
@@ -91,8 +234,8 @@ const (
 	// Public IPs only
 	PublicSpaces AddrSpace = SpacePublic4 | SpacePublic6
 
-	// Sensible defaults for most users, includes private and public spaces
-	DefaultSpaces AddrSpace = SpacePublic4 | SpacePublic6 | SpacePrivate4 | SpacePrivate6
+	// Sensible defaults for most users, includes private, CGNAT and public spaces
+	DefaultSpaces AddrSpace = SpacePublic4 | SpacePublic6 | SpacePrivate4 | SpacePrivate6 | SpaceCGNAT
 
 	// All IP spaces
 	AllSpaces AddrSpace = ^NoSpaces
@@ -118,10 +261,15 @@ func (s AddrSpace) String() string {
 		return "link6"
 	case SpaceLoopback:
 		return "loopback"
+	case SpaceCGNAT:
+		return "cgnat"
 	}
 	return "invalid"
 }
 
+// Shared address space for carrier-grade NAT, see RFC 6598
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
 // Get AddrPort and AddrSpace from a TCP net.Addr
 func FromNetAddr(na net.Addr) (addr netip.AddrPort, space AddrSpace) {
 	addr, _ = netip.ParseAddrPort(na.String())
@@ -150,6 +298,9 @@ func GetAddrSpace(ip netip.Addr) AddrSpace {
 		return SpacePrivate6
 	}
 	if ip.IsGlobalUnicast() {
+		if cgnatPrefix.Contains(ip) {
+			return SpaceCGNAT
+		}
 		if ip.Is4() {
 			return SpacePublic4
 		}
@@ -157,3 +308,30 @@ func GetAddrSpace(ip netip.Addr) AddrSpace {
 	}
 	return SpaceInvalid
 }
+
+// Checks that the addr can be used as a candidate addr, as required by the rdv protocol. Returns
+// ErrInvalidAddr for invalid addrs and zero ports, ErrDontUse for IPs that peers can't connect to
+// (unspecified, multicast and broadcast), and ErrPrivilegedPort for ports below 1024.
+func ValidateAddr(addr netip.AddrPort) error {
+	if !addr.IsValid() || addr.Port() == 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidAddr, addr)
+	}
+	if GetAddrSpace(addr.Addr()) == SpaceInvalid {
+		return fmt.Errorf("%w: %v", ErrDontUse, addr)
+	}
+	if addr.Port() < 1024 {
+		return fmt.Errorf("%w: %v", ErrPrivilegedPort, addr)
+	}
+	return nil
+}
+
+// Returns the addrs that pass ValidateAddr, without duplicates and in the original order.
+// Applied to the candidate addrs by both clients and the server.
+func SanitizeAddrs(addrs []netip.AddrPort) (valid []netip.AddrPort) {
+	for _, addr := range addrs {
+		if ValidateAddr(addr) == nil && !slices.Contains(valid, addr) {
+			valid = append(valid, addr)
+		}
+	}
+	return
+}
@@ -1,8 +1,10 @@
 package rdv
 
 import (
+	"errors"
 	"log"
 	"net/netip"
+	"slices"
 	"testing"
 )
 
@@ -20,7 +22,9 @@ func TestGetAddrSpace(t *testing.T) {
 		"link4":      {addr: "169.254.12.1", space: SpaceLink4},
 		"public4":    {addr: "213.213.213.213", space: SpacePublic4},
 		"public6":    {addr: "2003::1", space: SpacePublic6},
-		"tailscale":  {addr: "100.86.144.76", space: SpacePublic4},
+		"tailscale":  {addr: "100.86.144.76", space: SpaceCGNAT},
+		"cgnat":      {addr: "100.64.0.1", space: SpaceCGNAT},
+		"not_cgnat":  {addr: "100.128.0.1", space: SpacePublic4},
 		"zero4":      {addr: "0.0.0.0", space: SpaceInvalid},
 		"zero6":      {addr: "::", space: SpaceInvalid},
 		"broadcast":  {addr: "255.255.255.255", space: SpaceInvalid},
@@ -43,6 +47,66 @@ func TestGetAddrSpace(t *testing.T) {
 	}
 }
 
+func TestValidateAddr(t *testing.T) {
+	tests := map[string]struct {
+		addr string
+		err  error
+	}{
+		"public4":    {addr: "213.213.213.213:5000", err: nil},
+		"loopback6":  {addr: "[::1]:1024", err: nil},
+		"privileged": {addr: "192.168.0.2:80", err: ErrPrivilegedPort},
+		"zero_port":  {addr: "192.168.0.2:0", err: ErrInvalidAddr},
+		"zero4":      {addr: "0.0.0.0:5000", err: ErrDontUse},
+		"multicast6": {addr: "[ff02::fb]:5000", err: ErrDontUse},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateAddr(netip.MustParseAddrPort(tc.addr))
+			if !errors.Is(err, tc.err) || (err == nil) != (tc.err == nil) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+	if err := ValidateAddr(netip.AddrPort{}); !errors.Is(err, ErrInvalidAddr) {
+		t.Fatalf("expected %v, got %v", ErrInvalidAddr, err)
+	}
+}
+
+func TestSanitizeAddrs(t *testing.T) {
+	a, b := netip.MustParseAddrPort("10.0.0.1:5000"), netip.MustParseAddrPort("[2003::1]:5000")
+	addrs := []netip.AddrPort{a, netip.MustParseAddrPort("10.0.0.1:22"), b, a}
+	if got := SanitizeAddrs(addrs); !slices.Equal(got, []netip.AddrPort{a, b}) {
+		t.Fatalf("expected %v, got %v", []netip.AddrPort{a, b}, got)
+	}
+}
+
+func TestVerifyAddrs(t *testing.T) {
+	up, down := netip.MustParseAddr("192.168.0.2"), netip.MustParseAddr("fe80::1")
+	local := map[netip.Addr]bool{up: true, down: true}
+	canBind := func(addr netip.AddrPort) bool { return addr.Addr().WithZone("") != down }
+	tests := map[string]struct {
+		addr string
+		keep bool
+	}{
+		"bindable":   {addr: "192.168.0.2:5000", keep: true},
+		"unbindable": {addr: "[fe80::1]:5000", keep: false},
+		"zone":       {addr: "[fe80::1%en0]:5000", keep: false},
+		"mapped":     {addr: "213.213.213.213:5000", keep: true},
+		"stun6":      {addr: "[2003::1]:5000", keep: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			addr := netip.MustParseAddrPort(tc.addr)
+			got := verifyAddrs([]netip.AddrPort{addr}, local, canBind)
+			if keep := len(got) == 1; keep != tc.keep {
+				t.Fatalf("expected keep=%v, got %v", tc.keep, keep)
+			}
+		})
+	}
+}
+
 func TestAddrSpaceIncluded(t *testing.T) {
 	var spaces AddrSpace = SpacePrivate4 | SpacePublic6
 	if !spaces.Includes(SpacePrivate4) {
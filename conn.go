@@ -5,23 +5,69 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Conn struct {
 	net.Conn
 	r       io.Reader // TODO: Always bufio.Reader?
 	isRelay bool
+	inbound bool
 	meta    *Meta
 	req     *http.Request
+	state   *ConnState
+
+	// Handshake data of the client that is written along with the next write, so that small
+	// handshake messages share a segment, see clientShake. Client only.
+	pending []byte
+
+	// Timestamps of the handshake for estimating the peer's clock, see ClientConfig.ClockSync: of the
+	// acceptor's HELLO and the dialer's CONFIRM on the acceptor, and of the last PING and PONG on
+	// the dialer, which also keeps the HELLO's timestamp (T) and when it was received (Recv), to
+	// echo them in the CONFIRM. Client only.
+	clock, hello clockSample
+
+	// Data received before the conn was matched on the server, or read by a health check of a
+	// Pool, which is read before r.
+	early []byte
+
+	read   atomic.Int64 // number of bytes read, for events and stats
+	active atomic.Int64 // unix nanos of the last data relayed from the conn. Server only.
+	quota  int64        // max bytes read from both peers of a relay, or 0. Server only.
+
+	// Progress of the relay initiation, which a relay that is handed off resumes from (see
+	// initiateRelay): whether the response was sent to the conn, and whether its rdv header line
+	// was relayed to the peer. Server only.
+	respSent, headerRelayed bool
+
+	handoff *relayHandoff // hands off the relay, see Server.Handoff. Server only, dialer only.
+
+	written               atomic.Int64 // number of bytes written, for stats
+	ready                 time.Time    // when the chosen conn was ready, see Stats. Client only.
+	readBase, writtenBase int64        // bytes of the handshakes, which stats exclude
+	firstRead             atomic.Int64 // unix nanos of the first read once ready
+
+	wbuf *writeBuffer // buffered writes, see ClientConfig.WriteBuffer. Client only.
+
+	// Why the chosen conn was closed before it was handed out, which Read and Write return. Set
+	// when confirming a conn chosen in Client.Candidates fails. Client only.
+	failed error
 }
 
-func newDirectConn(nc net.Conn, meta *Meta, req *http.Request) *Conn {
+func newDirectConn(nc net.Conn, inbound bool, meta *Meta, req *http.Request) *Conn {
+	if tc := tcpConn(nc); tc != nil {
+		tc.SetNoDelay(true) // e.g. from a Transport, since handshake messages are small
+	}
 	return &Conn{
 		Conn:    nc,
 		r:       nc,
 		isRelay: false,
+		inbound: inbound,
 		meta:    meta,
 		req:     req,
+		state:   reqConnState(req),
 	}
 }
 
@@ -32,11 +78,60 @@ func newRelayConn(nc net.Conn, r io.Reader, meta *Meta, req *http.Request) *Conn
 		isRelay: true,
 		meta:    meta,
 		req:     req,
+		state:   reqConnState(req),
 	}
 }
 
 func (c *Conn) Read(p []byte) (int, error) {
-	return c.r.Read(p)
+	if c.failed != nil {
+		return 0, c.failed
+	}
+	if len(c.early) > 0 {
+		n := copy(p, c.early)
+		c.early = c.early[n:]
+		c.read.Add(int64(n))
+		return n, nil
+	}
+	n, err := c.r.Read(p)
+	c.read.Add(int64(n))
+	if n > 0 && !c.ready.IsZero() && c.firstRead.Load() == 0 {
+		c.firstRead.CompareAndSwap(0, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.failed != nil {
+		return 0, c.failed
+	}
+	if c.wbuf != nil {
+		return c.wbuf.Write(p)
+	}
+	return c.write(p)
+}
+
+// Writes the pending handshake data along with p, in a single write.
+func (c *Conn) write(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		n, err := c.Conn.Write(p)
+		c.written.Add(int64(n))
+		return n, err
+	}
+	buf := append(c.pending, p...)
+	c.pending = nil
+	n, err := c.Conn.Write(buf)
+	n = max(n-(len(buf)-len(p)), 0)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// Writes the pending handshake data, if any.
+func (c *Conn) flush() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	_, err := c.Write(nil)
+	return err
 }
 
 func (c *Conn) Meta() *Meta {
@@ -44,24 +139,93 @@ func (c *Conn) Meta() *Meta {
 }
 
 // Returns the http request for this conn. Read-only, so don't use its context or body.
+// Nil on the client if signaling didn't happen over http (see Signaler).
 func (c *Conn) Request() *http.Request {
 	return c.req
 }
 
+// Returns the state of this conn, which is never nil. If the request context has a state (see
+// ContextWithConnState), that state is used.
+func (c *Conn) State() *ConnState {
+	return c.state
+}
+
+func reqConnState(req *http.Request) *ConnState {
+	if req == nil {
+		return NewConnState()
+	}
+	if state := ConnStateFromContext(req.Context()); state != nil {
+		return state
+	}
+	return NewConnState()
+}
+
+// Returns the TCP conn of a direct conn, e.g. to set socket options, or nil if the conn is relayed
+// or isn't TCP (e.g. with a custom Handshaker). Data must not be read or written on it, since the
+// conn may buffer or encrypt data.
+func (c *Conn) TCPConn() *net.TCPConn {
+	if c.isRelay {
+		return nil
+	}
+	return tcpConn(c.Conn)
+}
+
+// Returns the raw conn of the TCP socket of a direct conn, e.g. to read TCP_INFO, enable kTLS or
+// attach socket filters. Returns ErrNotDirect if there is no such socket, see TCPConn.
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	tc := c.TCPConn()
+	if tc == nil {
+		return nil, ErrNotDirect
+	}
+	return tc.SyscallConn()
+}
+
+// Returns when data was last relayed from the conn, e.g. for monitoring the activity of each
+// direction of a relay in a ServeFunc, or the zero time if none was. Server only.
+func (c *Conn) LastActive() time.Time {
+	if nanos := c.active.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
 func (c *Conn) IsRelay() bool {
 	return c.isRelay
 }
 
+// Returns true if the conn is direct and was accepted from the peer, rather than dialed. Inbound
+// conns show that the NAT in front of this client lets the peer in, i.e. that it has a mapping
+// toward the peer.
+func (c *Conn) IsInbound() bool {
+	return c.inbound
+}
+
+// Returns the capabilities that both peers support, see Capability. Zero if the peer's
+// capabilities are unknown.
+func (c *Conn) Capabilities() Capability {
+	return c.meta.Capabilities & c.meta.PeerCapabilities
+}
+
 // Returns the rdv header, e.g. "rdv/1 HELLO token" + CRLF
 func rdvHeader(method, token string) string {
 	return fmt.Sprintf("%s %s %s\r\n", protocolName, method, token)
 }
 
+// Like rdvHeader, but with the negotiated protocol version.
+func (m *Meta) rdvHeader(method, token string) string {
+	return fmt.Sprintf("%s %s %s\r\n", protocolVersion(m.Version), method, token)
+}
+
 // The rdv header lines that should be sent by this peer and received by the other peer,
 // upon successful connection.
+// Relay conns use the server token, so that hashed tokens aren't revealed through the relay.
 func (c *Conn) headers() (self string, peer string) {
-	ah := rdvHeader("HELLO", c.meta.Token)
-	dh := rdvHeader("CONFIRM", c.meta.Token)
+	token := c.meta.Token
+	if c.isRelay {
+		token = c.meta.tokenForServer()
+	}
+	ah := c.meta.rdvHeader("HELLO", token)
+	dh := c.meta.rdvHeader("CONFIRM", token)
 	if c.meta.IsDialer {
 		return dh, ah
 	}
@@ -69,26 +233,43 @@ func (c *Conn) headers() (self string, peer string) {
 }
 
 // Establishes candidate connections. Dialers simply read hello, whereas acceptors write hello
-// and read confirm. Invoked multiple times, but succeeds at most once for acceptors.
+// and read confirm, while responding to pings (see LatencyChooser). Invoked multiple times, but succeeds at most once for acceptors.
 func (c *Conn) clientHand() error {
 	self, peer := c.headers()
 	if c.meta.IsDialer {
-		return expectStr(c, peer)
+		_, times, err := readHeader(c, peer)
+		if err == nil && len(times) == 1 {
+			c.hello = clockSample{T: times[0], Recv: time.Now().UnixNano()}
+		}
+		return err
+	}
+	if c.syncsClock() {
+		c.clock.Sent = time.Now().UnixNano()
+		self = withTimes(self, c.clock.Sent)
 	}
 	_, err := io.WriteString(c, self)
 	if err != nil {
 		return err
 	}
-	return expectStr(c, peer)
+	return c.expectHeader(peer)
 }
 
 // Finalizes candidate selection. Dialers write the confirm, whereas the listener do nothing
 // (they already read the confirm earlier). Invoked at most once, IFF clientHand succeeded.
+// The confirm is pending until the next write, e.g. of the Secure handshake, so that they share a
+// segment (see flush).
 func (c *Conn) clientShake() error {
 	if c.meta.IsDialer {
 		self, _ := c.headers()
-		_, err := io.WriteString(c, self)
-		return err
+		if c.syncsClock() && c.hello.T != 0 {
+			self = withTimes(self, time.Now().UnixNano(), c.hello.T, c.hello.Recv)
+		}
+		c.pending = append(c.pending, self...)
 	}
 	return nil
 }
+
+// Whether the header lines carry timestamps, which requires protocol version 2.
+func (c *Conn) syncsClock() bool {
+	return c.meta.clockSync && c.meta.Version >= 2
+}
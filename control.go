@@ -0,0 +1,364 @@
+package rdv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Control conns let a client wait for dialers on many tokens over a single conn to the server,
+// instead of holding a conn per token in the lobby. The client sends WATCH and UNWATCH lines for
+// its tokens, and the server sends a CALL line when a dialer of a watched token joins the lobby,
+// upon which the client accepts the dialer as usual. See Client.Control.
+const (
+	// Max number of tokens watched per control conn
+	maxControlTokens = 4096
+
+	// Max length of the lines of control conns
+	maxControlLine = 1024
+
+	// Number of lines that can be queued to a control conn, before it's considered stuck
+	controlQueue = 64
+
+	// Timeout of writes to control conns
+	controlWriteTimeout = 10 * time.Second
+
+	// Max duration of the signaling of accepts that were called, in case the dialer left
+	controlCallTimeout = 10 * time.Second
+
+	// Backoff between failed connections of a Control
+	minControlBackoff = 500 * time.Millisecond
+	maxControlBackoff = 30 * time.Second
+)
+
+// A control conn on the server.
+type controlConn struct {
+	conn *Conn
+	out  chan string   // queued lines
+	done chan struct{} // closed when the conn is done
+}
+
+// A request to update the tokens of a control conn, served by the Serve loop.
+type controlReq struct {
+	cc    *controlConn
+	token string
+	watch bool
+}
+
+// Queues a line for the client, and closes the conn if it's stuck.
+func (cc *controlConn) send(method, token string) {
+	select {
+	case cc.out <- rdvHeader(method, token):
+	default:
+		cc.conn.Close()
+	}
+}
+
+// Serves a control conn until it's closed, or the server is done. Lines are written by another
+// goroutine, so that the Serve loop never blocks on the client.
+func (l *Server) serveControl(conn *Conn) {
+	defer conn.Close()
+	cc := &controlConn{conn: conn, out: make(chan string, controlQueue), done: make(chan struct{})}
+	log := l.cfg.Logger.With("addr", conn.meta.ObservedAddr)
+	tokens := make(map[string]bool)
+	defer func() {
+		close(cc.done)
+		for token := range tokens {
+			l.updateControl(controlReq{cc, token, false})
+		}
+	}()
+	go func() {
+		select {
+		case <-l.done:
+			conn.Close()
+		case <-cc.done:
+		}
+	}()
+
+	negotiateVersion(conn.meta, conn.meta)
+	conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	if err := conn.meta.toResp(0).Write(conn); err != nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case line := <-cc.out:
+				conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+				if _, err := io.WriteString(conn, line); err != nil {
+					conn.Close()
+					return
+				}
+			case <-cc.done:
+				return
+			}
+		}
+	}()
+	log.Debug("rdv server: control conn opened")
+	for {
+		line, err := readLine(conn, maxControlLine)
+		if err != nil {
+			log.Debug("rdv server: control conn closed", "err", err, "tokens", len(tokens))
+			return
+		}
+		method, token, _ := strings.Cut(strings.TrimPrefix(line, protocolName+" "), " ")
+		switch {
+		case token == "":
+			log.Debug("rdv server: bad control line", "line", line)
+			return
+		case method == "UNWATCH":
+			if tokens[token] {
+				delete(tokens, token)
+				l.updateControl(controlReq{cc, token, false})
+			}
+		case method != "WATCH":
+			log.Debug("rdv server: bad control line", "line", line)
+			return
+		case len(tokens) >= maxControlTokens:
+			cc.send("ERR", token+" too many tokens")
+		default:
+			if err := l.authorizeControl(conn, token); err != nil {
+				cc.send("ERR", token+" "+err.Error())
+				continue
+			}
+			cc.send("OK", token)
+			if !tokens[token] {
+				tokens[token] = true
+				l.updateControl(controlReq{cc, token, true})
+			}
+		}
+	}
+}
+
+// Authorizes a token of a control conn, like a client request with the token.
+func (l *Server) authorizeControl(conn *Conn, token string) error {
+	meta := &Meta{Token: token, Namespace: conn.meta.Namespace, Header: conn.meta.Header}
+	if l.cfg.RequireTickets != nil {
+		if _, err := l.cfg.RequireTickets.Verify(token, time.Now()); err != nil {
+			return err // uses are counted when the clients connect
+		}
+	}
+	if l.cfg.AuthFunc != nil {
+		if err := l.cfg.AuthFunc(conn.req, meta); err != nil {
+			return err
+		}
+	}
+	return checkJoinFuncs(conn.req.Context(), meta)
+}
+
+func (l *Server) updateControl(req controlReq) {
+	select {
+	case l.controlCh <- req:
+	case <-l.done:
+	}
+}
+
+// Adds or removes a token of a control conn. Called by the Serve loop.
+func (l *Server) watchToken(req controlReq) {
+	key := (&Meta{Token: req.token, Namespace: req.cc.conn.meta.Namespace}).lobbyKey()
+	if !req.watch {
+		if delete(l.controls[key], req.cc); len(l.controls[key]) == 0 {
+			delete(l.controls, key)
+		}
+		return
+	}
+	if l.controls[key] == nil {
+		l.controls[key] = make(map[*controlConn]bool)
+	}
+	l.controls[key][req.cc] = true
+	if w := l.idle[key]; w != nil {
+		l.callControls(w.conn.meta)
+	}
+}
+
+// Calls the control conns that watch the token of a client that joined the lobby, if the client
+// needs an acceptor. Called by the Serve loop.
+func (l *Server) callControls(meta *Meta) {
+	if !meta.IsDialer && !meta.Symmetric {
+		return
+	}
+	for cc := range l.controls[meta.lobbyKey()] {
+		cc.send("CALL", meta.Token)
+	}
+}
+
+// A Control keeps one conn to the rdv server, over which any number of tokens are listened on
+// (see Control.Listen). Instead of waiting in the lobby with a conn per token, the client is
+// called by the server when a dialer arrives, and only then accepts it. This saves conns and
+// handshakes for clients with many tokens, such as a sync daemon with many peers. The conn is
+// re-established with a backoff if it fails.
+//
+// Servers with a shared Lobby only call control conns for dialers on the same instance.
+type Control struct {
+	c      *Client
+	addr   string
+	header http.Header
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	listeners map[string]*Listener // by server token
+	conn      net.Conn             // current conn, if connected
+}
+
+// Connects to the rdv server at addr, and maintains the conn until ctx is canceled or the Control
+// is closed. The request header is used for all requests, including the accepts.
+func (c *Client) Control(ctx context.Context, addr string, reqHeader http.Header) *Control {
+	ctx, cancel := context.WithCancel(ctx)
+	ct := &Control{
+		c:         c,
+		addr:      addr,
+		header:    reqHeader,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[string]*Listener),
+	}
+	ct.wg.Add(1)
+	go ct.run()
+	return ct
+}
+
+// Listens for dialers on the token, through the control conn. Any number of tokens can be listened
+// on concurrently, but each token only once. Closing the listener stops watching the token.
+func (ct *Control) Listen(token string) *Listener {
+	ctx, cancel := context.WithCancel(ct.ctx)
+	l := &Listener{
+		c:       ct.c,
+		addr:    ct.addr,
+		token:   token,
+		header:  ct.header,
+		control: ct,
+		calls:   make(chan struct{}, 1),
+		conns:   make(chan *Conn),
+		ready:   make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	ct.mu.Lock()
+	ct.listeners[ct.c.serverToken(token)] = l
+	ct.send("WATCH", ct.c.serverToken(token))
+	if ct.conn != nil {
+		l.setReady()
+	}
+	ct.mu.Unlock()
+	l.wg.Add(1)
+	go l.run()
+	return l
+}
+
+// Stops watching the token of the listener.
+func (ct *Control) unwatch(l *Listener) {
+	token := ct.c.serverToken(l.token)
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.listeners[token] == l {
+		delete(ct.listeners, token)
+		ct.send("UNWATCH", token)
+	}
+}
+
+// Sends a line on the current conn, if any. A failed write fails the conn, which is then
+// re-established with all tokens. Must be called with mu held.
+func (ct *Control) send(method, token string) {
+	if ct.conn == nil {
+		return
+	}
+	ct.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	if _, err := io.WriteString(ct.conn, rdvHeader(method, token)); err != nil {
+		ct.conn.Close()
+	}
+}
+
+// Stops the control conn and all its listeners.
+func (ct *Control) Close() error {
+	ct.cancel()
+	ct.wg.Wait()
+	return nil
+}
+
+// Connects with backoff, and serves the conn until the Control is closed.
+func (ct *Control) run() {
+	defer ct.wg.Done()
+	log := ct.c.cfg.Logger.With("addr", ct.addr)
+	backoff := minControlBackoff
+	for ct.ctx.Err() == nil {
+		conn, resp, err := ct.connect()
+		if err == nil {
+			backoff = minControlBackoff
+			err = ct.serve(conn)
+		}
+		if ct.ctx.Err() != nil {
+			return
+		}
+		wait := max(backoff, retryAfter(resp))
+		log.Warn("rdv control: conn failed", "err", err, "backoff", wait)
+		select {
+		case <-time.After(wait):
+		case <-ct.ctx.Done():
+		}
+		backoff = min(2*backoff, maxControlBackoff)
+	}
+}
+
+func (ct *Control) connect() (net.Conn, *http.Response, error) {
+	socket, err := NewSocket(ct.ctx, 0, ct.c.cfg.TlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer socket.Close() // only the listener, the conn stays open
+	meta := &Meta{control: true, Namespace: ct.c.cfg.Namespace, maxVersion: ct.c.cfg.ProtocolVersion}
+	sig := ct.c.httpSignaler(ct.addr, ct.header.Clone())
+	conn, err := sig.Signal(ct.ctx, socket, meta)
+	return conn, sig.Response, err
+}
+
+// Watches all tokens on the conn, and serves calls until it fails.
+func (ct *Control) serve(conn net.Conn) error {
+	stop := context.AfterFunc(ct.ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+	ct.mu.Lock()
+	ct.conn = conn
+	for token, l := range ct.listeners {
+		ct.send("WATCH", token)
+		l.setReady()
+	}
+	tokens := len(ct.listeners)
+	ct.mu.Unlock()
+	defer func() {
+		ct.mu.Lock()
+		ct.conn = nil
+		ct.mu.Unlock()
+	}()
+	log := ct.c.cfg.Logger.With("addr", ct.addr)
+	log.Debug("rdv control: connected", "tokens", tokens)
+	for {
+		line, err := readLine(conn, maxControlLine)
+		if err != nil {
+			return err
+		}
+		method, rest, _ := strings.Cut(strings.TrimPrefix(line, protocolName+" "), " ")
+		token, msg, _ := strings.Cut(rest, " ")
+		ct.mu.Lock()
+		l := ct.listeners[token]
+		ct.mu.Unlock()
+		switch method {
+		case "CALL":
+			if l != nil {
+				l.call()
+			}
+		case "OK":
+		case "ERR":
+			log.Warn("rdv control: server rejected token", "err", msg)
+		default:
+			return fmt.Errorf("%w: bad control line", ErrProtocol)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package rdv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// A dialer of a watched token calls the control conn, upon which the listener accepts it.
+func TestControl(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, nil)
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	ct := client.Control(ctx, hs.URL, nil)
+	defer ct.Close()
+
+	for _, token := range []string{"a", "b"} {
+		t.Run(token, func(t *testing.T) {
+			l := ct.Listen(token)
+			defer l.Close()
+			select {
+			case <-l.Ready():
+			case <-ctx.Done():
+				t.Fatal("expected the listener to be ready")
+			}
+			if n := lobbySize(t, server); n != 0 {
+				t.Fatalf("expected no conns in the lobby, got %d", n)
+			}
+			dialed := make(chan *Conn, 1)
+			go func() {
+				conn, _, err := client.Dial(ctx, hs.URL, token, nil)
+				if err != nil {
+					t.Error(err)
+				}
+				dialed <- conn
+			}()
+			ac, err := l.AcceptConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ac.Close()
+			dc := <-dialed
+			if dc == nil {
+				t.FailNow()
+			}
+			defer dc.Close()
+			exchange(t, dc, ac, "hello "+token)
+		})
+	}
+
+	// The tokens are unwatched once the listeners are closed
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		var watched int
+		if err := server.inLoop(ctx, func() { watched = len(server.controls) }); err != nil {
+			t.Fatal(err)
+		}
+		if watched == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no watched tokens, got %d", watched)
+		}
+	}
+}
+
+// Returns a raw control conn to the server, after the response.
+func dialControl(t *testing.T, ctx context.Context, client *Client, addr string) net.Conn {
+	t.Helper()
+	ct := &Control{c: client, addr: addr, ctx: ctx}
+	conn, _, err := ct.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestControlMaxTokens(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, nil)
+	conn := dialControl(t, ctx, NewClient(nil), hs.URL)
+
+	// One line at a time, since a client that doesn't keep up with the replies is closed
+	for i := 0; i <= maxControlTokens; i++ {
+		fmt.Fprintf(conn, "%s %s t%d\r\n", protocolName, "WATCH", i)
+		expected := fmt.Sprintf("%s OK t%d", protocolName, i)
+		if i == maxControlTokens {
+			expected = fmt.Sprintf("%s ERR t%d too many tokens", protocolName, i)
+		}
+		if line, err := readLine(conn, maxControlLine); err != nil || line != expected {
+			t.Fatalf("expected %v, got %v, %v", expected, line, err)
+		}
+	}
+}
+
+// A control conn which doesn't read its lines is closed, rather than blocking the server.
+func TestControlStuck(t *testing.T) {
+	nc, client := tcpPair(t)
+	cc := &controlConn{conn: newRelayConn(nc, nc, newMeta(false, "", ""), nil), out: make(chan string, controlQueue)}
+	for i := range controlQueue + 1 {
+		cc.send("CALL", fmt.Sprint("t", i))
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected %v, got %v, %v", io.EOF, n, err)
+	}
+}
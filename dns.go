@@ -0,0 +1,228 @@
+package rdv
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Default for ClientConfig.DNSCacheTTL
+const defaultDNSCacheTTL = 5 * time.Minute
+
+// Caches the resolved addrs of rdv servers, per host and network. Entries expire after the min TTL of the DNS
+// records, or maxTTL if lower or unknown (e.g. from /etc/hosts). A nil cache resolves every time.
+type dnsCache struct {
+	maxTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[dnsKey]dnsEntry
+}
+
+type dnsKey struct {
+	host, network string // network is "ip4", "ip6" or "ip"
+}
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+func newDNSCache(maxTTL time.Duration) *dnsCache {
+	if maxTTL < 0 {
+		return nil
+	}
+	return &dnsCache{maxTTL: maxTTL, entries: make(map[dnsKey]dnsEntry)}
+}
+
+// Returns the addrs of the host for the ip network, from the cache if possible.
+func (c *dnsCache) lookup(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if c == nil {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+		return sortAddrs(addrs), err
+	}
+	key := dnsKey{host, network}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+	addrs, ttl, err := resolveTTL(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	if ttl < 0 || ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	c.mu.Lock()
+	c.entries[key] = dnsEntry{addrs, time.Now().Add(ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// Removes the host from the cache, e.g. when none of its addrs could be dialed.
+func (c *dnsCache) evict(network, host string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, dnsKey{host, network})
+}
+
+// Resolves the host in the background for the tcp network, to warm up the cache.
+func (c *dnsCache) preResolve(network, addr string, log *slog.Logger) {
+	u, err := url.Parse(addr)
+	if c == nil || err != nil || u.Hostname() == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lobbyOpTimeout)
+		defer cancel()
+		if _, err := c.lookup(ctx, ipNetwork(network), u.Hostname()); err != nil {
+			log.Debug("rdv: pre-resolve failed", "host", u.Hostname(), "err", err)
+		}
+	}()
+}
+
+// Dials the rdv server over the tcp network ("tcp4", "tcp6" or "tcp"), using the cached addrs of
+// its host. Addrs are tried in order, ipv4 first, and evicted from the cache if none of them work.
+func (c *dnsCache) dial(ctx context.Context, socket *Socket, network string, u *url.URL) (net.Conn, error) {
+	host := u.Hostname()
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if network == "tcp" {
+			network = tcpNetwork(ip)
+		}
+		return socket.DialURLContext(ctx, network, u)
+	}
+	addrs, err := c.lookup(ctx, ipNetwork(network), host)
+	if err != nil {
+		return nil, err
+	}
+	err = &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	for _, addr := range addrs {
+		var nc net.Conn
+		nc, err = socket.dialURL(ctx, tcpNetwork(addr), u, addr.String())
+		if err == nil || ctx.Err() != nil {
+			return nc, err
+		}
+	}
+	c.evict(ipNetwork(network), host)
+	return nil, err
+}
+
+// Returns the ip network for resolving addrs of the tcp network.
+func ipNetwork(network string) string {
+	switch network {
+	case "tcp4":
+		return "ip4"
+	case "tcp6":
+		return "ip6"
+	}
+	return "ip"
+}
+
+// Puts ipv4 addrs first, since the observed ipv4 addr is needed to traverse NATs.
+func sortAddrs(addrs []netip.Addr) []netip.Addr {
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	slices.SortStableFunc(addrs, func(a, b netip.Addr) int {
+		return cmp.Compare(a.BitLen(), b.BitLen())
+	})
+	return addrs
+}
+
+// Resolves addrs of the ip network with the Go resolver, and returns the min TTL of the DNS answers, or -1 if
+// unknown. The standard library doesn't expose TTLs, so they're read from the DNS responses on
+// their way to the resolver.
+func resolveTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	var (
+		mu  sync.Mutex
+		ttl = time.Duration(-1)
+	)
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			nc, err := d.DialContext(ctx, network, address)
+			if udp, ok := nc.(*net.UDPConn); ok {
+				return &dnsSniffConn{udp, func(answerTTL time.Duration) {
+					mu.Lock()
+					defer mu.Unlock()
+					if ttl < 0 || answerTTL < ttl {
+						ttl = answerTTL
+					}
+				}}, nil
+			}
+			return nc, err // TCP fallbacks are rare, so TTLs are unknown
+		},
+	}
+	addrs, err := r.LookupNetIP(ctx, network, host)
+	mu.Lock()
+	defer mu.Unlock()
+	return sortAddrs(addrs), ttl, err
+}
+
+// A DNS conn which reports the min TTL of the answers it reads. It must remain a
+// net.PacketConn, since the resolver uses that to tell UDP from TCP.
+type dnsSniffConn struct {
+	*net.UDPConn
+	report func(ttl time.Duration)
+}
+
+func (c *dnsSniffConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if ttl, ok := answerTTL(b[:n]); ok {
+		c.report(ttl)
+	}
+	return n, err
+}
+
+// Returns the min TTL of the answer records of a DNS response, if there are any.
+func answerTTL(msg []byte) (ttl time.Duration, ok bool) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 { // not a response
+		return
+	}
+	qdCount, anCount := binary.BigEndian.Uint16(msg[4:]), binary.BigEndian.Uint16(msg[6:])
+	off := 12
+	for range qdCount {
+		if off = skipDNSName(msg, off) + 4; off > len(msg) {
+			return 0, false
+		}
+	}
+	for range anCount {
+		off = skipDNSName(msg, off)
+		if off+10 > len(msg) {
+			return 0, false
+		}
+		answer := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		if !ok || answer < ttl {
+			ttl, ok = answer, true
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+	return
+}
+
+// Returns the offset after a possibly compressed name, or past the end if it's malformed.
+func skipDNSName(msg []byte, off int) int {
+	for off < len(msg) {
+		switch n := int(msg[off]); {
+		case n == 0:
+			return off + 1
+		case n&0xC0 == 0xC0: // pointer, which ends the name
+			return off + 2
+		default:
+			off += 1 + n
+		}
+	}
+	return len(msg) + 1
+}
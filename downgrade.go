@@ -0,0 +1,74 @@
+package rdv
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Downgrades are ways in which a conn is less secure or featured than the client supports, because
+// the server or the peer negotiated down. They are set on Meta.Downgrades, reported as
+// TraceDowngrade, and can be refused with ClientConfig.RefuseDowngrades, so that applications can
+// warn their users or fail rather than proceed silently.
+type Downgrade uint32
+
+const (
+	// The negotiated protocol version is lower than the client proposed (see Meta.Version), e.g.
+	// because the server or the peer only supports version 1.
+	DowngradeVersion Downgrade = 1 << iota
+
+	// The conn isn't encrypted end-to-end (see ClientConfig.Secure), although this client or the
+	// peer advertised CapSecure.
+	DowngradeInsecure
+
+	// The conn is relayed through the rdv server, although this client isn't relay-only, e.g.
+	// because no direct conn succeeded or the peer is relay-only.
+	DowngradeRelay
+)
+
+var downgradeNames = map[Downgrade]string{
+	DowngradeVersion:  "version",
+	DowngradeInsecure: "insecure",
+	DowngradeRelay:    "relay",
+}
+
+func (d Downgrade) String() string {
+	var names []string
+	for downgrade := Downgrade(1); downgrade != 0 && downgrade <= d; downgrade <<= 1 {
+		if d&downgrade != 0 {
+			names = append(names, downgradeNames[downgrade])
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Returns the downgrades of the chosen conn, once it's secured.
+func (c *Client) downgrades(conn *Conn) (d Downgrade) {
+	m := conn.meta
+	if max(m.Version, 1) < c.cfg.ProtocolVersion {
+		d |= DowngradeVersion
+	}
+	if _, secure := conn.Conn.(*secureConn); !secure && (m.Capabilities | m.PeerCapabilities).Has(CapSecure) {
+		d |= DowngradeInsecure
+	}
+	if conn.isRelay && !m.Hints.Has(HintRelayOnly) {
+		d |= DowngradeRelay
+	}
+	return
+}
+
+// Records the downgrades of the chosen conn, and returns an error if any of them are refused.
+func (c *Client) checkDowngrades(log *slog.Logger, tr *tracer, conn *Conn) error {
+	d := c.downgrades(conn)
+	conn.meta.Downgrades = d
+	if d == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%w: %v", ErrDowngrade, d)
+	log.Debug("rdv: conn downgraded", "downgrades", d)
+	tr.connEvent(TraceDowngrade, conn, err)
+	if refused := d & c.cfg.RefuseDowngrades; refused != 0 {
+		return fmt.Errorf("%w: refused %v", ErrDowngrade, refused)
+	}
+	return nil
+}
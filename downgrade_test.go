@@ -0,0 +1,110 @@
+package rdv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDowngrades(t *testing.T) {
+	tests := map[string]struct {
+		version        int
+		relay, secure  bool
+		hints          Hint
+		caps, peerCaps Capability
+		want           Downgrade
+	}{
+		"none":           {version: maxProtocolVersion},
+		"version":        {version: 1, want: DowngradeVersion},
+		"version_unset":  {want: DowngradeVersion},
+		"insecure":       {version: maxProtocolVersion, peerCaps: CapSecure, want: DowngradeInsecure},
+		"insecure_self":  {version: maxProtocolVersion, caps: CapSecure, want: DowngradeInsecure},
+		"secure":         {version: maxProtocolVersion, caps: CapSecure, peerCaps: CapSecure, secure: true},
+		"relay":          {version: maxProtocolVersion, relay: true, want: DowngradeRelay},
+		"relay_only":     {version: maxProtocolVersion, relay: true, hints: HintRelayOnly},
+		"peer_relayonly": {version: maxProtocolVersion, relay: true, hints: HintPeerRelayOnly, want: DowngradeRelay},
+		"all":            {version: 1, relay: true, caps: CapSecure, want: DowngradeVersion | DowngradeInsecure | DowngradeRelay},
+	}
+
+	client := NewClient(nil)
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+			meta := newMeta(true, "", "token")
+			meta.Version, meta.Hints, meta.Capabilities, meta.PeerCapabilities = tc.version, tc.hints, tc.caps, tc.peerCaps
+			var nc net.Conn = a
+			if tc.secure {
+				nc = &secureConn{Conn: a}
+			}
+			conn := newDirectConn(nc, false, meta, nil)
+			if tc.relay {
+				conn = newRelayConn(nc, nc, meta, nil)
+			}
+			defer conn.Close()
+			if d := client.downgrades(conn); d != tc.want {
+				t.Fatalf("expected %v, got %v", tc.want, d)
+			}
+		})
+	}
+}
+
+func TestCheckDowngrades(t *testing.T) {
+	tests := map[string]struct {
+		refuse Downgrade
+		ok     bool
+	}{
+		"report":        {ok: true},
+		"refuse":        {refuse: DowngradeRelay},
+		"refuse_other":  {refuse: DowngradeInsecure, ok: true},
+		"refuse_either": {refuse: DowngradeInsecure | DowngradeRelay},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var trace bytes.Buffer
+			client := NewClient(&ClientConfig{RefuseDowngrades: tc.refuse, Trace: &trace})
+			a, b := net.Pipe()
+			defer b.Close()
+			meta := newMeta(true, "", "token")
+			meta.Version = maxProtocolVersion
+			conn := newRelayConn(a, a, meta, nil)
+			defer conn.Close()
+			log, tr := client.prepare(meta)
+			err := client.checkDowngrades(log, tr, conn)
+			if (err == nil) != tc.ok || (err != nil && !errors.Is(err, ErrDowngrade)) {
+				t.Fatalf("expected ok %v, got %v", tc.ok, err)
+			}
+			if meta.Downgrades != DowngradeRelay {
+				t.Fatalf("expected %v, got %v", DowngradeRelay, meta.Downgrades)
+			}
+			events, err := ReadTrace(&trace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 1 || events[0].Kind != TraceDowngrade || !events[0].Relay {
+				t.Fatalf("expected a downgrade event, got %+v", events)
+			}
+		})
+	}
+}
+
+// A peer that is relay-only downgrades the other to the relay, which it may refuse.
+func TestRefuseDowngrade(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, nil)
+	acceptor := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	dialer := NewClient(&ClientConfig{AddrSpaces: SpaceLoopback, RefuseDowngrades: DowngradeRelay})
+	go func() {
+		if conn, _, err := acceptor.Accept(ctx, hs.URL, "token", nil); err == nil {
+			conn.Close()
+		}
+	}()
+	if _, _, err := dialer.Dial(ctx, hs.URL, "token", nil); !errors.Is(err, ErrDowngrade) {
+		t.Fatalf("expected %v, got %v", ErrDowngrade, err)
+	}
+}
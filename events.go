@@ -0,0 +1,102 @@
+package rdv
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Kinds of server events, see ServerConfig.EventFunc.
+type EventKind int
+
+const (
+	// A client entered the lobby.
+	PeerJoined EventKind = iota + 1
+
+	// A client in the lobby was replaced by another with the same token and role.
+	PeerReplaced
+
+	// A client left the lobby without a match, because it timed out, disconnected, misbehaved or
+	// the server shut down. See Event.Err.
+	PeerTimedOut
+
+	// Two clients were matched, and the ServeFunc is starting.
+	PeerMatched
+
+	// The ServeFunc of a match returned.
+	RelayFinished
+
+	// All clients of a group joined, and the GroupServeFunc is starting. See Client.JoinGroup.
+	GroupMatched
+)
+
+var eventKindNames = map[EventKind]string{
+	PeerJoined:    "joined",
+	PeerReplaced:  "replaced",
+	PeerTimedOut:  "timed_out",
+	PeerMatched:   "matched",
+	RelayFinished: "relay_finished",
+	GroupMatched:  "group_matched",
+}
+
+func (k EventKind) String() string {
+	return eventKindNames[k]
+}
+
+// A server event, e.g. for billing, auditing or abuse detection.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+
+	Namespace, Token string
+
+	// Observed addr of the client, or of the dialer for match and relay events.
+	Addr *netip.AddrPort
+
+	// Observed addr of the acceptor, for match and relay events.
+	PeerAddr *netip.AddrPort
+
+	// Number of bytes read from the dialer and the acceptor (including the rdv header lines),
+	// and the duration of the relay. RelayFinished only.
+	DialBytes, AcceptBytes int64
+	Duration               time.Duration
+
+	// When data was last relayed from the dialer and the acceptor, or the zero time if none was.
+	// RelayFinished only.
+	DialActive, AcceptActive time.Time
+
+	// Max number of bytes of the relay, see ServerConfig.QuotaFunc. RelayFinished only.
+	Quota int64
+
+	// Number of clients in the group. GroupMatched only, where Addr is of the first client.
+	GroupSize int
+
+	// Why the client left the lobby (PeerTimedOut), or ErrRelayQuota if the relay exceeded its
+	// quota (RelayFinished).
+	Err error
+}
+
+func (l *Server) emit(ev Event) {
+	if l.cfg.EventFunc == nil {
+		return
+	}
+	ev.Time = time.Now()
+	l.cfg.EventFunc(ev)
+}
+
+// Emits an event about a single client.
+func (l *Server) emitConn(kind EventKind, conn *Conn, err error) {
+	l.emit(Event{Kind: kind, Namespace: conn.meta.Namespace, Token: conn.meta.Token, Addr: conn.meta.ObservedAddr, Err: err})
+}
+
+// Emits an event about a match.
+func (l *Server) emitMatch(kind EventKind, dc, ac *Conn, d time.Duration) {
+	ev := Event{Kind: kind, Namespace: dc.meta.Namespace, Token: dc.meta.Token, Addr: dc.meta.ObservedAddr, PeerAddr: ac.meta.ObservedAddr}
+	if kind == RelayFinished {
+		ev.DialBytes, ev.AcceptBytes, ev.Duration = dc.read.Load(), ac.read.Load(), d
+		ev.DialActive, ev.AcceptActive = dc.LastActive(), ac.LastActive()
+		if ev.Quota = dc.quota; quotaExceeded(dc, ac) {
+			ev.Err = ErrRelayQuota
+		}
+	}
+	l.emit(ev)
+}
@@ -0,0 +1,111 @@
+package rdv
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Returns an EventFunc which sends the events on the channel.
+func eventChan() (func(Event), chan Event) {
+	events := make(chan Event, 16)
+	return func(ev Event) { events <- ev }, events
+}
+
+// Receives the next events, and checks their kinds.
+func expectEvents(t *testing.T, events chan Event, kinds ...EventKind) []Event {
+	t.Helper()
+	var got []Event
+	for range kinds {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %v, got %v", kinds, got)
+		}
+	}
+	for i, ev := range got {
+		if ev.Kind != kinds[i] {
+			t.Fatalf("expected %v, got %v", kinds[i], ev.Kind)
+		}
+		if ev.Time.IsZero() || i > 0 && ev.Time.Before(got[i-1].Time) {
+			t.Fatalf("expected events in order, got %v after %v", ev.Time, got[i-1].Time)
+		}
+	}
+	return got
+}
+
+func TestEventsRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	eventFunc, events := eventChan()
+	_, hs := startServer(t, &ServerConfig{EventFunc: eventFunc})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	dc, ac := relayPair(t, ctx, client, hs.URL, "token")
+	confirm, hello := dc.headers()
+	exchange(t, dc, ac, "hello")
+	exchange(t, ac, dc, "hi")
+	dc.Close()
+	ac.Close()
+
+	got := expectEvents(t, events, PeerJoined, PeerMatched, RelayFinished)
+	for _, ev := range got {
+		if ev.Token != "token" || ev.Addr == nil {
+			t.Fatalf("expected the token and addr, got %+v", ev)
+		}
+	}
+	if matched := got[1]; matched.PeerAddr == nil {
+		t.Fatalf("expected the acceptor addr, got %+v", matched)
+	}
+	finished := got[2]
+	if expected := int64(len(confirm + "hello")); finished.DialBytes != expected {
+		t.Fatalf("expected %v, got %v", expected, finished.DialBytes)
+	}
+	if expected := int64(len(hello + "hi")); finished.AcceptBytes != expected {
+		t.Fatalf("expected %v, got %v", expected, finished.AcceptBytes)
+	}
+	if finished.Duration <= 0 || finished.DialActive.IsZero() || finished.AcceptActive.IsZero() {
+		t.Fatalf("expected a duration and activity, got %+v", finished)
+	}
+	if finished.DialActive.After(finished.Time) || finished.AcceptActive.After(finished.Time) {
+		t.Fatalf("expected activity before %v, got %+v", finished.Time, finished)
+	}
+}
+
+func TestEventsLobby(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	eventFunc, events := eventChan()
+	clock := new(manualClock)
+	server, hs := startServer(t, &ServerConfig{EventFunc: eventFunc, Clock: clock, LobbyTimeout: time.Minute})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+
+	resps := make(chan *http.Response, 2)
+	accept := func() {
+		_, resp, _ := client.Accept(ctx, hs.URL, "token", nil)
+		resps <- resp
+	}
+	go accept()
+	expectEvents(t, events, PeerJoined)
+	go accept()
+	expectEvents(t, events, PeerReplaced, PeerJoined)
+	awaitLobby(t, server, 1)
+	clock.fire()
+	timedOut := expectEvents(t, events, PeerTimedOut)[0]
+	if timedOut.Err != errIdleTimeout {
+		t.Fatalf("expected %v, got %v", errIdleTimeout, timedOut.Err)
+	}
+
+	var codes []int
+	for range 2 {
+		if resp := <-resps; resp != nil {
+			codes = append(codes, resp.StatusCode)
+		}
+	}
+	slices.Sort(codes)
+	if expected := []int{http.StatusRequestTimeout, http.StatusConflict}; !slices.Equal(codes, expected) {
+		t.Fatalf("expected %v, got %v", expected, codes)
+	}
+}
@@ -0,0 +1,75 @@
+// Chat is a minimal two-party chat over rdv. Each peer sends its name to the other through an echo
+// header, and then lines from stdin are sent to the peer and printed on the other side.
+//
+//	go run ./examples/chat ADDR TOKEN NAME dial
+//	go run ./examples/chat ADDR TOKEN NAME accept
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+func main() {
+	if len(os.Args) != 5 || (os.Args[4] != "dial" && os.Args[4] != "accept") {
+		fmt.Fprintln(os.Stderr, "usage: chat ADDR TOKEN NAME <dial|accept>")
+		os.Exit(2)
+	}
+	addr, token, name, dialer := os.Args[1], os.Args[2], os.Args[3], os.Args[4] == "dial"
+	conn, err := connect(context.Background(), rdv.NewClient(nil), addr, token, name, dialer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := chat(conn, os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Connects to the peer, sending our name in an echo header.
+func connect(ctx context.Context, client *rdv.Client, addr, token, name string, dialer bool) (*rdv.Conn, error) {
+	header := http.Header{rdv.EchoHeaderPrefix + "Name": {name}}
+	fn := client.Accept
+	if dialer {
+		fn = client.Dial
+	}
+	start := time.Now()
+	conn, _, err := fn(ctx, addr, token, header)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("chat: connected", "peer", peerName(conn), "relay", conn.IsRelay(), "addr", conn.RemoteAddr(), "dur", time.Since(start))
+	return conn, nil
+}
+
+func peerName(conn *rdv.Conn) string {
+	if name := conn.Meta().PeerHeader.Get("Name"); name != "" {
+		return name
+	}
+	return "peer"
+}
+
+// Sends lines from in to the peer, and writes the peer's lines to out, until either side is done.
+func chat(conn *rdv.Conn, in io.Reader, out io.Writer) error {
+	defer conn.Close()
+	go func() {
+		io.Copy(conn, in)
+		conn.Close() // we're done, which ends the peer's chat too
+	}()
+	name := peerName(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if _, err := fmt.Fprintf(out, "%s: %s\n", name, scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return nil // the conn is closed either way
+}
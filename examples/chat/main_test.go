@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+func TestChat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server := rdv.NewServer(nil)
+	go server.Serve(ctx)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client := rdv.NewClient(nil)
+	accepted := make(chan *rdv.Conn, 1)
+	go func() {
+		conn, err := connect(ctx, client, ts.URL, "chat", "bob", false)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	alice, err := connect(ctx, client, ts.URL, "chat", "alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := <-accepted
+	if bob == nil {
+		t.FailNow()
+	}
+
+	// Alice says hi and leaves, which ends both chats
+	var aliceOut, bobOut strings.Builder
+	done := make(chan error, 1)
+	go func() { done <- chat(bob, blockingReader{ctx}, &bobOut) }()
+	if err := chat(alice, strings.NewReader("hi bob\nbye\n"), &aliceOut); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bobOut.String(), "alice: hi bob\nalice: bye\n"; got != want {
+		t.Errorf("bob got %q, want %q", got, want)
+	}
+	if aliceOut.String() != "" {
+		t.Errorf("alice got %q, want nothing", aliceOut.String())
+	}
+}
+
+// Blocks until ctx is done, like a quiet stdin.
+type blockingReader struct{ ctx context.Context }
+
+func (r blockingReader) Read(p []byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
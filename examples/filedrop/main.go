@@ -0,0 +1,134 @@
+// Filedrop sends a file to a peer over rdv. The receiver verifies the transfer by replying with
+// the SHA-256 of what it received, which the sender checks.
+//
+//	go run ./examples/filedrop ADDR TOKEN send FILE
+//	go run ./examples/filedrop ADDR TOKEN receive DIR
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+// Sent before the file data
+type header struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func main() {
+	if len(os.Args) != 5 || (os.Args[3] != "send" && os.Args[3] != "receive") {
+		fmt.Fprintln(os.Stderr, "usage: filedrop ADDR TOKEN <send FILE|receive DIR>")
+		os.Exit(2)
+	}
+	addr, token, path := os.Args[1], os.Args[2], os.Args[4]
+	ctx, client := context.Background(), rdv.NewClient(nil)
+	var err error
+	if os.Args[3] == "send" {
+		err = send(ctx, client, addr, token, path)
+	} else {
+		_, err = receive(ctx, client, addr, token, path)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Dials the receiver and sends the file.
+func send(ctx context.Context, client *rdv.Client, addr, token, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	conn, _, err := client.Dial(ctx, addr, token, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	slog.Info("filedrop: connected", "relay", conn.IsRelay(), "addr", conn.RemoteAddr())
+
+	start, hash := time.Now(), sha256.New()
+	if err := json.NewEncoder(conn).Encode(header{filepath.Base(path), info.Size()}); err != nil {
+		return err
+	}
+	n, err := io.Copy(io.MultiWriter(conn, hash), f)
+	if err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("filedrop: no reply from receiver: %w", err)
+	}
+	if want := hex.EncodeToString(hash.Sum(nil)) + "\n"; reply != want {
+		return errors.New("filedrop: checksum mismatch")
+	}
+	logTransfer("sent", n, time.Since(start))
+	return nil
+}
+
+// Accepts the sender and writes the file to dir. Returns the path of the file.
+func receive(ctx context.Context, client *rdv.Client, addr, token, dir string) (string, error) {
+	conn, _, err := client.Accept(ctx, addr, token, nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	slog.Info("filedrop: connected", "relay", conn.IsRelay(), "addr", conn.RemoteAddr())
+
+	start := time.Now()
+	// The header is a JSON line, which is read without buffering past it
+	br := bufio.NewReader(conn)
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	var h header
+	if err := json.Unmarshal(line, &h); err != nil {
+		return "", err
+	}
+	name := filepath.Base(h.Name)
+	if name == "." || name == string(filepath.Separator) {
+		return "", fmt.Errorf("filedrop: bad file name %q", h.Name)
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(br, h.Size))
+	if err != nil {
+		return "", err
+	}
+	if n != h.Size {
+		return "", fmt.Errorf("filedrop: got %d of %d bytes", n, h.Size)
+	}
+	if _, err := io.WriteString(conn, hex.EncodeToString(hash.Sum(nil))+"\n"); err != nil {
+		return "", err
+	}
+	logTransfer("received", n, time.Since(start))
+	return path, f.Close()
+}
+
+func logTransfer(what string, n int64, d time.Duration) {
+	slog.Info("filedrop: "+what, "bytes", n, "dur", d, "mbps", float64(n)*8/1e6/d.Seconds())
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+func TestFiledrop(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server := rdv.NewServer(nil)
+	go server.Serve(ctx)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	src, dst := t.TempDir(), t.TempDir()
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	if err := os.WriteFile(filepath.Join(src, "photo.jpg"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := rdv.NewClient(nil)
+	received := make(chan string, 1)
+	go func() {
+		path, err := receive(ctx, client, ts.URL, "drop", dst)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- path
+	}()
+	if err := send(ctx, client, ts.URL, "drop", filepath.Join(src, "photo.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	path := <-received
+	if path != filepath.Join(dst, "photo.jpg") {
+		t.Fatalf("received %q", path)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Errorf("received file differs")
+	}
+}
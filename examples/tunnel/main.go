@@ -0,0 +1,124 @@
+// Tunnel forwards TCP conns to a service behind another peer's NAT, e.g. an SSH server at home.
+// The exposing peer listens for rdv conns on the token, and connects each one to the service.
+// The forwarding peer listens locally, and dials a new rdv conn for each local conn.
+//
+//	go run ./examples/tunnel ADDR TOKEN expose localhost:22
+//	go run ./examples/tunnel ADDR TOKEN forward localhost:2222
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+func main() {
+	if len(os.Args) != 5 || (os.Args[3] != "expose" && os.Args[3] != "forward") {
+		fmt.Fprintln(os.Stderr, "usage: tunnel ADDR TOKEN <expose TARGET|forward LISTEN_ADDR>")
+		os.Exit(2)
+	}
+	addr, token, hostPort := os.Args[1], os.Args[2], os.Args[4]
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	client := rdv.NewClient(nil)
+	var err error
+	if os.Args[3] == "expose" {
+		err = expose(ctx, client, addr, token, hostPort)
+	} else {
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", hostPort); err == nil {
+			err = forward(ctx, client, ln, addr, token)
+		}
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
+
+// Accepts peers until ctx is canceled, and connects each one to the target.
+func expose(ctx context.Context, client *rdv.Client, addr, token, target string) error {
+	ln := client.Listen(ctx, addr, token, nil)
+	defer ln.Close()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.AcceptConn()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			nc, err := net.DialTimeout("tcp", target, 10*time.Second)
+			if err != nil {
+				slog.Warn("tunnel: dial target failed", "target", target, "err", err)
+				return
+			}
+			tunnel(conn, nc)
+		}()
+	}
+}
+
+// Dials the exposing peer for each conn from ln, until ctx is canceled or ln fails.
+func forward(ctx context.Context, client *rdv.Client, ln net.Listener, addr, token string) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return cmp.Or(ctx.Err(), err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer nc.Close()
+			conn, _, err := client.Dial(ctx, addr, token, nil)
+			if err != nil {
+				slog.Warn("tunnel: dial peer failed", "err", err)
+				return
+			}
+			tunnel(conn, nc)
+		}()
+	}
+}
+
+// Copies data both ways until both directions are done, and logs the totals.
+func tunnel(conn *rdv.Conn, nc net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+	var tx int64
+	done := make(chan struct{})
+	go func() {
+		tx, _ = io.Copy(conn, nc)
+		if !conn.IsRelay() {
+			closeWrite(conn.Conn) // relays end on EOF, so the peer has to finish first
+		}
+		close(done)
+	}()
+	rx, _ := io.Copy(nc, conn)
+	closeWrite(nc)
+	<-done
+	slog.Info("tunnel: closed", "relay", conn.IsRelay(), "tx", tx, "rx", rx, "dur", time.Since(start))
+}
+
+// Half-closes the conn if possible, so that the other side reads EOF.
+func closeWrite(nc net.Conn) {
+	if cw, ok := nc.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		nc.Close()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+func TestTunnel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server := rdv.NewServer(nil)
+	go server.Serve(ctx)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// An echo service behind the exposing peer
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			nc, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(nc, nc)
+				closeWrite(nc)
+			}()
+		}
+	}()
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rdv.NewClient(nil)
+	go expose(ctx, client, ts.URL, "tunnel", echo.Addr().String())
+	go forward(ctx, client, local, ts.URL, "tunnel")
+
+	// Multiple conns go through the same token
+	for range 3 {
+		nc, err := net.Dial("tcp", local.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(nc, "ping")
+		closeWrite(nc)
+		got, err := io.ReadAll(nc)
+		nc.Close()
+		if err != nil || string(got) != "ping" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Signals through the rdv server and its fallbacks (see ClientConfig.FallbackServers), either in
+// turn or at once (see ClientConfig.RaceServers).
+type serverSignaler struct {
+	sigs []*HTTPSignaler
+	race bool
+
+	// Set to the response of the last server that responded with an error.
+	Response *http.Response
+}
+
+// Returns a signaler for the server at addr and the fallback servers.
+func (c *Client) serverSignaler(addr string, reqHeader http.Header) *serverSignaler {
+	s := &serverSignaler{race: c.cfg.RaceServers}
+	for i, addr := range append([]string{addr}, c.cfg.FallbackServers...) {
+		if i > 0 && c.cfg.RaceServers {
+			reqHeader = reqHeader.Clone() // modified when signaling
+		}
+		s.sigs = append(s.sigs, c.httpSignaler(addr, reqHeader))
+	}
+	return s
+}
+
+func (s *serverSignaler) Signal(ctx context.Context, socket *Socket, meta *Meta) (net.Conn, error) {
+	if s.race && len(s.sigs) > 1 && !meta.Symmetric { // the servers may assign different roles
+		return s.signalRace(ctx, socket, meta)
+	}
+	orig := *meta
+	var err error
+	for _, sig := range s.sigs {
+		*meta = orig // e.g. the version, which is lowered for version 1 servers
+		var nc net.Conn
+		nc, err = sig.Signal(ctx, socket, meta)
+		s.Response = sig.Response
+		if err == nil || !isTransient(sig.Response, err) || ctx.Err() != nil {
+			return nc, err
+		}
+	}
+	return nil, err
+}
+
+type signalResult struct {
+	meta *Meta
+	nc   net.Conn
+	resp *http.Response
+	err  error
+}
+
+// Signals through all servers at once, and returns the relay of the first server that matches the
+// peers. For dialers, the other servers are then canceled. Acceptors keep waiting for them until
+// ctx is canceled, and deliver their relays as late relays (see Meta.lateRelays), since the dialer
+// may have been matched by another server first. Only the relay that the dialer confirms
+// completes the handshake.
+func (s *serverSignaler) signalRace(ctx context.Context, socket *Socket, meta *Meta) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan signalResult)
+	for _, sig := range s.sigs {
+		m := *meta
+		go func() {
+			nc, err := sig.Signal(ctx, socket, &m)
+			results <- signalResult{&m, nc, sig.Response, err}
+		}()
+	}
+	var errs []error
+	for n := range len(s.sigs) {
+		r := <-results
+		if r.err != nil {
+			s.Response = r.resp
+			errs = append(errs, r.err)
+			continue
+		}
+		*meta = *r.meta
+		if conn, ok := r.nc.(*Conn); ok {
+			conn.meta = meta
+		}
+		var late chan *Conn
+		if meta.IsDialer {
+			cancel()
+		} else {
+			late = make(chan *Conn)
+			meta.lateRelays = late
+		}
+		go collectLateRelays(ctx, cancel, results, len(s.sigs)-n-1, late)
+		return r.nc, nil
+	}
+	cancel()
+	return nil, errors.Join(errs...)
+}
+
+// Collects the results of the remaining servers, and delivers their relays to late until ctx is
+// canceled, or closes them if late is nil.
+func collectLateRelays(ctx context.Context, cancel context.CancelFunc, results chan signalResult, n int, late chan *Conn) {
+	defer cancel()
+	if late != nil {
+		defer close(late)
+	}
+	for range n {
+		r := <-results
+		if r.nc == nil {
+			continue
+		}
+		conn, ok := r.nc.(*Conn)
+		if late == nil || !ok {
+			r.nc.Close()
+			continue
+		}
+		select {
+		case late <- conn:
+		case <-ctx.Done():
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package rdv_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/betamos/rdv/rdvtest"
+)
+
+// Connects a dialer and an acceptor through the server at addr and the fallback servers, and
+// checks that data flows between them.
+func connectFallback(t *testing.T, client *rdv.Client, addr string) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, _, err := client.Accept(ctx, addr, "token", nil)
+		if err == nil {
+			defer conn.Close()
+			_, err = io.WriteString(conn, "hello")
+		}
+		accepted <- err
+	}()
+	conn, _, err := client.Dial(ctx, addr, "token", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected hello, got %q, %v", buf, err)
+	}
+	return <-accepted
+}
+
+func TestFallbackServers(t *testing.T) {
+	forbid := func(*http.Request, *rdv.Meta) error { return &rdv.StatusError{Code: http.StatusForbidden} }
+	tests := map[string]struct {
+		primary  *rdv.ServerConfig // nil if the primary is down
+		race, ok bool
+	}{
+		"down":           {ok: true},
+		"forbidden":      {primary: &rdv.ServerConfig{AuthFunc: forbid}},
+		"up":             {primary: &rdv.ServerConfig{}, ok: true},
+		"race_down":      {race: true, ok: true},
+		"race_forbidden": {primary: &rdv.ServerConfig{AuthFunc: forbid}, race: true, ok: true},
+		"race_up":        {primary: &rdv.ServerConfig{}, race: true, ok: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			n := rdvtest.NewNetwork()
+			fallback := n.NewServer(t, "fallback.test", nil)
+			if tc.primary != nil {
+				n.NewServer(t, "primary.test", tc.primary)
+			}
+			client := fallback.Client(&rdv.ClientConfig{FallbackServers: []string{fallback.URL}, RaceServers: tc.race})
+			if err := connectFallback(t, client, "http://primary.test/"); (err == nil) != tc.ok {
+				t.Fatalf("expected ok %v, got %v", tc.ok, err)
+			}
+		})
+	}
+}
+
+// Racing dialers and acceptors may be matched by different servers first, in which case the
+// acceptor uses the relay that the dialer picked, which it receives late.
+func TestRaceServersLateRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n := rdvtest.NewNetwork()
+	a, b := n.NewServer(t, "a.test", nil), n.NewServer(t, "b.test", nil)
+	acceptor := a.Client(&rdv.ClientConfig{FallbackServers: []string{b.URL}, RaceServers: true})
+	dialer := b.Client(&rdv.ClientConfig{FallbackServers: []string{a.URL}, RaceServers: true})
+	for range 5 { // either server may match first
+		accepted := make(chan error, 1)
+		go func() {
+			conn, _, err := acceptor.Accept(ctx, a.URL, "token", nil)
+			if err == nil {
+				defer conn.Close()
+				_, err = io.WriteString(conn, "hello")
+			}
+			accepted <- err
+		}()
+		awaitLobby(t, a, 1)
+		awaitLobby(t, b, 1)
+		conn, _, err := dialer.Dial(ctx, b.URL, "token", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("expected hello, got %q, %v", buf, err)
+		}
+		conn.Close()
+		if err := <-accepted; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
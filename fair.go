@@ -0,0 +1,167 @@
+package rdv
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Default number of bytes per round for a relay direction of weight 1
+const defaultQuantum = 16 << 10
+
+// A scheduler which shares a capped uplink fairly between many relays, so that a bulk transfer
+// can't starve interactive relays. Data is relayed in quanta, in weighted round-robin order among
+// the relays that have data to send: in each round, a relay of weight n may send n quanta in each
+// direction. Relays that were idle don't accumulate credit. Use one scheduler for all Relayers
+// that share the uplink. Safe for concurrent use.
+type FairScheduler struct {
+	// Total number of bytes per second relayed, by all relays and in both directions.
+	// Zero means no scheduling.
+	Rate int64
+
+	// Max number of bytes that a relay of weight 1 may send per round. Defaults to 16 KiB.
+	Quantum int
+
+	// Returns the weight of a relay, e.g. based on the token or a tenant header of the request.
+	// Weights below 1 are treated as 1. If nil, all relays have weight 1.
+	Weight func(dc, ac *Conn) int
+
+	mu      sync.Mutex
+	pending []*fairFlow // flows waiting for a grant, in arrival order
+	vtime   float64     // tag of the last granted quantum
+	running bool        // whether the dispatcher is running
+	tokens  float64     // token bucket of the rate limit
+	last    time.Time   // when tokens were last refilled
+}
+
+// A relay direction
+type fairFlow struct {
+	s        *FairScheduler
+	ctx      context.Context
+	weight   float64
+	activity io.Writer
+
+	tag   float64 // virtual finish time of the pending (or last) quantum, guarded by s.mu
+	n     int     // size of the pending quantum, guarded by s.mu
+	grant chan struct{}
+}
+
+// Returns a tap which schedules one direction of a relay, or a noop tap if s is nil or has
+// no rate.
+func (s *FairScheduler) flow(ctx context.Context, dc, ac *Conn, activity io.Writer) io.Writer {
+	if s == nil || s.Rate <= 0 {
+		return noopTap{}
+	}
+	weight := 1
+	if s.Weight != nil {
+		weight = max(1, s.Weight(dc, ac))
+	}
+	return &fairFlow{
+		s:        s,
+		ctx:      ctx,
+		weight:   float64(weight),
+		activity: activity,
+		grant:    make(chan struct{}, 1),
+	}
+}
+
+func (s *FairScheduler) quantum() int {
+	if s.Quantum > 0 {
+		return s.Quantum
+	}
+	return defaultQuantum
+}
+
+func (f *fairFlow) Write(p []byte) (int, error) {
+	n, quantum := len(p), f.s.quantum()
+	for len(p) > 0 {
+		chunk := min(len(p), quantum)
+		if err := f.wait(chunk); err != nil {
+			return n - len(p), err
+		}
+		f.activity.Write(p[:chunk])
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// Waits until the chunk has been scheduled, or until the context is canceled.
+func (f *fairFlow) wait(n int) error {
+	s := f.s
+	s.mu.Lock()
+	// Flows that were idle start at the current round
+	f.tag = max(f.tag, s.vtime) + float64(n)/float64(s.quantum())/f.weight
+	f.n = n
+	s.pending = append(s.pending, f)
+	if !s.running {
+		s.running = true
+		go s.dispatch()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-f.grant:
+		return nil
+	case <-f.ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, g := range s.pending {
+		if g == f {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return context.Cause(f.ctx)
+		}
+	}
+	<-f.grant // granted concurrently
+	return context.Cause(f.ctx)
+}
+
+// Grants pending quanta in tag order, at the rate of the scheduler. Runs while there are
+// pending quanta.
+func (s *FairScheduler) dispatch() {
+	rate := float64(s.Rate)
+	// Allow short bursts, since sleeping for each quantum is imprecise at high rates
+	burst := max(float64(s.quantum()), rate/100)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.pending) > 0 {
+		i := s.next()
+		f := s.pending[i]
+		now := time.Now()
+		if s.last.IsZero() {
+			s.tokens = burst
+		} else {
+			s.tokens = min(burst, s.tokens+now.Sub(s.last).Seconds()*rate)
+		}
+		s.last = now
+		if need := float64(f.n) - s.tokens; need > 0 {
+			s.mu.Unlock()
+			time.Sleep(time.Duration(need / rate * float64(time.Second)))
+			s.mu.Lock()
+			continue // pending flows may have changed
+		}
+		s.tokens -= float64(f.n)
+		s.grantAt(i)
+	}
+	s.running = false
+}
+
+// Grants the pending quantum at index i. Requires s.mu.
+func (s *FairScheduler) grantAt(i int) {
+	f := s.pending[i]
+	s.vtime = f.tag
+	s.pending = append(s.pending[:i], s.pending[i+1:]...)
+	f.grant <- struct{}{}
+}
+
+// Returns the index of the pending flow with the lowest tag, the earliest on ties.
+func (s *FairScheduler) next() int {
+	best := 0
+	for i, f := range s.pending {
+		if f.tag < s.pending[best].tag {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,93 @@
+package rdv
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Waits until n flows are pending.
+func awaitPending(t *testing.T, s *FairScheduler, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		pending := len(s.pending)
+		s.mu.Unlock()
+		if pending == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d pending flows, got %d", n, pending)
+		}
+	}
+}
+
+func TestFairScheduler(t *testing.T) {
+	const quantum = 1000
+	tests := map[string]struct {
+		weights []int
+		sizes   []int  // written at a time, defaults to the quantum
+		starts  []int  // number of grants before the flow starts writing, defaults to 0
+		grants  string // the flows that are granted, in order
+	}{
+		"equal":      {weights: []int{1, 1}, grants: "01010101"},
+		"weighted":   {weights: []int{1, 4}, grants: "11101111011110"},
+		"small":      {weights: []int{1, 1}, sizes: []int{quantum, quantum / 2}, grants: "101101101"},
+		"no_credit":  {weights: []int{1, 1}, starts: []int{0, 4}, grants: "0000010101"},
+		"three_ways": {weights: []int{1, 1, 2}, grants: "20122012"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := &FairScheduler{Rate: 1, Quantum: quantum}
+			s.running = true // granted by the test
+			var flows []*fairFlow
+			for _, weight := range tc.weights {
+				f := s.flow(ctx, nil, nil, noopTap{}).(*fairFlow)
+				f.weight = float64(weight)
+				flows = append(flows, f)
+			}
+			start := func(i int) {
+				size := quantum
+				if tc.sizes != nil {
+					size = tc.sizes[i]
+				}
+				go func() {
+					for ctx.Err() == nil {
+						flows[i].Write(make([]byte, size))
+					}
+				}()
+			}
+
+			starts := tc.starts
+			if starts == nil {
+				starts = make([]int, len(flows))
+			}
+			var grants string
+			active := 0
+			for range len(tc.grants) {
+				awaitPending(t, s, active)
+				for i := range flows {
+					if starts[i] == len(grants) {
+						start(i)
+						active++
+						awaitPending(t, s, active) // one at a time, so that they're pending in order
+					}
+				}
+				// Grants the next flow, like the dispatcher without a rate limit
+				s.mu.Lock()
+				i := s.next()
+				grants += strconv.Itoa(slices.Index(flows, s.pending[i]))
+				s.grantAt(i)
+				s.mu.Unlock()
+			}
+			if grants != tc.grants {
+				t.Fatalf("expected %v, got %v", tc.grants, grants)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package rdv
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Queue length for pending fast open requests on the listener
+const fastOpenQueue = 16
+
+// Enables TCP Fast Open on the dialers and listener, as far as the kernel allows
+// (see net.ipv4.tcp_fastopen). Returns ErrFastOpenUnsupported if neither is allowed.
+// Must be called before the socket is used.
+func (s *Socket) EnableFastOpen() error {
+	client, server := fastOpenSupport()
+	if !client && !server {
+		return ErrFastOpenUnsupported
+	}
+	if server {
+		if err := s.setListenerOpt(unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueue); err != nil {
+			return err
+		}
+	}
+	if client {
+		for _, d := range []*net.Dialer{s.D4, s.D6} {
+			d.Control = withSockOpt(d.Control, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		}
+	}
+	return nil
+}
+
+// Reads the kernel fast open setting, where bit 1 enables clients and bit 2 servers.
+func fastOpenSupport() (client, server bool) {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return
+	}
+	return v&1 != 0, v&2 != 0
+}
+
+func (s *Socket) setListenerOpt(level, opt, value int) error {
+	sc, ok := s.Listener.(syscall.Conn)
+	if !ok {
+		return ErrFastOpenUnsupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var optErr error
+	err = rc.Control(func(fd uintptr) {
+		optErr = unix.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return optErr
+}
+
+// Wraps a dialer control func, additionally setting a socket option
+func withSockOpt(control func(network, address string, c syscall.RawConn) error, level, opt, value int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		var optErr error
+		err := c.Control(func(fd uintptr) {
+			optErr = unix.SetsockoptInt(int(fd), level, opt, value)
+		})
+		if err != nil {
+			return err
+		}
+		return optErr
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package rdv
+
+// TCP Fast Open is only supported on Linux.
+func (s *Socket) EnableFastOpen() error {
+	return ErrFastOpenUnsupported
+}
@@ -1,10 +1,9 @@
 module github.com/betamos/rdv
 
-go 1.22
+go 1.23
 
 require (
 	github.com/libp2p/go-reuseport v0.4.0
 	golang.org/x/sync v0.6.0
+	golang.org/x/sys v0.17.0
 )
-
-require golang.org/x/sys v0.17.0 // indirect
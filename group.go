@@ -0,0 +1,262 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Max number of clients in a group, see Client.JoinGroup.
+	maxGroupSize = 16
+
+	// Max time to write the response to a member of a complete group.
+	groupWriteTimeout = 10 * time.Second
+)
+
+// A group of clients that joined the same token, see Client.JoinGroup.
+type Group struct {
+	// Meta of the rendezvous, with the index of this client and the addrs of all members.
+	Meta *Meta
+
+	// Socket of the addrs that this client advertised to the group (see Meta.GroupAddrs), which
+	// stays open until Close, so that members can connect to each other directly on them.
+	Socket *Socket
+
+	client    *Client
+	reqHeader http.Header
+}
+
+// Joins a group of size clients (at most 16) on the token, and returns once all of them have
+// joined. Each member gets an index by order of arrival, and the observed and self addrs that
+// each member had when joining (see Meta.GroupAddrs). Use Group.Connect to establish a full mesh,
+// e.g. for small-group collaboration apps. Close the group once done, which closes its socket.
+func (c *Client) JoinGroup(ctx context.Context, addr string, token string, size int, reqHeader http.Header) (*Group, *http.Response, error) {
+	if size < 2 || size > maxGroupSize {
+		return nil, nil, fmt.Errorf("rdv: group size must be between 2 and %d", maxGroupSize)
+	}
+	sig := c.httpSignaler(addr, reqHeader.Clone())
+	meta := newMeta(false, addr, token)
+	meta.GroupSize = size
+	c.prepare(meta)
+	socket, err := c.newSocket(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.setSelfAddrs(ctx, socket, meta)
+	relay, _, err := c.signal(ctx, sig, socket, meta)
+	if err != nil {
+		socket.Close()
+		return nil, sig.Response, err
+	}
+	if relay != nil {
+		relay.Close()
+	}
+	return &Group{Meta: meta, Socket: socket, client: c, reqHeader: reqHeader}, sig.Response, nil
+}
+
+// Closes the socket of the group. Conns from Connect are not affected.
+func (g *Group) Close() error {
+	return g.Socket.Close()
+}
+
+// Connects to each other member of the group through the same rdv server, with a token that is
+// derived from the group token and the indexes of the pair. The member with the lower index
+// accepts. Returns the conns by member index, which are nil for this client and for members that
+// couldn't be connected to, whose errors are joined.
+func (g *Group) Connect(ctx context.Context) ([]*Conn, error) {
+	m := g.Meta
+	conns := make([]*Conn, m.GroupSize)
+	errs := make([]error, m.GroupSize)
+	var wg sync.WaitGroup
+	for i := range m.GroupSize {
+		if i == m.GroupIndex {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lo, hi := min(i, m.GroupIndex), max(i, m.GroupIndex)
+			token := fmt.Sprintf("%s/%d-%d", m.Token, lo, hi)
+			var err error
+			if m.GroupIndex == lo {
+				conns[i], _, err = g.client.Accept(ctx, m.ServerAddr, token, g.reqHeader.Clone())
+			} else {
+				conns[i], _, err = g.client.Dial(ctx, m.ServerAddr, token, g.reqHeader.Clone())
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("member %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return conns, errors.Join(errs...)
+}
+
+// Responds to each member of a complete group with its index and the addrs of all members.
+// Building block for custom GroupServeFuncs.
+func RespondGroup(conns []*Conn) error {
+	// Concurrently, so that a slow member doesn't hold up the others
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.SetWriteDeadline(time.Now().Add(groupWriteTimeout))
+			errs[i] = conn.meta.toResp(0).Write(conn)
+			conn.SetWriteDeadline(time.Time{})
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// A GroupServeFunc which responds to the members (see RespondGroup) and closes their conns.
+func DefaultGroupServeFunc(ctx context.Context, conns []*Conn) {
+	RespondGroup(conns)
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Clients in the lobby that wait for the rest of their group.
+type lobbyGroup struct {
+	size    int
+	members []*idleWatch // by order of arrival
+}
+
+// Adds a group member to the lobby, or serves the group if the conn completes it.
+func (l *Server) joinGroup(ctx context.Context, wg *sync.WaitGroup, conn *Conn, draining bool) {
+	key := conn.meta.lobbyKey()
+	g := l.groups[key]
+	if g != nil && g.size != conn.meta.GroupSize {
+		writeResponseErr(conn, http.StatusBadRequest, fmt.Sprintf("group size is %d", g.size))
+		return
+	}
+	if g != nil && len(g.members) == g.size-1 {
+		conns := append(l.takeGroup(key), conn)
+		if len(conns) == g.size {
+			l.release(key)
+			l.serveGroup(ctx, wg, conns)
+			return
+		}
+		// Members left while the group was completed, so the rest keep waiting
+		for _, member := range conns[:len(conns)-1] {
+			l.addGroupMember(member)
+		}
+	}
+	if l.groups[key] == nil && draining {
+		l.release(key)
+		writeResponseErr(conn, http.StatusServiceUnavailable, "rdv server shutting down, try again")
+		return
+	}
+	if conn.meta.Hints.Has(HintNotifyReady) {
+		writeReady(conn, l.cfg.LobbyTimeout)
+	}
+	l.addGroupMember(conn)
+	l.cfg.Logger.Debug("rdv server: joined group", "token", conn.meta.Token, "addr", conn.meta.ObservedAddr)
+	l.emitConn(PeerJoined, conn, nil)
+}
+
+func (l *Server) addGroupMember(conn *Conn) {
+	key := conn.meta.lobbyKey()
+	g := l.groups[key]
+	if g == nil {
+		g = &lobbyGroup{size: conn.meta.GroupSize}
+		l.groups[key] = g
+	}
+	g.members = append(g.members, l.watch(conn))
+}
+
+// Removes a member from its group, and releases the lobby key once the group is empty.
+func (l *Server) leaveGroup(w *idleWatch) {
+	key := w.conn.meta.lobbyKey()
+	if l.removeGroupMember(w) && l.groups[key] == nil {
+		l.release(key)
+	}
+}
+
+func (l *Server) removeGroupMember(w *idleWatch) bool {
+	key := w.conn.meta.lobbyKey()
+	g := l.groups[key]
+	if g == nil {
+		return false
+	}
+	for i, member := range g.members {
+		if member == w {
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			l.unwatch(w.conn)
+			if len(g.members) == 0 {
+				delete(l.groups, key)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Removes all members of a group from the lobby and stops their monitoring, and returns the conns
+// of those that are still there, by order of arrival.
+func (l *Server) takeGroup(key string) (conns []*Conn) {
+	// Members may be kicked out while interrupting another member
+	for g := l.groups[key]; g != nil; g = l.groups[key] {
+		w := g.members[0]
+		if l.interrupt(w) {
+			l.removeGroupMember(w)
+			conns = append(conns, w.conn)
+		}
+	}
+	return
+}
+
+// Assigns the indexes and addrs of a complete group, and starts the GroupServeFunc.
+func (l *Server) serveGroup(ctx context.Context, wg *sync.WaitGroup, conns []*Conn) {
+	version := conns[0].meta.maxVersion
+	addrs := make([][]netip.AddrPort, len(conns))
+	for i, conn := range conns {
+		version = min(version, conn.meta.maxVersion)
+		addrs[i] = conn.meta.candidateAddrs()
+	}
+	for i, conn := range conns {
+		conn.meta.GroupIndex, conn.meta.GroupAddrs = i, addrs
+		conn.meta.Version = max(version, 1)
+	}
+	first := conns[0].meta
+	l.cfg.Logger.Debug("rdv server: group matched", "token", first.Token, "size", len(conns))
+	l.emit(Event{Kind: GroupMatched, Namespace: first.Namespace, Token: first.Token, Addr: first.ObservedAddr, GroupSize: len(conns)})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.cfg.GroupServeFunc(ctx, conns)
+	}()
+}
+
+// Formats the addrs of each member of a group, see hGroupAddrs.
+func formatGroupAddrs(addrs [][]netip.AddrPort) string {
+	parts := make([]string, len(addrs))
+	for i, a := range addrs {
+		parts[i] = formatAddrs(a)
+	}
+	return strings.Join(parts, "; ")
+}
+
+func parseGroupAddrs(s string) ([][]netip.AddrPort, error) {
+	var addrs [][]netip.AddrPort
+	for _, part := range strings.Split(s, ";") {
+		a, err := parseAddrs(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if len(a) > maxAddrs {
+			return nil, fmt.Errorf("too many addrs %s", part)
+		}
+		addrs = append(addrs, SanitizeAddrs(a))
+	}
+	return addrs, nil
+}
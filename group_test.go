@@ -0,0 +1,192 @@
+package rdv_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/betamos/rdv/rdvtest"
+)
+
+// Waits until the server has n clients in its lobby.
+func awaitLobby(t *testing.T, s *rdvtest.Server, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		entries, err := s.Lobby(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients in the lobby, got %d", n, len(entries))
+		}
+	}
+}
+
+// Joins the group in the background, and delivers the result.
+func joinGroup(ctx context.Context, client *rdv.Client, s *rdvtest.Server, size int) chan *rdv.Group {
+	ch := make(chan *rdv.Group, 1)
+	go func() {
+		g, _, err := client.JoinGroup(ctx, s.URL, "group", size, nil)
+		if err != nil {
+			g = nil
+		}
+		ch <- g
+	}()
+	return ch
+}
+
+func TestGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := rdvtest.NewServer(t, nil)
+	client := s.Client(nil)
+
+	const size = 3
+	var joins []chan *rdv.Group
+	for i := range size - 1 {
+		joins = append(joins, joinGroup(ctx, client, s, size))
+		awaitLobby(t, s, i+1)
+	}
+	joins = append(joins, joinGroup(ctx, client, s, size)) // completes the group
+	groups := make([]*rdv.Group, size)
+	for _, ch := range joins {
+		g := <-ch
+		if g == nil {
+			t.Fatal("expected to join the group")
+		}
+		if g.Meta.GroupSize != size || len(g.Meta.GroupAddrs) != size || groups[g.Meta.GroupIndex] != nil {
+			t.Fatalf("unexpected group meta: index %d of %d, %d addrs", g.Meta.GroupIndex, g.Meta.GroupSize, len(g.Meta.GroupAddrs))
+		}
+		defer g.Close()
+		groups[g.Meta.GroupIndex] = g
+	}
+
+	// The members connect in a full mesh
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns, err := g.Connect(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j, conn := range conns {
+				if (j == i) != (conn == nil) {
+					t.Errorf("member %d: unexpected conn to member %d", i, j)
+					continue
+				}
+				if conn == nil {
+					continue
+				}
+				defer conn.Close()
+				if _, err := fmt.Fprintf(conn, "%d", i); err != nil {
+					t.Error(err)
+				}
+				buf := make([]byte, 1)
+				if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != fmt.Sprint(j) {
+					t.Errorf("member %d: expected %d, got %q, %v", i, j, buf, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGroupMemberLeave(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := rdvtest.NewServer(t, nil)
+	client := s.Client(nil)
+
+	leaveCtx, leave := context.WithCancel(ctx)
+	left := joinGroup(leaveCtx, client, s, 3)
+	awaitLobby(t, s, 1)
+	leave()
+	if g := <-left; g != nil {
+		t.Fatal("expected the join to fail once canceled")
+	}
+	awaitLobby(t, s, 0)
+
+	// The group is only complete with three members that are still there
+	a, b := joinGroup(ctx, client, s, 3), joinGroup(ctx, client, s, 3)
+	awaitLobby(t, s, 2)
+	c := joinGroup(ctx, client, s, 3)
+	for _, ch := range []chan *rdv.Group{a, b, c} {
+		if g := <-ch; g == nil || len(g.Meta.GroupAddrs) != 3 {
+			t.Fatal("expected to join a group of 3")
+		}
+	}
+	awaitLobby(t, s, 0)
+}
+
+func TestGroupSizeMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := rdvtest.NewServer(t, nil)
+	client := s.Client(nil)
+	joinGroup(ctx, client, s, 3)
+	awaitLobby(t, s, 1)
+	_, resp, err := client.JoinGroup(ctx, s.URL, "group", 4, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 Bad Request, got %v", err)
+	}
+}
+
+// The advertised addrs of each member stay open until the group is closed.
+func TestGroupSocket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := rdvtest.NewServer(t, nil)
+	client := rdv.NewClient(&rdv.ClientConfig{AddrSpaces: rdv.SpaceLoopback, DialServer: s.Network.Dial})
+	a := joinGroup(ctx, client, s, 2)
+	awaitLobby(t, s, 1)
+	b := joinGroup(ctx, client, s, 2)
+	groups := make([]*rdv.Group, 2)
+	for _, ch := range []chan *rdv.Group{a, b} {
+		g := <-ch
+		if g == nil {
+			t.Fatal("expected to join the group")
+		}
+		defer g.Close()
+		groups[g.Meta.GroupIndex] = g
+	}
+
+	// The second member connects to an advertised addr of the first
+	first := groups[0]
+	var addr netip.AddrPort
+	for _, a := range groups[1].Meta.GroupAddrs[0] {
+		if a.Addr().IsLoopback() && a.Port() == first.Socket.Port {
+			addr = a
+		}
+	}
+	if !addr.IsValid() {
+		t.Fatalf("expected a loopback addr of port %d, got %v", first.Socket.Port, groups[1].Meta.GroupAddrs[0])
+	}
+	nc, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	ac, err := first.Socket.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.Close()
+
+	first.Close()
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Fatal("expected the socket to be closed")
+	}
+}
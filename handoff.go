@@ -0,0 +1,310 @@
+//go:build unix
+
+package rdv
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Max size of a single handoff message, i.e. a lobby conn or relay, including request headers.
+const maxHandoffMsg = 64 << 10
+
+// A lobby conn or relay that is handed off. The file descriptors of the conns are passed
+// alongside it as SCM_RIGHTS, in the same order. A message without conns signals the end.
+type handoffMsg struct {
+	Conns   []*handoffEntry `json:",omitempty"` // a lobby conn, or the dialer and acceptor of a relay
+	Started time.Time       // when the relay started, zero for lobby conns
+}
+
+// A serialized conn.
+type handoffEntry struct {
+	Method     string      `json:",omitempty"`
+	URL        string      `json:",omitempty"`
+	Header     http.Header `json:",omitempty"`
+	RemoteAddr string      `json:",omitempty"`
+	Meta       *Meta       `json:",omitempty"`
+	Early      []byte      `json:",omitempty"`
+
+	// Relay state, see Conn.
+	Read          int64 `json:",omitempty"`
+	Quota         int64 `json:",omitempty"`
+	RespSent      bool  `json:",omitempty"`
+	HeaderRelayed bool  `json:",omitempty"`
+}
+
+// Hands off all conns currently waiting in the lobby, and the active relays, to another process
+// over a unix socket, for zero-downtime upgrades. The socket must be of type unixpacket
+// (SOCK_SEQPACKET), which preserves message boundaries. The receiving process should bind the
+// same port (e.g. with SO_REUSEPORT) and call AcceptHandoff. Clients are not notified, and see
+// no difference.
+//
+// Relays are stopped between reads and writes, so no data is lost, and then continue in the
+// other process, where they're served by its ServeFunc. Only relays run by Relayer.Run (e.g.
+// with DefaultServeFunc) can be handed off. Others, and groups being served, keep running in
+// this process, so Serve should keep running until they're done. Relays that can't be sent in
+// time end with the error, like lobby conns, which are rejected with 503.
+//
+// Conn state is not preserved. Only plain TCP conns can be handed off. Others, such as TLS or
+// WebSocket conns, are rejected with 503, or keep relaying. Requires that Serve is running.
+// Returns the number of conns handed off, with two per relay.
+func (l *Server) Handoff(ctx context.Context, uc *net.UnixConn) (n int, err error) {
+	if err := checkSeqPacket(uc); err != nil {
+		return 0, err
+	}
+	var conns []*Conn
+	if err := l.inLoop(ctx, func() { conns = l.takeIdle() }); err != nil {
+		return 0, err
+	}
+
+	// Sends can block, so they're bounded by ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		uc.SetWriteDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { uc.SetWriteDeadline(past()) })
+	defer func() {
+		stop()
+		uc.SetWriteDeadline(time.Time{})
+	}()
+	for _, conn := range conns {
+		if sendErr := sendHandoff(uc, time.Time{}, conn); sendErr != nil {
+			writeResponseErr(conn, http.StatusServiceUnavailable, "rdv server restarting, try again")
+			err = cmp.Or(err, sendErr)
+			continue
+		}
+		conn.Close() // the other process holds a duplicate
+		n++
+	}
+	for _, e := range l.relays.list() {
+		ok, sendErr := handOffRelay(ctx, uc, e)
+		if ok {
+			n += 2
+		}
+		err = cmp.Or(err, sendErr)
+	}
+	// A message without conns signals that we're done
+	_, _, doneErr := uc.WriteMsgUnix([]byte("{}"), nil, nil)
+	return n, cmp.Or(err, doneErr)
+}
+
+// Interrupts a relay and sends it once it has stopped. Returns false if the relay isn't sent,
+// e.g. because it isn't run by Relayer.Run or ended in the meantime.
+func handOffRelay(ctx context.Context, uc *net.UnixConn, e *relayEntry) (bool, error) {
+	h := e.dc.handoff
+	if h == nil || !canHandOff(e.dc) || !canHandOff(e.ac) || !h.request() {
+		return false, nil
+	}
+	select {
+	case intact := <-h.stopped:
+		if !intact {
+			return false, nil
+		}
+	case <-ctx.Done():
+		h.sent <- ctx.Err() // the relay ends once stopped
+		return false, ctx.Err()
+	}
+	err := sendHandoff(uc, e.started, e.dc, e.ac)
+	h.sent <- err
+	return err == nil, err
+}
+
+// Receives conns and relays from another process' Handoff, and adds them to the lobby and the
+// relays respectively. Requires that Serve is running. Returns once the sending process is done,
+// with the number of conns received.
+func (l *Server) AcceptHandoff(uc *net.UnixConn) (n int, err error) {
+	if err := checkSeqPacket(uc); err != nil {
+		return 0, err
+	}
+	buf, oob := make([]byte, maxHandoffMsg), make([]byte, syscall.CmsgSpace(2*4))
+	for {
+		bn, oobn, flags, _, err := uc.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return n, err
+		}
+		fds, err := parseHandoffRights(oob[:oobn])
+		if err != nil {
+			return n, err
+		}
+		conns, started, err := parseHandoff(buf[:bn], flags, fds)
+		if err != nil {
+			return n, err
+		}
+		switch len(conns) {
+		case 0: // done
+			return n, nil
+		case 1:
+			if err := l.addConn(conns[0]); err != nil {
+				writeResponseErr(conns[0], http.StatusServiceUnavailable, "rdv server shutting down, try again")
+				return n, err
+			}
+		case 2:
+			if err := l.addRelay(&relayEntry{dc: conns[0], ac: conns[1], started: started}); err != nil {
+				conns[0].Close() // the response was sent already
+				conns[1].Close()
+				return n, err
+			}
+		}
+		n += len(conns)
+	}
+}
+
+// Parses a handoff message into conns with the fds, which are closed on error.
+func parseHandoff(b []byte, flags int, fds []int) (conns []*Conn, started time.Time, err error) {
+	defer func() {
+		if err != nil {
+			for _, fd := range fds {
+				syscall.Close(fd)
+			}
+			for _, conn := range conns {
+				conn.Close()
+			}
+			conns = nil
+		}
+	}()
+	if flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0 {
+		return nil, started, fmt.Errorf("%w: handoff message truncated", ErrProtocol)
+	}
+	var msg handoffMsg
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return nil, started, fmt.Errorf("%w: bad handoff message: %v", ErrProtocol, err)
+	}
+	if len(msg.Conns) > 2 || len(msg.Conns) != len(fds) {
+		return nil, started, fmt.Errorf("%w: expected %d handoff fds, got %d", ErrProtocol, len(msg.Conns), len(fds))
+	}
+	for len(fds) > 0 {
+		conn, err := msg.Conns[len(conns)].toConn(fds[0])
+		fds = fds[1:] // closed by toConn
+		if err != nil {
+			return conns, started, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, msg.Started, nil
+}
+
+// Sends a lobby conn, or the dialer and acceptor of a relay that started at the time.
+func sendHandoff(uc *net.UnixConn, started time.Time, conns ...*Conn) error {
+	msg := &handoffMsg{Started: started}
+	var fds []int
+	for _, conn := range conns {
+		fc, ok := conn.Conn.(fileConn)
+		if !ok {
+			return fmt.Errorf("rdv handoff: unsupported conn type %T", conn.Conn)
+		}
+		f, err := fc.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fds = append(fds, int(f.Fd()))
+		msg.Conns = append(msg.Conns, newHandoffEntry(conn))
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxHandoffMsg {
+		return fmt.Errorf("rdv handoff: message too large (%d bytes)", len(b))
+	}
+	_, _, err = uc.WriteMsgUnix(b, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// A conn whose file descriptor can be passed, such as a TCP conn.
+type fileConn interface {
+	File() (*os.File, error)
+}
+
+func canHandOff(conn *Conn) bool {
+	_, ok := conn.Conn.(fileConn)
+	return ok
+}
+
+func newHandoffEntry(conn *Conn) *handoffEntry {
+	req := conn.req
+	return &handoffEntry{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		Header:        req.Header,
+		RemoteAddr:    req.RemoteAddr,
+		Meta:          conn.meta,
+		Early:         conn.early,
+		Read:          conn.read.Load(),
+		Quota:         conn.quota,
+		RespSent:      conn.respSent,
+		HeaderRelayed: conn.headerRelayed,
+	}
+}
+
+// Returns an error unless the unix conn preserves message boundaries, which the handoff
+// messages rely on.
+func checkSeqPacket(uc *net.UnixConn) error {
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var typ int
+	var optErr error
+	err = rc.Control(func(fd uintptr) {
+		typ, optErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+	})
+	if err = cmp.Or(err, optErr); err != nil {
+		return err
+	}
+	if typ != syscall.SOCK_SEQPACKET {
+		return errors.New("rdv handoff: unix socket must be of type unixpacket")
+	}
+	return nil
+}
+
+// Returns the fds passed in the oob data, if any.
+func parseHandoffRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// Returns the conn of the entry, with the fd, which is closed either way.
+func (e *handoffEntry) toConn(fd int) (*Conn, error) {
+	f := os.NewFile(uintptr(fd), "rdv-handoff")
+	defer f.Close()
+	if e.Meta == nil {
+		return nil, fmt.Errorf("%w: missing handoff meta", ErrProtocol)
+	}
+	nc, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(e.Method, e.URL, nil)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	req.Header = e.Header
+	e.Meta.maxVersion = requestVersion(req) // not serialized
+	req.RemoteAddr = e.RemoteAddr
+	conn := newRelayConn(nc, nc, e.Meta, req)
+	conn.early = e.Early
+	conn.read.Store(e.Read)
+	conn.quota = e.Quota
+	conn.respSent, conn.headerRelayed = e.RespSent, e.HeaderRelayed
+	return conn, nil
+}
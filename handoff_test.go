@@ -0,0 +1,237 @@
+//go:build unix
+
+package rdv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Returns a connected pair of unix conns of the socket type.
+func unixPair(t *testing.T, typ int) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, typ, 0)
+	if err != nil {
+		t.Skipf("unix socket type %d unsupported: %v", typ, err)
+	}
+	var ucs [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "handoff")
+		nc, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ucs[i] = nc.(*net.UnixConn)
+		t.Cleanup(func() { nc.Close() })
+	}
+	return ucs[0], ucs[1]
+}
+
+func TestHandoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	old, oldHs := startServer(t, nil)
+	next, nextHs := startServer(t, nil)
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := client.Accept(ctx, oldHs.URL, "token", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	awaitLobby(t, old, 1)
+
+	oldUc, nextUc := unixPair(t, syscall.SOCK_SEQPACKET)
+	received := make(chan int, 1)
+	go func() {
+		n, err := next.AcceptHandoff(nextUc)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- n
+	}()
+	n, err := old.Handoff(ctx, oldUc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || <-received != 1 {
+		t.Fatalf("expected 1 conn handed off, got %d", n)
+	}
+	if lobbySize(t, old) != 0 {
+		t.Fatal("expected the old lobby to be empty")
+	}
+
+	// The acceptor is matched by the new server
+	dc, _, err := client.Dial(ctx, nextHs.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	ac := <-accepted
+	if ac == nil {
+		t.FailNow()
+	}
+	defer ac.Close()
+	go io.WriteString(dc, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ac, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected hello, got %q, %v", buf, err)
+	}
+}
+
+// Active relays continue in the other process.
+func TestHandoffRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	old, oldHs := startServer(t, nil)
+	next, _ := startServer(t, nil)
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := client.Accept(ctx, oldHs.URL, "token", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dc, _, err := client.Dial(ctx, oldHs.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	ac := <-accepted
+	if ac == nil {
+		t.FailNow()
+	}
+	defer ac.Close()
+	exchange := func(msg string) {
+		t.Helper()
+		for _, pair := range [][2]*Conn{{dc, ac}, {ac, dc}} {
+			go io.WriteString(pair[0], msg)
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(pair[1], buf); err != nil || string(buf) != msg {
+				t.Fatalf("expected %v, got %q, %v", msg, buf, err)
+			}
+		}
+	}
+	exchange("before")
+
+	oldUc, nextUc := unixPair(t, syscall.SOCK_SEQPACKET)
+	received := make(chan int, 1)
+	go func() {
+		n, err := next.AcceptHandoff(nextUc)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- n
+	}()
+	n, err := old.Handoff(ctx, oldUc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || <-received != 2 {
+		t.Fatalf("expected 2 conns handed off, got %d", n)
+	}
+	exchange("after")
+	for deadline := time.Now().Add(2 * time.Second); len(old.Relays()) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no relays in the old server, got %v", old.Relays())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if relays := next.Relays(); len(relays) != 1 {
+		t.Fatalf("expected 1 relay in the new server, got %v", relays)
+	}
+}
+
+// A relay that is handed off before the dialer's confirm resumes its initiation, including the
+// part of the confirm that was read already.
+func TestHandoffUnconfirmed(t *testing.T) {
+	dcServer, dcClient := tcpPair(t)
+	acServer, acClient := tcpPair(t)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	dc := newRelayConn(dcServer, dcServer, newMeta(true, "", "token"), req)
+	ac := newRelayConn(acServer, acServer, newMeta(false, "", "token"), req)
+	dc.handoff = newRelayHandoff()
+	confirm, hello := dc.headers()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := new(Relayer).Run(context.Background(), dc, ac)
+		done <- err
+	}()
+
+	acr, dcr := bufio.NewReader(acClient), bufio.NewReader(dcClient)
+	for _, r := range []*bufio.Reader{acr, dcr} {
+		if _, err := http.ReadResponse(r, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	io.WriteString(acClient, hello+"early")
+	if err := expectStr(dcr, hello); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(dcClient, confirm[:4])
+	for !dc.handoff.request() {
+		time.Sleep(time.Millisecond) // until relaying
+	}
+	if !<-dc.handoff.stopped {
+		t.Fatal("expected the relay to stop intact")
+	}
+	oldUc, nextUc := unixPair(t, syscall.SOCK_SEQPACKET)
+	err := sendHandoff(oldUc, time.Now(), dc, ac)
+	dc.handoff.sent <- err
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, ErrHandedOff) {
+		t.Fatalf("expected %v, got %v", ErrHandedOff, err)
+	}
+
+	buf, oob := make([]byte, maxHandoffMsg), make([]byte, syscall.CmsgSpace(2*4))
+	bn, oobn, flags, _, err := nextUc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := parseHandoffRights(oob[:oobn])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, _, err := parseHandoff(buf[:bn], flags, fds)
+	if err != nil || len(conns) != 2 {
+		t.Fatalf("expected 2 conns, got %d, %v", len(conns), err)
+	}
+	go new(Relayer).Run(context.Background(), conns[0], conns[1])
+
+	// Neither response is sent again
+	io.WriteString(dcClient, confirm[4:]+"ping")
+	if err := expectStr(acr, confirm+"ping"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectStr(dcr, "early"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandoffSocketType(t *testing.T) {
+	server, _ := startServer(t, nil)
+	uc, _ := unixPair(t, syscall.SOCK_STREAM)
+	if _, err := server.Handoff(context.Background(), uc); err == nil {
+		t.Fatal("expected an error for a stream socket")
+	}
+	if _, err := server.AcceptHandoff(uc); err == nil {
+		t.Fatal("expected an error for a stream socket")
+	}
+}
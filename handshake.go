@@ -0,0 +1,40 @@
+package rdv
+
+import "net"
+
+// A Handshaker replaces the rdv HELLO/CONFIRM handshake on direct conns, so that rdv can connect
+// to peers which speak another protocol, e.g. TLS or an application-specific magic exchange.
+// Relay conns always use the rdv handshake, since the rdv server depends on it.
+type Handshaker interface {
+	// Called concurrently on each direct candidate conn, once connected. Returns an error if the
+	// peer is not the expected one, which discards the conn. Otherwise, it returns the conn to
+	// use from now on, which may wrap nc (e.g. a *tls.Conn). The conn's deadline is expired once
+	// a conn has been chosen, which aborts the handshake of the other candidates.
+	Hand(nc net.Conn, meta *Meta) (net.Conn, error)
+
+	// Called once on the chosen conn, if it's direct. Note that the acceptor chooses the first conn
+	// whose Hand succeeds, so if several conns may succeed, the dialer should use Shake to inform
+	// the acceptor, which waits for it in Hand (like the rdv CONFIRM line).
+	Shake(nc net.Conn, meta *Meta) error
+}
+
+// Runs the candidate handshake, which is the rdv handshake unless a handshaker is provided.
+func (c *Conn) hand(hs Handshaker) error {
+	if hs == nil || c.isRelay {
+		return c.clientHand()
+	}
+	nc, err := hs.Hand(c.Conn, c.meta)
+	if err != nil {
+		return err
+	}
+	c.Conn, c.r = nc, nc
+	return nil
+}
+
+// Finalizes the chosen conn, see hand.
+func (c *Conn) shake(hs Handshaker) error {
+	if hs == nil || c.isRelay {
+		return c.clientShake()
+	}
+	return hs.Shake(c.Conn, c.meta)
+}
@@ -0,0 +1,169 @@
+package rdv
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Min number of attempts on a network before its history is used
+	historyMinAttempts = 3
+
+	// Counts are halved above this many attempts, so that recent outcomes weigh more
+	historyMaxAttempts = 20
+
+	// Networks without attempts for this long are forgotten, so that they're probed again
+	historyMaxAge = 7 * 24 * time.Hour
+)
+
+// Past outcomes of connection attempts on a network, which is identified by the prefix of the
+// observed IP, i.e. the public IP of the NAT. See ClientConfig.HistoryFile.
+type NetworkHistory struct {
+	// Attempts where direct conns were tried, and those where a direct conn completed the
+	// handshake (whether it was chosen or not).
+	Attempts, Direct int
+
+	// Average time from signaling until the first direct conn completed the handshake.
+	DirectTime time.Duration
+
+	// Time of the last attempt
+	Updated time.Time
+}
+
+// Whether direct conns never succeed on the network, in which case the punch is skipped.
+func (h *NetworkHistory) neverDirect() bool {
+	return h != nil && h.Attempts >= historyMinAttempts && h.Direct == 0
+}
+
+// Adjusts the relay penalty: zero if direct conns never succeed, and longer if they usually
+// succeed, but slowly.
+func (h *NetworkHistory) penalty(penalty time.Duration) time.Duration {
+	switch {
+	case h == nil || h.Attempts < historyMinAttempts:
+		return penalty
+	case h.Direct == 0:
+		return 0
+	case 2*h.Direct >= h.Attempts:
+		return min(max(penalty, h.DirectTime*3/2), 4*penalty)
+	}
+	return penalty
+}
+
+// The on-disk history of all networks. A nil history records nothing.
+type history struct {
+	path string
+	log  *slog.Logger
+
+	mu       sync.Mutex
+	networks map[string]*NetworkHistory
+}
+
+// Loads the history from the file, which doesn't need to exist. Returns nil if path is empty.
+func openHistory(path string, log *slog.Logger) *history {
+	if path == "" {
+		return nil
+	}
+	h := &history{path: path, log: log, networks: make(map[string]*NetworkHistory)}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &h.networks)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warn("rdv: failed to read history", "path", path, "err", err)
+	}
+	return h
+}
+
+// Returns a copy of the history of the meta's network, or nil if unknown.
+func (h *history) lookup(meta *Meta) *NetworkHistory {
+	key, ok := networkKey(meta)
+	if h == nil || !ok {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	nh := h.networks[key]
+	if nh == nil || time.Since(nh.Updated) > historyMaxAge {
+		return nil
+	}
+	cp := *nh
+	return &cp
+}
+
+// Records the outcome of an attempt from its report, and saves the history.
+func (h *history) record(meta *Meta) {
+	key, ok := networkKey(meta)
+	if h == nil || !ok || meta.Report == nil || meta.History.neverDirect() {
+		return
+	}
+	var (
+		signaled   time.Duration // when the relay was ready, i.e. after signaling
+		directTime time.Duration = -1
+	)
+	for _, c := range meta.Report.Candidates {
+		if c.Relay {
+			signaled = c.DialTime
+		} else if c.ShakeTime > 0 && c.ShakeErr == nil && (directTime < 0 || c.ShakeTime < directTime) {
+			directTime = c.ShakeTime
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	nh := h.networks[key]
+	if nh == nil || time.Since(nh.Updated) > historyMaxAge {
+		nh = &NetworkHistory{}
+		h.networks[key] = nh
+	}
+	nh.Attempts++
+	if directTime >= 0 {
+		nh.Direct++
+		d := max(0, directTime-signaled)
+		nh.DirectTime += (d - nh.DirectTime) / time.Duration(nh.Direct)
+	}
+	if nh.Attempts > historyMaxAttempts {
+		nh.Attempts, nh.Direct = nh.Attempts/2, (nh.Direct+1)/2
+	}
+	nh.Updated = time.Now()
+	for key, nh := range h.networks {
+		if time.Since(nh.Updated) > historyMaxAge {
+			delete(h.networks, key)
+		}
+	}
+	if err := h.save(); err != nil {
+		h.log.Warn("rdv: failed to save history", "path", h.path, "err", err)
+	}
+}
+
+// Writes the history atomically, so that concurrent readers never see a partial file.
+func (h *history) save() error {
+	data, err := json.MarshalIndent(h.networks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// Returns the network of the attempt, if its outcome says anything about the network. Conns
+// between peers behind the same NAT, or without direct conns, are not recorded.
+func networkKey(meta *Meta) (string, bool) {
+	if meta.ObservedAddr == nil || meta.Hints.Has(HintRelayOnly|HintPeerRelayOnly|HintSameObservedIP) {
+		return "", false
+	}
+	addr := meta.ObservedAddr.Addr().Unmap()
+	bits := 24
+	if addr.Is6() {
+		bits = 56
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String(), true
+}
@@ -0,0 +1,94 @@
+package rdv
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"time"
+)
+
+// Keeps punching after the relay is chosen, see ClientConfig.RelayHoldDown.
+type holdDown struct {
+	ctx      context.Context // of the punch, which outlives the attempt if the relay is chosen
+	cancel   context.CancelFunc
+	stop     func() bool // stops canceling the punch along with the attempt
+	duration time.Duration
+	chosen   chan bool     // whether the relay was chosen
+	done     chan struct{} // closed once the candidates are forwarded or closed, see forward
+}
+
+// Returns a hold-down whose punch is canceled with ctx until release.
+func newHoldDown(ctx context.Context, duration time.Duration) *holdDown {
+	h := &holdDown{duration: duration, chosen: make(chan bool, 1)}
+	h.ctx, h.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	h.stop = context.AfterFunc(ctx, h.cancel)
+	return h
+}
+
+// Forwards the candidates to the chooser until choose is done. Then, the remaining candidates are
+// closed, and if the dialer chose the relay, the first direct one is reported as TraceHoldDown,
+// or the lack of one when the hold-down ends.
+func (h *holdDown) forward(choose context.Context, log *slog.Logger, tr *tracer, meta *Meta, candidates chan *Conn) chan *Conn {
+	out := make(chan *Conn)
+	h.done = make(chan struct{})
+	go func() {
+		defer close(h.done)
+		var late *Conn // received once choose is done
+	loop:
+		for {
+			select {
+			case conn, ok := <-candidates:
+				if !ok {
+					break loop
+				}
+				select {
+				case out <- conn:
+				case <-choose.Done():
+					late = conn
+					break loop
+				}
+			case <-choose.Done():
+				break loop
+			}
+		}
+		close(out)
+		report := <-h.chosen && meta.IsDialer
+		var direct bool
+		discard := func(conn *Conn) {
+			if report && !direct && !conn.IsRelay() {
+				direct = true
+				log.Debug("rdv: hold-down, direct conn succeeded", "addr", conn.RemoteAddr())
+				tr.connEvent(TraceHoldDown, conn, nil)
+			}
+			tr.connEvent(TraceDiscard, conn, nil)
+			conn.Close()
+		}
+		if late != nil {
+			discard(late)
+		}
+		for conn := range candidates {
+			discard(conn)
+		}
+		if report && !direct {
+			log.Debug("rdv: hold-down, no direct conn")
+			tr.event(TraceHoldDown, netip.AddrPort{}, nil)
+		}
+	}()
+	return out
+}
+
+// Keeps punching for the hold-down duration if the relay was chosen. Otherwise, stops the punch
+// and waits until the remaining candidates are closed, so that they're in the report of the
+// chosen conn (see Meta.Report). The choose context of forward must be done.
+func (h *holdDown) release(chosen *Conn) {
+	relay := h.stop() && chosen != nil && chosen.IsRelay()
+	h.chosen <- relay
+	if relay {
+		time.AfterFunc(h.duration, h.cancel)
+		return
+	}
+	h.cancel()
+	if h.done != nil {
+		<-h.done
+	}
+}
@@ -0,0 +1,136 @@
+package rdv
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// A pipe conn with a TCP remote addr, so that trace events have an addr.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// Returns a direct or relay candidate from the addr, and closes the other end when the test ends.
+func holdDownCandidate(t *testing.T, addr string, relay bool, meta *Meta) *Conn {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { b.Close() })
+	nc := &addrConn{a, net.TCPAddrFromAddrPort(netip.MustParseAddrPort(addr))}
+	if relay {
+		return newRelayConn(nc, nc, meta, nil)
+	}
+	return newDirectConn(nc, false, meta, nil)
+}
+
+func isClosed(conn *Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	return err == io.ErrClosedPipe
+}
+
+func TestHoldDown(t *testing.T) {
+	tests := map[string]struct {
+		dialer, relay, direct bool // whether the relay is chosen, and a direct conn arrives late
+		holdDown              bool // whether the punch goes on after release
+		event                 string
+	}{
+		"relay_direct":    {dialer: true, relay: true, direct: true, holdDown: true, event: "203.0.113.2:4000"},
+		"relay_no_direct": {dialer: true, relay: true, holdDown: true, event: "invalid AddrPort"},
+		"direct_chosen":   {dialer: true, direct: true},
+		"acceptor":        {relay: true, direct: true, holdDown: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			events := make(chan CandidateEvent, 10)
+			tr := newTracer(nil, func(ev CandidateEvent) {
+				if ev.Kind == TraceHoldDown {
+					events <- ev
+				}
+			}, "token")
+			meta := newMeta(tc.dialer, "", "token")
+			h := newHoldDown(context.Background(), time.Hour)
+			choose, stopChoose := context.WithCancel(context.Background())
+			candidates := make(chan *Conn)
+			out := h.forward(choose, slog.Default(), tr, meta, candidates)
+
+			// Candidates are forwarded until choose is done
+			relay := holdDownCandidate(t, "203.0.113.1:443", true, meta)
+			candidates <- relay
+			if got := <-out; got != relay {
+				t.Fatalf("expected the relay to be forwarded, got %v", got)
+			}
+			stopChoose()
+			if _, ok := <-out; ok {
+				t.Fatal("expected the forwarding to end")
+			}
+			chosen := relay
+			if !tc.relay {
+				chosen = holdDownCandidate(t, "203.0.113.3:4000", false, meta)
+			}
+			released := make(chan struct{})
+			go func() {
+				h.release(chosen)
+				close(released)
+			}()
+			select {
+			case <-h.ctx.Done():
+				if tc.holdDown {
+					t.Fatal("expected the punch to go on")
+				}
+			case <-released:
+				if !tc.holdDown {
+					t.Fatal("expected release to wait for the remaining candidates")
+				}
+			}
+
+			// Late candidates are closed
+			var late *Conn
+			if tc.direct && tc.holdDown {
+				late = holdDownCandidate(t, "203.0.113.2:4000", false, meta)
+				candidates <- late
+			}
+			close(candidates)
+			<-released
+			<-h.done
+			if late != nil && !isClosed(late) {
+				t.Fatal("expected the late candidate to be closed")
+			}
+			select {
+			case ev := <-events:
+				if tc.event == "" || ev.Addr.String() != tc.event {
+					t.Fatalf("expected %q, got %v", tc.event, ev.Addr)
+				}
+			default:
+				if tc.event != "" {
+					t.Fatalf("expected a hold-down event, got none")
+				}
+			}
+			if tc.holdDown && h.ctx.Err() != nil {
+				t.Fatal("expected the punch to go on for the hold-down duration")
+			}
+			h.cancel()
+		})
+	}
+}
+
+// Releasing with the parent context done stops the punch, even if the relay was chosen.
+func TestHoldDownCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := newHoldDown(ctx, time.Hour)
+	cancel()
+	<-h.ctx.Done()
+	meta := newMeta(true, "", "token")
+	h.release(holdDownCandidate(t, "203.0.113.1:443", true, meta)) // without forward
+	if relay := <-h.chosen; relay {
+		t.Fatal("expected the hold-down to be skipped")
+	}
+}
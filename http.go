@@ -3,19 +3,29 @@ package rdv
 import (
 	"bufio"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func (m *Meta) toReq(ctx context.Context, header http.Header) (*http.Request, error) {
 
 	method := "ACCEPT"
-	if m.IsDialer {
+	if m.control {
+		method = "CONTROL"
+	} else if m.GroupSize > 0 {
+		method = "GROUP"
+	} else if m.Symmetric {
+		method = "PAIR"
+	} else if m.IsDialer {
 		method = "DIAL"
 	}
 	req, err := http.NewRequestWithContext(ctx, method, m.ServerAddr, nil) // overwrite GET
@@ -25,48 +35,165 @@ func (m *Meta) toReq(ctx context.Context, header http.Header) (*http.Request, er
 	if header != nil {
 		req.Header = header
 	}
-	req.Header.Set("Upgrade", protocolName)
+	req.Header.Set("Upgrade", upgradeVersions(m.maxVersion))
 	req.Header.Set("Connection", "upgrade")
-	req.Header.Set(hToken, m.Token)
+	req.Header.Set(hToken, m.tokenForServer())
 	req.Header.Set(hSelfAddrs, formatAddrs(m.SelfAddrs))
+	if m.Namespace != "" {
+		req.Header.Set(hNamespace, m.Namespace)
+	}
+	if m.GroupSize > 0 {
+		req.Header.Set(hGroupSize, strconv.Itoa(m.GroupSize))
+	}
+	if m.Capabilities != 0 {
+		req.Header.Set(hCaps, formatCaps(m.Capabilities))
+	}
+	if len(m.Banner) > 0 {
+		req.Header.Set(hBanner, base64.StdEncoding.EncodeToString(m.Banner))
+	}
+	for k, vs := range m.Header {
+		if name := http.CanonicalHeaderKey(EchoHeaderPrefix + k); req.Header[name] == nil {
+			req.Header[name] = vs
+		}
+	}
+	h := m.Hints & requestHints
+	if expiryFuncFromContext(ctx) != nil {
+		h |= HintNotifyReady | HintExpiryUpdates
+	} else if readyFuncFromContext(ctx) != nil {
+		h |= HintNotifyReady
+	}
+	if h != 0 {
+		req.Header.Set(hHints, h.String())
+	}
 	return req, nil
 }
 
-func (m *Meta) toResp() *http.Response {
-	resp := newUpgradeResponse(http.StatusSwitchingProtocols, protocolName)
+func (m *Meta) toResp(hints Hint) *http.Response {
+	resp := newUpgradeResponse(http.StatusSwitchingProtocols, protocolVersion(m.Version))
 	resp.Header.Set(hPeerAddrs, formatAddrs(m.PeerAddrs))
+	if h := hints & responseHints; h != 0 {
+		resp.Header.Set(hHints, h.String())
+	}
+	if m.Symmetric {
+		role := "accept"
+		if m.IsDialer {
+			role = "dial"
+		}
+		resp.Header.Set(hRole, role)
+	}
+	if m.Session != "" {
+		resp.Header.Set(hSession, m.Session)
+	}
+	if len(m.RelayAddrs) > 0 {
+		resp.Header.Set(hRelayAddrs, strings.Join(m.RelayAddrs, ","))
+		resp.Header.Set(hRelayToken, m.relayToken)
+	}
+	if m.GroupSize > 0 {
+		resp.Header.Set(hGroupIndex, strconv.Itoa(m.GroupIndex))
+		resp.Header.Set(hGroupAddrs, formatGroupAddrs(m.GroupAddrs))
+	}
+	if m.PeerCapabilities != 0 {
+		resp.Header.Set(hCaps, formatCaps(m.PeerCapabilities))
+	}
+	if len(m.PeerBanner) > 0 {
+		resp.Header.Set(hBanner, base64.StdEncoding.EncodeToString(m.PeerBanner))
+	}
 	if m.ObservedAddr != nil {
 		resp.Header.Set(hObservedAddr, m.ObservedAddr.String()) // TODO: Rename header?
 	}
+	for k, vs := range m.PeerHeader {
+		resp.Header[http.CanonicalHeaderKey(EchoHeaderPrefix+k)] = vs
+	}
 	return resp
 }
 
+// Decodes a banner, which is nil if empty.
+func parseBanner(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid banner: %w", err)
+	}
+	if len(b) > maxBannerSize {
+		return nil, fmt.Errorf("banner exceeds %d bytes", maxBannerSize)
+	}
+	return b, nil
+}
+
+// Returns the echo headers without the prefix, or nil if there are none.
+func echoHeaders(header http.Header) (echo http.Header) {
+	for k, vs := range header {
+		if name, ok := strings.CutPrefix(k, EchoHeaderPrefix); ok && name != "" {
+			if echo == nil {
+				echo = make(http.Header)
+			}
+			echo[name] = vs
+		}
+	}
+	return
+}
+
 // Returns ErrUpgrade if upgrade is missing
 func parseReq(req *http.Request) (m *Meta, err error) {
 	m = new(Meta)
-	if err := checkUpgradeRequest(req, protocolName); err != nil {
-		return nil, err
+	method := req.Method
+	if isWebSocketReq(req) {
+		if err := checkWebSocketRequest(req); err != nil {
+			return nil, err
+		}
+		method = rdvParam(req, hMethod)
+	} else if err := checkUpgradeRequest(req, protocolVersion(requestVersion(req))); err != nil {
+		return nil, err // unsupported versions fail the check as version 1
 	}
-	m.IsDialer = req.Method == "DIAL"
-	if !m.IsDialer && req.Method != "ACCEPT" {
-		return nil, fmt.Errorf("%w: bad http method %v", ErrProtocol, req.Method)
+	m.maxVersion = requestVersion(req)
+	switch method {
+	case "DIAL":
+		m.IsDialer = true
+	case "ACCEPT":
+	case "PAIR":
+		m.Symmetric = true
+	case "GROUP":
+		size := rdvParam(req, hGroupSize)
+		if m.GroupSize, err = strconv.Atoi(size); err != nil || m.GroupSize < 2 || m.GroupSize > maxGroupSize {
+			return nil, fmt.Errorf("%w: invalid group size %q", ErrProtocol, size)
+		}
+	case "CONTROL":
+		m.control = true
+		m.Header = echoHeaders(req.Header)
+		return m, nil // tokens are sent over the conn
+	default:
+		return nil, fmt.Errorf("%w: bad http method %v", ErrProtocol, method)
 	}
-	m.Token = req.Header.Get(hToken)
+	m.Token = rdvParam(req, hToken)
 	if m.Token == "" {
 		return nil, fmt.Errorf("%w: missing token", ErrProtocol)
 	}
-	m.SelfAddrs, err = parseAddrs(req.Header.Get(hSelfAddrs))
+	selfAddrs := rdvParam(req, hSelfAddrs)
+	m.SelfAddrs, err = parseAddrs(selfAddrs)
 	if err != nil {
-		return nil, fmt.Errorf("%w: invalid self addrs %s", ErrProtocol, req.Header.Get(hSelfAddrs))
+		return nil, fmt.Errorf("%w: invalid self addrs %s", ErrProtocol, selfAddrs)
 	}
 	if len(m.SelfAddrs) > maxAddrs-1 {
-		return nil, fmt.Errorf("%w: too many self addrs %s", ErrProtocol, req.Header.Get(hSelfAddrs))
+		return nil, fmt.Errorf("%w: too many self addrs %s", ErrProtocol, selfAddrs)
+	}
+	m.SelfAddrs = SanitizeAddrs(m.SelfAddrs)
+	m.Hints = parseHints(rdvParam(req, hHints)) & requestHints
+	m.Capabilities = parseCaps(rdvParam(req, hCaps))
+	if m.Banner, err = parseBanner(rdvParam(req, hBanner)); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProtocol, err)
 	}
+	m.Header = echoHeaders(req.Header)
 	return m, nil
 }
 
 func (m *Meta) parseResp(resp *http.Response) (err error) {
-	if err = checkUpgradeResponse(resp, protocolName); err != nil {
+	m.Version = parseVersions(resp.Header.Get("Upgrade"))
+	if m.Version > max(m.maxVersion, 1) {
+		return fmt.Errorf("%w: server chose unproposed version %d", ErrBadHandshake, m.Version)
+	}
+	if err = checkUpgradeResponse(resp, protocolVersion(m.Version)); err != nil {
 		return fmt.Errorf("%w: %v", ErrBadHandshake, err)
 	}
 	m.PeerAddrs, err = parseAddrs(resp.Header.Get(hPeerAddrs))
@@ -76,44 +203,183 @@ func (m *Meta) parseResp(resp *http.Response) (err error) {
 	if len(m.PeerAddrs) > maxAddrs {
 		return fmt.Errorf("%w: too many peer addrs %s", ErrBadHandshake, resp.Header.Get(hPeerAddrs))
 	}
+	m.PeerAddrs = SanitizeAddrs(m.PeerAddrs)
+	m.Hints |= parseHints(resp.Header.Get(hHints)) & responseHints
+	m.PeerHeader = echoHeaders(resp.Header)
+	m.PeerCapabilities = parseCaps(resp.Header.Get(hCaps))
+	if m.PeerBanner, err = parseBanner(resp.Header.Get(hBanner)); err != nil {
+		return fmt.Errorf("%w: %w", ErrBadHandshake, err)
+	}
+	m.Session = resp.Header.Get(hSession)
+	if m.relayToken = resp.Header.Get(hRelayToken); m.relayToken != "" {
+		m.RelayAddrs = splitAndTrim(resp.Header.Get(hRelayAddrs), ",")
+	}
+	if m.GroupSize > 0 {
+		if m.GroupIndex, err = strconv.Atoi(resp.Header.Get(hGroupIndex)); err != nil || m.GroupIndex < 0 || m.GroupIndex >= m.GroupSize {
+			return fmt.Errorf("%w: invalid group index %s", ErrBadHandshake, resp.Header.Get(hGroupIndex))
+		}
+		m.GroupAddrs, err = parseGroupAddrs(resp.Header.Get(hGroupAddrs))
+		if err != nil || len(m.GroupAddrs) != m.GroupSize {
+			return fmt.Errorf("%w: invalid group addrs %s", ErrBadHandshake, resp.Header.Get(hGroupAddrs))
+		}
+	}
+	if m.Symmetric {
+		switch role := resp.Header.Get(hRole); role {
+		case "dial":
+			m.IsDialer = true
+		case "accept":
+			m.IsDialer = false
+		default:
+			return fmt.Errorf("%w: invalid role %q", ErrBadHandshake, role)
+		}
+	}
 
 	if resp.Header.Get(hObservedAddr) != "" {
 		observedAddr, err := netip.ParseAddrPort(resp.Header.Get(hObservedAddr))
-		m.ObservedAddr = &observedAddr
 		if err != nil {
 			return fmt.Errorf("%w: invalid observed addr %s", ErrBadHandshake, resp.Header.Get(hObservedAddr))
 		}
+		m.ObservedAddr = &observedAddr
 	}
 	return nil
 }
 
-func dialRdvServer(ctx context.Context, socket *Socket, meta *Meta, reqHeader http.Header) (*Conn, *http.Response, error) {
+// Dials the server and awaits the upgrade. Error response bodies are limited to maxBody bytes.
+// If webSocket is set, the rdv response is read from a WebSocket instead.
+func dialRdvServer(ctx context.Context, meta *Meta, reqHeader http.Header, maxBody int64, webSocket bool, dial func(context.Context, *url.URL) (net.Conn, error)) (*Conn, *http.Response, error) {
 	// Force ipv4 to allow for zero-stun
 	req, err := meta.toReq(ctx, reqHeader)
 	if err != nil {
 		return nil, nil, err
 	}
-	nc, err := socket.DialURLContext(ctx, "tcp4", req.URL)
+	var wsAccept string
+	if webSocket {
+		wsAccept = toWebSocketReq(req)
+	}
+	nc, err := dial(ctx, req.URL)
 	if err != nil {
 		return nil, nil, err
 	}
 	closers := []io.Closer{nc}
 	defer closeAll(&closers)
 
-	br := bufio.NewReader(nc)
+	lr := &headerLimitReader{r: nc, n: maxRespHeaderBytes}
+	br := bufio.NewReader(lr)
 	resp, err := doHttp(nc, br, req)
 	if err != nil {
 		return nil, nil, err
 	}
+	var relay net.Conn = nc
+	if webSocket {
+		if err = checkWebSocketResponse(resp, wsAccept); err != nil {
+			slurp(resp, maxBody)
+			return nil, resp, maintenanceErr(resp, err)
+		}
+		lr.unlimit()
+		relay = newWSConn(nc, br, true)
+		lr = &headerLimitReader{r: relay, n: maxRespHeaderBytes}
+		br = bufio.NewReader(lr)
+		reset := ctxIO(ctx, nc)
+		resp, err = http.ReadResponse(br, req)
+		reset()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if resp, err = readFinalResp(ctx, nc, br, lr, req, resp); err != nil {
+		return nil, nil, err
+	}
 	err = meta.parseResp(resp)
 	if err != nil {
-		slurp(resp, 1024)
+		slurp(resp, maxBody)
+		if resp.StatusCode == http.StatusUpgradeRequired {
+			resetOnClose(nc) // the socket may retry with an older version
+		}
+		return nil, resp, maintenanceErr(resp, err)
+	}
+	lr.unlimit()
+	closers = nil
+	return newRelayConn(relay, br, meta, req), nil, nil
+}
+
+// Like dialRdvServer, but over the browser's WebSocket API, which does the http handshake itself.
+// The rdv headers are sent as query params, and other request headers are dropped.
+func dialRdvBrowser(ctx context.Context, meta *Meta, reqHeader http.Header, maxBody int64) (*Conn, *http.Response, error) {
+	req, err := meta.toReq(ctx, reqHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	nc, err := dialBrowserWebSocket(ctx, browserWebSocketURL(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	closers := []io.Closer{nc}
+	defer closeAll(&closers)
+
+	lr := &headerLimitReader{r: nc, n: maxRespHeaderBytes}
+	br := bufio.NewReader(lr)
+	reset := ctxIO(ctx, nc)
+	resp, err := http.ReadResponse(br, req)
+	reset()
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp, err = readFinalResp(ctx, nc, br, lr, req, resp); err != nil {
+		return nil, nil, err
+	}
+	if err = meta.parseResp(resp); err != nil {
+		slurp(resp, maxBody)
 		return nil, resp, err
 	}
+	lr.unlimit()
 	closers = nil
 	return newRelayConn(nc, br, meta, req), nil, nil
 }
 
+// Reads responses until the final one, after the interim responses that the client joined the
+// lobby (see HintNotifyReady). Calls the ready func of ctx on the first interim response, or on a
+// successful final response, and the expiry func on each interim response with the remaining time.
+// Each response gets its own header limit, since the server may send any number of updates.
+func readFinalResp(ctx context.Context, nc net.Conn, br *bufio.Reader, lr *headerLimitReader, req *http.Request, resp *http.Response) (*http.Response, error) {
+	ready, expiry := readyFuncFromContext(ctx), expiryFuncFromContext(ctx)
+	if ready == nil && expiry == nil {
+		return resp, nil
+	}
+	if ready == nil {
+		ready = func() {}
+	}
+	reset := ctxIO(ctx, nc)
+	defer reset()
+	for resp.StatusCode == http.StatusProcessing {
+		ready()
+		if secs, err := strconv.ParseFloat(resp.Header.Get(hExpiresIn), 64); err == nil && expiry != nil {
+			expiry(time.Now().Add(time.Duration(secs * float64(time.Second))))
+		}
+		var err error
+		lr.n = maxRespHeaderBytes
+		if resp, err = http.ReadResponse(br, req); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		ready()
+	}
+	return resp, nil
+}
+
+// Writes an interim response that the client joined the lobby, with its remaining time unless
+// zero, see HintNotifyReady.
+func writeReady(nc net.Conn, expiresIn time.Duration) error {
+	nc.SetWriteDeadline(verySoon())
+	defer nc.SetWriteDeadline(time.Time{})
+	resp := "HTTP/1.1 102 Processing\r\n"
+	if expiresIn > 0 {
+		resp += fmt.Sprintf("%s: %.3f\r\n", hExpiresIn, expiresIn.Seconds())
+	}
+	_, err := io.WriteString(nc, resp+"\r\n")
+	return err
+}
+
 // Write a response err and close the conn, with a short deadline
 func writeResponseErr(nc net.Conn, statusCode int, reason string) error {
 	defer nc.Close()
@@ -128,7 +394,9 @@ func writeResponseErr(nc net.Conn, statusCode int, reason string) error {
 	return resp.Write(nc)
 }
 
-func upgradeRdv(w http.ResponseWriter, req *http.Request) (*Conn, error) {
+// Upgrades the request. Up to earlyLimit bytes of client data received before the response are
+// kept and delivered on the conn.
+func upgradeRdv(w http.ResponseWriter, req *http.Request, earlyLimit int, auth func(*http.Request, *Meta) error) (*Conn, error) {
 	meta, err := parseReq(req)
 	if errors.Is(err, ErrUpgrade) {
 		http.Error(w, err.Error(), http.StatusUpgradeRequired)
@@ -137,16 +405,38 @@ func upgradeRdv(w http.ResponseWriter, req *http.Request) (*Conn, error) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return nil, err
 	}
+	if auth != nil {
+		if err := auth(req, meta); err != nil {
+			code := http.StatusForbidden
+			var se *StatusError
+			if errors.As(err, &se) {
+				code = se.Code
+			}
+			http.Error(w, err.Error(), code)
+			return nil, fmt.Errorf("%w: %w", ErrUnauthorized, err)
+		}
+	}
+	if isWebSocketReq(req) {
+		ws, err := upgradeWebSocket(w, req)
+		if err != nil {
+			return nil, err
+		}
+		return newRelayConn(ws, ws, meta, req), nil
+	}
 	nc, brw, err := upgradeHttp(w, req, protocolName)
 	if err != nil {
 		return nil, err
 	}
-	if brw.Reader.Buffered() > 0 {
+	if n := brw.Reader.Buffered(); n > earlyLimit {
 		err = fmt.Errorf("%w: received client data before response header", ErrProtocol)
 		writeResponseErr(nc, http.StatusBadRequest, err.Error())
 		return nil, err
 	}
 
 	sw := newRelayConn(nc, nc, meta, req)
+	if n := brw.Reader.Buffered(); n > 0 {
+		early, _ := brw.Reader.Peek(n)
+		sw.early = append([]byte(nil), early...)
+	}
 	return sw, nil
 }
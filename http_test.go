@@ -0,0 +1,217 @@
+package rdv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFinalResp(t *testing.T) {
+	interim := func(padding int) string {
+		return "HTTP/1.1 102 Processing\r\nRdv-Expires-In: 60.000\r\nX-Padding: " + strings.Repeat("x", padding) + "\r\n\r\n"
+	}
+	final := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: rdv/2\r\nConnection: Upgrade\r\n\r\n"
+	tests := map[string]struct {
+		resps   string
+		updates int // expected calls of the expiry func
+		err     error
+	}{
+		"final":           {resps: final},
+		"interim":         {resps: interim(0) + final, updates: 1},
+		"updates":         {resps: strings.Repeat(interim(0), 10) + final, updates: 10},
+		"updates_limit":   {resps: strings.Repeat(interim(maxRespHeaderBytes/2), 4) + final, updates: 4},
+		"interim_too_big": {resps: interim(maxRespHeaderBytes) + final, err: ErrHeaderTooLarge},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			go func() {
+				b.Write([]byte(tc.resps))
+				b.Close()
+			}()
+			var ready bool
+			var updates int
+			ctx := ContextWithReadyFunc(context.Background(), func() { ready = true })
+			ctx = ContextWithExpiryFunc(ctx, func(expires time.Time) {
+				if d := time.Until(expires); d < 59*time.Second || d > time.Minute {
+					t.Errorf("expected to expire in a minute, got %v", d)
+				}
+				updates++
+			})
+			req, _ := http.NewRequest("GET", "http://rdv.test/", nil)
+			lr := &headerLimitReader{r: a, n: maxRespHeaderBytes}
+			br := bufio.NewReader(lr)
+			resp, err := http.ReadResponse(br, req)
+			if err == nil {
+				resp, err = readFinalResp(ctx, a, br, lr, req, resp)
+			}
+			if !errors.Is(err, tc.err) || (err == nil) != (tc.err == nil) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols || !ready || updates != tc.updates {
+				t.Fatalf("expected %d updates of a ready conn, got %v, ready %v, %d updates", tc.updates, resp.Status, ready, updates)
+			}
+		})
+	}
+}
+
+func TestParseBanner(t *testing.T) {
+	full := bytes.Repeat([]byte{'b'}, maxBannerSize)
+	tests := map[string]struct {
+		s      string
+		banner []byte
+		ok     bool
+	}{
+		"empty":     {s: "", ok: true},
+		"valid":     {s: base64.StdEncoding.EncodeToString([]byte("proto/1")), banner: []byte("proto/1"), ok: true},
+		"max":       {s: base64.StdEncoding.EncodeToString(full), banner: full, ok: true},
+		"too_big":   {s: base64.StdEncoding.EncodeToString(append(full, 'b'))},
+		"url":       {s: base64.URLEncoding.EncodeToString([]byte{0xfb, 0xff})},
+		"unpadded":  {s: base64.RawStdEncoding.EncodeToString([]byte("proto/1"))},
+		"malformed": {s: "not base64"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			banner, err := parseBanner(tc.s)
+			if ok := err == nil; ok != tc.ok {
+				t.Fatalf("expected %v, got %v", tc.ok, err)
+			}
+			if !bytes.Equal(banner, tc.banner) {
+				t.Fatalf("expected %q, got %q", tc.banner, banner)
+			}
+		})
+	}
+}
+
+// The banner is delivered through the request to the server, and the response to the peer,
+// and both sides refuse a banner above the size limit.
+func TestBannerHeaders(t *testing.T) {
+	tests := map[string]struct {
+		size int
+		ok   bool
+	}{
+		"none":    {size: 0, ok: true},
+		"small":   {size: 7, ok: true},
+		"max":     {size: maxBannerSize, ok: true},
+		"too_big": {size: maxBannerSize + 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			banner := bytes.Repeat([]byte{'b'}, tc.size)
+			m := newMeta(false, "http://rdv.test/", "token")
+			m.Banner = banner
+			req, err := m.toReq(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := parseReq(req)
+			if !tc.ok {
+				if !errors.Is(err, ErrProtocol) {
+					t.Fatalf("expected %v, got %v", ErrProtocol, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(parsed.Banner, banner) {
+				t.Fatalf("expected a banner of %d bytes, got %d", tc.size, len(parsed.Banner))
+			}
+
+			server := &Meta{Version: 1, PeerBanner: banner}
+			peer := newMeta(true, "http://rdv.test/", "token")
+			err = peer.parseResp(server.toResp(0))
+			if !tc.ok {
+				if !errors.Is(err, ErrBadHandshake) {
+					t.Fatalf("expected %v, got %v", ErrBadHandshake, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(peer.PeerBanner, banner) {
+				t.Fatalf("expected a peer banner of %d bytes, got %d", tc.size, len(peer.PeerBanner))
+			}
+		})
+	}
+}
+
+// Sends the request of the meta to the server at addr, followed by data in the same write.
+func rawRequest(t *testing.T, addr string, meta *Meta, data string) net.Conn {
+	t.Helper()
+	meta.ServerAddr = addr
+	req, err := meta.toReq(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	req.Write(&b)
+	b.WriteString(data)
+	nc, err := net.Dial("tcp", req.URL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	if _, err := nc.Write(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return nc
+}
+
+func TestUpgradeEarlyData(t *testing.T) {
+	tests := map[string]struct {
+		limit  int
+		early  string
+		status int // if rejected
+	}{
+		"none":      {limit: 0},
+		"allowed":   {limit: 5, early: "early"},
+		"rejected":  {limit: 0, early: "early", status: http.StatusBadRequest},
+		"too_large": {limit: 4, early: "early", status: http.StatusBadRequest},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			conns := make(chan *Conn, 1)
+			hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				conn, _ := upgradeRdv(w, req, tc.limit, nil)
+				conns <- conn
+			}))
+			defer hs.Close()
+			nc := rawRequest(t, hs.URL, newMeta(false, "", "token"), tc.early)
+			conn := <-conns
+			if tc.status != 0 {
+				resp, err := http.ReadResponse(bufio.NewReader(nc), nil)
+				if err != nil || resp.StatusCode != tc.status {
+					t.Fatalf("expected %v, got %v, %v", tc.status, resp, err)
+				}
+				if conn != nil {
+					t.Fatal("expected no conn")
+				}
+				return
+			}
+			if conn == nil {
+				t.FailNow()
+			}
+			defer conn.Close()
+			if string(conn.early) != tc.early {
+				t.Fatalf("expected %q, got %q", tc.early, conn.early)
+			}
+			buf := make([]byte, len(tc.early))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != tc.early {
+				t.Fatalf("expected %q, got %q, %v", tc.early, buf, err)
+			}
+		})
+	}
+}
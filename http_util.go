@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -45,9 +46,10 @@ func checkUpgradeResponse(resp *http.Response, protocol string) error {
 	return checkUpgrade(resp.Header, protocol, true)
 }
 
+// Checks that the request upgrades to protocol, which may be one of several that are proposed.
 func checkUpgradeRequest(r *http.Request, protocol string) error {
 	// Check that upgrade is intended before protocol, to report a better error
-	if err := checkUpgrade(r.Header, protocol, true); err != nil {
+	if err := checkUpgrade(r.Header, protocol, false); err != nil {
 		return err
 	}
 	if strings.ToLower(r.Proto) != "http/1.1" {
@@ -57,10 +59,70 @@ func checkUpgradeRequest(r *http.Request, protocol string) error {
 }
 
 // Slurp up a bit of the response body to aid in debugging prior to closing the response.
-func slurp(resp *http.Response, size int) {
-	buf := make([]byte, size)
-	n, _ := io.ReadFull(resp.Body, buf)
-	resp.Body = io.NopCloser(bytes.NewReader(buf[:n]))
+// At most size bytes are read, so that broken or malicious servers can't stream unbounded bodies.
+func slurp(resp *http.Response, size int64) {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, size))
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+}
+
+// A reader which allows a bounded number of bytes to be read, until the limit is lifted.
+// Used to bound the size of response headers, before the conn is used for relaying.
+type headerLimitReader struct {
+	r io.Reader
+	n int64 // remaining bytes, or negative if unlimited
+}
+
+func (l *headerLimitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return l.r.Read(p)
+	}
+	if l.n == 0 {
+		return 0, ErrHeaderTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (l *headerLimitReader) unlimit() {
+	l.n = -1
+}
+
+// Returns the protocol name of the version, e.g. "rdv/2". Version 0 means version 1.
+func protocolVersion(version int) string {
+	return "rdv/" + strconv.Itoa(max(version, 1))
+}
+
+// Returns an Upgrade value which proposes the versions from max down to 1, e.g. "rdv/2, rdv/1".
+func upgradeVersions(max int) string {
+	protos := []string{protocolName}
+	for v := 2; v <= min(max, maxProtocolVersion); v++ {
+		protos = append([]string{protocolVersion(v)}, protos...)
+	}
+	return strings.Join(protos, ", ")
+}
+
+// Returns the highest supported version in an Upgrade value, or 0 if there is none.
+func parseVersions(upgrade string) (version int) {
+	for _, proto := range splitAndTrim(strings.ToLower(upgrade), ",") {
+		v, err := strconv.Atoi(strings.TrimPrefix(proto, "rdv/"))
+		if err == nil && strings.HasPrefix(proto, "rdv/") && v >= 1 && v <= maxProtocolVersion {
+			version = max(version, v)
+		}
+	}
+	return
+}
+
+// Returns the highest supported version that the request proposed, or 0 if there is none.
+// WebSocket requests propose versions in a param, and use version 1 without it.
+func requestVersion(req *http.Request) int {
+	if isWebSocketReq(req) {
+		return max(parseVersions(rdvParam(req, hUpgrade)), 1)
+	}
+	return parseVersions(req.Header.Get("Upgrade"))
 }
 
 func newUpgradeResponse(statusCode int, protocol string) *http.Response {
@@ -79,13 +141,8 @@ func newUpgradeResponse(statusCode int, protocol string) *http.Response {
 func upgradeHttp(w http.ResponseWriter, req *http.Request, protocol string) (net.Conn, *bufio.ReadWriter, error) {
 	w.Header().Set("Connection", "upgrade")
 	w.Header().Set("Upgrade", protocol)
-	h, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "", http.StatusInternalServerError)
-		return nil, nil, ErrHijackFailed
-	}
-
-	nc, brw, err := h.Hijack()
+	// Unwraps the writers of middleware, if they implement Unwrap
+	nc, brw, err := http.NewResponseController(w).Hijack()
 	if err != nil {
 		http.Error(w, "", http.StatusInternalServerError)
 		return nil, nil, fmt.Errorf("%w: %v", ErrHijackFailed, err)
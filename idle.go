@@ -0,0 +1,155 @@
+package rdv
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Detects inactivity of a relay. Relayed data is written to it to register activity, which must
+// be cheap, since it happens for every chunk of data. See Relayer.IdleDetector.
+type IdleDetector interface {
+	io.Writer
+
+	// Stops detection. Called once, when the relay ends.
+	Stop()
+}
+
+// Returns an IdleDetector which calls onIdle once, after at least timeout without activity.
+type IdleDetectorFunc func(timeout time.Duration, onIdle func()) IdleDetector
+
+// An IdleDetector which resets a timer on each write. Precise, but resetting timers is costly
+// at high throughput.
+func TimerIdle(timeout time.Duration, onIdle func()) IdleDetector {
+	return &timerIdle{timeout, time.AfterFunc(timeout, onIdle)}
+}
+
+type timerIdle struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// Registers activity and prolongs the deadline
+func (t *timerIdle) Write(p []byte) (int, error) {
+	t.timer.Reset(t.timeout)
+	return len(p), nil
+}
+
+func (t *timerIdle) Stop() {
+	t.timer.Stop()
+}
+
+// Returns IdleDetectors which only set an atomic flag on each write, and check it every
+// resolution. Inactivity is detected up to one resolution late, but there is no per-write
+// timer churn, which matters for relays at gigabit speeds.
+func SampledIdle(resolution time.Duration) IdleDetectorFunc {
+	return func(timeout time.Duration, onIdle func()) IdleDetector {
+		s := &sampledIdle{ticker: time.NewTicker(max(resolution, time.Millisecond)), done: make(chan struct{})}
+		go s.run(timeout, onIdle)
+		return s
+	}
+}
+
+type sampledIdle struct {
+	active atomic.Bool
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+func (s *sampledIdle) Write(p []byte) (int, error) {
+	if !s.active.Load() { // avoid contention on the cache line
+		s.active.Store(true)
+	}
+	return len(p), nil
+}
+
+func (s *sampledIdle) run(timeout time.Duration, onIdle func()) {
+	defer s.ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case now := <-s.ticker.C:
+			if s.active.Swap(false) {
+				last = now
+			} else if now.Sub(last) >= timeout {
+				onIdle()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *sampledIdle) Stop() {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// An IdleDetector which never detects inactivity.
+type noopIdle struct {
+	noopTap
+}
+
+func (noopIdle) Stop() {}
+
+// An IdleDetector whose detection starts over after the peers are probed, see Relayer.IdleProbes.
+type probingIdle struct {
+	cur     atomic.Pointer[IdleDetector]
+	stopped atomic.Bool
+}
+
+// Replaces the current detector, which has detected inactivity.
+func (p *probingIdle) set(it IdleDetector) {
+	p.cur.Store(&it)
+	if p.stopped.Load() {
+		it.Stop()
+	}
+}
+
+func (p *probingIdle) Write(b []byte) (int, error) {
+	return (*p.cur.Load()).Write(b)
+}
+
+func (p *probingIdle) Stop() {
+	p.stopped.Store(true)
+	(*p.cur.Load()).Stop()
+}
+
+// Sends TCP keepalive probes to the peers, one per second, which fail their conns if they don't
+// answer. Returns a func that restores the previous keepalives of the conns, or false if any of
+// the conns isn't over TCP.
+func probeKeepAlive(probes int, conns ...*Conn) (restore func(), ok bool) {
+	var tcs []*net.TCPConn
+	for _, c := range conns {
+		tc := tcpConn(c.Conn)
+		if tc == nil {
+			return nil, false
+		}
+		tcs = append(tcs, tc)
+	}
+	prev := make([]net.KeepAliveConfig, len(tcs))
+	for i, tc := range tcs {
+		prev[i] = keepAliveConfig(tc)
+		tc.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: time.Second, Interval: time.Second, Count: probes})
+	}
+	return func() {
+		for i, tc := range tcs {
+			tc.SetKeepAliveConfig(prev[i])
+		}
+	}, true
+}
+
+// Registers the time of the last data relayed from the conn, see Conn.LastActive.
+type activityTap struct {
+	c *Conn
+}
+
+func (t activityTap) Write(p []byte) (int, error) {
+	t.c.active.Store(time.Now().UnixNano())
+	return len(p), nil
+}
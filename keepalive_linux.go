@@ -0,0 +1,36 @@
+package rdv
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the current keepalive config of the conn, or the default if it can't be read.
+func keepAliveConfig(tc *net.TCPConn) net.KeepAliveConfig {
+	cfg := net.KeepAliveConfig{Enable: true}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return cfg
+	}
+	rc.Control(func(fd uintptr) {
+		enable, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+		if err != nil {
+			return
+		}
+		idle, err1 := unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+		interval, err2 := unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL)
+		count, err3 := unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return
+		}
+		cfg = net.KeepAliveConfig{
+			Enable:   enable != 0,
+			Idle:     time.Duration(idle) * time.Second,
+			Interval: time.Duration(interval) * time.Second,
+			Count:    count,
+		}
+	})
+	return cfg
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package rdv
+
+import "net"
+
+// Reading the keepalive config is only supported on Linux, so the default is assumed elsewhere.
+func keepAliveConfig(tc *net.TCPConn) net.KeepAliveConfig {
+	return net.KeepAliveConfig{Enable: true}
+}
@@ -0,0 +1,149 @@
+package rdv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Max length of a PING or PONG line
+const maxPingLine = 64
+
+// A chooser which pings each direct conn once it's ready, and chooses the one with the lowest RTT
+// among those that responded within the window, starting from the first candidate. This prefers
+// e.g. a LAN path over a public path, even if the public path was ready first. The relay is only
+// chosen if no direct conn is available, after a penalty of the same window (see RelayPenalty).
+//
+// Both peers must be recent enough to respond to pings, and use the rdv handshake.
+func LatencyChooser(window time.Duration) Chooser {
+	return func(cancel func(), candidates chan *Conn) (chosen *Conn, unchosen []*Conn) {
+		return withLatency(cancel, candidates, window)
+	}
+}
+
+func withLatency(cancel func(), candidates chan *Conn, window time.Duration) (chosen *Conn, unchosen []*Conn) {
+	type pinged struct {
+		conn *Conn
+		rtt  time.Duration
+		err  error
+	}
+	var (
+		results = make(chan pinged)
+		pending int
+		timer   <-chan time.Time
+		relay   *Conn
+		bestRTT time.Duration
+	)
+	for candidates != nil || pending > 0 {
+		select {
+		case nc, ok := <-candidates:
+			if !ok {
+				candidates = nil
+				continue
+			}
+			if timer == nil {
+				d := window
+				if nc.IsRelay() {
+					d = hintedPenalty(window, nc.meta)
+				}
+				timer = time.After(d)
+			}
+			if nc.IsRelay() {
+				if relay != nil {
+					unchosen = append(unchosen, relay)
+				}
+				relay = nc
+				continue
+			}
+			pending++
+			go func() {
+				rtt, err := nc.ping()
+				results <- pinged{nc, rtt, err}
+			}()
+		case r := <-results:
+			pending--
+			if r.err != nil || (chosen != nil && r.rtt >= bestRTT) {
+				unchosen = append(unchosen, r.conn)
+				continue
+			}
+			if chosen != nil {
+				unchosen = append(unchosen, chosen)
+			}
+			chosen, bestRTT = r.conn, r.rtt
+		case <-timer:
+			timer = make(chan time.Time) // never fires
+			cancel()
+		}
+	}
+	if chosen == nil {
+		return relay, unchosen
+	}
+	if relay != nil {
+		unchosen = append(unchosen, relay)
+	}
+	return chosen, unchosen
+}
+
+func pingLine(method, nonce string) string {
+	return fmt.Sprintf("%s %s %s\r\n", protocolName, method, nonce)
+}
+
+// Sends a PING to the acceptor, and measures the time until the PONG is received. With clock
+// sync, the PONG carries when the acceptor received the PING and sent the PONG, which are kept
+// for estimating its clock. Dialer only.
+func (c *Conn) ping() (time.Duration, error) {
+	var b [8]byte
+	rand.Read(b[:])
+	nonce := hex.EncodeToString(b[:])
+	start := time.Now()
+	if _, err := io.WriteString(c, pingLine("PING", nonce)); err != nil {
+		return 0, err
+	}
+	line, err := readLine(c, maxPingLine+maxLineTimes)
+	if err != nil {
+		return 0, err
+	}
+	done := time.Now()
+	times, err := parseTimes(line, pingLine("PONG", nonce))
+	if err != nil {
+		return 0, fmt.Errorf("%w: unexpected pong", ErrProtocol)
+	}
+	if len(times) == 2 && c.meta.clockSync {
+		c.clock = clockSample{Sent: start.UnixNano(), Recv: times[0], T: times[1], Done: done.UnixNano()}
+	}
+	return done.Sub(start), nil
+}
+
+// Reads the peer header line, and responds to any PINGs before it. With clock sync, PONGs carry
+// when the PING was received and the PONG sent, and the timestamps in the confirm are kept for
+// estimating the dialer's clock. Acceptor only.
+func (c *Conn) expectHeader(peer string) error {
+	for {
+		line, err := readLine(c, max(len(peer), maxPingLine)+maxLineTimes)
+		if err != nil {
+			return err
+		}
+		recv := time.Now().UnixNano()
+		if times, err := parseTimes(line, peer); err == nil {
+			// The confirm echoes the timestamp of our HELLO, and when the dialer received it
+			if len(times) == 3 && c.clock.Sent != 0 && times[1] == c.clock.Sent {
+				c.clock = clockSample{Sent: c.clock.Sent, Recv: times[2], T: times[0], Done: recv}
+			}
+			return nil
+		}
+		nonce, ok := strings.CutPrefix(line, protocolName+" PING ")
+		if !ok || nonce == "" || strings.ContainsAny(nonce, " \r") {
+			return fmt.Errorf("%w: invalid peer handshake", ErrProtocol)
+		}
+		pong := pingLine("PONG", nonce)
+		if c.meta.clockSync {
+			pong = withTimes(pong, recv, time.Now().UnixNano())
+		}
+		if _, err := io.WriteString(c, pong); err != nil {
+			return err
+		}
+	}
+}
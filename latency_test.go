@@ -0,0 +1,79 @@
+package rdv
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A candidate of a test of LatencyChooser. Direct conns respond to pings after the delay, unless
+// they fail.
+type latencyCandidate struct {
+	relay bool
+	delay time.Duration
+	fail  bool
+}
+
+// Returns a dialer conn of the candidate, whose peer responds to its pings.
+func (lc latencyCandidate) conn(t *testing.T) *Conn {
+	nc, peer := net.Pipe()
+	t.Cleanup(func() {
+		nc.Close()
+		peer.Close()
+	})
+	meta := newMeta(true, "", "token")
+	if lc.relay {
+		return newRelayConn(nc, nc, meta, nil)
+	}
+	go func() {
+		if lc.fail {
+			peer.Close()
+			return
+		}
+		for {
+			line, err := readLine(peer, maxPingLine)
+			if err != nil {
+				return
+			}
+			time.Sleep(lc.delay)
+			if _, err := peer.Write([]byte(pingLine("PONG", strings.TrimPrefix(line, protocolName+" PING ")))); err != nil {
+				return
+			}
+		}
+	}()
+	return newDirectConn(nc, false, meta, nil)
+}
+
+func TestLatencyChooser(t *testing.T) {
+	tests := map[string]struct {
+		candidates []latencyCandidate
+		chosen     int
+	}{
+		"lowest_rtt":   {candidates: []latencyCandidate{{delay: 50 * time.Millisecond}, {}}, chosen: 1},
+		"failed_ping":  {candidates: []latencyCandidate{{fail: true}, {delay: 10 * time.Millisecond}}, chosen: 1},
+		"relay_only":   {candidates: []latencyCandidate{{relay: true}}, chosen: 0},
+		"direct_first": {candidates: []latencyCandidate{{relay: true}, {delay: 10 * time.Millisecond}}, chosen: 1},
+		"all_failed":   {candidates: []latencyCandidate{{fail: true}, {relay: true}}, chosen: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			candidates := make(chan *Conn, len(tc.candidates))
+			var conns []*Conn
+			for _, lc := range tc.candidates {
+				conn := lc.conn(t)
+				conns = append(conns, conn)
+				candidates <- conn
+			}
+			close(candidates)
+			chosen, unchosen := LatencyChooser(time.Second)(func() {}, candidates)
+			if chosen != conns[tc.chosen] {
+				t.Fatalf("expected candidate %d, got %v", tc.chosen, chosen)
+			}
+			if len(unchosen) != len(conns)-1 {
+				t.Fatalf("expected %d unchosen, got %d", len(conns)-1, len(unchosen))
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Runs the http server and the rdv server (which should be one of its handlers) until the context
+// is canceled, and then shuts them down in the right order:
+//
+//  1. The http server stops accepting conns, and in-flight requests are awaited in the background.
+//  2. The rdv server shuts down (see Server.Shutdown): waiting clients have
+//     ServerConfig.ShutdownGracePeriod to be matched, and are then asked to try again.
+//  3. Active relays are awaited, and canceled after ServerConfig.ShutdownTimeout.
+//  4. The http server is closed, if in-flight requests didn't finish within the same timeout.
+//
+// The http server is served with TLS if it has a TLS config with certificates. Returns the error
+// of the http server if it failed, otherwise the context error.
+func Serve(ctx context.Context, hs *http.Server, rs *Server) error {
+	rdvCtx, cancelRdv := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelRdv()
+	go rs.Serve(rdvCtx)
+	httpDone := make(chan error, 1)
+	go func() {
+		if hs.TLSConfig != nil && (len(hs.TLSConfig.Certificates) > 0 || hs.TLSConfig.GetCertificate != nil) {
+			httpDone <- hs.ListenAndServeTLS("", "")
+		} else {
+			httpDone <- hs.ListenAndServe()
+		}
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-httpDone:
+		rs.cfg.Logger.Error("rdv: http server failed", "err", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), rs.cfg.ShutdownTimeout)
+	defer cancel()
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- hs.Shutdown(shutdownCtx)
+	}()
+	rs.Shutdown(shutdownCtx)
+	if shutdownErr := <-shutdownDone; shutdownErr != nil {
+		hs.Close()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil // closed by someone else
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Returns a loopback address that is likely free.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// Clients in the lobby are asked to try again, and relays are canceled after the shutdown timeout.
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr := freeAddr(t)
+	rs := NewServer(&ServerConfig{ShutdownTimeout: 200 * time.Millisecond})
+	hs := &http.Server{Addr: addr, Handler: rs}
+	serveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	served := make(chan error, 1)
+	go func() { served <- Serve(serveCtx, hs, rs) }()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if nc, err := net.Dial("tcp", addr); err == nil {
+			nc.Close()
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	dc, ac := relayPair(t, ctx, client, "http://"+addr, "relay")
+	rejected := make(chan *http.Response, 1)
+	go func() {
+		_, resp, _ := client.Accept(ctx, "http://"+addr, "lobby", nil)
+		rejected <- resp
+	}()
+	awaitLobby(t, rs, 1)
+	stop()
+
+	if resp := <-rejected; resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %v, got %v", http.StatusServiceUnavailable, resp)
+	}
+	exchange(t, dc, ac, "draining")
+	dc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := dc.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected %v, got %v", io.EOF, err)
+	}
+	if err := <-served; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("expected the http server to be closed")
+	}
+}
+
+// The error of the http server is returned, once the rdv server is shut down.
+func TestServeHTTPErr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	rs := NewServer(nil)
+	err = Serve(context.Background(), &http.Server{Addr: ln.Addr().String(), Handler: rs}, rs)
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "listen" {
+		t.Fatalf("expected a listen error, got %v", err)
+	}
+	select {
+	case <-rs.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the rdv server to be shut down")
+	}
+}
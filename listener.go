@@ -0,0 +1,219 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Backoff between failed registrations of a listener
+const (
+	minListenBackoff = 500 * time.Millisecond
+	maxListenBackoff = 30 * time.Second
+)
+
+// A Listener accepts multiple dialers on one token, by re-registering with the rdv server as soon
+// as the previous registration was matched. Implements net.Listener.
+type Listener struct {
+	c      *Client
+	addr   string
+	token  string
+	header http.Header
+
+	control *Control      // if listening through a control conn
+	calls   chan struct{} // calls from the control conn, with capacity 1
+
+	ready     chan struct{} // closed once registered, see Ready
+	readyOnce sync.Once
+
+	conns  chan *Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Listens for dialers on the token until the context is canceled or the listener is closed.
+// Errors are retried with a backoff, and logged.
+func (c *Client) Listen(ctx context.Context, addr string, token string, reqHeader http.Header) *Listener {
+	ctx, cancel := context.WithCancel(ctx)
+	l := &Listener{
+		c:      c,
+		addr:   addr,
+		token:  token,
+		header: reqHeader,
+		conns:  make(chan *Conn),
+		ready:  make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	l.wg.Add(1)
+	go l.run()
+	return l
+}
+
+// Accepts the next conn, and returns net.ErrClosed once the listener is closed.
+func (l *Listener) AcceptConn() (*Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptConn()
+}
+
+// Returns a channel that is closed once the listener is first registered in the lobby of the rdv
+// server, i.e. once dialers can reach it (see ContextWithReadyFunc). Listeners of a Control are
+// ready once their token is watched on a connected control conn.
+func (l *Listener) Ready() <-chan struct{} {
+	return l.ready
+}
+
+func (l *Listener) setReady() {
+	l.readyOnce.Do(func() { close(l.ready) })
+}
+
+// Stops listening, and waits for pending connection attempts to finish.
+func (l *Listener) Close() error {
+	l.cancel()
+	if l.control != nil {
+		l.control.unwatch(l)
+	}
+	l.wg.Wait()
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return listenerAddr(l.addr + " " + l.token)
+}
+
+type listenerAddr string
+
+func (a listenerAddr) Network() string { return "rdv" }
+func (a listenerAddr) String() string  { return string(a) }
+
+// Registers with the server one at a time. Once a registration is matched, the connection attempt
+// continues concurrently while the next registration begins.
+func (l *Listener) run() {
+	defer l.wg.Done()
+	log := l.c.cfg.Logger.With("token", l.token)
+	if l.control != nil {
+		l.serveCalls(log)
+		return
+	}
+	changes, unsubscribe := l.c.netmon.subscribe(l.c.cfg.WatchNetwork)
+	defer unsubscribe()
+	backoff := minListenBackoff
+	for l.ctx.Err() == nil {
+		sig := l.c.serverSignaler(l.addr, l.header)
+		signaled := make(chan error, 1)
+		ctx, cancel := context.WithCancel(l.ctx) // canceled if the network changes before a match
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			defer cancel()
+			err := l.accept(ContextWithReadyFunc(ctx, l.setReady), log, &notifySignaler{sig, signaled})
+			select {
+			case signaled <- err: // in case it failed before signaling
+			default:
+			}
+		}()
+		var err error
+		select {
+		case err = <-signaled:
+		case <-changes:
+			log.Info("rdv listener: network changed, re-registering")
+			cancel()
+			if err = <-signaled; err != nil {
+				backoff = minListenBackoff
+				continue
+			}
+		}
+		if err == nil || errors.Is(err, context.DeadlineExceeded) || (sig.Response != nil && sig.Response.StatusCode == http.StatusRequestTimeout) {
+			backoff = minListenBackoff
+			continue // matched, or no dialer arrived in time (see ConnTimeout)
+		}
+		if l.ctx.Err() != nil {
+			return
+		}
+		wait := max(backoff, retryAfter(sig.Response))
+		log.Warn("rdv listener: registration failed", "err", err, "backoff", wait)
+		select {
+		case <-time.After(wait):
+		case <-l.ctx.Done():
+		}
+		backoff = min(2*backoff, maxListenBackoff)
+	}
+}
+
+// Accepts a dialer once each time the control conn calls, until the listener is closed.
+func (l *Listener) serveCalls(log *slog.Logger) {
+	for {
+		select {
+		case <-l.calls:
+		case <-l.ctx.Done():
+			return
+		}
+		log.Debug("rdv listener: called")
+		sig := &timeoutSignaler{l.c.httpSignaler(l.addr, l.header.Clone()), controlCallTimeout}
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.accept(l.ctx, log, sig)
+		}()
+	}
+}
+
+// Wakes up the listener, when a dialer is waiting.
+func (l *Listener) call() {
+	select {
+	case l.calls <- struct{}{}:
+	default:
+	}
+}
+
+// Accepts a dialer, and delivers the conn.
+func (l *Listener) accept(ctx context.Context, log *slog.Logger, sig Signaler) error {
+	conn, err := l.c.do(ctx, newMeta(false, l.addr, l.token), sig)
+	if err != nil {
+		log.Debug("rdv listener: accept failed", "err", err)
+		return err
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+	return nil
+}
+
+// Signaler which reports when signaling has completed.
+type notifySignaler struct {
+	Signaler
+	done chan error
+}
+
+func (s *notifySignaler) Signal(ctx context.Context, socket *Socket, meta *Meta) (net.Conn, error) {
+	nc, err := s.Signaler.Signal(ctx, socket, meta)
+	s.done <- err
+	return nc, err
+}
+
+// Signaler with a timeout, for accepts whose dialer should already be waiting.
+type timeoutSignaler struct {
+	Signaler
+	timeout time.Duration
+}
+
+func (s *timeoutSignaler) Signal(ctx context.Context, socket *Socket, meta *Meta) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Signaler.Signal(ctx, socket, meta)
+}
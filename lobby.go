@@ -0,0 +1,183 @@
+package rdv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timeouts for lobby operations, and for dialing other server instances
+const (
+	lobbyOpTimeout = 5 * time.Second
+
+	// Claims must expire eventually in case an instance dies. Used if there's no LobbyTimeout.
+	defaultClaimTTL = 10 * time.Minute
+
+	// Max age of the signature of a forwarded client, see hForwardedSig
+	forwardMaxAge = time.Minute
+)
+
+// A Lobby keeps track of which server instance holds the waiting client of each token, so that
+// peers that arrive at different instances behind a load balancer can be matched. A client that
+// arrives at an instance other than the one holding its peer is forwarded to that instance, which
+// then does the matching and relaying. See RedisLobby.
+type Lobby interface {
+	// Claims the token for the instance at addr, unless it's already claimed, and returns the
+	// addr of the instance which holds the token. Claims expire after ttl. Tokens in a namespace
+	// are prefixed by the namespace and a NUL byte.
+	Claim(ctx context.Context, token, addr string, ttl time.Duration) (owner string, err error)
+
+	// Releases the token, if it's claimed by the instance at addr.
+	Release(ctx context.Context, token, addr string) error
+}
+
+// Claims the token of a new conn. Returns the addr of another instance that holds the token,
+// or empty if the conn should be handled by this instance.
+func (l *Server) claim(conn *Conn) string {
+	if l.cfg.Lobby == nil || conn.req.Header.Get(hForwardedSig) != "" {
+		return "" // don't forward twice, see stripForwarded
+	}
+	ttl := defaultClaimTTL
+	if l.cfg.LobbyTimeout > 0 {
+		ttl = l.cfg.LobbyTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lobbyOpTimeout)
+	defer cancel()
+	owner, err := l.cfg.Lobby.Claim(ctx, conn.meta.lobbyKey(), l.cfg.InstanceAddr, ttl)
+	if err != nil {
+		l.cfg.Logger.Warn("rdv server: lobby claim failed", "token", conn.meta.Token, "err", err)
+		return ""
+	}
+	if owner == l.cfg.InstanceAddr {
+		return ""
+	}
+	return owner
+}
+
+// Releases the lobby key in the background, once it's no longer in the lobby of this instance.
+func (l *Server) release(key string) {
+	if l.cfg.Lobby == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lobbyOpTimeout)
+		defer cancel()
+		if err := l.cfg.Lobby.Release(ctx, key, l.cfg.InstanceAddr); err != nil {
+			l.cfg.Logger.Warn("rdv server: lobby release failed", "key", key, "err", err)
+		}
+	}()
+}
+
+// Forwards the conn to the instance that holds its token, and copies data both ways until
+// either side is done. The other instance then responds to the client as usual.
+func (l *Server) forward(conn *Conn, owner string) {
+	defer conn.Close()
+	log := l.cfg.Logger.With("token", conn.meta.Token, "owner", owner)
+	header := conn.req.Header.Clone()
+	for _, h := range []string{"Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions", hMethod, hUpgrade} {
+		header.Del(h)
+	}
+	if conn.meta.ObservedAddr != nil {
+		header.Set(hForwardedAddr, conn.meta.ObservedAddr.String())
+	}
+	header.Set(hForwardedSig, signForward(l.cfg.InstanceKey, header.Get(hForwardedAddr), conn.meta.tokenForServer(), time.Now()))
+	meta := *conn.meta
+	meta.ServerAddr = owner
+	req, err := meta.toReq(context.Background(), header)
+	if err != nil {
+		writeResponseErr(conn, http.StatusInternalServerError, "bad lobby owner")
+		log.Warn("rdv server: bad lobby owner", "err", err)
+		return
+	}
+	nc, err := dialInstance(req.URL)
+	if err == nil {
+		nc.SetWriteDeadline(time.Now().Add(lobbyOpTimeout))
+		err = req.Write(nc)
+		nc.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		writeResponseErr(conn, http.StatusBadGateway, "could not reach peer's rdv server")
+		log.Warn("rdv server: forward failed", "err", err)
+		return
+	}
+	defer nc.Close()
+	log.Debug("rdv server: forwarded")
+	done := make(chan struct{})
+	go func() {
+		RelayCopy(conn, nc)
+		conn.SetReadDeadline(past())
+		close(done)
+	}()
+	RelayCopy(nc, conn)
+	nc.SetReadDeadline(past())
+	<-done
+}
+
+func dialInstance(u *url.URL) (net.Conn, error) {
+	d := &net.Dialer{Timeout: lobbyOpTimeout}
+	hostPort := net.JoinHostPort(u.Hostname(), urlPort(u))
+	if u.Scheme == "https" {
+		return tls.DialWithDialer(d, "tcp", hostPort, nil)
+	}
+	return d.Dial("tcp", hostPort)
+}
+
+// Removes the forwarding headers of a request, unless another instance signed them with the
+// instance key, so that clients can neither claim an observed addr nor skip the lobby claim.
+func (l *Server) stripForwarded(req *http.Request) {
+	sig := req.Header.Get(hForwardedSig)
+	if sig != "" && l.cfg.Lobby != nil && verifyForward(l.cfg.InstanceKey, req.Header.Get(hForwardedAddr), req.Header.Get(hToken), sig, time.Now()) {
+		return
+	}
+	if sig != "" || req.Header.Get(hForwardedAddr) != "" {
+		l.cfg.Logger.Debug("rdv server: stripped unverified forwarding headers", "addr", req.RemoteAddr)
+	}
+	req.Header.Del(hForwardedAddr)
+	req.Header.Del(hForwardedSig)
+}
+
+// Returns the signature of a forwarded client with its observed addr (which may be empty) and
+// server token, see hForwardedSig.
+func signForward(key, addr, token string, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return ts + "." + hex.EncodeToString(forwardMAC(key, addr, token, ts))
+}
+
+func verifyForward(key, addr, token, sig string, now time.Time) bool {
+	ts, mac, ok := strings.Cut(sig, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > forwardMaxAge || age < -forwardMaxAge {
+		return false
+	}
+	b, err := hex.DecodeString(mac)
+	return err == nil && hmac.Equal(b, forwardMAC(key, addr, token, ts))
+}
+
+func forwardMAC(key, addr, token, ts string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "rdv forward\n%s\n%s\n%s", addr, token, ts)
+	return mac.Sum(nil)
+}
+
+// Returns the observed addr that another instance forwarded, if any. Must be called after
+// stripForwarded.
+func forwardedAddr(req *http.Request) (netip.AddrPort, bool) {
+	addr, err := netip.ParseAddrPort(req.Header.Get(hForwardedAddr))
+	return addr, err == nil
+}
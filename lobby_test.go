@@ -0,0 +1,81 @@
+package rdv
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Lobby of a single instance, which records the claimed tokens.
+type memLobby struct {
+	mu     sync.Mutex
+	claims []string
+}
+
+func (m *memLobby) Claim(ctx context.Context, token, addr string, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims = append(m.claims, token)
+	return addr, nil
+}
+
+func (m *memLobby) Release(ctx context.Context, token, addr string) error {
+	return nil
+}
+
+func TestSpoofedForward(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lobby := new(memLobby)
+	server, hs := startServer(t, &ServerConfig{Lobby: lobby, InstanceAddr: "http://rdv.test/", InstanceKey: "secret"})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+
+	spoofed := "203.0.113.7:4000"
+	header := http.Header{}
+	header.Set(hForwardedAddr, spoofed)
+	header.Set(hForwardedSig, signForward("guess", spoofed, "token", time.Now()))
+	go client.Accept(ctx, hs.URL, "token", header)
+	awaitLobby(t, server, 1)
+
+	entries, err := server.Lobby(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := entries[0].Addr; addr == nil || addr.String() == spoofed {
+		t.Fatalf("expected the real observed addr, got %v", addr)
+	}
+	lobby.mu.Lock()
+	defer lobby.mu.Unlock()
+	if len(lobby.claims) != 1 {
+		t.Fatalf("expected the token to be claimed, got %d claims", len(lobby.claims))
+	}
+}
+
+func TestVerifyForward(t *testing.T) {
+	now := time.Now()
+	sig := signForward("secret", "203.0.113.7:4000", "token", now)
+	tests := map[string]struct {
+		key, addr, token, sig string
+		now                   time.Time
+		ok                    bool
+	}{
+		"valid":     {key: "secret", addr: "203.0.113.7:4000", token: "token", sig: sig, now: now, ok: true},
+		"wrong_key": {key: "other", addr: "203.0.113.7:4000", token: "token", sig: sig, now: now},
+		"addr":      {key: "secret", addr: "203.0.113.8:4000", token: "token", sig: sig, now: now},
+		"token":     {key: "secret", addr: "203.0.113.7:4000", token: "other", sig: sig, now: now},
+		"expired":   {key: "secret", addr: "203.0.113.7:4000", token: "token", sig: sig, now: now.Add(2 * forwardMaxAge)},
+		"future":    {key: "secret", addr: "203.0.113.7:4000", token: "token", sig: sig, now: now.Add(-2 * forwardMaxAge)},
+		"malformed": {key: "secret", addr: "203.0.113.7:4000", token: "token", sig: "deadbeef", now: now},
+		"empty":     {key: "secret", addr: "203.0.113.7:4000", token: "token", sig: "", now: now},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if ok := verifyForward(tc.key, tc.addr, tc.token, tc.sig, tc.now); ok != tc.ok {
+				t.Fatalf("expected %v, got %v", tc.ok, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package rdv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// End of the maintenance window of a server, in RFC 3339. Sent with 503 responses during
+// maintenance, see Server.SetMaintenance. Response only.
+const hMaintenanceUntil = "Rdv-Maintenance-Until"
+
+// Returned by the client when the rdv server rejects it due to maintenance, see
+// Server.SetMaintenance. Matches ErrMaintenance with errors.Is.
+type MaintenanceError struct {
+	// Message of the server operator, e.g. a reason or a status page.
+	Message string
+
+	// End of the maintenance window, after which clients can try again.
+	Until time.Time
+}
+
+func (e *MaintenanceError) Error() string {
+	msg := fmt.Sprintf("%v until %v", ErrMaintenance, e.Until.Format(time.RFC3339))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *MaintenanceError) Unwrap() error {
+	return ErrMaintenance
+}
+
+// Rejects new clients with 503 Service Unavailable until the given time, with the message and the
+// maintenance window, which clients return as a MaintenanceError. Clients that are already in the
+// lobby or relaying are unaffected. Call with a time in the past (e.g. the zero time) to end
+// maintenance early.
+func (l *Server) SetMaintenance(msg string, until time.Time) {
+	if !time.Now().Before(until) {
+		l.maintenance.Store(nil)
+		return
+	}
+	l.maintenance.Store(&MaintenanceError{Message: msg, Until: until})
+}
+
+// Rejects the request if the server is under maintenance.
+func (l *Server) checkMaintenance(w http.ResponseWriter) error {
+	m := l.maintenance.Load()
+	if m == nil {
+		return nil
+	}
+	wait := time.Until(m.Until)
+	if wait <= 0 {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Set(hMaintenanceUntil, m.Until.UTC().Format(time.RFC3339))
+	http.Error(w, m.Message, http.StatusServiceUnavailable)
+	return m
+}
+
+// Returns a MaintenanceError if the response is a maintenance notice, otherwise err. The body
+// must have been slurped.
+func maintenanceErr(resp *http.Response, err error) error {
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(hMaintenanceUntil) == "" {
+		return err
+	}
+	until, parseErr := time.Parse(time.RFC3339, resp.Header.Get(hMaintenanceUntil))
+	if parseErr != nil {
+		return err
+	}
+	var body []byte
+	if resp.Body != nil {
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return &MaintenanceError{Message: strings.TrimSpace(string(body)), Until: until}
+}
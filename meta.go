@@ -1,26 +1,314 @@
 package rdv
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
 	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Meta struct {
-	ServerAddr           string
-	IsDialer             bool
+	ServerAddr string
+	IsDialer   bool
+
+	// If set, the role (IsDialer) is assigned by the server instead of chosen by the client.
+	Symmetric bool
+
 	Token                string
 	ObservedAddr         *netip.AddrPort
 	SelfAddrs, PeerAddrs []netip.AddrPort
+
+	// Scopes the token, so that tenants of a shared server can't collide. Empty is the default
+	// namespace. See ServerConfig.NamespaceFunc.
+	Namespace string
+
+	// Hints from the client, and on the client also from the server.
+	Hints Hint
+
+	// Echo headers (see EchoHeaderPrefix) from the client, without the prefix. On the server, they
+	// may be modified before the relay starts, e.g. in the ServeFunc. On the client, they're from
+	// ClientConfig.EchoHeader.
+	Header http.Header
+
+	// Echo headers from the peer, without the prefix.
+	PeerHeader http.Header
+
+	// Capabilities of the client (see ClientConfig.Capabilities), and of the peer as exchanged
+	// through the rdv server. The peer's are zero if it's unknown, e.g. with other signalers. See
+	// Conn.Capabilities for the capabilities that both peers support.
+	Capabilities, PeerCapabilities Capability
+
+	// Banner of the client (see ClientConfig.Banner), and of the peer as delivered by the rdv
+	// server.
+	Banner, PeerBanner []byte
+
+	// Estimated offset of the peer's clock relative to ours (peer minus self), and the round-trip
+	// time to the peer. Only set on the client if ClientConfig.ClockSync is enabled, and on the
+	// dialer only if it pinged the chosen conn.
+	ClockOffset, RTT time.Duration
+
+	// The outcome of each candidate of the connection attempt. Client only.
+	Report *ConnReport
+
+	// NAT characteristics of this client, if discovered by the SelfAddrFunc (see StunSelfAddrs).
+	// Client only.
+	NAT *NATInfo
+
+	// Past outcomes on the current network, if known. Client only, see ClientConfig.HistoryFile.
+	History *NetworkHistory
+
+	// Ways in which the conn is less secure or featured than the client supports. Client only.
+	Downgrades Downgrade
+
+	// Protocol version negotiated with the server and the peer, which both peers use. The server
+	// picks the highest version that both peers proposed (see ClientConfig.ProtocolVersion).
+	// Version 2 versions the rdv header lines, and is the basis of new protocol features. Zero
+	// means version 1, e.g. with signalers other than the rdv server.
+	Version int
+
+	// Session of a resumable conn, which is assigned by the server when the peers are matched.
+	// See Client.DialResumable.
+	Session string
+
+	// Relay servers that the peers were redirected to by the rdv server, see RedirectRelay.
+	RelayAddrs []string
+
+	// Number of clients in the group of this client, and its index in the group, which is the
+	// order of arrival. Zero for pairs of peers. See Client.JoinGroup.
+	GroupSize, GroupIndex int
+
+	// The observed and self addrs of each member of the group, by index. Set when the group is
+	// complete.
+	GroupAddrs [][]netip.AddrPort
+
+	// Token of the peers on the relay servers, see RelayAddrs.
+	relayToken string
+
+	// Token sent to the server, if different from Token. Client only.
+	serverToken string
+
+	// Session that the client reattaches to, which it's matched by instead of the token. Server
+	// only, see Client.DialResumable.
+	resumed string
+
+	// Highest protocol version proposed by the client
+	maxVersion int
+
+	// Whether this is a control conn, see Client.Control
+	control bool
+
+	// Whether the client estimates the peer's clock, see ClientConfig.ClockSync. Client only.
+	clockSync bool
+
+	// Relays of other servers that matched the peers later, when racing. Acceptor only, see
+	// ClientConfig.RaceServers.
+	lateRelays <-chan *Conn
+}
+
+// Sets the version of matched peers to the highest that both proposed.
+func negotiateVersion(a, b *Meta) {
+	v := max(min(a.maxVersion, b.maxVersion), 1)
+	a.Version, b.Version = v, v
 }
 
 func newMeta(isDialer bool, addr string, token string) *Meta {
 	return &Meta{IsDialer: isDialer, Token: token, ServerAddr: addr}
 }
 
+// Sets the peer addrs to the valid self addrs and observed addr of the peer.
 func (m *Meta) setPeerAddrsFrom(peer *Meta) {
-	m.PeerAddrs = make([]netip.AddrPort, len(peer.SelfAddrs), len(peer.SelfAddrs)+1)
-	copy(m.PeerAddrs, peer.SelfAddrs)
+	m.PeerAddrs = peer.candidateAddrs()
+	m.PeerHeader = peer.Header
+	m.PeerCapabilities = peer.Capabilities
+	m.PeerBanner = peer.Banner
+}
+
+// Returns the valid self addrs and observed addr of a client. Server only.
+func (m *Meta) candidateAddrs() []netip.AddrPort {
+	addrs := slices.Clone(m.SelfAddrs)
+	if m.ObservedAddr != nil {
+		addrs = append(addrs, *m.ObservedAddr)
+	}
+	return SanitizeAddrs(addrs)
+}
+
+// Returns the key of the meta in the server's lobby, i.e. the token scoped by the namespace.
+func (m *Meta) lobbyKey() string {
+	token := m.Token
+	if m.resumed != "" {
+		token = resumeToken(m.resumed)
+	}
+	if m.Namespace == "" {
+		return token
+	}
+	return m.Namespace + "\x00" + token // header values can't contain NUL
+}
+
+// Returns the token to send to the server
+func (m *Meta) tokenForServer() string {
+	if m.serverToken != "" {
+		return m.serverToken
+	}
+	return m.Token
+}
+
+// Returns a hex-encoded HMAC-SHA256 of the token, keyed by the salt. Used to hide tokens from the
+// server, while still allowing it to match peers. See ClientConfig.HashToken.
+func HashToken(salt, token string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Hints are flags exchanged with the server, to help choosers decide. Request hints are declared by
+// the client and response hints are derived by the server. Unknown hints are ignored.
+type Hint uint32
+
+const (
+	// Request: the client won't connect directly, only through the relay.
+	HintRelayOnly Hint = 1 << iota
+
+	// Response: the peer won't connect directly, so there's no point waiting for a direct conn.
+	HintPeerRelayOnly
+
+	// Response: both peers have the same observed IP, i.e. they're likely behind the same NAT and
+	// can connect over the local network.
+	HintSameObservedIP
+
+	// Request: the client frames its data so that the conn can be resumed, see
+	// Client.DialResumable. The server then assigns a session to the peers.
+	HintResumable
+
+	// Request: the client wants an interim response once it has joined the lobby, see
+	// ContextWithReadyFunc.
+	HintNotifyReady
+
+	// Request: the client wants interim responses with its remaining time in the lobby, see
+	// ContextWithExpiryFunc and ServerConfig.ExpiryUpdates. Requires HintNotifyReady.
+	HintExpiryUpdates
+
+	requestHints  = HintRelayOnly | HintResumable | HintNotifyReady | HintExpiryUpdates
+	responseHints = HintPeerRelayOnly | HintSameObservedIP
+)
+
+var hintNames = map[Hint]string{
+	HintRelayOnly:      "relay-only",
+	HintPeerRelayOnly:  "peer-relay-only",
+	HintSameObservedIP: "same-observed-ip",
+	HintResumable:      "resumable",
+	HintNotifyReady:    "notify-ready",
+	HintExpiryUpdates:  "expiry-updates",
+}
+
+func (h Hint) Has(hint Hint) bool {
+	return h&hint != 0
+}
+
+func (h Hint) String() string {
+	var names []string
+	for hint := Hint(1); hint != 0 && hint <= h; hint <<= 1 {
+		if name, ok := hintNames[hint]; ok && h.Has(hint) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func parseHints(s string) (h Hint) {
+	if s == "" {
+		return
+	}
+	for _, name := range splitAndTrim(s, ",") {
+		for hint, hintName := range hintNames {
+			if strings.EqualFold(name, hintName) {
+				h |= hint
+			}
+		}
+	}
+	return
+}
+
+// Returns response hints for m, derived from the peer. Doesn't modify m, since the peer may
+// concurrently do the same.
+func (m *Meta) hintsFrom(peer *Meta) (h Hint) {
+	if peer.Hints.Has(HintRelayOnly) {
+		h |= HintPeerRelayOnly
+	}
+	if m.ObservedAddr != nil && peer.ObservedAddr != nil && m.ObservedAddr.Addr() == peer.ObservedAddr.Addr() {
+		h |= HintSameObservedIP
+	}
+	return
+}
+
+// Capabilities are optional features of a client, which peers exchange through the rdv server so
+// that they can agree on features up front, without trial and error. The features themselves are
+// implemented by the application (or packages like mux), and are only used if both peers support
+// them. Bits from CapApp and up are for application-defined capabilities.
+type Capability uint32
+
+const (
+	// Streams are multiplexed over the conn, see the mux package.
+	CapMux Capability = 1 << iota
+
+	// The conn is encrypted end-to-end, see ClientConfig.Secure.
+	CapSecure
+
+	// Data is framed, e.g. into messages.
+	CapFraming
+
+	// Data is compressed.
+	CapCompress
+
+	// Peers send keepalives when idle.
+	CapKeepalive
+
+	// The first application-defined capability, i.e. CapApp<<1 is the second and so on.
+	CapApp Capability = 1 << 16
+)
+
+var capNames = map[Capability]string{
+	CapMux:       "mux",
+	CapSecure:    "secure",
+	CapFraming:   "framing",
+	CapCompress:  "compress",
+	CapKeepalive: "keepalive",
+}
+
+// Reports whether all of the given capabilities are set.
+func (c Capability) Has(capability Capability) bool {
+	return c&capability == capability
+}
+
+func (c Capability) String() string {
+	var names []string
+	for capability := Capability(1); capability != 0 && capability <= c; capability <<= 1 {
+		if !c.Has(capability) {
+			continue
+		}
+		if name, ok := capNames[capability]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("0x%x", uint32(capability)))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Capabilities are sent as a hex bitmask, so that the server can exchange those it doesn't know.
+func formatCaps(c Capability) string {
+	return strconv.FormatUint(uint64(c), 16)
+}
 
-	if peer.ObservedAddr != nil {
-		m.PeerAddrs = append(m.PeerAddrs, *peer.ObservedAddr)
+func parseCaps(s string) Capability {
+	c, err := strconv.ParseUint(s, 16, 32)
+	if err != nil { // ParseUint returns the max value if out of range
+		return 0
 	}
+	return Capability(c)
 }
@@ -0,0 +1,64 @@
+package rdv
+
+import "testing"
+
+func TestHints(t *testing.T) {
+	tests := map[string]struct {
+		str   string
+		hints Hint
+	}{
+		"empty":   {str: "", hints: 0},
+		"single":  {str: "relay-only", hints: HintRelayOnly},
+		"multi":   {str: "peer-relay-only, same-observed-ip", hints: HintPeerRelayOnly | HintSameObservedIP},
+		"case":    {str: "Relay-Only", hints: HintRelayOnly},
+		"unknown": {str: "relay-only, from-the-future", hints: HintRelayOnly},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			hints := parseHints(tc.str)
+			if hints != tc.hints {
+				t.Fatalf("expected %v, got %v", tc.hints, hints)
+			}
+			if parseHints(hints.String()) != hints {
+				t.Fatalf("expected %v to round-trip", hints)
+			}
+		})
+	}
+}
+
+func TestCaps(t *testing.T) {
+	tests := map[string]struct {
+		str  string
+		caps Capability
+		name string
+	}{
+		"empty":     {str: "", caps: 0, name: ""},
+		"single":    {str: "1", caps: CapMux, name: "mux"},
+		"multi":     {str: "3", caps: CapMux | CapSecure, name: "mux, secure"},
+		"app":       {str: "10002", caps: CapApp | CapSecure, name: "secure, 0x10000"},
+		"upper":     {str: "1C", caps: CapFraming | CapCompress | CapKeepalive, name: "framing, compress, keepalive"},
+		"highest":   {str: "80000000", caps: CapApp << 15, name: "0x80000000"},
+		"overflow":  {str: "100000000", caps: 0, name: ""},
+		"malformed": {str: "mux", caps: 0, name: ""},
+		"negative":  {str: "-1", caps: 0, name: ""},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			caps := parseCaps(tc.str)
+			if caps != tc.caps {
+				t.Fatalf("expected %v, got %v", tc.caps, caps)
+			}
+			if s := caps.String(); s != tc.name {
+				t.Fatalf("expected %q, got %q", tc.name, s)
+			}
+			if parseCaps(formatCaps(caps)) != caps {
+				t.Fatalf("expected %v to round-trip", caps)
+			}
+		})
+	}
+	if c := CapMux | CapSecure; !c.Has(CapMux) || !c.Has(CapMux|CapSecure) || c.Has(CapMux|CapFraming) {
+		t.Fatalf("unexpected Has of %v", c)
+	}
+}
@@ -0,0 +1,291 @@
+// Package mux multiplexes streams over an rdv conn, so that applications can open many logical
+// streams per rendezvous, without connecting for each stream. Both peers must use a Session.
+//
+// Streams are flow controlled individually, so a slow reader of one stream doesn't block the
+// others. The wire format is similar to yamux: frames have a 12-byte header with a version,
+// type, flags, stream id and length, followed by data for data frames.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/betamos/rdv"
+)
+
+const (
+	version    = 0
+	headerSize = 12
+
+	// Initial receive window of each stream, and the max amount of buffered data per stream
+	maxWindow = 256 << 10
+
+	// Max data per frame, so that streams interleave fairly
+	maxFrame = 16 << 10
+
+	// Max number of opened streams that haven't been accepted yet
+	acceptBacklog = 256
+)
+
+// Frame types
+const (
+	typeData   = 0
+	typeWindow = 1 // length is the window delta
+)
+
+// Frame flags
+const (
+	flagSYN = 1 << iota // opens a stream
+	flagFIN             // half-closes a stream
+	flagRST             // resets a stream
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamReset   = errors.New("mux: stream reset by peer")
+	ErrProtocol      = errors.New("mux: protocol error")
+)
+
+// A session of streams over a conn. Safe for concurrent use.
+type Session struct {
+	nc       net.Conn
+	nextID   uint32 // odd for the dialer, even for the acceptor
+	acceptCh chan *Stream
+
+	wmu sync.Mutex // serializes frames
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	queue   []frameHeader // control frames of the read loop, see queueFrame
+	err     error         // set when the session is closed
+	done    chan struct{} // closed when the session is closed
+
+	queued chan struct{} // signaled when frames are queued, with capacity 1
+}
+
+// A frame without data.
+type frameHeader struct {
+	typ        byte
+	flags      uint16
+	id, length uint32
+}
+
+// Returns a session over the conn, which is closed with the session. Data must not be read or
+// written on the conn directly afterwards.
+func New(conn *rdv.Conn) *Session {
+	return NewSession(conn, conn.Meta().IsDialer)
+}
+
+// Returns a session over any conn, e.g. one that was wrapped. The peers must have different roles,
+// e.g. based on rdv.Meta.IsDialer.
+func NewSession(nc net.Conn, isDialer bool) *Session {
+	s := &Session{
+		nc:       nc,
+		nextID:   2,
+		acceptCh: make(chan *Stream, acceptBacklog),
+		streams:  make(map[uint32]*Stream),
+		done:     make(chan struct{}),
+		queued:   make(chan struct{}, 1),
+	}
+	if isDialer {
+		s.nextID = 1
+	}
+	go s.readLoop()
+	go s.controlLoop()
+	return s
+}
+
+// Opens a new stream. The peer accepts it with Accept once the first frame arrives, which is
+// sent immediately.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(typeWindow, flagSYN, id, 0, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Waits for a stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// Closes the session and the conn. All streams fail with ErrSessionClosed.
+func (s *Session) Close() error {
+	s.close(ErrSessionClosed)
+	return nil
+}
+
+// Returns a channel which is closed when the session is closed, e.g. when the conn fails.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Returns the error that closed the session, or nil if it's open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = nil
+	close(s.done)
+	s.mu.Unlock()
+
+	s.nc.Close()
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+func (s *Session) writeFrame(typ byte, flags uint16, id, length uint32, data []byte) error {
+	buf := make([]byte, headerSize, headerSize+len(data))
+	buf[0], buf[1] = version, typ
+	binary.BigEndian.PutUint16(buf[2:], flags)
+	binary.BigEndian.PutUint32(buf[4:], id)
+	binary.BigEndian.PutUint32(buf[8:], length)
+	buf = append(buf, data...)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, err := s.nc.Write(buf); err != nil {
+		s.close(fmt.Errorf("%w: %w", ErrSessionClosed, err))
+		return s.Err()
+	}
+	return nil
+}
+
+// Queues a frame without data, which is written by the control loop, so that the read loop never
+// blocks on writes. Otherwise, if both peers' read loops were writing, neither would read.
+func (s *Session) queueFrame(typ byte, flags uint16, id, length uint32) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.queue = append(s.queue, frameHeader{typ, flags, id, length})
+	}
+	s.mu.Unlock()
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Writes the queued frames, until the session is closed.
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case <-s.queued:
+		case <-s.done:
+			return
+		}
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, f := range queue {
+			if err := s.writeFrame(f.typ, f.flags, f.id, f.length, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) readLoop() {
+	var (
+		hdr  [headerSize]byte
+		data = make([]byte, maxFrame)
+	)
+	for {
+		if _, err := io.ReadFull(s.nc, hdr[:]); err != nil {
+			s.close(fmt.Errorf("%w: %w", ErrSessionClosed, err))
+			return
+		}
+		typ, flags := hdr[1], binary.BigEndian.Uint16(hdr[2:])
+		id, length := binary.BigEndian.Uint32(hdr[4:]), binary.BigEndian.Uint32(hdr[8:])
+		if hdr[0] != version || typ > typeWindow || (typ == typeData && length > maxFrame) {
+			s.close(fmt.Errorf("%w: bad frame header", ErrProtocol))
+			return
+		}
+		var payload []byte
+		if typ == typeData {
+			payload = data[:length]
+			if _, err := io.ReadFull(s.nc, payload); err != nil {
+				s.close(fmt.Errorf("%w: %w", ErrSessionClosed, err))
+				return
+			}
+		}
+		if err := s.handleFrame(typ, flags, id, length, payload); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(typ byte, flags uint16, id, length uint32, payload []byte) error {
+	s.mu.Lock()
+	st := s.streams[id]
+	if flags&flagSYN != 0 {
+		if st != nil || id%2 == s.nextID%2 {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: bad stream id %d", ErrProtocol, id)
+		}
+		st = newStream(s, id)
+		select {
+		case s.acceptCh <- st:
+			s.streams[id] = st
+		default:
+			s.mu.Unlock()
+			s.queueFrame(typeWindow, flagRST, id, 0)
+			return nil
+		}
+	}
+	s.mu.Unlock()
+	if st == nil {
+		return nil // already closed locally
+	}
+	if typ == typeWindow {
+		st.addSendWindow(length)
+	} else if err := st.receive(payload); err != nil {
+		return err
+	}
+	if flags&flagFIN != 0 {
+		st.receiveFIN()
+	}
+	if flags&flagRST != 0 {
+		st.fail(ErrStreamReset)
+	}
+	return nil
+}
+
+// Removes the stream, once it's closed in both directions or reset.
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
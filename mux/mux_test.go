@@ -0,0 +1,185 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns a dialer and an acceptor session over a pipe, which are closed when the test ends.
+func sessionPair(t *testing.T) (*Session, *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	sa, sb := NewSession(a, true), NewSession(b, false)
+	t.Cleanup(func() {
+		sa.Close()
+		sb.Close()
+	})
+	return sa, sb
+}
+
+// Echoes each accepted stream until the session is closed.
+func echo(s *Session) {
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(st, st)
+			st.CloseWrite()
+		}()
+	}
+}
+
+func TestStreams(t *testing.T) {
+	sa, sb := sessionPair(t)
+	go echo(sb)
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := sa.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+			data := make([]byte, 1<<20) // exceeds the window
+			rand.Read(data)
+			go func() {
+				st.Write(data)
+				st.CloseWrite()
+			}()
+			got, err := io.ReadAll(st)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("expected %d echoed bytes, got %d, %v", len(data), len(got), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStreamClose(t *testing.T) {
+	sa, sb := sessionPair(t)
+	st, err := sa.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := sb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing discards unread data, and the peer reads EOF after the data that was written
+	if err := peer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v, got %v", net.ErrClosed, err)
+	}
+	if _, err := io.ReadAll(st); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write(make([]byte, maxWindow)); err != nil { // discarded by the peer
+		t.Fatal(err)
+	}
+	st.Close()
+	for deadline := time.Now().Add(2 * time.Second); streamCount(sa)+streamCount(sb) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected closed streams to be removed, got %d and %d", streamCount(sa), streamCount(sb))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Closing the session fails the other streams
+	st, _ = sa.Open()
+	sb.Close()
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("expected %v, got %v", ErrSessionClosed, err)
+	}
+}
+
+func streamCount(s *Session) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Streams beyond the accept backlog are reset. The read loop keeps reading while the reset is
+// pending, even if the peer doesn't read.
+func TestStreamReset(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	sb := NewSession(b, false)
+	defer sb.Close()
+	frame := func(flags uint16, id uint32) []byte {
+		f := make([]byte, headerSize)
+		f[1] = typeWindow
+		binary.BigEndian.PutUint16(f[2:], flags)
+		binary.BigEndian.PutUint32(f[4:], id)
+		return f
+	}
+	a.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	for i := range acceptBacklog + 2 {
+		if _, err := a.Write(frame(flagSYN, uint32(2*i+1))); err != nil {
+			t.Fatalf("expected the read loop to keep reading, got %v", err)
+		}
+	}
+	a.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, id := range []uint32{2*acceptBacklog + 1, 2*acceptBacklog + 3} {
+		got := make([]byte, headerSize)
+		if _, err := io.ReadFull(a, got); err != nil {
+			t.Fatal(err)
+		}
+		if want := frame(flagRST, id); !bytes.Equal(got, want) {
+			t.Fatalf("expected a reset of stream %d, got %x", id, got)
+		}
+	}
+	if st, err := sb.Accept(); err != nil || st.ID() != 1 {
+		t.Fatalf("expected the first stream to be accepted, got %v", err)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	sa, sb := sessionPair(t)
+	st, err := sa.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2*maxWindow)
+	rand.Read(data)
+
+	// The writer blocks once the peer's window is full
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := st.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != maxWindow {
+		t.Fatalf("expected to write the window of %d bytes, got %d, %v", maxWindow, n, err)
+	}
+
+	// Reading opens the window again
+	peer, err := sb.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetWriteDeadline(time.Time{})
+	go func() {
+		st.Write(data[n:])
+		st.CloseWrite()
+	}()
+	got, err := io.ReadAll(peer)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected %d bytes, got %d, %v", len(data), len(got), err)
+	}
+}
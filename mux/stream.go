@@ -0,0 +1,280 @@
+package mux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A stream of a session, which implements net.Conn. Safe for concurrent use, although
+// concurrent reads (or writes) are interleaved arbitrarily.
+type Stream struct {
+	s  *Session
+	id uint32
+
+	mu         sync.Mutex
+	buf        []byte // received data not yet read
+	consumed   uint32 // data read since the last window update
+	sendWindow uint32
+	finRecv    bool  // the peer won't write more
+	finSent    bool  // we won't write more
+	closed     bool  // closed locally, incoming data is discarded
+	err        error // set if reset, or the session is closed
+
+	readable, writable chan struct{} // signaled on changes, with capacity 1
+
+	readDeadline, writeDeadline deadline
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		s:             s,
+		id:            id,
+		sendWindow:    maxWindow,
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// Returns the id of the stream, which is odd for streams opened by the dialer.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(st.buf) > 0:
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			st.consumed += uint32(n)
+			var update uint32
+			if st.consumed >= maxWindow/2 && !st.finRecv {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				st.s.writeFrame(typeWindow, 0, st.id, update, nil)
+			}
+			return n, nil
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		case st.finRecv:
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		st.mu.Unlock()
+		select {
+		case <-st.readable:
+		case <-st.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.finSent:
+			st.mu.Unlock()
+			return n, net.ErrClosed
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return n, err
+		case st.sendWindow == 0:
+			st.mu.Unlock()
+			select {
+			case <-st.writable:
+			case <-st.writeDeadline.wait():
+				return n, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		chunk := p[:min(len(p), int(st.sendWindow), maxFrame)]
+		st.sendWindow -= uint32(len(chunk))
+		st.mu.Unlock()
+		if err := st.s.writeFrame(typeData, 0, st.id, uint32(len(chunk)), chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Half-closes the stream, after which the peer reads EOF once it has read all data.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+	err := st.s.writeFrame(typeWindow, flagFIN, st.id, 0, nil)
+	if done {
+		st.s.remove(st.id)
+	}
+	return err
+}
+
+// Closes the stream in both directions. Data that the peer writes afterwards is discarded.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	var credit uint32 // of unread data, so that the peer doesn't block on the window
+	if !st.closed && !st.finRecv {
+		credit = uint32(len(st.buf)) + st.consumed
+	}
+	st.closed = true
+	st.buf, st.consumed = nil, 0
+	st.mu.Unlock()
+	if credit > 0 {
+		st.s.writeFrame(typeWindow, 0, st.id, credit, nil)
+	}
+	st.notify(st.readable)
+	st.notify(st.writable)
+	return st.CloseWrite()
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.s.nc.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.s.nc.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	st.writeDeadline.set(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.set(t)
+	return nil
+}
+
+// Buffers data from the peer, which must not exceed the receive window.
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		// Keep the peer's writes flowing, since no one will read
+		if len(data) > 0 {
+			st.s.queueFrame(typeWindow, 0, st.id, uint32(len(data)))
+		}
+		return nil
+	}
+	if len(st.buf)+int(st.consumed)+len(data) > maxWindow {
+		return fmt.Errorf("%w: stream %d exceeded the receive window", ErrProtocol, st.id)
+	}
+	st.buf = append(st.buf, data...)
+	st.notify(st.readable)
+	return nil
+}
+
+func (st *Stream) receiveFIN() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.mu.Unlock()
+	st.notify(st.readable)
+	if done {
+		st.s.remove(st.id)
+	}
+}
+
+func (st *Stream) addSendWindow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	st.notify(st.writable)
+}
+
+// Fails pending and future reads and writes, when reset or the session is closed.
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	st.notify(st.readable)
+	st.notify(st.writable)
+	st.s.remove(st.id)
+}
+
+func (st *Stream) notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// A deadline, which can be waited for through a channel that is closed when it expires.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer func to close it
+	}
+	d.timer = nil
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
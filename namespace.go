@@ -0,0 +1,49 @@
+package rdv
+
+import (
+	"context"
+	"net/http"
+)
+
+// Settings of a namespace, see ServerConfig.Namespaces.
+type NamespaceConfig struct {
+	// Max number of clients waiting in the lobby of the namespace. Additional clients are
+	// rejected like with ServerConfig.MaxLobbySize. Zero means no limit.
+	MaxLobby int
+
+	// Overrides ServerConfig.ServeFunc for the namespace, if non-nil.
+	ServeFunc func(ctx context.Context, dc, ac *Conn)
+}
+
+// Returns the Rdv-Namespace request header (or query param, for browsers), which clients set from
+// ClientConfig.Namespace.
+func DefaultNamespace(req *http.Request) (string, error) {
+	return rdvParam(req, hNamespace), nil
+}
+
+// Sets the namespace of a new client, and authenticates it with its ticket, AuthFunc and the join
+// funcs of middleware.
+func (l *Server) checkClient(req *http.Request, meta *Meta) (err error) {
+	if meta.Namespace, err = l.cfg.NamespaceFunc(req); err != nil {
+		return err
+	}
+	meta.resumed = l.resumedSession(req, meta)
+	if l.cfg.RequireTickets != nil && !meta.control {
+		if err := l.checkTicket(meta, meta.resumed != ""); err != nil {
+			return err
+		}
+	}
+	if l.cfg.AuthFunc != nil {
+		if err := l.cfg.AuthFunc(req, meta); err != nil {
+			return err
+		}
+	}
+	return checkJoinFuncs(req.Context(), meta)
+}
+
+func (l *Server) serveFunc(namespace string) func(ctx context.Context, dc, ac *Conn) {
+	if fn := l.cfg.Namespaces[namespace].ServeFunc; fn != nil {
+		return fn
+	}
+	return l.cfg.ServeFunc
+}
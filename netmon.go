@@ -0,0 +1,142 @@
+package rdv
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// Delay before the interface addrs are compared after a change notification, since an
+	// interface typically changes several times when it comes up
+	netmonDebounce = 500 * time.Millisecond
+
+	// Interval of polling the interface addrs, where the OS doesn't notify about changes
+	netmonPollInterval = 5 * time.Second
+)
+
+// Network monitor of a client, which notifies subscribers when the interface addrs change, e.g.
+// when switching between Wi-Fi and cellular. The OS is watched while there are subscribers that
+// asked for it: netlink on Linux and route sockets on BSDs and macOS. Other systems are polled.
+type netmon struct {
+	log *slog.Logger
+
+	mu       sync.Mutex
+	subs     map[chan struct{}]bool // value is whether the subscriber watches the OS
+	watchers int
+	stop     context.CancelFunc
+}
+
+// Returns a channel that receives (coalesced) network changes, and a func to unsubscribe.
+// If watch is set, the OS is watched for changes, otherwise changes must be reported to notify.
+func (m *netmon) subscribe(watch bool) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subs == nil {
+		m.subs = make(map[chan struct{}]bool)
+	}
+	m.subs[ch] = watch
+	if watch {
+		if m.watchers++; m.watchers == 1 {
+			var ctx context.Context
+			ctx, m.stop = context.WithCancel(context.Background())
+			go m.run(ctx)
+		}
+	}
+	return ch, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.subs[ch]; !ok {
+			return
+		}
+		delete(m.subs, ch)
+		if watch {
+			if m.watchers--; m.watchers == 0 {
+				m.stop()
+			}
+		}
+	}
+}
+
+// Notifies all subscribers of a network change.
+func (m *netmon) notify() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ch := range m.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Watches the OS until canceled, and notifies when the interface addrs have changed.
+func (m *netmon) run(ctx context.Context) {
+	events := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		if err := watchInterfaces(ctx, changed); err != nil && ctx.Err() == nil {
+			m.log.Debug("rdv: can't watch interfaces, polling instead", "err", err)
+			pollInterfaces(ctx, changed)
+		}
+	}()
+	prev := interfaceAddrs()
+	for {
+		select {
+		case <-events:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-time.After(netmonDebounce):
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-events: // part of the same change
+		default:
+		}
+		if addrs := interfaceAddrs(); !slices.Equal(addrs, prev) {
+			m.log.Debug("rdv: interface addrs changed", "addrs", addrs)
+			prev = addrs
+			m.notify()
+		}
+	}
+}
+
+// Calls changed periodically until canceled, for systems without change notifications.
+func pollInterfaces(ctx context.Context, changed func()) {
+	ticker := time.NewTicker(netmonPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			changed()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Returns the sorted addrs of all interfaces, or nil if they can't be listed.
+func interfaceAddrs() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	slices.Sort(strs)
+	return strs
+}
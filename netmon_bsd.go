@@ -0,0 +1,46 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package rdv
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Calls changed when the route socket reports interface or addr changes, until canceled.
+func watchInterfaces(ctx context.Context, changed func()) error {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	unix.CloseOnExec(fd)
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	// Non-blocking, so that reads use the runtime poller and are interrupted by Close
+	f := os.NewFile(uintptr(fd), "route")
+	stop := context.AfterFunc(ctx, func() { f.Close() })
+	defer stop()
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := f.Read(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n < 4 {
+			continue
+		}
+		// Each read returns one message, with the type after the length and version
+		switch buf[3] {
+		case unix.RTM_IFINFO, unix.RTM_NEWADDR, unix.RTM_DELADDR:
+			changed()
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package rdv
+
+import (
+	"context"
+	"errors"
+)
+
+func watchInterfaces(ctx context.Context, changed func()) error {
+	return errors.ErrUnsupported
+}
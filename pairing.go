@@ -0,0 +1,62 @@
+package rdv
+
+import (
+	"net/netip"
+)
+
+// A condition for dialing a peer addr, see PairingMatrix.
+type PairCondition uint8
+
+const (
+	// Always dial the addr.
+	PairAlways PairCondition = iota
+
+	// Dial if both peers have the same observed IP, i.e. they're likely behind the same NAT or
+	// on the same host, or if the observed IP is unknown.
+	PairSameObservedIP
+
+	// Dial if a self addr is in the same space, e.g. if both peers have public ipv6 addrs, or
+	// link-local addrs on the same link.
+	PairSameSpace
+
+	// Never dial the addr.
+	PairNever
+)
+
+// Conditions for dialing peer addrs, by the addr space of the peer addr. Candidates that are
+// hopeless, such as private addrs of a peer behind another NAT, are skipped before dialing, which
+// saves latency and SYN noise on the network. Spaces without an entry are always dialed.
+// See ClientConfig.Pairing.
+type PairingMatrix map[AddrSpace]PairCondition
+
+// The default pairing. Don't modify it, but use maps.Clone to customize, e.g. to dial private
+// addrs of peers in a network with multiple public IPs.
+var DefaultPairing = PairingMatrix{
+	SpacePublic4:  PairAlways,
+	SpacePublic6:  PairSameSpace,
+	SpacePrivate4: PairSameObservedIP,
+	SpacePrivate6: PairSameObservedIP,
+	SpaceLink4:    PairSameSpace,
+	SpaceLink6:    PairSameSpace,
+	SpaceLoopback: PairSameObservedIP,
+	SpaceCGNAT:    PairSameSpace,
+}
+
+// Returns true if the peer addr should be dialed, given the meta of the attempt.
+func (m PairingMatrix) Dialable(meta *Meta, addr netip.AddrPort) bool {
+	space := GetAddrSpace(addr.Addr())
+	switch m[space] {
+	case PairSameObservedIP:
+		return meta.ObservedAddr == nil || meta.Hints.Has(HintSameObservedIP)
+	case PairSameSpace:
+		for _, self := range meta.SelfAddrs {
+			if GetAddrSpace(self.Addr()) == space {
+				return true
+			}
+		}
+		return false
+	case PairNever:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package rdv
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Default size of the copy buffers of relays, same as io.Copy
+const relayBufSize = 32 << 10
+
+// Pools of relay copy buffers by size, which are shared by all relayers, see Relayer.BufferSize
+var relayBufPools sync.Map
+
+// Returns the pool of copy buffers of the size, or of the default size if not positive.
+func relayBufPool(size int) *sync.Pool {
+	if size <= 0 {
+		size = relayBufSize
+	}
+	if pool, ok := relayBufPools.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := relayBufPools.LoadOrStore(size, &sync.Pool{New: func() any {
+		buf := make([]byte, size)
+		return &buf
+	}})
+	return pool.(*sync.Pool)
+}
+
+// Parks idle relay directions, see Relayer.ParkAfter. Parking uses read deadlines, so the parker
+// also guards them, to ensure that parking can't undo a timeout of the relay. A nil parker
+// doesn't park.
+type parker struct {
+	after time.Duration
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (r *Relayer) newParker() *parker {
+	if r.ParkAfter <= 0 {
+		return nil
+	}
+	return &parker{after: r.ParkAfter}
+}
+
+// Prevents further changes to read deadlines, before the relay times out.
+func (p *parker) stop() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+}
+
+func (p *parker) isStopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopped
+}
+
+// Sets the read deadline unless stopped, and returns false if stopped.
+func (p *parker) setReadDeadline(c *Conn, t time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped {
+		c.SetReadDeadline(t)
+	}
+	return !p.stopped
+}
+
+// Like RelayCopy with a buffer from the pool, but parks once the source has been idle for a while:
+// the copy buffer is returned to the pool, and a single byte is read until the source becomes
+// active again.
+func (p *parker) copy(pool *sync.Pool, to io.Writer, from *Conn, taps ...io.Writer) (n int64, err error) {
+	if p == nil {
+		return relayCopy(pool, to, from, taps...)
+	}
+	w := io.MultiWriter(append(taps[:len(taps):len(taps)], to)...)
+	small := make([]byte, 1)
+	buf := pool.Get().(*[]byte)
+	defer func() {
+		if buf != nil {
+			pool.Put(buf)
+		}
+	}()
+	for {
+		b, deadline := small, time.Time{}
+		if buf != nil {
+			b, deadline = *buf, time.Now().Add(p.after)
+		}
+		if !p.setReadDeadline(from, deadline) {
+			return n, os.ErrDeadlineExceeded
+		}
+		nr, rerr := from.Read(b)
+		if nr > 0 {
+			nw, werr := w.Write(b[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		switch {
+		case rerr == nil && buf == nil: // resume
+			buf = pool.Get().(*[]byte)
+		case errors.Is(rerr, os.ErrDeadlineExceeded) && buf != nil && !p.isStopped(): // park
+			pool.Put(buf)
+			buf = nil
+		case rerr != nil:
+			return n, rerr
+		}
+	}
+}
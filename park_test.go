@@ -0,0 +1,68 @@
+package rdv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Records the size of the buffer of each read.
+type readSizes struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (r *readSizes) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.r.Read(p)
+}
+
+func TestParkAfter(t *testing.T) {
+	nc, client := tcpPair(t)
+	reads := &readSizes{r: nc}
+	from := newRelayConn(nc, reads, newMeta(true, "", "token"), nil)
+	p := (&Relayer{ParkAfter: 20 * time.Millisecond}).newParker()
+
+	var (
+		to   bytes.Buffer
+		n    int64
+		err  error
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		n, err = p.copy(relayBufPool(0), &to, from)
+	}()
+	io.WriteString(client, "before")
+	time.Sleep(100 * time.Millisecond) // parked
+	io.WriteString(client, "after")
+	client.Close()
+	<-done
+
+	if !errors.Is(err, io.EOF) || n != 11 || to.String() != "beforeafter" {
+		t.Fatalf("expected beforeafter, got %q, %v, %v", to.String(), n, err)
+	}
+	// Parked reads are of a single byte, and the buffer is used again once resumed
+	i := slices.Index(reads.sizes, 1)
+	if i < 0 || i+1 == len(reads.sizes) || reads.sizes[i+1] != relayBufSize {
+		t.Fatalf("expected a parked read followed by a buffered read, got %v", reads.sizes)
+	}
+}
+
+// A relay whose directions are parked keeps relaying in both directions.
+func TestParkedRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := &Relayer{ParkAfter: 20 * time.Millisecond}
+	_, hs := startServer(t, &ServerConfig{ServeFunc: func(ctx context.Context, dc, ac *Conn) { r.Run(ctx, dc, ac) }})
+	dc, ac := relayPair(t, ctx, NewClient(&ClientConfig{AddrSpaces: NoSpaces}), hs.URL, "token")
+	for _, msg := range []string{"before", "after", "again"} {
+		exchange(t, dc, ac, msg)
+		exchange(t, ac, dc, msg)
+		time.Sleep(100 * time.Millisecond) // parked
+	}
+}
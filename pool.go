@@ -0,0 +1,232 @@
+package rdv
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Caches established conns per peer key, for apps that make many short exchanges with the same
+// peers. Get hands out an idle conn to one caller at a time, after checking its health, and
+// establishes a new conn if there is none or if the check fails. Callers return conns with Put
+// when done, or close them if the exchange failed. The zero value is not usable, Dial must be set.
+type Pool struct {
+	// Establishes a conn to the peer with the given key, e.g. with Client.Dial on a token that is
+	// derived from the key. Required.
+	Dial func(ctx context.Context, key string) (*Conn, error)
+
+	// Checks that an idle conn is healthy before it's handed out, and periodically while it's
+	// idle. Apps with their own ping message should use it here, since the default only detects
+	// conns that are closed by the peer or reset, and not peers that are silently gone. The default
+	// doesn't check conns that frame their data, e.g. with Secure, TLS or WebSocket.
+	Ping func(ctx context.Context, conn *Conn) error
+
+	// Max number of idle conns per key. Defaults to 2.
+	MaxIdle int
+
+	// Idle conns are closed after this long. Defaults to 90s.
+	IdleTimeout time.Duration
+
+	// Interval of health checks of idle conns. Defaults to 30s. Negative means no periodic checks.
+	CheckInterval time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]pooledConn
+	cancel context.CancelFunc // cancels the checker and its pings, nil until it starts
+	closed bool
+}
+
+// Timeout of each periodic health check of an idle conn
+const poolPingTimeout = 10 * time.Second
+
+type pooledConn struct {
+	conn *Conn
+	at   time.Time // when the conn was returned
+}
+
+// Returns a healthy conn to the peer with the given key, either an idle one or a new one.
+func (p *Pool) Get(ctx context.Context, key string) (*Conn, error) {
+	for {
+		pc, ok, err := p.takeIdle(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if err := p.ping(ctx, pc.conn); err == nil {
+			return pc.conn, nil
+		}
+		pc.conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return p.Dial(ctx, key)
+}
+
+// Returns a conn to the pool for reuse, after the caller is done with it. The conn is closed if
+// the pool is closed or has enough idle conns for the key. Conns that aren't in a clean state,
+// e.g. after a failed exchange, should be closed instead.
+func (p *Pool) Put(key string, conn *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle[key]) >= cmp.Or(p.MaxIdle, 2) {
+		conn.Close()
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]pooledConn)
+	}
+	p.idle[key] = append(p.idle[key], pooledConn{conn, time.Now()})
+	if p.cancel == nil {
+		var ctx context.Context
+		ctx, p.cancel = context.WithCancel(context.Background())
+		if interval := cmp.Or(p.CheckInterval, 30*time.Second); interval > 0 {
+			go p.check(ctx, interval)
+		}
+	}
+}
+
+// Closes all idle conns. Conns that are in use are closed when they're returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.cancel != nil {
+		p.cancel()
+	}
+	for _, pcs := range p.idle {
+		for _, pc := range pcs {
+			pc.conn.Close()
+		}
+	}
+	p.idle = nil
+	return nil
+}
+
+// Takes the most recently returned idle conn of the key, which is closed if it has been idle for
+// too long.
+func (p *Pool) takeIdle(key string) (pc pooledConn, ok bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return pc, false, ErrPoolClosed
+	}
+	for pcs := p.idle[key]; len(pcs) > 0; pcs = p.idle[key] {
+		pc = pcs[len(pcs)-1]
+		p.setIdle(key, pcs[:len(pcs)-1])
+		if time.Since(pc.at) < cmp.Or(p.IdleTimeout, 90*time.Second) {
+			return pc, true, nil
+		}
+		pc.conn.Close()
+	}
+	return pc, false, nil
+}
+
+func (p *Pool) setIdle(key string, pcs []pooledConn) {
+	if len(pcs) == 0 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = pcs
+	}
+}
+
+// Periodically closes idle conns which have timed out or fail the health check.
+func (p *Pool) check(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		p.mu.Lock()
+		keys := make([]string, 0, len(p.idle))
+		for key := range p.idle {
+			keys = append(keys, key)
+		}
+		p.mu.Unlock()
+		for _, key := range keys {
+			p.checkKey(ctx, key)
+		}
+	}
+}
+
+// Checks the idle conns of a key. They're taken out of the pool during the check, so that they
+// aren't handed out concurrently.
+func (p *Pool) checkKey(ctx context.Context, key string) {
+	var healthy []pooledConn
+	for {
+		pc, ok, err := p.takeIdle(key)
+		if err != nil || !ok {
+			break
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, poolPingTimeout)
+		err = p.ping(pingCtx, pc.conn)
+		cancel()
+		if err != nil {
+			pc.conn.Close()
+			continue
+		}
+		healthy = append(healthy, pc)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range healthy {
+		if p.closed || len(p.idle[key]) >= cmp.Or(p.MaxIdle, 2) {
+			pc.conn.Close()
+			continue
+		}
+		p.idle[key] = append(p.idle[key], pc) // keeps the return time, for the idle timeout
+	}
+}
+
+func (p *Pool) ping(ctx context.Context, conn *Conn) error {
+	if p.Ping != nil {
+		return p.Ping(ctx, conn)
+	}
+	if framed(conn) {
+		return nil
+	}
+	return checkOpen(conn)
+}
+
+// Whether the conn frames its data, so that a read that times out within a frame may leave it in
+// a bad state, which rules out checkOpen.
+func framed(c *Conn) bool {
+	switch c.Conn.(type) {
+	case *secureConn, *tls.Conn, *wsConn:
+		return true
+	}
+	return false
+}
+
+// Returns an error if the peer closed or reset the conn, by reading with a short deadline. Data
+// that was read is kept, and returned by the next read.
+func checkOpen(c *Conn) error {
+	if len(c.early) > 0 {
+		return nil
+	}
+	var b [1]byte
+	c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := c.Read(b[:])
+	c.SetReadDeadline(time.Time{})
+	if n > 0 {
+		c.early = append(c.early, b[:n]...)
+		c.read.Add(-int64(n)) // counted again when read
+		return nil
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package rdv
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A pool whose Dial returns one end of a pipe, and keeps the other ends by key.
+type pipePool struct {
+	Pool
+	mu    sync.Mutex
+	peers map[string][]net.Conn
+}
+
+func newPipePool(t *testing.T) *pipePool {
+	p := &pipePool{peers: make(map[string][]net.Conn)}
+	p.Dial = func(ctx context.Context, key string) (*Conn, error) {
+		a, b := net.Pipe()
+		p.mu.Lock()
+		p.peers[key] = append(p.peers[key], b)
+		p.mu.Unlock()
+		return newDirectConn(a, false, newMeta(true, "", key), nil), nil
+	}
+	t.Cleanup(func() {
+		p.Close()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, ncs := range p.peers {
+			for _, nc := range ncs {
+				nc.Close()
+			}
+		}
+	})
+	return p
+}
+
+func (p *pipePool) dials(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.peers[key])
+}
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	p := newPipePool(t)
+	conn, err := p.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put("a", conn)
+	if reused, _ := p.Get(ctx, "a"); reused != conn || p.dials("a") != 1 {
+		t.Fatalf("expected the idle conn to be reused, got %d dials", p.dials("a"))
+	}
+
+	// Conns that the peer closed fail the check
+	p.Put("a", conn)
+	p.peers["a"][0].Close()
+	if fresh, _ := p.Get(ctx, "a"); fresh == conn || p.dials("a") != 2 {
+		t.Fatalf("expected a new conn, got %d dials", p.dials("a"))
+	}
+
+	p.Close()
+	if _, err := p.Get(ctx, "a"); err != ErrPoolClosed {
+		t.Fatalf("expected %v, got %v", ErrPoolClosed, err)
+	}
+}
+
+func TestPoolCloseCancelsPing(t *testing.T) {
+	p := newPipePool(t)
+	p.CheckInterval = time.Millisecond
+	pinging := make(chan struct{})
+	p.Ping = func(ctx context.Context, conn *Conn) error {
+		close(pinging)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	conn, _ := p.Dial(context.Background(), "a")
+	p.Put("a", conn)
+	<-pinging
+	p.Close()
+	if _, err := conn.Write(nil); err == nil {
+		t.Fatal("expected the pinged conn to be closed")
+	}
+}
+
+func TestPoolFramed(t *testing.T) {
+	tests := map[string]struct {
+		conn   func(nc net.Conn) net.Conn
+		framed bool
+	}{
+		"plain":     {conn: func(nc net.Conn) net.Conn { return nc }},
+		"secure":    {conn: func(nc net.Conn) net.Conn { return &secureConn{Conn: nc} }, framed: true},
+		"websocket": {conn: func(nc net.Conn) net.Conn { return newWSConn(nc, nil, true) }, framed: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			conn := newDirectConn(tc.conn(a), false, newMeta(true, "", "token"), nil)
+			if framed(conn) != tc.framed {
+				t.Fatalf("expected framed %v", tc.framed)
+			}
+			// A check of a framed conn must not read from it
+			var p Pool
+			go b.Write([]byte{1})
+			if err := p.ping(context.Background(), conn); err != nil {
+				t.Fatal(err)
+			}
+			if tc.framed && len(conn.early) > 0 {
+				t.Fatal("expected no read")
+			}
+		})
+	}
+}
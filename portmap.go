@@ -0,0 +1,405 @@
+package rdv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Lifetime of port mappings. They are not removed, so they should expire eventually.
+	portMapLifetime = time.Hour
+
+	// Port of NAT-PMP and PCP servers
+	natPMPPort = 5351
+
+	ssdpAddr = "239.255.255.250:1900"
+)
+
+var errNoPortMap = errors.New("no port mapping available")
+
+// Returns a SelfAddrFunc which maps the socket port on the gateway, using PCP, NAT-PMP or UPnP IGD,
+// and adds the resulting external addr to the default self addrs. This allows direct connections
+// to peers behind NATs which support port mapping. Waits at most timeout for the gateway, which
+// is added to the connection time. Mappings are not removed, but expire after an hour.
+func PortMapSelfAddrs(timeout time.Duration) func(ctx context.Context, socket *Socket) []netip.AddrPort {
+	return func(ctx context.Context, socket *Socket) []netip.AddrPort {
+		addrs := DefaultSelfAddrs(ctx, socket)
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		mapped, err := mapPort(ctx, socket.Port)
+		if err != nil {
+			return addrs
+		}
+		// The mapped addr is the most useful, so it's first in case there are too many
+		addrs = append([]netip.AddrPort{mapped}, addrs...)
+		return addrs[:min(len(addrs), maxAddrs-1)]
+	}
+}
+
+// Maps the TCP port with all protocols concurrently, and returns the first external addr.
+func mapPort(ctx context.Context, port uint16) (netip.AddrPort, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		addr netip.AddrPort
+		err  error
+	}
+	var (
+		fns = []func(context.Context, netip.Addr, uint16) (netip.AddrPort, error){mapPCP, mapNATPMP}
+		ch  = make(chan result)
+		n   int
+	)
+	for _, gw := range gateways() {
+		for _, fn := range fns {
+			n++
+			go func() {
+				addr, err := fn(ctx, gw, port)
+				ch <- result{addr, err}
+			}()
+		}
+	}
+	n++
+	go func() {
+		addr, err := mapUPnP(ctx, port)
+		ch <- result{addr, err}
+	}()
+	err := errNoPortMap
+	for i := range n {
+		r := <-ch
+		if r.err == nil && r.addr.Addr().IsValid() && !r.addr.Addr().IsUnspecified() {
+			cancel()
+			go func() { // drain the pending results, so that their goroutines end
+				for range n - i - 1 {
+					<-ch
+				}
+			}()
+			return r.addr, nil
+		}
+		err = errors.Join(err, r.err)
+	}
+	return netip.AddrPort{}, err
+}
+
+// Returns candidate ipv4 gateways: the default gateway if known, otherwise the first addr of
+// each private subnet (which is a common convention).
+func gateways() (gws []netip.Addr) {
+	if gw, ok := defaultGateway(); ok {
+		return []netip.Addr{gw}
+	}
+	netAddrs, _ := net.InterfaceAddrs()
+	for _, netAddr := range netAddrs {
+		prefix, err := netip.ParsePrefix(netAddr.String())
+		if err != nil || !prefix.Addr().Is4() || GetAddrSpace(prefix.Addr()) != SpacePrivate4 {
+			continue
+		}
+		gws = append(gws, prefix.Masked().Addr().Next())
+	}
+	return
+}
+
+// Reads the default ipv4 gateway from the routing table, on Linux.
+func defaultGateway() (netip.Addr, bool) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		// Little endian
+		gw := netip.AddrFrom4([4]byte{b[3], b[2], b[1], b[0]})
+		if gw.IsUnspecified() {
+			continue
+		}
+		return gw, true
+	}
+	return netip.Addr{}, false
+}
+
+// Sends the request to the gateway and returns the first valid response, with retries.
+func udpRequest(ctx context.Context, gw netip.Addr, req []byte, valid func(resp []byte) bool) ([]byte, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "udp4", netip.AddrPortFrom(gw, natPMPPort).String())
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+	stop := context.AfterFunc(ctx, func() { nc.SetDeadline(past()) })
+	defer stop()
+
+	buf := make([]byte, 1100)
+	for wait := 250 * time.Millisecond; ; wait *= 2 {
+		if _, err := nc.Write(req); err != nil {
+			return nil, err
+		}
+		nc.SetReadDeadline(time.Now().Add(wait))
+		for {
+			n, err := nc.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break // retry
+				}
+				return nil, err
+			}
+			if valid(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+	}
+}
+
+// Maps the port with NAT-PMP (RFC 6886).
+func mapNATPMP(ctx context.Context, gw netip.Addr, port uint16) (netip.AddrPort, error) {
+	// External address request
+	resp, err := udpRequest(ctx, gw, []byte{0, 0}, func(resp []byte) bool {
+		return len(resp) >= 12 && resp[0] == 0 && resp[1] == 128
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return netip.AddrPort{}, fmt.Errorf("nat-pmp: result code %d", code)
+	}
+	ip := netip.AddrFrom4([4]byte(resp[8:12]))
+
+	// TCP mapping request
+	req := make([]byte, 12)
+	req[1] = 2
+	binary.BigEndian.PutUint16(req[4:6], port)
+	binary.BigEndian.PutUint16(req[6:8], port)
+	binary.BigEndian.PutUint32(req[8:12], uint32(portMapLifetime.Seconds()))
+	resp, err = udpRequest(ctx, gw, req, func(resp []byte) bool {
+		return len(resp) >= 16 && resp[0] == 0 && resp[1] == 130 && binary.BigEndian.Uint16(resp[8:10]) == port
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return netip.AddrPort{}, fmt.Errorf("nat-pmp: result code %d", code)
+	}
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(resp[10:12])), nil
+}
+
+// Maps the port with a PCP MAP request (RFC 6887).
+func mapPCP(ctx context.Context, gw netip.Addr, port uint16) (netip.AddrPort, error) {
+	// The client ip is needed in the request, so find it first
+	var d net.Dialer
+	probe, err := d.DialContext(ctx, "udp4", netip.AddrPortFrom(gw, natPMPPort).String())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	local, _ := FromNetAddr(probe.LocalAddr())
+	probe.Close()
+
+	var nonce [12]byte
+	rand.Read(nonce[:])
+	req := make([]byte, 60)
+	req[0] = 2 // version
+	req[1] = 1 // MAP
+	binary.BigEndian.PutUint32(req[4:8], uint32(portMapLifetime.Seconds()))
+	clientIP := netip.AddrFrom16(local.Addr().As16()).As16()
+	copy(req[8:24], clientIP[:])
+	copy(req[24:36], nonce[:])
+	req[36] = 6 // TCP
+	binary.BigEndian.PutUint16(req[40:42], port)
+	binary.BigEndian.PutUint16(req[42:44], port)
+	anyIP := netip.AddrFrom16(netip.IPv4Unspecified().As16()).As16()
+	copy(req[44:60], anyIP[:])
+
+	resp, err := udpRequest(ctx, gw, req, func(resp []byte) bool {
+		return len(resp) >= 60 && resp[0] == 2 && resp[1] == 0x81 && bytes.Equal(resp[24:36], nonce[:])
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if code := resp[3]; code != 0 {
+		return netip.AddrPort{}, fmt.Errorf("pcp: result code %d", code)
+	}
+	ip := netip.AddrFrom16([16]byte(resp[44:60])).Unmap()
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(resp[42:44])), nil
+}
+
+// Maps the port with UPnP IGD, using the first gateway that responds to discovery.
+func mapUPnP(ctx context.Context, port uint16) (netip.AddrPort, error) {
+	location, err := discoverIGD(ctx)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	controlURL, service, err := igdService(ctx, location)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	// The internal client is our ip as seen from the gateway
+	var d net.Dialer
+	probe, err := d.DialContext(ctx, "udp4", net.JoinHostPort(controlURL.Hostname(), urlPort(controlURL)))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	local, _ := FromNetAddr(probe.LocalAddr())
+	probe.Close()
+
+	args := fmt.Sprintf("<NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort>"+
+		"<NewProtocol>TCP</NewProtocol><NewInternalPort>%d</NewInternalPort>"+
+		"<NewInternalClient>%s</NewInternalClient><NewEnabled>1</NewEnabled>"+
+		"<NewPortMappingDescription>rdv</NewPortMappingDescription><NewLeaseDuration>%d</NewLeaseDuration>",
+		port, port, local.Addr(), int(portMapLifetime.Seconds()))
+	if _, err := soapCall(ctx, controlURL, service, "AddPortMapping", args); err != nil {
+		return netip.AddrPort{}, err
+	}
+	body, err := soapCall(ctx, controlURL, service, "GetExternalIPAddress", "")
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var env struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(body, &env); err != nil {
+		return netip.AddrPort{}, err
+	}
+	ip, err := netip.ParseAddr(strings.TrimSpace(env.IP))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("upnp: bad external ip %q", env.IP)
+	}
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+// Returns the location of the first internet gateway device that responds to SSDP discovery.
+func discoverIGD(ctx context.Context) (*url.URL, error) {
+	var lc net.ListenConfig
+	pc, err := lc.ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	stop := context.AfterFunc(ctx, func() { pc.SetDeadline(past()) })
+	defer stop()
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: " + ssdpAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+	if _, err := pc.WriteTo([]byte(search), dst); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+		if location, err := url.Parse(resp.Header.Get("Location")); err == nil && location.Scheme == "http" {
+			return location, nil
+		}
+	}
+}
+
+type igdDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []igdDevice `xml:"deviceList>device"`
+}
+
+// Fetches the device description, and returns the control URL and type of the WAN connection
+// service.
+func igdService(ctx context.Context, location *url.URL) (*url.URL, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var root struct {
+		URLBase string    `xml:"URLBase"`
+		Device  igdDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, "", err
+	}
+	base := location
+	if root.URLBase != "" {
+		if u, err := url.Parse(root.URLBase); err == nil {
+			base = u
+		}
+	}
+	devices := []igdDevice{root.Device}
+	for len(devices) > 0 {
+		dev := devices[0]
+		devices = append(devices[1:], dev.Devices...)
+		for _, svc := range dev.Services {
+			if strings.Contains(svc.ServiceType, ":WANIPConnection:") || strings.Contains(svc.ServiceType, ":WANPPPConnection:") {
+				controlURL, err := base.Parse(svc.ControlURL)
+				if err != nil {
+					return nil, "", err
+				}
+				return controlURL, svc.ServiceType, nil
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("upnp: no wan connection service at %s", location)
+}
+
+// Invokes a SOAP action and returns the response body.
+func soapCall(ctx context.Context, controlURL *url.URL, service, action, args string) ([]byte, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + service + `">` + args + `</u:` + action + `></s:Body></s:Envelope>`
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controlURL.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+service+"#"+action+`"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp: %s failed with %s", action, resp.Status)
+	}
+	return b, nil
+}
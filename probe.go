@@ -0,0 +1,33 @@
+package rdv
+
+import (
+	"context"
+	"net/http"
+)
+
+// Exchanges candidates through the rdv server with a peer that also calls Probe with the same
+// token, without connecting. Returns the meta of the exchange, with the self addrs, the peer's
+// addrs and echo headers, and the server's observations (ObservedAddr and Hints). Useful for
+// support tooling, e.g. to diagnose the connectivity of two users before a real attempt. Like
+// Connect, the roles are assigned by the server.
+func (c *Client) Probe(ctx context.Context, addr string, token string, reqHeader http.Header) (*Meta, *http.Response, error) {
+	sig := c.httpSignaler(addr, reqHeader)
+	meta := newMeta(false, addr, token)
+	meta.Symmetric = true
+	c.prepare(meta)
+	socket, err := NewSocket(ctx, 0, c.cfg.TlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer socket.Close()
+	c.setSelfAddrs(ctx, socket, meta)
+	relay, _, err := c.signal(ctx, sig, socket, meta)
+	if err != nil {
+		return nil, sig.Response, err
+	}
+	if relay != nil {
+		relay.Close() // the server drops the relay when the rdv header doesn't arrive
+	}
+	meta.History = c.history.lookup(meta)
+	return meta, sig.Response, nil
+}
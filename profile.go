@@ -0,0 +1,74 @@
+package rdv
+
+import "time"
+
+// Profiles are configs with sensible settings for common deployments. Each call returns a new
+// config, whose fields can be overridden before it's passed to NewClient or NewServer. Unset
+// fields use the defaults.
+
+// Client profile for peers on the same local network, e.g. in a home or office. Only local addr
+// spaces and public ipv6 are used, since hosts on a LAN often only have public ipv6 addrs. They're
+// dialed at once without hole punching, and direct conns are given more time before the relay is
+// chosen, since they're expected to succeed.
+func ProfileLAN() *ClientConfig {
+	return &ClientConfig{
+		AddrSpaces:            SpacePrivate4 | SpacePrivate6 | SpacePublic6 | SpaceLink4,
+		DialChooser:           RelayPenalty(2 * time.Second),
+		DialAttempts:          2,
+		DialStagger:           -1,
+		MaxPunchWindow:        10 * time.Second,
+		ServerResponseTimeout: 5 * time.Second,
+		HandshakeTimeout:      5 * time.Second,
+	}
+}
+
+// Client profile for peers on different networks, usually behind NATs. Uses the default spaces
+// and hole punching, detects unresponsive servers and retries transient signaling failures.
+func ProfileInternet() *ClientConfig {
+	return &ClientConfig{
+		DialChooser:           RelayPenalty(time.Second),
+		ServerResponseTimeout: 10 * time.Second,
+		Retry:                 &RetryConfig{},
+	}
+}
+
+// Client profile for mobile devices, whose networks change and whose carrier NATs rarely allow
+// hole punching. The relay is chosen sooner, the server is reached over either ipv4 or ipv6,
+// listeners follow network changes, and signaling and resumable conns are more persistent.
+func ProfileMobile() *ClientConfig {
+	return &ClientConfig{
+		DialChooser:           RelayPenalty(500 * time.Millisecond),
+		ServerNetwork:         "tcp",
+		MaxPunchWindow:        10 * time.Second,
+		ServerResponseTimeout: 15 * time.Second,
+		HandshakeTimeout:      20 * time.Second,
+		Retry:                 &RetryConfig{MaxAttempts: 8},
+		WatchNetwork:          true,
+		ResumeTimeout:         2 * time.Minute,
+	}
+}
+
+// Server profile for a small relay server, e.g. for a single app or team. The lobby and the
+// number of clients per IP are bounded, and shutdowns let relays finish briefly.
+func ProfileRelayServerSmall() *ServerConfig {
+	return &ServerConfig{
+		LobbyTimeout:        5 * time.Minute,
+		MaxLobbySize:        1000,
+		MaxConnsPerIP:       10,
+		ShutdownTimeout:     10 * time.Second,
+		ShutdownGracePeriod: 5 * time.Second,
+	}
+}
+
+// Server profile for a large relay server with many users, possibly behind NATs of their own, and
+// longer shutdowns for rolling deploys.
+func ProfileRelayServerLarge() *ServerConfig {
+	return &ServerConfig{
+		LobbyTimeout:        10 * time.Minute,
+		MaxLobbySize:        100_000,
+		MaxConnsPerIP:       50,
+		ShutdownTimeout:     time.Minute,
+		ShutdownGracePeriod: 15 * time.Second,
+		HeaderTimeout:       5 * time.Second,
+	}
+}
@@ -0,0 +1,88 @@
+package rdv
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracks relayed bytes per direction and reports progress. A nil progress ignores all calls.
+type progress struct {
+	fn     func(dn, an int64)
+	every  int64
+	dn, an atomic.Int64
+
+	mu   sync.Mutex   // serializes reports
+	last atomic.Int64 // total bytes at the last report
+
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+func (r *Relayer) newProgress() *progress {
+	if r.Progress == nil {
+		return nil
+	}
+	p := &progress{fn: r.Progress, every: r.ProgressBytes, done: make(chan struct{})}
+	if r.ProgressInterval > 0 {
+		p.ticker = time.NewTicker(r.ProgressInterval)
+		go func() {
+			for {
+				select {
+				case <-p.ticker.C:
+					p.report()
+				case <-p.done:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// Returns a tap which counts bytes for the direction
+func (p *progress) tap(fromDialer bool) io.Writer {
+	if p == nil {
+		return noopTap{}
+	}
+	return &progressTap{p, fromDialer}
+}
+
+func (p *progress) report() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dn, an := p.dn.Load(), p.an.Load()
+	p.last.Store(dn + an)
+	p.fn(dn, an)
+}
+
+// Stops the ticker and reports a final time
+func (p *progress) stop() {
+	if p == nil {
+		return
+	}
+	if p.ticker != nil {
+		p.ticker.Stop()
+		close(p.done)
+	}
+	p.report()
+}
+
+type progressTap struct {
+	p          *progress
+	fromDialer bool
+}
+
+func (t *progressTap) Write(b []byte) (int, error) {
+	p, n := t.p, int64(len(b))
+	if t.fromDialer {
+		p.dn.Add(n)
+	} else {
+		p.an.Add(n)
+	}
+	if p.every > 0 && p.dn.Load()+p.an.Load()-p.last.Load() >= p.every {
+		p.report()
+	}
+	return len(b), nil
+}
@@ -0,0 +1,310 @@
+package rdv
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Max length of proxy request and reply lines
+	maxProxyLine = 1024
+
+	// Timeout for reading the proxy request of a local client, and for dialing a destination
+	proxyTimeout = 30 * time.Second
+)
+
+// Serves a local SOCKS5 and HTTP proxy on ln, which routes arbitrary applications through rdv
+// conns. Each proxied conn is tunneled through a new rdv conn to the peer with the token, which
+// must serve the other end with ServeProxyExit, typically on a Listener. HTTP clients may use
+// CONNECT, or plain requests to one host per conn. Runs until ctx is canceled, which also closes
+// ln and all proxied conns, or until ln fails.
+func (c *Client) ServeProxy(ctx context.Context, ln net.Listener, addr, token string, reqHeader http.Header) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return cmp.Or(ctx.Err(), err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop := context.AfterFunc(ctx, func() { nc.Close() })
+			defer stop()
+			if err := c.proxy(ctx, nc, addr, token, reqHeader); err != nil {
+				c.cfg.Logger.Debug("rdv proxy: failed", "token", token, "err", err)
+			}
+		}()
+	}
+}
+
+// Handles a local proxy client.
+func (c *Client) proxy(ctx context.Context, nc net.Conn, addr, token string, reqHeader http.Header) error {
+	defer nc.Close()
+	br := bufio.NewReader(nc)
+	nc.SetReadDeadline(time.Now().Add(proxyTimeout))
+	first, err := br.Peek(1)
+	if err != nil {
+		return err
+	}
+	var (
+		target string
+		reply  func(err error) error
+		req    *http.Request // plain http request, which is forwarded
+	)
+	if first[0] == socksVersion {
+		target, err = readSocksRequest(br, nc)
+		reply = func(err error) error { return writeSocksReply(nc, err) }
+	} else {
+		req, err = http.ReadRequest(br)
+		if err == nil {
+			target, reply = proxyTarget(req), func(err error) error { return writeProxyReply(nc, req, err) }
+		}
+	}
+	if err != nil {
+		return err
+	}
+	nc.SetReadDeadline(time.Time{})
+
+	conn, _, err := c.Dial(ctx, addr, token, reqHeader.Clone())
+	if err == nil {
+		defer conn.Close()
+		err = requestProxy(conn, target)
+	}
+	if replyErr := reply(err); err != nil || replyErr != nil {
+		return cmp.Or(err, replyErr)
+	}
+	if req != nil && req.Method != http.MethodConnect {
+		removeProxyHeaders(req.Header)
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+	}
+	pipe(conn, nc, br)
+	return nil
+}
+
+// Serves the exit of proxies (see Client.ServeProxy), by connecting each conn from ln to its
+// requested destination with dial, which must restrict the destinations, since the peer can
+// otherwise reach anything that this host can. Use AllowProxyTargets for a fixed set of
+// destinations. Returns an error if dial is nil. Runs until ln is closed.
+func ServeProxyExit(ln net.Listener, dial func(ctx context.Context, network, addr string) (net.Conn, error)) error {
+	if dial == nil {
+		return errors.New("rdv proxy: ServeProxyExit requires a dial func, e.g. AllowProxyTargets")
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveProxyExit(conn, dial)
+	}
+}
+
+// Returns a dial func for ServeProxyExit that only connects to the targets, as host:port like the
+// proxy clients request them (e.g. "example.com:443"), and fails with ErrProxyDenied otherwise.
+func AllowProxyTargets(targets ...string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	allowed := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		allowed[strings.ToLower(target)] = true
+	}
+	d := &net.Dialer{Timeout: proxyTimeout}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !allowed[strings.ToLower(addr)] {
+			return nil, fmt.Errorf("%w: %s", ErrProxyDenied, addr)
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+func serveProxyExit(conn net.Conn, dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(proxyTimeout))
+	line, err := readLine(conn, maxProxyLine)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	target, ok := strings.CutPrefix(line, protocolName+" PROXY ")
+	if !ok {
+		io.WriteString(conn, rdvHeader("ERR", "bad proxy request"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proxyTimeout)
+	defer cancel()
+	nc, err := dial(ctx, "tcp", target)
+	if err != nil {
+		io.WriteString(conn, rdvHeader("ERR", unwrapOp(err).Error()))
+		return
+	}
+	defer nc.Close()
+	if _, err := io.WriteString(conn, rdvHeader("OK", target)); err != nil {
+		return
+	}
+	pipe(nc, conn, conn)
+}
+
+// Sends the proxy request line and reads the reply.
+func requestProxy(conn net.Conn, target string) error {
+	if _, err := io.WriteString(conn, rdvHeader("PROXY", target)); err != nil {
+		return err
+	}
+	line, err := readLine(conn, maxProxyLine)
+	if err != nil {
+		return err
+	}
+	if msg, ok := strings.CutPrefix(line, protocolName+" ERR "); ok {
+		return fmt.Errorf("rdv proxy: peer could not connect to %s: %s", target, msg)
+	}
+	if line+"\r\n" != rdvHeader("OK", target) {
+		return fmt.Errorf("%w: unexpected proxy reply", ErrProtocol)
+	}
+	return nil
+}
+
+// Copies data both ways until either side is done. Reads from nc through r.
+func pipe(upstream net.Conn, nc net.Conn, r io.Reader) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(nc, upstream)
+		nc.SetReadDeadline(past())
+		close(done)
+	}()
+	io.Copy(upstream, r)
+	upstream.SetReadDeadline(past())
+	<-done
+}
+
+// Returns the host:port of an http proxy request.
+func proxyTarget(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return req.Host // host:port
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
+func writeProxyReply(nc net.Conn, req *http.Request, err error) error {
+	if err != nil {
+		resp := fmt.Sprintf("HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s", len(err.Error()), err)
+		_, writeErr := io.WriteString(nc, resp)
+		return writeErr
+	}
+	if req.Method != http.MethodConnect {
+		return nil // the response comes from the destination
+	}
+	_, err = io.WriteString(nc, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return err
+}
+
+func removeProxyHeaders(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(k, "Proxy-") {
+			h.Del(k)
+		}
+	}
+}
+
+// SOCKS5, see RFC 1928
+const (
+	socksVersion       = 5
+	socksNoAuth        = 0
+	socksNoAcceptable  = 0xff
+	socksConnect       = 1
+	socksAtypIPv4      = 1
+	socksAtypDomain    = 3
+	socksAtypIPv6      = 4
+	socksSucceeded     = 0
+	socksFailure       = 1
+	socksCmdNotSupport = 7
+)
+
+var errSocksCommand = errors.New("rdv proxy: only socks connect is supported")
+
+// Negotiates no authentication, and reads a connect request.
+func readSocksRequest(br *bufio.Reader, nc net.Conn) (target string, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(br, head[:]); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err = io.ReadFull(br, methods); err != nil {
+		return
+	}
+	if !strings.ContainsRune(string(methods), socksNoAuth) {
+		nc.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", fmt.Errorf("%w: socks client requires authentication", ErrProtocol)
+	}
+	if _, err = nc.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return
+	}
+	var req [4]byte // version, command, reserved, address type
+	if _, err = io.ReadFull(br, req[:]); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, 4)
+		if req[3] == socksAtypIPv6 {
+			ip = make([]byte, 16)
+		}
+		if _, err = io.ReadFull(br, ip); err != nil {
+			return
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case socksAtypDomain:
+		var n byte
+		if n, err = br.ReadByte(); err != nil {
+			return
+		}
+		name := make([]byte, n)
+		if _, err = io.ReadFull(br, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("%w: bad socks address type %d", ErrProtocol, req[3])
+	}
+	var port [2]byte
+	if _, err = io.ReadFull(br, port[:]); err != nil {
+		return
+	}
+	if req[1] != socksConnect {
+		writeSocksReply(nc, errSocksCommand)
+		return "", errSocksCommand
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func writeSocksReply(nc net.Conn, err error) error {
+	code := byte(socksSucceeded)
+	if errors.Is(err, errSocksCommand) {
+		code = socksCmdNotSupport
+	} else if err != nil {
+		code = socksFailure
+	}
+	// The bound addr is unknown, so it's zero
+	_, writeErr := nc.Write([]byte{socksVersion, code, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return writeErr
+}
@@ -0,0 +1,65 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyExit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			nc.Close()
+		}
+	}()
+	dial := AllowProxyTargets(ln.Addr().String())
+	tests := map[string]struct {
+		target string
+		denied bool
+	}{
+		"allowed":  {target: ln.Addr().String()},
+		"port":     {target: "127.0.0.1:1", denied: true},
+		"host":     {target: "example.com:443", denied: true},
+		"internal": {target: "169.254.169.254:80", denied: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			go serveProxyExit(b, dial)
+			err := requestProxy(a, tc.target)
+			if denied := err != nil && strings.Contains(err.Error(), ErrProxyDenied.Error()); denied != tc.denied {
+				t.Fatalf("expected denied=%v, got %v", tc.denied, err)
+			}
+			if !tc.denied && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestProxyExitRequiresDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := ServeProxyExit(ln, nil); err == nil {
+		t.Fatal("expected an error without dial")
+	}
+	if _, err := AllowProxyTargets()(context.Background(), "tcp", ln.Addr().String()); !errors.Is(err, ErrProxyDenied) {
+		t.Fatalf("expected %v, got %v", ErrProxyDenied, err)
+	}
+}
@@ -0,0 +1,180 @@
+package rdv
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 username/password auth method, see RFC 1929
+const socksUserPass = 2
+
+// Returns a tunnel to target (host:port) through the proxy, which is an http(s) proxy that
+// supports CONNECT, or a socks5 proxy. Credentials are taken from the proxy URL.
+func dialProxy(ctx context.Context, proxy *url.URL, target string) (net.Conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), proxyPort(proxy)))
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		tc := tls.Client(nc, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	reset := ctxIO(ctx, nc)
+	switch proxy.Scheme {
+	case "http", "https":
+		err = connectHTTP(nc, proxy, target)
+	case "socks5", "socks5h":
+		err = connectSocks(nc, proxy, target)
+	default:
+		err = fmt.Errorf("rdv: unsupported proxy scheme [%s]", proxy.Scheme)
+	}
+	reset()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return nc, nil
+}
+
+func proxyPort(proxy *url.URL) string {
+	if port := proxy.Port(); port != "" {
+		return port
+	}
+	switch proxy.Scheme {
+	case "https":
+		return "443"
+	case "socks5", "socks5h":
+		return "1080"
+	}
+	return "80"
+}
+
+// Opens a tunnel with an http CONNECT request.
+func connectHTTP(nc net.Conn, proxy *url.URL, target string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(nc); err != nil {
+		return err
+	}
+	br := bufio.NewReader(&headerLimitReader{r: nc, n: maxRespHeaderBytes})
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rdv: proxy refused to connect to %s: %s", target, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return fmt.Errorf("%w: proxy sent data before the request", ErrProtocol)
+	}
+	return nil
+}
+
+// Opens a tunnel with a SOCKS5 connect request, see RFC 1928. The host is resolved by the proxy.
+func connectSocks(nc net.Conn, proxy *url.URL, target string) error {
+	methods := []byte{socksNoAuth}
+	if proxy.User != nil {
+		methods = append(methods, socksUserPass)
+	}
+	if _, err := nc.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(nc, reply[:]); err != nil {
+		return err
+	}
+	switch {
+	case reply[1] == socksUserPass && proxy.User != nil:
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("rdv: socks credentials are too long")
+		}
+		msg := append([]byte{1, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := nc.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(nc, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != socksSucceeded {
+			return fmt.Errorf("rdv: socks proxy rejected the credentials")
+		}
+	case reply[1] != socksNoAuth:
+		return fmt.Errorf("rdv: socks proxy requires an unsupported auth method")
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip, err := netip.ParseAddr(host); err == nil && ip.Is4() {
+		req = append(append(req, socksAtypIPv4), ip.AsSlice()...)
+	} else if err == nil {
+		req = append(append(req, socksAtypIPv6), ip.AsSlice()...)
+	} else if len(host) <= 255 {
+		req = append(append(req, socksAtypDomain, byte(len(host))), host...)
+	} else {
+		return fmt.Errorf("rdv: socks host name is too long")
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := nc.Write(req); err != nil {
+		return err
+	}
+	var head [4]byte // version, reply, reserved, address type
+	if _, err := io.ReadFull(nc, head[:]); err != nil {
+		return err
+	}
+	if head[1] != socksSucceeded {
+		return fmt.Errorf("rdv: socks proxy failed to connect to %s (reply %d)", target, head[1])
+	}
+	// Skip the bound addr and port
+	var n int
+	switch head[3] {
+	case socksAtypIPv4:
+		n = 4
+	case socksAtypIPv6:
+		n = 16
+	case socksAtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(nc, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("%w: bad socks address type %d", ErrProtocol, head[3])
+	}
+	_, err = io.ReadFull(nc, make([]byte, n+2))
+	return err
+}
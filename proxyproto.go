@@ -0,0 +1,249 @@
+package rdv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Max length of a PROXY protocol v1 header, including the CRLF
+	maxProxyV1Header = 107
+
+	// PROXY protocol v2 commands, in the low bits of the version and command byte
+	proxyCmdLocal = 0x0
+	proxyCmdProxy = 0x1
+
+	// PROXY protocol v2 address families and protocols
+	proxyFamTCP4 = 0x11
+	proxyFamTCP6 = 0x21
+)
+
+// Signature of PROXY protocol v2 headers
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Wraps a listener behind an L4 load balancer, such as HAProxy or AWS NLB, which sends a PROXY
+// protocol header (v1 or v2) at the start of each conn. The RemoteAddr and LocalAddr of accepted
+// conns are then the addrs of the original client conn, so that DefaultObservedAddr works as if
+// clients connected directly, unlike with X-Forwarded-For which only has the IP. Use with
+// ServeListener, or an http.Server. The header is read on the first Read or RemoteAddr, and conns
+// without a valid header fail with ErrProxyHeader. Headers of health checks (LOCAL) are accepted,
+// and keep the addrs of the load balancer.
+type ProxyProtocolListener struct {
+	net.Listener
+
+	// Max duration for reading the header. Defaults to 10s.
+	HeaderTimeout time.Duration
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	nc, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &proxyProtoConn{Conn: nc, timeout: timeout, br: bufio.NewReader(nc)}, nil
+}
+
+// A conn with a PROXY protocol header, which is read lazily so that Accept doesn't block.
+type proxyProtoConn struct {
+	net.Conn
+	timeout time.Duration
+	br      *bufio.Reader
+
+	once          sync.Once
+	remote, local net.Addr
+	err           error
+
+	mu       sync.Mutex
+	deadline time.Time // read deadline set by the user, which the header timeout doesn't replace
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := time.Now().Add(c.timeout)
+		if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+			deadline = c.deadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+		c.mu.Unlock()
+
+		src, dst, err := readProxyHeader(c.br)
+		if err != nil {
+			c.err = fmt.Errorf("%w: %w", ErrProxyHeader, err)
+		} else if src.IsValid() {
+			c.remote, c.local = net.TCPAddrFromAddrPort(src), net.TCPAddrFromAddrPort(dst)
+		}
+
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Reads a PROXY protocol v1 or v2 header, and returns the source and destination addrs, which are
+// invalid if the header doesn't have TCP addrs, e.g. for health checks of the load balancer.
+func readProxyHeader(br *bufio.Reader) (src, dst netip.AddrPort, err error) {
+	sig, err := br.Peek(len(proxyV2Sig))
+	if err != nil {
+		return src, dst, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(br)
+	}
+	if !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return src, dst, errors.New("missing header")
+	}
+	line, err := br.ReadSlice('\n')
+	if len(line) > maxProxyV1Header || err == bufio.ErrBufferFull {
+		return src, dst, errors.New("v1 header too long")
+	} else if err != nil {
+		return src, dst, err
+	}
+	return parseProxyV1(string(line))
+}
+
+func parseProxyV1(line string) (src, dst netip.AddrPort, err error) {
+	line, ok := strings.CutSuffix(line, "\r\n")
+	if !ok {
+		return src, dst, errors.New("v1 header without CRLF")
+	}
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return src, dst, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return src, dst, fmt.Errorf("bad v1 header [%s]", line)
+	}
+	src, err = parseProxyV1Addr(fields[2], fields[4])
+	if err == nil {
+		dst, err = parseProxyV1Addr(fields[3], fields[5])
+	}
+	if err != nil {
+		return src, dst, fmt.Errorf("bad v1 header [%s]: %w", line, err)
+	}
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(ip, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+func readProxyV2(br *bufio.Reader) (src, dst netip.AddrPort, err error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return src, dst, err
+	}
+	verCmd, fam, n := hdr[12], hdr[13], binary.BigEndian.Uint16(hdr[14:])
+	body := make([]byte, n)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return src, dst, err
+	}
+	if verCmd>>4 != 2 {
+		return src, dst, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+	if cmd := verCmd & 0xf; cmd == proxyCmdLocal {
+		return src, dst, nil
+	} else if cmd != proxyCmdProxy {
+		return src, dst, fmt.Errorf("unsupported v2 command %d", cmd)
+	}
+	switch {
+	case fam == proxyFamTCP4 && n >= 12:
+		src = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[0:4])), binary.BigEndian.Uint16(body[8:]))
+		dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[4:8])), binary.BigEndian.Uint16(body[10:]))
+	case fam == proxyFamTCP6 && n >= 36:
+		src = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[0:16])), binary.BigEndian.Uint16(body[32:]))
+		dst = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[16:32])), binary.BigEndian.Uint16(body[34:]))
+	case fam == proxyFamTCP4 || fam == proxyFamTCP6:
+		return src, dst, errors.New("short v2 addrs")
+	}
+	return src, dst, nil // other families are ignored, like LOCAL
+}
+
+// Writes a PROXY protocol v2 header with the source and destination addrs, e.g. in a ServeFunc
+// that forwards relayed conns to a backend behind a load balancer, with the observed addr of the
+// client (see Meta.ObservedAddr) as the source. If either addr is invalid, a LOCAL header is
+// written, which backends treat like a conn without a header.
+func WriteProxyHeader(w io.Writer, src, dst netip.AddrPort) error {
+	src, dst = netip.AddrPortFrom(src.Addr().Unmap(), src.Port()), netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	var body []byte
+	verCmd, fam := byte(0x20|proxyCmdProxy), byte(proxyFamTCP6)
+	switch {
+	case !src.IsValid() || !dst.IsValid():
+		verCmd, fam = 0x20|proxyCmdLocal, 0
+	case src.Addr().Is4() && dst.Addr().Is4():
+		fam = proxyFamTCP4
+		body = append(body, src.Addr().AsSlice()...)
+		body = append(body, dst.Addr().AsSlice()...)
+	default:
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		body = append(append(body, s[:]...), d[:]...)
+	}
+	if fam != 0 {
+		body = binary.BigEndian.AppendUint16(body, src.Port())
+		body = binary.BigEndian.AppendUint16(body, dst.Port())
+	}
+	hdr := append(append([]byte{}, proxyV2Sig...), verCmd, fam)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+	_, err := w.Write(append(hdr, body...))
+	return err
+}
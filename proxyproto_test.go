@@ -0,0 +1,199 @@
+package rdv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseProxyV1(t *testing.T) {
+	tests := map[string]struct {
+		line     string
+		src, dst string
+		ok       bool
+	}{
+		"tcp4":       {line: "PROXY TCP4 192.0.2.1 198.51.100.1 4000 443\r\n", src: "192.0.2.1:4000", dst: "198.51.100.1:443", ok: true},
+		"tcp6":       {line: "PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n", src: "[2001:db8::1]:4000", dst: "[2001:db8::2]:443", ok: true},
+		"unknown":    {line: "PROXY UNKNOWN\r\n", ok: true},
+		"unknown_ip": {line: "PROXY UNKNOWN 192.0.2.1 198.51.100.1 4000 443\r\n", ok: true},
+		"no_crlf":    {line: "PROXY TCP4 192.0.2.1 198.51.100.1 4000 443\n"},
+		"udp":        {line: "PROXY UDP4 192.0.2.1 198.51.100.1 4000 443\r\n"},
+		"fields":     {line: "PROXY TCP4 192.0.2.1 198.51.100.1 4000\r\n"},
+		"bad_ip":     {line: "PROXY TCP4 192.0.2 198.51.100.1 4000 443\r\n"},
+		"bad_port":   {line: "PROXY TCP4 192.0.2.1 198.51.100.1 4000 65536\r\n"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			src, dst, err := parseProxyV1(tc.line)
+			if (err == nil) != tc.ok {
+				t.Fatalf("expected ok %v, got %v", tc.ok, err)
+			}
+			if tc.src != "" && (src.String() != tc.src || dst.String() != tc.dst) {
+				t.Fatalf("expected %v %v, got %v %v", tc.src, tc.dst, src, dst)
+			}
+		})
+	}
+}
+
+// Returns a PROXY protocol v2 header with the version and command, family and body.
+func proxyV2Header(verCmd, fam byte, body []byte) []byte {
+	hdr := append(append([]byte{}, proxyV2Sig...), verCmd, fam)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+	return append(hdr, body...)
+}
+
+func TestReadProxyV2(t *testing.T) {
+	tcp4 := append([]byte{192, 0, 2, 1, 198, 51, 100, 1}, 0x0f, 0xa0, 0x01, 0xbb)
+	tests := map[string]struct {
+		data     []byte
+		src, dst string
+		ok       bool
+	}{
+		"tcp4":      {data: proxyV2Header(0x21, proxyFamTCP4, tcp4), src: "192.0.2.1:4000", dst: "198.51.100.1:443", ok: true},
+		"tlvs":      {data: proxyV2Header(0x21, proxyFamTCP4, append(tcp4, 0x04, 0x00, 0x01, 0x00)), src: "192.0.2.1:4000", dst: "198.51.100.1:443", ok: true},
+		"local":     {data: proxyV2Header(0x20, 0, nil), ok: true},
+		"udp4":      {data: proxyV2Header(0x21, 0x12, tcp4), ok: true},
+		"short":     {data: proxyV2Header(0x21, proxyFamTCP4, tcp4[:8])},
+		"short6":    {data: proxyV2Header(0x21, proxyFamTCP6, tcp4)},
+		"version":   {data: proxyV2Header(0x11, proxyFamTCP4, tcp4)},
+		"command":   {data: proxyV2Header(0x22, proxyFamTCP4, tcp4)},
+		"truncated": {data: proxyV2Header(0x21, proxyFamTCP4, tcp4)[:20]},
+		"no_len":    {data: proxyV2Header(0x21, proxyFamTCP4, tcp4)[:14]},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			src, dst, err := readProxyV2(bufio.NewReader(bytes.NewReader(tc.data)))
+			if (err == nil) != tc.ok {
+				t.Fatalf("expected ok %v, got %v", tc.ok, err)
+			}
+			if tc.ok && tc.src == "" && (src.IsValid() || dst.IsValid()) {
+				t.Fatalf("expected no addrs, got %v %v", src, dst)
+			}
+			if tc.src != "" && (src.String() != tc.src || dst.String() != tc.dst) {
+				t.Fatalf("expected %v %v, got %v %v", tc.src, tc.dst, src, dst)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	tests := map[string]struct {
+		src, dst string
+		fam      byte
+	}{
+		"tcp4":    {src: "192.0.2.1:4000", dst: "198.51.100.1:443", fam: proxyFamTCP4},
+		"tcp6":    {src: "[2001:db8::1]:4000", dst: "[2001:db8::2]:443", fam: proxyFamTCP6},
+		"mapped4": {src: "[::ffff:192.0.2.1]:4000", dst: "198.51.100.1:443", fam: proxyFamTCP4},
+		"mixed":   {src: "192.0.2.1:4000", dst: "[2001:db8::2]:443", fam: proxyFamTCP6},
+		"invalid": {dst: "198.51.100.1:443"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var src, dst netip.AddrPort
+			if tc.src != "" {
+				src = netip.MustParseAddrPort(tc.src)
+			}
+			dst = netip.MustParseAddrPort(tc.dst)
+			var buf bytes.Buffer
+			if err := WriteProxyHeader(&buf, src, dst); err != nil {
+				t.Fatal(err)
+			}
+			if fam := buf.Bytes()[13]; fam != tc.fam {
+				t.Fatalf("expected family %#x, got %#x", tc.fam, fam)
+			}
+			gotSrc, gotDst, err := readProxyHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.fam == 0 {
+				if gotSrc.IsValid() || gotDst.IsValid() {
+					t.Fatalf("expected a LOCAL header, got %v %v", gotSrc, gotDst)
+				}
+				return
+			}
+			unmap := func(ap netip.AddrPort) netip.AddrPort { return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()) }
+			if unmap(gotSrc) != unmap(src) || unmap(gotDst) != unmap(dst) {
+				t.Fatalf("expected %v %v, got %v %v", src, dst, gotSrc, gotDst)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		ok   bool
+	}{
+		"v1":           {data: "PROXY TCP4 192.0.2.1 198.51.100.1 4000 443\r\nGET /", ok: true},
+		"v1_max":       {data: "PROXY UNKNOWN " + strings.Repeat("x", maxProxyV1Header-16) + "\r\n", ok: true},
+		"v1_oversized": {data: "PROXY UNKNOWN " + strings.Repeat("x", maxProxyV1Header-15) + "\r\n"},
+		"v1_unbounded": {data: "PROXY UNKNOWN " + strings.Repeat("x", 8192)},
+		"v1_truncated": {data: "PROXY TCP4 192.0.2.1"},
+		"v2_truncated": {data: string(proxyV2Sig[:8])},
+		"missing":      {data: "GET / HTTP/1.1\r\n\r\n"},
+		"empty":        {data: ""},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(tc.data)))
+			if (err == nil) != tc.ok {
+				t.Fatalf("expected ok %v, got %v", tc.ok, err)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := &ProxyProtocolListener{Listener: ln}
+	defer pl.Close()
+	for name, tc := range map[string]struct {
+		header string
+		remote string
+		err    error
+	}{
+		"v1":      {header: "PROXY TCP4 192.0.2.1 198.51.100.1 4000 443\r\n", remote: "192.0.2.1:4000"},
+		"local":   {header: string(proxyV2Header(0x20, 0, nil))},
+		"missing": {header: "hello world\r\n", err: ErrProxyHeader},
+	} {
+		t.Run(name, func(t *testing.T) {
+			nc, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			go io.WriteString(nc, tc.header+"hello")
+			conn, err := pl.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			remote := nc.LocalAddr().String()
+			if tc.remote != "" {
+				remote = tc.remote
+			}
+			if tc.err == nil && conn.RemoteAddr().String() != remote {
+				t.Fatalf("expected %v, got %v", remote, conn.RemoteAddr())
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			} else if err == nil && string(buf) != "hello" {
+				t.Fatalf("expected hello, got %q", buf)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package rdv
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Suggested wait for clients that are rejected by MaxLobbySize or MaxConnsPerIP
+const quotaRetryAfter = 5 * time.Second
+
+// Sets the relay quota of a matched pair, see ServerConfig.QuotaFunc.
+func (l *Server) setRelayQuota(dc, ac *Conn) {
+	if l.cfg.QuotaFunc == nil {
+		return
+	}
+	quota := l.cfg.QuotaFunc(dc.meta.Token)
+	dc.quota, ac.quota = quota, quota
+}
+
+// A tap which fails once the bytes read from both conns exceed their quota, so that the relay
+// ends before the excess data is forwarded.
+type relayQuota struct {
+	dc, ac *Conn
+}
+
+func (q relayQuota) Write(p []byte) (int, error) {
+	if used := q.dc.read.Load() + q.ac.read.Load(); used > q.dc.quota {
+		return 0, fmt.Errorf("%w: %d bytes relayed, quota is %d", ErrRelayQuota, used, q.dc.quota)
+	}
+	return len(p), nil
+}
+
+// Whether the relay of the conns exceeded its quota.
+func quotaExceeded(dc, ac *Conn) bool {
+	return dc.quota > 0 && dc.read.Load()+ac.read.Load() > dc.quota
+}
+
+// Counts the conns in the lobby, in total, per namespace and per observed IP. Updated by the Serve
+// loop, and checked concurrently by AddClient.
+type lobbyQuota struct {
+	mu           sync.Mutex
+	total        int
+	keys         map[string]int // number of conns per lobby key, which group members share
+	perNamespace map[string]int
+	perIP        map[netip.Addr]int
+}
+
+func newLobbyQuota() lobbyQuota {
+	return lobbyQuota{keys: make(map[string]int), perNamespace: make(map[string]int), perIP: make(map[netip.Addr]int)}
+}
+
+func (q *lobbyQuota) add(conn *Conn, delta int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.total += delta
+	key := conn.meta.lobbyKey()
+	if q.keys[key] += delta; q.keys[key] <= 0 {
+		delete(q.keys, key)
+	}
+	ns := conn.meta.Namespace
+	if q.perNamespace[ns] += delta; q.perNamespace[ns] <= 0 {
+		delete(q.perNamespace, ns)
+	}
+	if conn.meta.ObservedAddr == nil {
+		return
+	}
+	ip := conn.meta.ObservedAddr.Addr().Unmap()
+	if q.perIP[ip] += delta; q.perIP[ip] <= 0 {
+		delete(q.perIP, ip)
+	}
+}
+
+// Returns ErrQuotaExceeded if the client would exceed MaxLobbySize, the MaxLobby of its namespace
+// or MaxConnsPerIP by entering the lobby. Clients whose lobby key is already in the lobby don't
+// count towards the lobby sizes,
+// since they are matched or replace the idle conn, and so do the rest of an incomplete group.
+// Clients are checked before they reach the Serve loop, so concurrent clients may exceed the
+// limits briefly.
+func (l *Server) checkQuota(req *http.Request, meta *Meta) error {
+	maxLobby, maxPerIP := l.cfg.MaxLobbySize, l.cfg.MaxConnsPerIP
+	maxNamespace := l.cfg.Namespaces[meta.Namespace].MaxLobby
+	if maxLobby <= 0 && maxNamespace <= 0 && maxPerIP <= 0 {
+		return nil
+	}
+	addr, err := l.observedAddr(req)
+	q := &l.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := q.keys[meta.lobbyKey()]
+	expected := n > 0 && (meta.GroupSize == 0 || n < meta.GroupSize)
+	switch {
+	case maxLobby > 0 && !expected && q.total >= maxLobby:
+		return fmt.Errorf("%w: lobby is full", ErrQuotaExceeded)
+	case maxNamespace > 0 && !expected && q.perNamespace[meta.Namespace] >= maxNamespace:
+		return fmt.Errorf("%w: lobby of namespace %q is full", ErrQuotaExceeded, meta.Namespace)
+	case maxPerIP > 0 && err == nil && q.perIP[addr.Addr().Unmap()] >= maxPerIP:
+		return fmt.Errorf("%w: too many clients from %v", ErrQuotaExceeded, addr.Addr())
+	}
+	return nil
+}
+
+// Sets the namespace of a new client, authenticates it and checks the quotas, which are rejected
+// with 429 Too Many Requests.
+func (l *Server) admitClient(w http.ResponseWriter) func(req *http.Request, meta *Meta) error {
+	return func(req *http.Request, meta *Meta) error {
+		if err := l.checkClient(req, meta); err != nil {
+			return err
+		}
+		if err := l.checkQuota(req, meta); err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(quotaRetryAfter/time.Second)))
+			return &StatusError{Code: http.StatusTooManyRequests, Err: err}
+		}
+		return nil
+	}
+}
+
+// Returns the Retry-After of a response in seconds, or zero if there is none.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,94 @@
+package rdv
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Group members count towards MaxLobbySize one by one, even though they share a lobby key.
+func TestMaxLobbySize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, &ServerConfig{MaxLobbySize: 2})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	for range 2 {
+		go client.JoinGroup(ctx, hs.URL, "group", 4, nil)
+	}
+	awaitLobby(t, server, 2)
+
+	_, resp, err := client.Accept(ctx, hs.URL, "token", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected %v, got %v", http.StatusTooManyRequests, err)
+	}
+	if d := retryAfter(resp); d != quotaRetryAfter {
+		t.Fatalf("expected %v, got %v", quotaRetryAfter, d)
+	}
+}
+
+// The rest of an incomplete group is let in, even after some members left.
+func TestQuotaGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, &ServerConfig{MaxLobbySize: 2})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	leaveCtx, leave := context.WithCancel(ctx)
+	go client.JoinGroup(leaveCtx, hs.URL, "group", 4, nil)
+	go client.JoinGroup(ctx, hs.URL, "group", 4, nil)
+	awaitLobby(t, server, 2)
+	leave()
+	awaitLobby(t, server, 1)
+	go client.Accept(ctx, hs.URL, "token", nil)
+	awaitLobby(t, server, 2)
+
+	go client.JoinGroup(ctx, hs.URL, "group", 4, nil)
+	awaitLobby(t, server, 3)
+	_, resp, err := client.Accept(ctx, hs.URL, "other", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected %v, got %v", http.StatusTooManyRequests, err)
+	}
+}
+
+// Clients whose lobby key is in the lobby are still limited per IP.
+func TestMaxConnsPerIP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, &ServerConfig{MaxConnsPerIP: 1})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	go client.Accept(ctx, hs.URL, "token", nil)
+	awaitLobby(t, server, 1)
+	for _, token := range []string{"token", "other"} {
+		_, resp, err := client.Accept(ctx, hs.URL, token, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("expected %v, got %v", http.StatusTooManyRequests, err)
+		}
+	}
+}
+
+// The lobby of a namespace is limited like the whole lobby, while other namespaces are not.
+func TestNamespaceMaxLobby(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, &ServerConfig{Namespaces: map[string]NamespaceConfig{"small": {MaxLobby: 1}}})
+	small := NewClient(&ClientConfig{AddrSpaces: NoSpaces, Namespace: "small"})
+	other := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	go small.Accept(ctx, hs.URL, "token", nil)
+	go other.Accept(ctx, hs.URL, "token", nil)
+	awaitLobby(t, server, 2)
+
+	_, resp, err := small.Accept(ctx, hs.URL, "other", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected %v, got %v", http.StatusTooManyRequests, err)
+	}
+	if d := retryAfter(resp); d != quotaRetryAfter {
+		t.Fatalf("expected %v, got %v", quotaRetryAfter, d)
+	}
+
+	// The peer of a waiting client is let in
+	conn, _, err := small.Dial(ctx, hs.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
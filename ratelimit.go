@@ -0,0 +1,75 @@
+package rdv
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// A token bucket tap, which delays relaying to stay within a rate limit. Data is let through in
+// chunks of at most the burst size, and each chunk counts as activity for the idle timer, so slow
+// relays aren't mistaken for idle ones. Not safe for concurrent use, so use one per direction.
+type rateLimiter struct {
+	ctx      context.Context
+	clock    Clock
+	rate     float64 // bytes per second
+	burst    int
+	tokens   float64
+	last     time.Time
+	activity io.Writer
+}
+
+// Returns a rate limiting tap, or a noop tap if there's no rate limit.
+func (r *Relayer) newRateLimiter(ctx context.Context, clock Clock, activity io.Writer) io.Writer {
+	if r.RateLimit <= 0 {
+		return noopTap{}
+	}
+	burst := r.BurstSize
+	if burst <= 0 {
+		burst = r.RateLimit
+	}
+	return &rateLimiter{
+		ctx:      ctx,
+		clock:    clock,
+		rate:     float64(r.RateLimit),
+		burst:    int(burst),
+		tokens:   float64(burst),
+		last:     clock.Now(),
+		activity: activity,
+	}
+}
+
+func (l *rateLimiter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := min(len(p), l.burst)
+		if err := l.wait(chunk); err != nil {
+			return n - len(p), err
+		}
+		l.activity.Write(p[:chunk])
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// Waits until n tokens are available and takes them, or until the context is canceled.
+func (l *rateLimiter) wait(n int) error {
+	for {
+		now := l.clock.Now()
+		l.tokens = min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			return nil
+		}
+		d := time.Duration((float64(n) - l.tokens) / l.rate * float64(time.Second))
+		woken := make(chan struct{})
+		t := l.clock.AfterFunc(d, func() { close(woken) })
+		select {
+		case <-woken:
+		case <-l.ctx.Done():
+			t.Stop()
+			return context.Cause(l.ctx)
+		}
+	}
+}
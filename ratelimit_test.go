@@ -0,0 +1,75 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Records the size of each write.
+type writeSizes []int
+
+func (w *writeSizes) Write(p []byte) (int, error) {
+	*w = append(*w, len(p))
+	return len(p), nil
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := new(manualClock)
+	var activity writeSizes
+	l := (&Relayer{RateLimit: 10}).newRateLimiter(context.Background(), clock, &activity)
+
+	// The burst is let through right away
+	if n, err := l.Write(make([]byte, 10)); n != 10 || err != nil {
+		t.Fatalf("expected 10, got %v, %v", n, err)
+	}
+
+	// Then it's throttled to the rate, in chunks of the burst size
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Write(make([]byte, 15))
+		done <- err
+	}()
+	for range 3 { // half the burst is refilled each time
+		clock.awaitTimer(t)
+		select {
+		case err := <-done:
+			t.Fatalf("expected the write to be throttled, got %v", err)
+		default:
+		}
+		clock.advance(500 * time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{10, 10, 5}; !slices.Equal(activity, expected) {
+		t.Fatalf("expected %v, got %v", expected, activity)
+	}
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	clock := new(manualClock)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	l := (&Relayer{RateLimit: 10, BurstSize: 5}).newRateLimiter(ctx, clock, new(writeSizes))
+
+	var (
+		n    int
+		err  error
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		n, err = l.Write(make([]byte, 8))
+	}()
+	clock.awaitTimer(t)
+	cause := errors.New("relay ended")
+	cancel(cause)
+	<-done
+
+	// The first chunk was let through
+	if n != 5 || err != cause {
+		t.Fatalf("expected 5, %v, got %v, %v", cause, n, err)
+	}
+}
@@ -0,0 +1,128 @@
+package rdv
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Size of the read buffer of raw conns, which is dropped after the upgrade
+const rawBufferSize = 4 << 10
+
+// Serves rdv requests from raw conns of the listener, e.g. a TCP or TLS listener, without an
+// http.Server. The requests are parsed by the Server itself, and conns that aren't upgraded are
+// closed after the response. This avoids the handler goroutines that net/http leaks for hijacked
+// conns, and bounds the time (HeaderTimeout) and memory (MaxHeaderBytes) of each conn until it's
+// upgraded, e.g. for large public relays. Other http requests are served like ServeHTTP, i.e. by
+// rejecting them. Returns when ctx is canceled or ln fails, and closes ln. Serve must be running.
+func (l *Server) ServeListener(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	defer ln.Close()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return cmp.Or(ctx.Err(), err)
+		}
+		go l.serveRaw(ctx, nc)
+	}
+}
+
+// Reads the request of a raw conn, and serves it like ServeHTTP.
+func (l *Server) serveRaw(ctx context.Context, nc net.Conn) {
+	nc.SetDeadline(time.Now().Add(l.cfg.HeaderTimeout))
+	var state *tls.ConnectionState
+	if tc, ok := nc.(*tls.Conn); ok {
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return
+		}
+		cs := tc.ConnectionState()
+		state = &cs
+	}
+	// Like net/http, the limit has some slack for the read buffer
+	lr := &headerLimitReader{r: nc, n: int64(l.cfg.MaxHeaderBytes) + rawBufferSize}
+	br := bufio.NewReaderSize(lr, rawBufferSize)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, ErrHeaderTooLarge) {
+			code = http.StatusRequestHeaderFieldsTooLarge
+		}
+		var netErr net.Error
+		if errors.Is(err, io.EOF) || errors.As(err, &netErr) {
+			nc.Close() // nobody to respond to
+		} else {
+			writeResponseErr(nc, code, http.StatusText(code))
+		}
+		return
+	}
+	lr.unlimit()
+	req.RemoteAddr = nc.RemoteAddr().String()
+	req.TLS = state
+	w := &rawResponseWriter{nc: nc, br: br, header: make(http.Header)}
+	l.ServeHTTP(w, req.WithContext(ctx))
+	if !w.hijacked {
+		w.finish()
+	}
+}
+
+// A response writer for raw conns, which buffers the response until it's finished, unless the
+// conn is hijacked for the upgrade.
+type rawResponseWriter struct {
+	nc       net.Conn
+	br       *bufio.Reader
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	hijacked bool
+}
+
+func (w *rawResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rawResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *rawResponseWriter) Write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *rawResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked || w.status != 0 {
+		return nil, nil, http.ErrHijacked
+	}
+	w.hijacked = true
+	return w.nc, bufio.NewReadWriter(w.br, bufio.NewWriter(w.nc)), nil
+}
+
+// Writes the response, and closes the conn.
+func (w *rawResponseWriter) finish() {
+	defer w.nc.Close()
+	resp := &http.Response{
+		StatusCode:    cmp.Or(w.status, http.StatusOK),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		ContentLength: int64(w.body.Len()),
+		Body:          io.NopCloser(&w.body),
+		Close:         true,
+	}
+	w.nc.SetWriteDeadline(verySoon())
+	resp.Write(w.nc)
+}
@@ -0,0 +1,75 @@
+package rdv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves raw conns of a loopback listener with the server until the test ends, and returns
+// the URL of the listener.
+func startListener(t *testing.T, server *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.ServeListener(ctx, ln) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	})
+	return "http://" + ln.Addr().String()
+}
+
+func TestServeListener(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, _ := startServer(t, &ServerConfig{HeaderTimeout: 100 * time.Millisecond})
+	addr := startListener(t, server)
+	dc, ac := relayPair(t, ctx, NewClient(&ClientConfig{AddrSpaces: NoSpaces}), addr, "token")
+	exchange(t, dc, ac, "hello")
+
+	// The header timeout no longer applies once upgraded
+	time.Sleep(200 * time.Millisecond)
+	exchange(t, ac, dc, "later")
+}
+
+func TestServeListenerReject(t *testing.T) {
+	server, _ := startServer(t, &ServerConfig{MaxHeaderBytes: 1 << 10})
+	addr := startListener(t, server)
+	tests := map[string]struct {
+		req    string
+		status int
+	}{
+		"not_rdv":   {req: "GET / HTTP/1.1\r\nHost: rdv\r\n\r\n", status: http.StatusUpgradeRequired},
+		"malformed": {req: "GET\r\n\r\n", status: http.StatusBadRequest},
+		"too_large": {req: fmt.Sprintf("GET / HTTP/1.1\r\nHost: rdv\r\nX-Large: %s\r\n\r\n", strings.Repeat("x", 8<<10)), status: http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			nc, err := net.Dial("tcp", strings.TrimPrefix(addr, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			io.WriteString(nc, tc.req)
+			resp, err := http.ReadResponse(bufio.NewReader(nc), nil)
+			if err != nil || resp.StatusCode != tc.status {
+				t.Fatalf("expected %v, got %v, %v", tc.status, resp, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+// Package rdvmobile is a thin layer over rdv with types that gomobile can bind, so that iOS and
+// Android apps can embed rdv clients and servers:
+//
+//	gomobile bind -target=android github.com/betamos/rdv/rdvmobile
+//
+// Signatures only use strings, numbers, byte slices and callback interfaces. Blocking methods
+// should be called off the main thread, or use the async variants, which report through callbacks
+// from another goroutine.
+package rdvmobile
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+// Client options. The zero value uses the rdv defaults.
+type ClientOptions struct {
+	// Use only the relay, e.g. to test it
+	RelayOnly bool
+
+	// Connect to the server over WebSocket, see rdv.ClientConfig.WebSocket
+	WebSocket bool
+
+	// File with the history of attempts per network, e.g. in the app's cache dir
+	HistoryFile string
+
+	// Timeout of Dial and Accept in milliseconds, or 0 for no timeout
+	TimeoutMillis int64
+
+	// Watch the OS for network changes, see rdv.ClientConfig.WatchNetwork. Apps that receive
+	// network callbacks can call Client.NetworkChanged instead.
+	WatchNetwork bool
+}
+
+// Receives the result of an async call. Exactly one of the methods is called, except for Listen,
+// which calls OnConn for each conn until OnError.
+type ConnCallback interface {
+	OnConn(conn *Conn)
+	OnError(msg string)
+}
+
+// Receives data from Conn.Receive. OnClose is called once with an empty message at EOF, or with
+// the error otherwise.
+type DataHandler interface {
+	OnData(data []byte)
+	OnClose(msg string)
+}
+
+// Cancels an async call or a listener.
+type Task struct {
+	cancel context.CancelFunc
+}
+
+func (t *Task) Cancel() {
+	t.cancel()
+}
+
+type Client struct {
+	client  *rdv.Client
+	timeout time.Duration
+}
+
+// Returns a client. The options may be nil.
+func NewClient(opts *ClientOptions) *Client {
+	if opts == nil {
+		opts = &ClientOptions{}
+	}
+	cfg := &rdv.ClientConfig{
+		WebSocket:    opts.WebSocket,
+		HistoryFile:  opts.HistoryFile,
+		WatchNetwork: opts.WatchNetwork,
+	}
+	if opts.RelayOnly {
+		cfg.AddrSpaces = rdv.NoSpaces
+	}
+	return &Client{
+		client:  rdv.NewClient(cfg),
+		timeout: time.Duration(opts.TimeoutMillis) * time.Millisecond,
+	}
+}
+
+// Dials the peer with the token through the rdv server at addr. Blocks until connected.
+func (c *Client) Dial(addr, token string) (*Conn, error) {
+	return c.connect(context.Background(), true, addr, token)
+}
+
+// Accepts the peer with the token through the rdv server at addr. Blocks until connected.
+func (c *Client) Accept(addr, token string) (*Conn, error) {
+	return c.connect(context.Background(), false, addr, token)
+}
+
+// Dials in the background, and reports the outcome to cb.
+func (c *Client) DialAsync(addr, token string, cb ConnCallback) *Task {
+	return c.async(true, addr, token, cb)
+}
+
+// Accepts in the background, and reports the outcome to cb.
+func (c *Client) AcceptAsync(addr, token string, cb ConnCallback) *Task {
+	return c.async(false, addr, token, cb)
+}
+
+// Accepts any number of dialers with the token in the background, until canceled or the listener
+// fails, see rdv.Client.Listen.
+func (c *Client) Listen(addr, token string, cb ConnCallback) *Task {
+	ctx, cancel := context.WithCancel(context.Background())
+	ln := c.client.Listen(ctx, addr, token, nil)
+	go func() {
+		defer ln.Close()
+		for {
+			conn, err := ln.AcceptConn()
+			if err != nil {
+				cb.OnError(err.Error())
+				return
+			}
+			cb.OnConn(&Conn{conn: conn})
+		}
+	}()
+	return &Task{cancel}
+}
+
+// Reports a network change, e.g. from ConnectivityManager on Android or NWPathMonitor on iOS,
+// so that listeners re-register with fresh addrs.
+func (c *Client) NetworkChanged() {
+	c.client.NetworkChanged()
+}
+
+func (c *Client) async(dialer bool, addr, token string, cb ConnCallback) *Task {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		conn, err := c.connect(ctx, dialer, addr, token)
+		if err != nil {
+			cb.OnError(err.Error())
+			return
+		}
+		cb.OnConn(conn)
+	}()
+	return &Task{cancel}
+}
+
+func (c *Client) connect(ctx context.Context, dialer bool, addr, token string) (*Conn, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	fn := c.client.Accept
+	if dialer {
+		fn = c.client.Dial
+	}
+	conn, _, err := fn(ctx, addr, token, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn}, nil
+}
+
+// A conn to a peer.
+type Conn struct {
+	conn *rdv.Conn
+}
+
+// Reads into data, and returns the number of bytes read.
+func (c *Conn) Read(data []byte) (int, error) {
+	return c.conn.Read(data)
+}
+
+func (c *Conn) Write(data []byte) (int, error) {
+	return c.conn.Write(data)
+}
+
+// Reads in the background until EOF or an error, and passes the data to h. Read must not be used
+// concurrently.
+func (c *Conn) Receive(h DataHandler) {
+	go func() {
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := c.conn.Read(buf)
+			if n > 0 {
+				h.OnData(append([]byte(nil), buf[:n]...))
+			}
+			if err != nil {
+				msg := err.Error()
+				if errors.Is(err, io.EOF) {
+					msg = ""
+				}
+				h.OnClose(msg)
+				return
+			}
+		}
+	}()
+}
+
+// Sets a deadline for reads and writes that many milliseconds from now, or clears it if 0.
+func (c *Conn) SetTimeout(millis int64) error {
+	var t time.Time
+	if millis > 0 {
+		t = time.Now().Add(time.Duration(millis) * time.Millisecond)
+	}
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Whether the conn goes through the relay.
+func (c *Conn) IsRelay() bool {
+	return c.conn.IsRelay()
+}
+
+func (c *Conn) Token() string {
+	return c.conn.Meta().Token
+}
+
+func (c *Conn) LocalAddr() string {
+	return c.conn.LocalAddr().String()
+}
+
+func (c *Conn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+// The public addr of this client as observed by the server, or empty if unknown.
+func (c *Conn) ObservedAddr() string {
+	if addr := c.conn.Meta().ObservedAddr; addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// An rdv server with the default config, which relays conns that can't be direct.
+type Server struct {
+	addr string
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// Returns a server that listens on addr (host:port) with plain http, serving rdv on any path.
+func NewServer(addr string) *Server {
+	return &Server{addr: addr}
+}
+
+// Serves until Stop is called or the http server fails. Blocks.
+func (s *Server) Serve() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	rs := rdv.NewServer(nil)
+	err := rdv.Serve(ctx, &http.Server{Addr: s.addr, Handler: rs}, rs)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// Stops the server, which closes all conns.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
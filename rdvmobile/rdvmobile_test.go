@@ -0,0 +1,133 @@
+package rdvmobile
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Sends the outcome of an async call to a channel.
+type connResult struct {
+	conn *Conn
+	err  string
+}
+
+type chanCallback chan connResult
+
+func (ch chanCallback) OnConn(conn *Conn)  { ch <- connResult{conn: conn} }
+func (ch chanCallback) OnError(msg string) { ch <- connResult{err: msg} }
+
+type chanHandler struct {
+	data   chan string
+	closed chan string
+}
+
+func (h chanHandler) OnData(b []byte)    { h.data <- string(b) }
+func (h chanHandler) OnClose(msg string) { h.closed <- msg }
+
+// Starts a server on a free port, which is stopped when the test ends. Returns its url.
+func startServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s := NewServer(addr)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve() }()
+	t.Cleanup(func() {
+		s.Stop()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if nc, err := net.Dial("tcp", addr); err == nil {
+			nc.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start")
+		}
+	}
+	return "http://" + addr
+}
+
+func await[T any](t *testing.T, ch chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+		panic("unreachable")
+	}
+}
+
+func TestDialAcceptAsync(t *testing.T) {
+	url := startServer(t)
+	client := NewClient(&ClientOptions{RelayOnly: true, TimeoutMillis: 5000})
+	accepted := make(chanCallback, 1)
+	client.AcceptAsync(url, "token", accepted)
+	dc, err := client.Dial(url, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := await(t, accepted)
+	if res.err != "" {
+		t.Fatal(res.err)
+	}
+	ac := res.conn
+	if !dc.IsRelay() || dc.Token() != "token" || ac.ObservedAddr() == "" {
+		t.Fatalf("unexpected conn: relay %v, token %q, observed addr %q", dc.IsRelay(), dc.Token(), ac.ObservedAddr())
+	}
+
+	h := chanHandler{data: make(chan string, 4), closed: make(chan string, 1)}
+	ac.Receive(h)
+	if _, err := dc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if data := await(t, h.data); data != "hello" {
+		t.Fatalf("expected hello, got %q", data)
+	}
+	dc.Close()
+	if msg := await(t, h.closed); msg != "" {
+		t.Fatalf("expected a clean close, got %q", msg)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	url := startServer(t)
+	client := NewClient(nil)
+	cb := make(chanCallback, 1)
+	task := client.AcceptAsync(url, "lonely", cb)
+	task.Cancel()
+	if res := await(t, cb); res.err == "" {
+		t.Fatal("expected an error once canceled")
+	}
+}
+
+func TestListen(t *testing.T) {
+	url := startServer(t)
+	client := NewClient(&ClientOptions{RelayOnly: true, TimeoutMillis: 5000})
+	cb := make(chanCallback, 2)
+	task := client.Listen(url, "token", cb)
+	for range 2 {
+		dc, err := client.Dial(url, "token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dc.Close()
+		if res := await(t, cb); res.err != "" {
+			t.Fatal(res.err)
+		} else {
+			res.conn.Close()
+		}
+	}
+	task.Cancel()
+	if res := await(t, cb); res.err == "" {
+		t.Fatal("expected an error once canceled")
+	}
+}
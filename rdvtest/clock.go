@@ -0,0 +1,108 @@
+package rdvtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+// A clock that only advances when told to, for the lobby timeouts of a server (see
+// rdv.ServerConfig.Clock). Timers fire synchronously within Advance, in the order of their due
+// times, so that tests don't need to sleep.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// Returns a fake clock, which starts at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) rdv.ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, f: f}
+	t.resetLocked(d)
+	return t
+}
+
+// Advances the clock by d, and fires the timers that are due by then.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		t := c.nextLocked(end)
+		if t == nil {
+			break
+		}
+		t.stopLocked()
+		c.now = t.when
+		c.mu.Unlock()
+		t.f() // may reset timers
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Returns the number of pending timers, e.g. to wait until the server has started a timer.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Returns the earliest timer that is due by end, or nil if there is none.
+func (c *FakeClock) nextLocked(end time.Time) (next *fakeTimer) {
+	for _, t := range c.timers {
+		if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+			next = t
+		}
+	}
+	return next
+}
+
+type fakeTimer struct {
+	c    *FakeClock
+	f    func()
+	when time.Time
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.stopLocked()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	active := t.stopLocked()
+	t.resetLocked(d)
+	return active
+}
+
+func (t *fakeTimer) resetLocked(d time.Duration) {
+	t.when = t.c.now.Add(d)
+	t.c.timers = append(t.c.timers, t)
+}
+
+// Removes the timer, and returns whether it was pending.
+func (t *fakeTimer) stopLocked() bool {
+	for i, other := range t.c.timers {
+		if other == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
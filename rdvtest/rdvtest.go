@@ -0,0 +1,174 @@
+// Package rdvtest provides an in-process rdv server for tests, which clients reach over an
+// in-memory network of pipes, so that dial, accept and relay flows can be tested without binding
+// sockets. Clients of the server only use the relay, since there are no direct conns in memory.
+// The lobby timeouts of the server follow a fake clock, which tests advance explicitly. Clients
+// still use real time for their own timeouts.
+package rdvtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+// An in-memory network, whose conns are synchronous pipes (see net.Pipe) with TCP addrs on
+// 127.0.0.1, so that servers observe distinct addrs for each conn.
+type Network struct {
+	mu        sync.Mutex
+	listeners map[string]*Listener
+	port      uint16
+}
+
+func NewNetwork() *Network {
+	return &Network{listeners: make(map[string]*Listener), port: 49151}
+}
+
+// Listens on the addr, which is any host:port string.
+func (n *Network) Listen(addr string) (*Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners[addr] != nil {
+		return nil, errors.New("rdvtest: addr in use")
+	}
+	l := &Listener{n: n, addr: n.nextAddr(), conns: make(chan net.Conn), done: make(chan struct{}), name: addr}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dials a listener of the network.
+func (n *Network) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	l := n.listeners[addr]
+	local := n.nextAddr()
+	n.mu.Unlock()
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: errors.New("connection refused")}
+	}
+	c, s := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{s, l.addr, local}:
+		return &pipeConn{c, local, l.addr}, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: errors.New("connection refused")}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (n *Network) nextAddr() net.Addr {
+	n.port++
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), n.port))
+}
+
+// A listener of a Network.
+type Listener struct {
+	n     *Network
+	name  string
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case nc := <-l.conns:
+		return nc, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		l.n.mu.Lock()
+		delete(l.n.listeners, l.name)
+		l.n.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+type pipeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+// An rdv server that serves over an in-memory network, until the test ends.
+type Server struct {
+	*rdv.Server
+
+	// URL of the server, for Dial and Accept of its clients.
+	URL string
+
+	Network *Network
+
+	// Clock of the server, unless the config has its own.
+	Clock *FakeClock
+}
+
+// Starts a server with the config, which may be nil, and stops it when the test ends.
+func NewServer(tb testing.TB, cfg *rdv.ServerConfig) *Server {
+	tb.Helper()
+	return NewNetwork().NewServer(tb, "rdv.test", cfg)
+}
+
+// Starts a server on the network at the host, like NewServer, so that clients of any server on the
+// network can reach it, e.g. to test fallback servers (see rdv.ClientConfig.FallbackServers).
+func (n *Network) NewServer(tb testing.TB, host string, cfg *rdv.ServerConfig) *Server {
+	tb.Helper()
+	var c rdv.ServerConfig
+	if cfg != nil {
+		c = *cfg
+	}
+	clock := NewFakeClock(time.Now())
+	if c.Clock == nil {
+		c.Clock = clock
+	}
+	s := &Server{Server: rdv.NewServer(&c), URL: "http://" + host + "/", Network: n, Clock: clock}
+	ln, err := n.Listen(host + ":80")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.Serve(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.ServeListener(ctx, ln)
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return s
+}
+
+// Returns a client of the server with the config, which may be nil. The client only uses the
+// relay, and dials the server, or any other server, over the network.
+func (s *Server) Client(cfg *rdv.ClientConfig) *rdv.Client {
+	var c rdv.ClientConfig
+	if cfg != nil {
+		c = *cfg
+	}
+	c.AddrSpaces = rdv.NoSpaces
+	c.DialServer = s.Network.Dial
+	return rdv.NewClient(&c)
+}
@@ -0,0 +1,75 @@
+package rdvtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+)
+
+func TestRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := NewServer(t, nil)
+	client := s.Client(nil)
+	go func() {
+		conn, _, err := client.Accept(ctx, s.URL, "token", nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "hello")
+	}()
+	conn, _, err := client.Dial(ctx, s.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !conn.IsRelay() {
+		t.Fatal("expected a relay conn")
+	}
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("got %q, want %q", b, "hello")
+	}
+}
+
+func TestLobbyTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := NewServer(t, &rdv.ServerConfig{LobbyTimeout: time.Hour})
+	client := s.Client(nil)
+	errCh := make(chan error, 1)
+	go func() {
+		conn, resp, err := client.Accept(ctx, s.URL, "token", nil)
+		if err == nil {
+			conn.Close()
+		} else if resp == nil || resp.StatusCode != http.StatusRequestTimeout {
+			err = fmt.Errorf("expected %v, got %v", http.StatusRequestTimeout, resp)
+		} else {
+			err = nil
+		}
+		errCh <- err
+	}()
+	for s.Clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.Clock.Advance(time.Hour - time.Second)
+	select {
+	case err := <-errCh:
+		t.Fatalf("expected to wait in the lobby, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Clock.Advance(time.Second)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,109 @@
+package rdv
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Comma-separated list of urls of relay servers, through which the peers relay instead of
+	// the rdv server that matched them. Response only.
+	hRelayAddrs = "Rdv-Relay-Addrs"
+
+	// Token that the peers use on the relay servers. Response only.
+	hRelayToken = "Rdv-Relay-Token"
+
+	// How long relay tokens can be used after the peers are matched
+	relayTokenTTL = time.Minute
+)
+
+// Returns a ServeFunc for a matchmaking tier, which redirects matched peers to a separate tier of
+// relay servers instead of relaying itself, e.g. to the relays closest to the peers. The addrs
+// func returns the urls of the relay servers in order of preference, or nil to relay as usual.
+// The peers still connect directly if they can, and otherwise through the first relay server
+// that they can reach. Relay servers must accept the relay tokens with RelayTokenAuth, using the
+// same key. Relay urls with a ws or wss scheme are reached over WebSocket.
+func RedirectRelay(key string, addrs func(dc, ac *Conn) []string) func(ctx context.Context, dc, ac *Conn) {
+	return func(ctx context.Context, dc, ac *Conn) {
+		relays := addrs(dc, ac)
+		if len(relays) == 0 {
+			DefaultServeFunc(ctx, dc, ac)
+			return
+		}
+		token := newRelayToken(key, time.Now().Add(relayTokenTTL))
+		for _, c := range [][2]*Conn{{dc, ac}, {ac, dc}} {
+			to, from := c[0], c[1]
+			to.meta.setPeerAddrsFrom(from.meta)
+			to.meta.RelayAddrs, to.meta.relayToken = relays, token
+			to.SetWriteDeadline(time.Now().Add(relayTokenTTL))
+			to.meta.toResp(to.meta.hintsFrom(from.meta)).Write(to)
+			to.Close()
+		}
+	}
+}
+
+// Returns an AuthFunc for relay servers behind RedirectRelay, which only admits clients with a
+// valid relay token that was signed with the key.
+func RelayTokenAuth(key string) func(req *http.Request, meta *Meta) error {
+	return func(req *http.Request, meta *Meta) error {
+		if !validRelayToken(key, meta.Token, time.Now()) {
+			return fmt.Errorf("%w: bad relay token", ErrUnauthorized)
+		}
+		return nil
+	}
+}
+
+// Returns a new relay token, i.e. a random nonce and the expiry, signed with the key.
+func newRelayToken(key string, expires time.Time) string {
+	payload := newSessionID() + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + HashToken(key, payload)
+}
+
+func validRelayToken(key, token string, now time.Time) bool {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return false
+	}
+	payload, mac := token[:i], token[i+1:]
+	if subtle.ConstantTimeCompare([]byte(mac), []byte(HashToken(key, payload))) != 1 {
+		return false
+	}
+	_, expires, _ := strings.Cut(payload, ".")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	return err == nil && now.Unix() <= unix
+}
+
+// Signals through the relay servers that the peers were redirected to, in order until one
+// succeeds, and returns the relay conn, or nil if none succeeded. Closes the conn to the
+// matchmaking server, which doesn't relay.
+func (c *Client) redirectRelay(ctx context.Context, log *slog.Logger, tr *tracer, socket *Socket, lobby *Conn) *Conn {
+	lobby.Close()
+	meta := lobby.meta
+	for _, addr := range meta.RelayAddrs {
+		rm := newMeta(meta.IsDialer, addr, meta.Token)
+		rm.serverToken = meta.relayToken
+		rm.maxVersion = max(meta.Version, 1) // both peers propose the same version
+		rm.Hints = HintRelayOnly
+		tr.data(TraceServerDial, netip.AddrPort{}, addr)
+		nc, err := c.httpSignaler(addr, nil).Signal(ctx, socket, rm)
+		if err != nil {
+			log.Debug("rdv: relay redirect failed", "addr", addr, "err", err)
+			tr.event(TraceServerResp, netip.AddrPort{}, err)
+			continue
+		}
+		// The relay conn has the meta of the attempt, but the relay's token and version
+		relayMeta := *meta
+		relayMeta.serverToken, relayMeta.Version = rm.serverToken, rm.Version
+		relay := newRelayConn(nc, nc, &relayMeta, nil)
+		tr.event(TraceServerResp, connAddr(relay), nil)
+		return relay
+	}
+	return nil
+}
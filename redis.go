@@ -0,0 +1,185 @@
+package rdv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deletes a key only if it has the expected value
+const redisReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+// A Lobby backed by Redis, shared by all server instances. Uses a single connection, which is
+// redialed as needed.
+type RedisLobby struct {
+	// Addr of the Redis server, host:port
+	Addr string
+
+	// Password for AUTH, if non-empty
+	Password string
+
+	// Prefix of keys, defaults to "rdv:"
+	Prefix string
+
+	mu sync.Mutex
+	nc net.Conn
+	br *bufio.Reader
+}
+
+func (r *RedisLobby) Claim(ctx context.Context, token, addr string, ttl time.Duration) (string, error) {
+	key := r.key(token)
+	for range 2 { // retry once, in case the key expires in between
+		reply, err := r.do(ctx, "SET", key, addr, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+		if err != nil {
+			return "", err
+		}
+		if reply != nil {
+			return addr, nil
+		}
+		reply, err = r.do(ctx, "GET", key)
+		if err != nil {
+			return "", err
+		}
+		if owner, ok := reply.(string); ok {
+			return owner, nil
+		}
+	}
+	return "", fmt.Errorf("rdv redis: could not claim %s", key)
+}
+
+func (r *RedisLobby) Release(ctx context.Context, token, addr string) error {
+	_, err := r.do(ctx, "EVAL", redisReleaseScript, "1", r.key(token), addr)
+	return err
+}
+
+func (r *RedisLobby) key(token string) string {
+	if r.Prefix == "" {
+		return "rdv:" + token
+	}
+	return r.Prefix + token
+}
+
+// Runs a command and returns the reply, which is a string, int64, []any or nil.
+func (r *RedisLobby) do(ctx context.Context, args ...string) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nc == nil {
+		if err := r.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		r.nc.SetDeadline(deadline)
+	} else {
+		r.nc.SetDeadline(time.Time{})
+	}
+	reply, err := r.roundTrip(args)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		r.nc.Close() // the conn may be out of sync
+		r.nc = nil
+	}
+	return reply, err
+}
+
+func (r *RedisLobby) connect(ctx context.Context) error {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return err
+	}
+	r.nc, r.br = nc, bufio.NewReader(nc)
+	if r.Password != "" {
+		if deadline, ok := ctx.Deadline(); ok {
+			nc.SetDeadline(deadline)
+		}
+		if _, err := r.roundTrip([]string{"AUTH", r.Password}); err != nil {
+			nc.Close()
+			r.nc = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RedisLobby) roundTrip(args []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(r.nc, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(r.br)
+}
+
+// An error reply from Redis
+type redisError string
+
+func (e redisError) Error() string {
+	return "rdv redis: " + string(e)
+}
+
+// Max size of bulk strings and arrays, which are small in practice
+const maxRedisReply = 1 << 20
+
+// Reads a RESP2 reply.
+func readRedisReply(br *bufio.Reader) (any, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("%w: empty redis reply", ErrProtocol)
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxRedisReply {
+			return nil, fmt.Errorf("%w: bad redis bulk length %s", ErrProtocol, line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxRedisReply {
+			return nil, fmt.Errorf("%w: bad redis array length %s", ErrProtocol, line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			arr[i], err = readRedisReply(br)
+			var redisErr redisError
+			if errors.As(err, &redisErr) {
+				arr[i] = redisErr // keep reading the rest of the array
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("%w: bad redis reply %q", ErrProtocol, line)
+}
@@ -0,0 +1,209 @@
+package rdv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Redis server which supports the commands of RedisLobby, with keys that don't expire.
+type fakeRedis struct {
+	password string
+
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+// Serves conns on a loopback addr until the test ends, and returns the addr.
+func (f *fakeRedis) start(t *testing.T) string {
+	t.Helper()
+	f.keys = make(map[string]string)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(nc)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(nc net.Conn) {
+	defer nc.Close()
+	br := bufio.NewReader(nc)
+	authed := f.password == ""
+	for {
+		cmd, err := readRedisReply(br)
+		if err != nil {
+			return
+		}
+		args, _ := cmd.([]any)
+		if len(args) == 0 {
+			return
+		}
+		var reply string
+		switch name := args[0].(string); {
+		case name == "AUTH" && len(args) == 2:
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required\r\n"
+		default:
+			reply = f.exec(args)
+		}
+		if _, err := io.WriteString(nc, reply); err != nil {
+			return
+		}
+	}
+}
+
+// Runs a command, and returns the reply.
+func (f *fakeRedis) exec(args []any) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	str := func(i int) string {
+		if i >= len(args) {
+			return ""
+		}
+		s, _ := args[i].(string)
+		return s
+	}
+	switch str(0) {
+	case "SET": // key value NX PX ms
+		if _, ok := f.keys[str(1)]; ok && str(3) == "NX" {
+			return "$-1\r\n"
+		}
+		f.keys[str(1)] = str(2)
+		return "+OK\r\n"
+	case "GET":
+		if v, ok := f.keys[str(1)]; ok {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+		}
+		return "$-1\r\n"
+	case "EVAL": // the release script: key value
+		if str(1) == redisReleaseScript && f.keys[str(3)] == str(4) {
+			delete(f.keys, str(3))
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisLobby(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	redis := &fakeRedis{password: "secret"}
+	lobby := &RedisLobby{Addr: redis.start(t), Password: "secret"}
+	steps := []struct {
+		op, addr, owner string
+	}{
+		{op: "claim", addr: "a", owner: "a"},
+		{op: "claim", addr: "b", owner: "a"},
+		{op: "release", addr: "b"}, // not the owner
+		{op: "claim", addr: "b", owner: "a"},
+		{op: "release", addr: "a"},
+		{op: "claim", addr: "b", owner: "b"},
+	}
+	for i, step := range steps { // in order, since they change the lobby
+		if step.op == "release" {
+			if err := lobby.Release(ctx, "token", step.addr); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		owner, err := lobby.Claim(ctx, "token", step.addr, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner != step.owner {
+			t.Fatalf("step %d: expected %v, got %v", i, step.owner, owner)
+		}
+	}
+	redis.mu.Lock()
+	defer redis.mu.Unlock()
+	if owner := redis.keys["rdv:token"]; owner != "b" {
+		t.Fatalf("expected the key to be prefixed, got %v", redis.keys)
+	}
+}
+
+func TestRedisLobbyAuth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	redis := &fakeRedis{password: "secret"}
+	lobby := &RedisLobby{Addr: redis.start(t), Password: "wrong"}
+	if _, err := lobby.Claim(ctx, "token", "a", time.Minute); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// Starts an instance with the lobby, whose InstanceAddr is its own URL.
+func startInstance(t *testing.T, lobby Lobby) *httptest.Server {
+	t.Helper()
+	hs := httptest.NewUnstartedServer(nil)
+	server, _ := startServer(t, &ServerConfig{Lobby: lobby, InstanceAddr: "http://" + hs.Listener.Addr().String(), InstanceKey: "secret"})
+	hs.Config.Handler = server
+	hs.Start()
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+// Peers that arrive at different instances are matched by the instance of the first.
+func TestRedisLobbyForward(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	redis := new(fakeRedis)
+	redisAddr := redis.start(t)
+	a := startInstance(t, &RedisLobby{Addr: redisAddr})
+	b := startInstance(t, &RedisLobby{Addr: redisAddr})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := client.Accept(ctx, a.URL, "token", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	// Wait for the claim, so that the dialer is forwarded
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		redis.mu.Lock()
+		claimed := len(redis.keys) > 0
+		redis.mu.Unlock()
+		if claimed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the token to be claimed")
+		}
+	}
+	dc, _, err := client.Dial(ctx, b.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	ac := <-accepted
+	if ac == nil {
+		t.FailNow()
+	}
+	defer ac.Close()
+	exchange(t, dc, ac, "forwarded")
+	exchange(t, ac, dc, "back")
+}
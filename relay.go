@@ -4,8 +4,8 @@ import (
 	"context"
 	"errors"
 	"io"
-	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,10 +14,69 @@ type Relayer struct {
 	DialTap, AcceptTap io.Writer
 
 	// At least this much inactivity is allowed on both peers before terminating the connection.
+	// Data in either direction is activity, so one-way transfers are kept open.
 	// Recommended at least 30s to account for network conditions and
 	// application level heartbeats. Zero means no timeout.
 	// As relays may serve a lot of traffic, activity is checked at an interval.
 	IdleTimeout time.Duration
+
+	// Detects inactivity for IdleTimeout. Defaults to SampledIdle with a resolution of a tenth of
+	// the timeout, up to a second. Use TimerIdle for precise timeouts at low throughput.
+	IdleDetector IdleDetectorFunc
+
+	// If positive, idle relays are probed before they're terminated: each peer is sent up to this
+	// many TCP keepalive probes, one per second, and a peer that doesn't answer ends the relay.
+	// If both answer, the relay is kept open, and idle detection starts over once the probes are
+	// done. Keeps quiet sessions open, e.g. with long polls, while reclaiming relays of peers that
+	// are gone. Relays that aren't over TCP are terminated as usual.
+	//
+	// The probes are answered by the peers' TCP stacks, not by rdv or the application, since
+	// relayed data is opaque to the relay and can't carry probes. So they detect hosts that are
+	// gone or unreachable, but not applications that hang while their host is up.
+	IdleProbes int
+
+	// Called once the dialer has chosen the relay, i.e. when direct connectivity failed, before
+	// any data is relayed. If it returns an error, both conns are closed and Run returns that error.
+	// Can be used to relay only as a last resort with operator approval. Use DenyRelay to only
+	// exchange addresses and rdv headers. If nil, relaying is always allowed.
+	ApproveRelay func(dc, ac *Conn) error
+
+	// Called with the number of bytes relayed so far from the dialer and acceptor, for monitoring
+	// live throughput. Called every ProgressInterval (if positive), whenever another ProgressBytes
+	// have been relayed (if positive), and once when the relay ends. Calls are not concurrent,
+	// but should return quickly, since they may block relaying.
+	Progress         func(dn, an int64)
+	ProgressInterval time.Duration
+	ProgressBytes    int64
+
+	// Max number of bytes per second that are relayed in each direction. Zero means no limit.
+	// Can be used by public relays to cap the throughput of each relay.
+	RateLimit int64
+
+	// Max number of bytes that can be relayed at once, when the rate limit hasn't been reached
+	// recently. Defaults to RateLimit, i.e. one second worth of data. Relaying waits up to
+	// BurstSize/RateLimit at a time, which should be well below IdleTimeout.
+	BurstSize int64
+
+	// Shares a capped uplink fairly with other relays that use the same scheduler. Optional.
+	Scheduler *FairScheduler
+
+	// Parks a relay direction once the source has been idle for this long: its copy buffer is
+	// released, and relaying resumes transparently when the peer writes again. Reduces memory
+	// usage of relays that are kept open but are mostly idle. Zero means never.
+	ParkAfter time.Duration
+
+	// Size of the buffers that data is copied through, in each direction. Buffers are pooled
+	// across relays, which reduces allocations and GC pressure on busy relays. Smaller buffers
+	// save memory with many concurrent relays, larger ones may increase throughput. Defaults to
+	// 32 KiB, like io.Copy.
+	BufferSize int
+}
+
+// An ApproveRelay func which never allows relaying. The server still completes the address exchange,
+// so peers can connect directly.
+func DenyRelay(dc, ac *Conn) error {
+	return ErrRelayDenied
 }
 
 func (r *Relayer) Reject(dc, ac *Conn, statusCode int, reason string) error {
@@ -27,42 +86,183 @@ func (r *Relayer) Reject(dc, ac *Conn, statusCode int, reason string) error {
 }
 
 // Runs the relay service. Return actual data transferred and the first error that occurred.
-// In case one end closed the connection in a normal manner, the error is io.EOF.
+// In case one end closed the connection in a normal manner, the error is io.EOF. If the relay was
+// handed off to another process (see Server.Handoff), the error is ErrHandedOff.
+// If the server set a quota (see ServerConfig.QuotaFunc), the relay ends with ErrRelayQuota
+// once it's exceeded.
 func (r *Relayer) Run(ctx context.Context, dc, ac *Conn) (dn int64, an int64, err error) {
 
 	ctx, cancel := context.WithCancelCause(ctx)
 
 	// Causes all IO to return timeout errors immediately
+	park := r.newParker()
 	timeoutFn := sync.OnceFunc(func() {
+		park.stop()
 		dc.SetDeadline(past())
 		ac.SetDeadline(past())
 	})
 	stop := context.AfterFunc(ctx, timeoutFn)
 	defer stop()
 
-	it := newIdleTimer(r.idleTimeout(), timeoutFn)
+	it := r.newIdleDetector(dc, ac, timeoutFn)
 	defer it.Stop()
 	dTap, aTap := r.taps()
+	var quota io.Writer = noopTap{}
+	if dc.quota > 0 {
+		quota = relayQuota{dc, ac}
+	}
+	dLimit, aLimit := r.newRateLimiter(ctx, systemClock{}, it), r.newRateLimiter(ctx, systemClock{}, it)
+	dSched, aSched := r.Scheduler.flow(ctx, dc, ac, it), r.Scheduler.flow(ctx, dc, ac, it)
+	p := r.newProgress()
+	defer p.stop()
+	pool := relayBufPool(r.BufferSize)
+
+	// Invoked once the dialer's confirm has been received. Data is relayed in either direction
+	// only once approved, so that the acceptor can't send data to a dialer that didn't choose
+	// the relay (or was denied) either.
+	approved := make(chan struct{})
+	approve := func() error {
+		if r.ApproveRelay != nil {
+			if err := r.ApproveRelay(dc, ac); err != nil {
+				return err
+			}
+		}
+		close(approved)
+		return nil
+	}
+
+	if dc.headerRelayed {
+		close(approved) // handed off after the confirm was relayed
+	}
+
+	// Only reads are interrupted when the relay is handed off, so that no data is lost in between
+	h := dc.handoff
+	h.start(func() {
+		park.stop()
+		dc.SetReadDeadline(past())
+		ac.SetReadDeadline(past())
+	})
 
 	// Start only one extra goroutine to save resources
 	done := make(chan struct{})
 	go func() {
-		dn = copyRelay(ac, dc, dTap, it, cancel)
+		dn = copyRelay(ctx, ac, dc, cancel, approve, approved, h, park, pool, it, activityTap{dc}, dLimit, dSched, p.tap(true), quota, dTap)
 		close(done)
 	}()
-	an = copyRelay(dc, ac, aTap, it, cancel)
+	an = copyRelay(ctx, dc, ac, cancel, nil, approved, h, park, pool, it, activityTap{ac}, aLimit, aSched, p.tap(false), quota, aTap)
 	<-done
 	err = context.Cause(ctx)
+	if h.finish() {
+		err = h.handOff(ctx, dc, ac)
+	}
 	return
 }
 
-func copyRelay(to, from *Conn, tap io.Writer, it *idleTimer, cancel context.CancelCauseFunc) (n int64) {
-	defer to.Close()
-	err := initiateRelay(to, from)
-	if err != nil {
+// Hands off a relay that Relayer.Run serves to another process, see Server.Handoff. Set by the
+// server on the dialer conn. A nil relayHandoff is never interrupted.
+type relayHandoff struct {
+	mu          sync.Mutex
+	interrupt   func() // stops reading from the peers, set while Run is relaying
+	requested   bool
+	requestedCh chan struct{} // closed once requested
+
+	stopped   chan bool   // whether the relay stopped intact once interrupted, sent by Run
+	sent      chan error  // result of sending the stopped relay, sent by Handoff
+	handedOff atomic.Bool // set once the relay is handed off
+}
+
+func newRelayHandoff() *relayHandoff {
+	return &relayHandoff{
+		requestedCh: make(chan struct{}),
+		stopped:     make(chan bool, 1),
+		sent:        make(chan error, 1),
+	}
+}
+
+// Sets the func that interrupts the relay.
+func (h *relayHandoff) start(interrupt func()) {
+	if h == nil {
 		return
 	}
-	n, err = copyRelayInner(to, from, tap, it)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.interrupt = interrupt
+}
+
+// Unsets the interrupt func, and returns true if the relay was interrupted.
+func (h *relayHandoff) finish() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.interrupt = nil
+	return h.requested
+}
+
+// Interrupts the relay, and returns false if it isn't relaying. Otherwise, Run then sends whether
+// the relay stopped intact on stopped, and awaits the result on sent.
+func (h *relayHandoff) request() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.interrupt == nil || h.requested {
+		return false
+	}
+	h.requested = true
+	close(h.requestedCh)
+	h.interrupt()
+	return true
+}
+
+func (h *relayHandoff) interrupted() <-chan struct{} {
+	if h == nil {
+		return nil
+	}
+	return h.requestedCh
+}
+
+func (h *relayHandoff) isInterrupted() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requested
+}
+
+// Passes the interrupted relay to Handoff, unless it ended in the meantime, and closes the conns,
+// which the other process then holds duplicates of.
+func (h *relayHandoff) handOff(ctx context.Context, dc, ac *Conn) error {
+	defer dc.Close()
+	defer ac.Close()
+	if ctx.Err() != nil {
+		h.stopped <- false
+		return context.Cause(ctx)
+	}
+	h.stopped <- true
+	if err := <-h.sent; err != nil {
+		return err
+	}
+	h.handedOff.Store(true)
+	return ErrHandedOff
+}
+
+// Initiates one direction of the relay, and copies it once the relay is approved. Cancels the
+// relay when done, with the error that ended it, unless the relay is being handed off.
+func copyRelay(ctx context.Context, to, from *Conn, cancel context.CancelCauseFunc, approve func() error, approved chan struct{}, h *relayHandoff, park *parker, pool *sync.Pool, taps ...io.Writer) (n int64) {
+	err := initiateRelay(to, from, approve)
+	if err == nil {
+		select {
+		case <-approved:
+			n, err = park.copy(pool, to, from, taps...)
+		case <-ctx.Done():
+		case <-h.interrupted():
+		}
+	}
+	if h.isInterrupted() {
+		return // the conns stay open for the handoff
+	}
+	to.Close()
 	cancel(err)
 	return
 }
@@ -70,41 +270,101 @@ func copyRelay(to, from *Conn, tap io.Writer, it *idleTimer, cancel context.Canc
 // Sends response header containing addresses from the other conn,
 // reads the rdv header line and relays it. Returns EOF if the rdv header line
 // wasn't received, which typically indicates that p2p was established out-of-bounds.
-func initiateRelay(to, from *Conn) error {
+//
+// Building block for custom relays: call it once in each direction, concurrently, and then
+// use RelayCopy. See Relayer.Run.
+func InitiateRelay(to, from *Conn) error {
+	return initiateRelay(to, from, nil)
+}
 
-	to.meta.setPeerAddrsFrom(from.meta)
-	resp := to.meta.toResp()
-	err := resp.Write(to)
-	if err != nil {
-		return err
+// Like InitiateRelay, but calls approve (if non-nil) before the rdv header line is relayed.
+// Steps that are already done are skipped, e.g. for relays that were handed off (see
+// Server.Handoff).
+func initiateRelay(to, from *Conn, approve func() error) error {
+	if !to.respSent {
+		to.meta.setPeerAddrsFrom(from.meta)
+		resp := to.meta.toResp(to.meta.hintsFrom(from.meta))
+		if err := resp.Write(to); err != nil {
+			return err
+		}
+		to.respSent = true
+	}
+	if from.headerRelayed {
+		return nil
 	}
 
-	// Read expected rdv header line
+	// Read expected rdv header line, with any timestamps (see ClientConfig.ClockSync). If
+	// interrupted, what was read is read again next time.
 	selfHeader, _ := from.headers()
-	err = expectStr(from, selfHeader)
+	line, _, err := readHeader(from, selfHeader)
 	if err != nil {
+		if !errors.Is(err, ErrProtocol) {
+			from.early = append(line, from.early...)
+			from.read.Add(-int64(len(line)))
+		}
 		return err
 	}
-	// Write rdv header line to the other peer
-	_, err = io.WriteString(to, selfHeader)
-	return err
+	if approve != nil {
+		if err = approve(); err != nil {
+			return err
+		}
+	}
+	// Write rdv header line to the other peer, as is
+	if _, err = to.Write(line); err != nil {
+		return err
+	}
+	from.headerRelayed = true
+	return nil
+}
+
+// Copies data from one peer to the other, after InitiateRelay has completed. Data is written to the
+// taps before the destination, which can be used for accounting, rate limiting or inspection.
+// Returns the number of bytes copied, and io.EOF if the source ended normally.
+func RelayCopy(to io.Writer, from io.Reader, taps ...io.Writer) (n int64, err error) {
+	return relayCopy(relayBufPool(0), to, from, taps...)
 }
 
-// Copies data with the configured tap
-func copyRelayInner(to io.WriteCloser, from io.Reader, tap io.Writer, it *idleTimer) (n int64, err error) {
-	w := io.MultiWriter(it, tap, to)
-	n, err = io.Copy(w, from)
+// Like RelayCopy, with a copy buffer from the pool.
+func relayCopy(pool *sync.Pool, to io.Writer, from io.Reader, taps ...io.Writer) (n int64, err error) {
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	w := io.MultiWriter(append(taps[:len(taps):len(taps)], to)...)
+	n, err = io.CopyBuffer(w, from, *buf)
 	if err == nil {
 		err = io.EOF
 	}
 	return
 }
 
-func (r *Relayer) idleTimeout() time.Duration {
-	if r.IdleTimeout > 0 {
-		return r.IdleTimeout
+func (r *Relayer) newIdleDetector(dc, ac *Conn, onIdle func()) IdleDetector {
+	if r.IdleTimeout <= 0 {
+		return noopIdle{}
+	}
+	fn := r.IdleDetector
+	if fn == nil {
+		fn = SampledIdle(min(time.Second, r.IdleTimeout/10))
+	}
+	if r.IdleProbes <= 0 {
+		return fn(r.IdleTimeout, onIdle)
+	}
+	p := new(probingIdle)
+	var start func()
+	start = func() {
+		p.set(fn(r.IdleTimeout, func() {
+			restore, ok := probeKeepAlive(r.IdleProbes, dc, ac)
+			if !ok {
+				onIdle()
+				return
+			}
+			// Dead peers fail their conn within the probes, which ends the relay
+			time.AfterFunc(time.Duration(r.IdleProbes+1)*time.Second, func() {
+				restore()
+				start()
+			})
+		}))
 	}
-	return math.MaxInt64
+	start()
+	return p
 }
 
 // Utility to get non-nil taps
@@ -0,0 +1,141 @@
+package rdv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Copies short relay sessions, with the pooled buffers of the Relayer and with io.Copy, which
+// allocates a buffer per session.
+func BenchmarkRelayCopy(b *testing.B) {
+	data := make([]byte, 64<<10)
+	session := func(b *testing.B, copy func(io.Writer, io.Reader) (int64, error)) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for range b.N {
+			// Hide WriterTo, which conns don't implement either
+			copy(io.Discard, struct{ io.Reader }{bytes.NewReader(data)})
+		}
+	}
+	for _, size := range []int{4 << 10, 32 << 10} {
+		b.Run(fmt.Sprintf("pool-%dk", size>>10), func(b *testing.B) {
+			pool := relayBufPool(size)
+			session(b, func(w io.Writer, r io.Reader) (int64, error) {
+				return relayCopy(pool, w, r, noopTap{})
+			})
+		})
+	}
+	b.Run("io.Copy", func(b *testing.B) {
+		session(b, func(w io.Writer, r io.Reader) (int64, error) {
+			return io.Copy(io.MultiWriter(noopTap{}, w), r)
+		})
+	})
+}
+
+func TestProbeKeepAlive(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("keepalive config can only be read on linux")
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	nc, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	tc := nc.(*net.TCPConn)
+	custom := net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 7 * time.Second, Count: 4}
+	tc.SetKeepAliveConfig(custom)
+	conn := newDirectConn(nc, false, newMeta(true, "", "token"), nil)
+
+	restore, ok := probeKeepAlive(3, conn)
+	if !ok {
+		t.Fatal("expected a tcp conn")
+	}
+	probing := net.KeepAliveConfig{Enable: true, Idle: time.Second, Interval: time.Second, Count: 3}
+	if got := keepAliveConfig(tc); got != probing {
+		t.Fatalf("expected %+v, got %+v", probing, got)
+	}
+	restore()
+	if got := keepAliveConfig(tc); got != custom {
+		t.Fatalf("expected %+v, got %+v", custom, got)
+	}
+}
+
+// Nothing is relayed in either direction until the dialer confirms and the relay is approved.
+func TestApproveRelay(t *testing.T) {
+	for name, approval := range map[string]error{"approved": nil, "denied": ErrRelayDenied} {
+		t.Run(name, func(t *testing.T) {
+			dcClient, dcServer := net.Pipe()
+			acClient, acServer := net.Pipe()
+			defer dcClient.Close()
+			defer acClient.Close()
+			dc := newRelayConn(dcServer, dcServer, newMeta(true, "", "token"), nil)
+			ac := newRelayConn(acServer, acServer, newMeta(false, "", "token"), nil)
+			confirm, hello := dc.headers()
+			approving := make(chan struct{})
+			r := &Relayer{ApproveRelay: func(dc, ac *Conn) error {
+				close(approving)
+				return approval
+			}}
+			done := make(chan error, 1)
+			go func() {
+				_, _, err := r.Run(context.Background(), dc, ac)
+				done <- err
+			}()
+
+			// The acceptor sends data right after its hello
+			acr := bufio.NewReader(acClient)
+			if _, err := http.ReadResponse(acr, nil); err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				io.WriteString(acClient, hello+"early")
+				io.Copy(io.Discard, acr) // the confirm, if relayed
+			}()
+			dcr := bufio.NewReader(dcClient)
+			if _, err := http.ReadResponse(dcr, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := expectStr(dcr, hello); err != nil {
+				t.Fatal(err)
+			}
+			dcClient.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			if _, err := dcr.ReadByte(); !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("expected nothing before the confirm, got %v", err)
+			}
+			dcClient.SetReadDeadline(time.Time{})
+
+			go io.WriteString(dcClient, confirm)
+			<-approving
+			if approval != nil {
+				if got, _ := io.ReadAll(dcr); len(got) > 0 {
+					t.Fatalf("expected nothing once denied, got %q", got)
+				}
+				if err := <-done; !errors.Is(err, approval) {
+					t.Fatalf("expected %v, got %v", approval, err)
+				}
+				return
+			}
+			got := make([]byte, 5)
+			if _, err := io.ReadFull(dcr, got); err != nil || string(got) != "early" {
+				t.Fatalf("expected early, got %q, %v", got, err)
+			}
+			dcClient.Close()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package rdv
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// A report of a client's connection attempt, with the outcome of each candidate. Useful for
+// debugging e.g. why a conn went through the relay. See Meta.Report.
+type ConnReport struct {
+	Start      time.Time
+	Candidates []CandidateReport
+}
+
+// The outcome of a candidate conn. Times are relative to the start of the attempt, and zero if
+// the step never completed.
+type CandidateReport struct {
+	Addr  netip.AddrPort
+	Space AddrSpace
+
+	// Whether the candidate is the relay, or was accepted from the peer rather than dialed.
+	Relay, Inbound bool
+
+	// Not dialed, or rejected if inbound, because the addr space isn't in ClientConfig.AddrSpaces,
+	// or because the addr is hopeless (see ClientConfig.Pairing).
+	Skipped bool
+
+	DialTime  time.Duration // when the conn was established
+	DialErr   error
+	ShakeTime time.Duration // when the candidate handshake completed
+	ShakeErr  error
+	Chosen    bool
+}
+
+// Returns a human readable table of the candidates.
+func (r *ConnReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "rdv attempt at %s, %d candidates\n", r.Start.Format(time.RFC3339Nano), len(r.Candidates))
+	for _, c := range r.Candidates {
+		kind := "dial"
+		switch {
+		case c.Relay:
+			kind = "relay"
+		case c.Inbound:
+			kind = "accept"
+		}
+		outcome := "pending"
+		switch {
+		case c.Skipped:
+			outcome = "skipped"
+		case c.DialErr != nil:
+			outcome = fmt.Sprintf("dial failed after %v: %v", c.DialTime, c.DialErr)
+		case c.ShakeErr != nil:
+			outcome = fmt.Sprintf("shake failed after %v: %v", c.ShakeTime, c.ShakeErr)
+		case c.ShakeTime > 0:
+			outcome = fmt.Sprintf("connected in %v, shook in %v", c.DialTime, c.ShakeTime)
+		case c.DialTime > 0:
+			outcome = fmt.Sprintf("connected in %v", c.DialTime)
+		}
+		chosen := ""
+		if c.Chosen {
+			chosen = " (chosen)"
+		}
+		fmt.Fprintf(&b, "  %-6s %-8s %s: %s%s\n", kind, c.Space, c.Addr, outcome, chosen)
+	}
+	return b.String()
+}
+
+// Updates the report with a trace event.
+func (r *ConnReport) record(ev TraceEvent, addr netip.AddrPort, err error) {
+	if !addr.IsValid() {
+		return
+	}
+	var c *CandidateReport
+	switch ev.Kind {
+	case TraceServerResp, TraceSkip, TraceAccept, TraceReject, TraceDial:
+		r.Candidates = append(r.Candidates, CandidateReport{Addr: addr, Space: GetAddrSpace(addr.Addr())})
+		c = &r.Candidates[len(r.Candidates)-1]
+	default:
+		// The same addr may be both dialed and accepted, so find the one that's still alive
+		for i := len(r.Candidates) - 1; i >= 0 && c == nil; i-- {
+			if cand := &r.Candidates[i]; cand.Addr == addr && cand.Inbound == ev.Inbound && cand.DialErr == nil && !cand.Skipped {
+				c = cand
+			}
+		}
+		if c == nil {
+			return
+		}
+	}
+	since := ev.Time.Sub(r.Start)
+	switch ev.Kind {
+	case TraceServerResp:
+		c.Relay, c.DialTime = true, since
+	case TraceSkip:
+		c.Skipped = true
+	case TraceReject:
+		c.Inbound, c.Skipped = true, true
+	case TraceAccept:
+		c.Inbound, c.DialTime = true, since
+	case TraceDialOk:
+		c.DialTime = since
+	case TraceDialErr:
+		c.DialTime, c.DialErr = since, err
+	case TraceShakeOk:
+		c.ShakeTime = since
+	case TraceShakeErr:
+		c.ShakeTime, c.ShakeErr = since, err
+	case TraceChosen:
+		c.Chosen = true
+	}
+}
+
+// Returns a copy of the report.
+func (r *ConnReport) clone() *ConnReport {
+	return &ConnReport{Start: r.Start, Candidates: append([]CandidateReport(nil), r.Candidates...)}
+}
@@ -0,0 +1,397 @@
+package rdv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Resumable conns frame their data, so that a conn can be reattached after it fails, e.g. when
+// the rdv server fails over to its standby (see ServerConfig.Standby). Each attach starts with a
+// hello of each peer, with the session id and the number of bytes received, after which each
+// peer resends the data that the other hasn't received:
+//
+//	hello: session [16] | received [8]
+//	frame: type [1] | length [4] | payload
+const (
+	frameResumeData  = 0 // payload is data
+	frameResumeAck   = 1 // payload is the number of bytes read by the app [8]
+	frameResumeClose = 2 // no payload, the peer closed the conn
+
+	// Max payload of data frames
+	maxResumeFrame = 16 << 10
+
+	// Max number of bytes sent that the peer hasn't read yet, which bounds the buffers of both
+	resumeWindow = 1 << 20
+
+	// Number of bytes read between acks
+	resumeAckEvery = resumeWindow / 4
+
+	// Timeouts of the hello and of each attempt to reattach
+	resumeHelloTimeout   = 10 * time.Second
+	resumeAttemptTimeout = 10 * time.Second
+
+	// Backoff between attempts to reattach
+	minResumeBackoff = 250 * time.Millisecond
+	maxResumeBackoff = 5 * time.Second
+)
+
+// A conn that survives failures of the underlying conn, e.g. of the rdv server that relays it,
+// by reattaching through the next rdv server, e.g. a standby. Data is buffered until the peer
+// has read it, and resent after reattaching, so that none is lost. Both peers must use resumable
+// conns. Experimental.
+type ResumableConn struct {
+	c        *Client
+	addrs    []string
+	token    string
+	header   http.Header
+	isDialer bool
+	log      *slog.Logger
+
+	ctx    context.Context // canceled on Close
+	cancel context.CancelFunc
+
+	wmu sync.Mutex // serializes frames, and orders resent data before new data
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	session  []byte
+	conn     *Conn // current conn, nil while reattaching
+	gen      int   // incremented on each attach and failure, so that failures are handled once
+	sendBuf  []byte
+	acked    uint64 // bytes that the peer has received, i.e. the offset of sendBuf
+	readBuf  []byte
+	received uint64 // bytes received from the peer
+	read     uint64 // bytes read by the app
+	ackedAt  uint64 // bytes read by the app when the last ack was sent
+	err      error  // set when the conn is closed, or reattaching failed
+}
+
+// Like Dial, but returns a resumable conn, which reattaches through the next of addrs if the conn
+// fails, and so on, until ClientConfig.ResumeTimeout. Typically, addrs has the primary rdv server
+// and its standby. The peer must use AcceptResumable with the same addrs.
+func (c *Client) DialResumable(ctx context.Context, addrs []string, token string, reqHeader http.Header) (*ResumableConn, error) {
+	return c.resumable(ctx, true, addrs, token, reqHeader)
+}
+
+// Like Accept, but returns a resumable conn, see DialResumable.
+func (c *Client) AcceptResumable(ctx context.Context, addrs []string, token string, reqHeader http.Header) (*ResumableConn, error) {
+	return c.resumable(ctx, false, addrs, token, reqHeader)
+}
+
+func (c *Client) resumable(ctx context.Context, isDialer bool, addrs []string, token string, reqHeader http.Header) (*ResumableConn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("rdv: no addrs to resume through")
+	}
+	conn, _, err := c.doHTTP(ctx, func() *Meta {
+		meta := newMeta(isDialer, addrs[0], token)
+		meta.Hints |= HintResumable
+		return meta
+	}, addrs[0], reqHeader)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ResumableConn{
+		c:        c,
+		addrs:    addrs,
+		token:    token,
+		header:   reqHeader,
+		isDialer: isDialer,
+		log:      c.cfg.Logger.With("token", token),
+	}
+	rc.cond = sync.NewCond(&rc.mu)
+	if session, err := hex.DecodeString(conn.meta.Session); err == nil && len(session) == 16 {
+		rc.session = session
+	} else if isDialer {
+		// The server didn't assign a session, so the acceptor adopts the dialer's in the first hello
+		rc.session, _ = hex.DecodeString(newSessionID())
+	}
+	rc.ctx, rc.cancel = context.WithCancel(context.Background())
+	if err := rc.attach(conn); err != nil {
+		rc.cancel()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Returns the current conn, or nil while reattaching. Data must not be read or written on it.
+func (rc *ResumableConn) Conn() *Conn {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.conn
+}
+
+func (rc *ResumableConn) Read(p []byte) (int, error) {
+	rc.mu.Lock()
+	for len(rc.readBuf) == 0 && rc.err == nil {
+		rc.cond.Wait()
+	}
+	if len(rc.readBuf) == 0 {
+		defer rc.mu.Unlock()
+		return 0, rc.err
+	}
+	n := copy(p, rc.readBuf)
+	rc.readBuf = rc.readBuf[n:]
+	rc.read += uint64(n)
+	var ack []byte
+	if rc.read-rc.ackedAt >= resumeAckEvery {
+		rc.ackedAt = rc.read
+		ack = binary.BigEndian.AppendUint64(nil, rc.read)
+	}
+	conn, gen := rc.conn, rc.gen
+	rc.mu.Unlock()
+	if ack != nil && conn != nil {
+		rc.wmu.Lock()
+		err := writeResumeFrame(conn, frameResumeAck, ack)
+		rc.wmu.Unlock()
+		if err != nil {
+			rc.fail(gen, err)
+		}
+	}
+	return n, nil
+}
+
+func (rc *ResumableConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		rc.mu.Lock()
+		for len(rc.sendBuf) >= resumeWindow && rc.err == nil {
+			rc.cond.Wait()
+		}
+		rc.mu.Unlock()
+
+		rc.wmu.Lock()
+		rc.mu.Lock()
+		if rc.err != nil {
+			rc.mu.Unlock()
+			rc.wmu.Unlock()
+			return n, rc.err
+		}
+		chunk := p[:min(len(p), maxResumeFrame)]
+		rc.sendBuf = append(rc.sendBuf, chunk...)
+		conn, gen := rc.conn, rc.gen
+		rc.mu.Unlock()
+		if conn != nil {
+			if err := writeResumeFrame(conn, frameResumeData, chunk); err != nil {
+				rc.fail(gen, err) // the chunk is resent after reattaching
+			}
+		}
+		rc.wmu.Unlock()
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Closes the conn, and tells the peer if it's attached. Data that the peer hasn't received is
+// discarded.
+func (rc *ResumableConn) Close() error {
+	rc.wmu.Lock()
+	rc.mu.Lock()
+	if rc.err != nil {
+		rc.mu.Unlock()
+		rc.wmu.Unlock()
+		return nil
+	}
+	conn := rc.conn
+	rc.closeLocked(net.ErrClosed)
+	rc.mu.Unlock()
+	if conn != nil {
+		conn.SetWriteDeadline(verySoon())
+		writeResumeFrame(conn, frameResumeClose, nil)
+		conn.Close()
+	}
+	rc.wmu.Unlock()
+	return nil
+}
+
+// Must be called with mu held.
+func (rc *ResumableConn) closeLocked(err error) {
+	rc.err = err
+	rc.gen++
+	rc.conn = nil
+	rc.cancel()
+	rc.cond.Broadcast()
+}
+
+// Exchanges hellos on the conn, resends the data that the peer hasn't received, and starts
+// reading from it.
+func (rc *ResumableConn) attach(conn *Conn) error {
+	rc.mu.Lock()
+	hello := make([]byte, 16, 24)
+	copy(hello, rc.session) // zeros if the acceptor hasn't adopted the session yet
+	hello = binary.BigEndian.AppendUint64(hello, rc.received)
+	rc.mu.Unlock()
+	conn.SetDeadline(time.Now().Add(resumeHelloTimeout))
+	if _, err := conn.Write(hello); err != nil {
+		conn.Close()
+		return err
+	}
+	peer := make([]byte, 24)
+	if _, err := io.ReadFull(conn, peer); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	peerReceived := binary.BigEndian.Uint64(peer[16:])
+
+	rc.wmu.Lock()
+	defer rc.wmu.Unlock()
+	rc.mu.Lock()
+	if rc.session == nil {
+		rc.session = peer[:16]
+	}
+	adopting := rc.gen == 0 && string(peer[:16]) == string(make([]byte, 16))
+	if (string(peer[:16]) != string(rc.session) && !adopting) || peerReceived < rc.acked || peerReceived > rc.acked+uint64(len(rc.sendBuf)) {
+		rc.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("%w: bad resume hello", ErrProtocol)
+	}
+	if rc.err != nil {
+		rc.mu.Unlock()
+		conn.Close()
+		return rc.err
+	}
+	rc.sendBuf = rc.sendBuf[peerReceived-rc.acked:]
+	rc.acked = peerReceived
+	rc.conn = conn
+	rc.gen++
+	gen, resend := rc.gen, rc.sendBuf
+	rc.cond.Broadcast()
+	rc.mu.Unlock()
+
+	go rc.readLoop(conn, gen)
+	for len(resend) > 0 {
+		chunk := resend[:min(len(resend), maxResumeFrame)]
+		if err := writeResumeFrame(conn, frameResumeData, chunk); err != nil {
+			rc.fail(gen, err)
+			break
+		}
+		resend = resend[len(chunk):]
+	}
+	return nil
+}
+
+// Reads frames from the conn until it fails.
+func (rc *ResumableConn) readLoop(conn *Conn, gen int) {
+	br := bufio.NewReader(conn)
+	hdr := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			rc.fail(gen, err)
+			return
+		}
+		n := binary.BigEndian.Uint32(hdr[1:])
+		if n > maxResumeFrame || (hdr[0] == frameResumeAck && n != 8) {
+			rc.fail(gen, fmt.Errorf("%w: bad resume frame", ErrProtocol))
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			rc.fail(gen, err)
+			return
+		}
+		rc.mu.Lock()
+		if gen != rc.gen {
+			rc.mu.Unlock()
+			return
+		}
+		switch hdr[0] {
+		case frameResumeData:
+			rc.readBuf = append(rc.readBuf, payload...)
+			rc.received += uint64(n)
+		case frameResumeAck:
+			if read := binary.BigEndian.Uint64(payload); read > rc.acked && read <= rc.acked+uint64(len(rc.sendBuf)) {
+				rc.sendBuf = rc.sendBuf[read-rc.acked:]
+				rc.acked = read
+			}
+		case frameResumeClose:
+			rc.closeLocked(io.EOF)
+			rc.mu.Unlock()
+			conn.Close()
+			return
+		}
+		rc.cond.Broadcast()
+		rc.mu.Unlock()
+	}
+}
+
+// Handles a failure of the conn of the given attach, by reattaching in the background.
+func (rc *ResumableConn) fail(gen int, err error) {
+	rc.mu.Lock()
+	if gen != rc.gen || rc.err != nil {
+		rc.mu.Unlock()
+		return
+	}
+	conn := rc.conn
+	rc.conn = nil
+	rc.gen++
+	rc.mu.Unlock()
+	conn.Close()
+	go rc.reattach(err)
+}
+
+// Reattaches through the addrs in order, until it succeeds or ResumeTimeout passes.
+func (rc *ResumableConn) reattach(cause error) {
+	rc.log.Info("rdv: resumable conn failed, reattaching", "err", cause)
+	ctx, cancel := context.WithTimeout(rc.ctx, rc.c.cfg.ResumeTimeout)
+	defer cancel()
+	header := rc.header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set(hSession, hex.EncodeToString(rc.session))
+	backoff := minResumeBackoff
+	for i := 0; ; i++ {
+		addr := rc.addrs[i%len(rc.addrs)]
+		err := rc.reattachTo(ctx, addr, header)
+		if err == nil {
+			rc.log.Info("rdv: resumable conn reattached", "addr", addr)
+			return
+		}
+		rc.log.Debug("rdv: reattach failed", "addr", addr, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			rc.mu.Lock()
+			if rc.err == nil {
+				rc.closeLocked(fmt.Errorf("rdv: resumable conn failed: %w", cause))
+			}
+			rc.mu.Unlock()
+			return
+		}
+		backoff = min(2*backoff, maxResumeBackoff)
+	}
+}
+
+func (rc *ResumableConn) reattachTo(ctx context.Context, addr string, header http.Header) error {
+	ctx, cancel := context.WithTimeout(ctx, resumeAttemptTimeout)
+	defer cancel()
+	conn, _, err := rc.c.doHTTP(ctx, func() *Meta {
+		meta := newMeta(rc.isDialer, addr, rc.token)
+		meta.Hints |= HintResumable
+		return meta
+	}, addr, header)
+	if err != nil {
+		return err
+	}
+	return rc.attach(conn)
+}
+
+func writeResumeFrame(w io.Writer, typ byte, payload []byte) error {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
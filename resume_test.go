@@ -0,0 +1,102 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Dials and accepts resumable conns through a server, which are closed when the test ends.
+func resumablePair(t *testing.T, cfg *ServerConfig) (dc, ac *ResumableConn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, cfg)
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces, ResumeTimeout: 500 * time.Millisecond})
+	addrs := []string{hs.URL}
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		ac, err = client.AcceptResumable(ctx, addrs, "token", nil)
+		done <- err
+	}()
+	dc, err := client.DialResumable(ctx, addrs, "token", nil)
+	if err := errors.Join(err, <-done); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dc.Close()
+		ac.Close()
+	})
+	return dc, ac
+}
+
+func TestResume(t *testing.T) {
+	var auths atomic.Int32
+	dc, ac := resumablePair(t, &ServerConfig{AuthFunc: func(req *http.Request, meta *Meta) error {
+		if meta.Token != "token" {
+			t.Errorf("expected the token of the conn, got %q", meta.Token)
+		}
+		auths.Add(1)
+		return nil
+	}})
+	if _, err := io.WriteString(dc, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	dc.Conn().Close() // both peers reattach
+
+	if _, err := io.WriteString(dc, " world"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(ac, buf); err != nil || string(buf) != "hello world" {
+		t.Fatalf("expected hello world, got %q, %v", buf, err)
+	}
+	if n := auths.Load(); n != 4 {
+		t.Fatalf("expected each peer to be authenticated twice, got %d", n)
+	}
+}
+
+func TestResumeRejected(t *testing.T) {
+	var reject atomic.Bool
+	dc, ac := resumablePair(t, &ServerConfig{AuthFunc: func(req *http.Request, meta *Meta) error {
+		if reject.Load() {
+			return &StatusError{Code: http.StatusForbidden}
+		}
+		return nil
+	}})
+	reject.Store(true)
+	dc.Conn().Close()
+	if _, err := ac.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the conn to fail, got %v", err)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	var s sessionStore
+	s.add("a", "ns")
+	if !s.has("a", "ns") || s.has("a", "other") || s.has("b", "ns") {
+		t.Fatal("expected only session a in ns")
+	}
+	for i := range maxSessions {
+		s.add(strconv.Itoa(i), "ns")
+	}
+	if s.has("a", "ns") || !s.has(strconv.Itoa(0), "ns") {
+		t.Fatal("expected the oldest session to be evicted")
+	}
+	if len(s.m) != maxSessions || s.order.Len() != maxSessions {
+		t.Fatalf("expected %d sessions, got %d", maxSessions, len(s.m))
+	}
+
+	// Adding a session again extends it
+	s.add(strconv.Itoa(0), "ns")
+	s.add("b", "ns")
+	if !s.has(strconv.Itoa(0), "ns") || s.has(strconv.Itoa(1), "ns") {
+		t.Fatal("expected the extended session to be kept")
+	}
+}
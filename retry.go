@@ -0,0 +1,108 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Retries of Dial, Accept and Connect when signaling fails transiently, e.g. with 503 during a
+// server restart, or a reset conn. Not when replaced in the lobby (409), since two clients with
+// the same token and role would evict each other until they give up. See ClientConfig.Retry.
+type RetryConfig struct {
+	// Max number of attempts, including the first. Defaults to 5.
+	MaxAttempts int
+
+	// Backoff before the first retry, which doubles on each retry up to MaxBackoff, or the
+	// Retry-After of the server if longer. Defaults to 250ms and 10s.
+	MinBackoff, MaxBackoff time.Duration
+
+	// Fraction of the backoff which is random, between 0 and 1, so that many clients don't retry
+	// at once after a server restart. Defaults to 0.5. Negative means no jitter.
+	Jitter float64
+}
+
+func (r *RetryConfig) setDefaults() {
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = 5
+	}
+	if r.MinBackoff == 0 {
+		r.MinBackoff = 250 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 10 * time.Second
+	}
+	if r.Jitter == 0 {
+		r.Jitter = 0.5
+	}
+}
+
+// Returns the backoff before the next attempt, after the given number of failed attempts.
+func (r *RetryConfig) backoff(attempts int, resp *http.Response) time.Duration {
+	d := r.MinBackoff << min(attempts-1, 30)
+	if d <= 0 || d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	if r.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * min(r.Jitter, 1) * float64(d))
+	}
+	return max(d, retryAfter(resp))
+}
+
+// Returns true if signaling failed in a way that's likely to succeed later.
+func isTransient(resp *http.Response, err error) bool {
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, ErrServerTimeout) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Connects through the rdv server or its fallbacks, and retries if signaling fails transiently
+// (see Retry).
+func (c *Client) doHTTP(ctx context.Context, meta func() *Meta, addr string, reqHeader http.Header) (*Conn, *http.Response, error) {
+	for attempts := 1; ; attempts++ {
+		sig := c.serverSignaler(addr, reqHeader)
+		signaled := make(chan error, 1)
+		conn, err := c.do(ctx, meta(), &notifySignaler{sig, signaled})
+		if err == nil || c.cfg.Retry == nil || attempts >= c.cfg.Retry.MaxAttempts || ctx.Err() != nil {
+			return conn, sig.Response, err
+		}
+		select {
+		case sigErr := <-signaled:
+			if sigErr == nil || !isTransient(sig.Response, sigErr) {
+				return conn, sig.Response, err
+			}
+		default: // failed before signaling
+			return conn, sig.Response, err
+		}
+		backoff := c.cfg.Retry.backoff(attempts, sig.Response)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return conn, sig.Response, err
+		}
+		c.cfg.Logger.Debug("rdv: retrying", "addr", addr, "attempts", attempts, "backoff", backoff, "err", err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return conn, sig.Response, err
+		}
+	}
+}
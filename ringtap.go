@@ -0,0 +1,81 @@
+package rdv
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// A tap which keeps the last bytes of a relay direction in a ring buffer, for debugging protocol
+// issues between peers without capturing all traffic. Use it as a Relayer tap, and Dump it e.g.
+// when Run returns an unexpected error. It can also be served over http, for dumping on demand
+// from an admin endpoint. Safe for concurrent use.
+type RingTap struct {
+	mu    sync.Mutex
+	buf   []byte
+	pos   int // next write position
+	total int64
+}
+
+// Returns a ring tap which keeps the last size bytes.
+func NewRingTap(size int) *RingTap {
+	return &RingTap{buf: make([]byte, size)}
+}
+
+func (t *RingTap) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total += int64(len(p))
+	if len(t.buf) == 0 {
+		return len(p), nil
+	}
+	n := len(p)
+	if len(p) > len(t.buf) {
+		p = p[len(p)-len(t.buf):]
+	}
+	for len(p) > 0 {
+		c := copy(t.buf[t.pos:], p)
+		p = p[c:]
+		t.pos = (t.pos + c) % len(t.buf)
+	}
+	return n, nil
+}
+
+// Returns a copy of the kept bytes, oldest first, and the total number of bytes written.
+func (t *RingTap) Bytes() (b []byte, total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.total < int64(len(t.buf)) {
+		return append([]byte(nil), t.buf[:t.total]...), t.total
+	}
+	b = append(b, t.buf[t.pos:]...)
+	return append(b, t.buf[:t.pos]...), t.total
+}
+
+// Writes a hex and ASCII dump of the kept bytes. Offsets are relative to the start of the stream.
+func (t *RingTap) Dump(w io.Writer) error {
+	b, total := t.Bytes()
+	start := total - int64(len(b))
+	if _, err := fmt.Fprintf(w, "last %d of %d bytes\n", len(b), total); err != nil {
+		return err
+	}
+	// Dump line by line, replacing the offsets of hex.Dump
+	for len(b) > 0 {
+		line := b[:min(16, len(b))]
+		b = b[len(line):]
+		dump := hex.Dump(line)
+		if _, err := fmt.Fprintf(w, "%08x%s", start, dump[8:]); err != nil {
+			return err
+		}
+		start += int64(len(line))
+	}
+	return nil
+}
+
+// Serves the dump as plain text.
+func (t *RingTap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	t.Dump(w)
+}
@@ -0,0 +1,335 @@
+package rdv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	noiseProtocol = "Noise_NNpsk0_25519_AESGCM_SHA256"
+
+	// Max size of a Noise message, including the tag
+	noiseMaxMsg = 65535
+	noiseTagLen = 16
+)
+
+// Configures end-to-end encryption of the chosen conn, so that data can't be read or modified by
+// the relay or anyone else in between, using the Noise protocol (Noise_NNpsk0_25519_AESGCM_SHA256)
+// with a pre-shared key. Both peers must use the same config. See ClientConfig.Secure.
+type SecureConfig struct {
+	// Pre-shared key of 32 bytes. If nil, it's derived from the token as HMAC-SHA256 keyed with
+	// "rdv psk", which then must be kept secret from the relay, so HashToken is required. Since
+	// the derivation is unsalted and fast, anyone who records the handshake can guess low-entropy
+	// tokens offline, e.g. with a dictionary, and then decrypt the conn. Use random tokens of at
+	// least 128 bits, or a random Key.
+	Key []byte
+}
+
+// Returns the pre-shared key for the token.
+func (s *SecureConfig) psk(token string) ([]byte, error) {
+	if s.Key == nil {
+		mac := hmac.New(sha256.New, []byte("rdv psk"))
+		mac.Write([]byte(token))
+		return mac.Sum(nil), nil
+	}
+	if len(s.Key) != 32 {
+		return nil, fmt.Errorf("rdv: secure key must be 32 bytes, got %d", len(s.Key))
+	}
+	return s.Key, nil
+}
+
+// Runs the Noise handshake on the chosen conn, with the dialer as the initiator, and replaces the
+// conn with an encrypted one.
+func (c *Conn) secure(cfg *SecureConfig) error {
+	psk, err := cfg.psk(c.meta.Token)
+	if err != nil {
+		return err
+	}
+	hs := newNoiseState(psk)
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	// -> psk, e
+	// <- e, ee
+	var send, recv *noiseCipher
+	if c.meta.IsDialer {
+		if err = writeNoiseMsg(c, hs.writeEphemeral(e)); err != nil {
+			return err
+		}
+		msg, err := readNoiseMsg(c)
+		if err != nil {
+			return err
+		}
+		if err = hs.readEphemeral(e, msg); err != nil {
+			return err
+		}
+		send, recv = hs.split()
+	} else {
+		msg, err := readNoiseMsg(c)
+		if err != nil {
+			return err
+		}
+		if err = hs.readEphemeral(nil, msg); err != nil {
+			return err
+		}
+		reply := hs.writeEphemeral(e)
+		if err = writeNoiseMsg(c, reply); err != nil {
+			return err
+		}
+		recv, send = hs.split()
+	}
+	sc := &secureConn{Conn: c.Conn, r: c.r, send: send, recv: recv}
+	c.Conn, c.r = sc, sc
+	return nil
+}
+
+// The symmetric state of a Noise handshake
+type noiseState struct {
+	ck, h []byte
+	k     *noiseCipher // nil until a key is mixed
+	re    *ecdh.PublicKey
+}
+
+func newNoiseState(psk []byte) *noiseState {
+	// Protocol names up to the hash length are zero-padded, and only longer ones hashed
+	h := make([]byte, sha256.Size)
+	if len(noiseProtocol) <= len(h) {
+		copy(h, noiseProtocol)
+	} else {
+		sum := sha256.Sum256([]byte(noiseProtocol))
+		h = sum[:]
+	}
+	s := &noiseState{ck: h, h: h}
+	s.mixHash([]byte(protocolName)) // prologue
+	s.mixKeyAndHash(psk)
+	return s
+}
+
+func (s *noiseState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h)
+	h.Write(data)
+	s.h = h.Sum(nil)
+}
+
+func (s *noiseState) mixKey(ikm []byte) {
+	out := noiseHKDF(s.ck, ikm, 2)
+	s.ck, s.k = out[0], newNoiseCipher(out[1])
+}
+
+func (s *noiseState) mixKeyAndHash(ikm []byte) {
+	out := noiseHKDF(s.ck, ikm, 3)
+	s.ck = out[0]
+	s.mixHash(out[1])
+	s.k = newNoiseCipher(out[2])
+}
+
+// Writes our ephemeral key, and mixes in the DH with the peer's if we have it. The payload is empty.
+func (s *noiseState) writeEphemeral(e *ecdh.PrivateKey) []byte {
+	pub := e.PublicKey().Bytes()
+	s.mixHash(pub)
+	s.mixKey(pub) // psk mode
+	if s.re != nil {
+		dh, _ := e.ECDH(s.re)
+		s.mixKey(dh)
+	}
+	tag := s.k.seal(nil, s.h, nil)
+	s.mixHash(tag)
+	return append(pub, tag...)
+}
+
+// Reads the peer's ephemeral key, and mixes in the DH with ours if e is non-nil.
+func (s *noiseState) readEphemeral(e *ecdh.PrivateKey, msg []byte) (err error) {
+	if len(msg) != 32+noiseTagLen {
+		return fmt.Errorf("%w: bad noise handshake length %d", ErrBadHandshake, len(msg))
+	}
+	if s.re, err = ecdh.X25519().NewPublicKey(msg[:32]); err != nil {
+		return fmt.Errorf("%w: %w", ErrBadHandshake, err)
+	}
+	s.mixHash(msg[:32])
+	s.mixKey(msg[:32])
+	if e != nil {
+		dh, err := e.ECDH(s.re)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrBadHandshake, err)
+		}
+		s.mixKey(dh)
+	}
+	if _, err := s.k.open(nil, s.h, msg[32:]); err != nil {
+		return fmt.Errorf("%w: noise handshake failed, the peer has a different key", ErrBadHandshake)
+	}
+	s.mixHash(msg[32:])
+	return nil
+}
+
+// Returns the initiator's and the responder's sending ciphers.
+func (s *noiseState) split() (*noiseCipher, *noiseCipher) {
+	out := noiseHKDF(s.ck, nil, 2)
+	return newNoiseCipher(out[0]), newNoiseCipher(out[1])
+}
+
+func noiseHKDF(ck, ikm []byte, n int) [][]byte {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+	out := make([][]byte, n)
+	var prev []byte
+	for i := range out {
+		mac := hmac.New(sha256.New, temp)
+		mac.Write(prev)
+		mac.Write([]byte{byte(i + 1)})
+		prev = mac.Sum(nil)
+		out[i] = prev
+	}
+	return out
+}
+
+// An AES-GCM cipher with a counter nonce
+type noiseCipher struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newNoiseCipher(key []byte) *noiseCipher {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return &noiseCipher{aead: aead}
+}
+
+func (c *noiseCipher) nonce() []byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], c.n)
+	c.n++
+	return nonce[:]
+}
+
+func (c *noiseCipher) seal(dst, ad, plaintext []byte) []byte {
+	return c.aead.Seal(dst, c.nonce(), plaintext, ad)
+}
+
+func (c *noiseCipher) open(dst, ad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(dst, c.nonce(), ciphertext, ad)
+}
+
+// Messages are prefixed by a 2-byte big-endian length
+func writeNoiseMsg(w io.Writer, msg []byte) error {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+func readNoiseMsg(r io.Reader) ([]byte, error) {
+	var fr noiseFrameReader
+	return fr.next(r)
+}
+
+// Reads length-prefixed Noise messages, and keeps a partially read message across calls, so
+// that an error such as a timeout mid-message doesn't desync the stream.
+type noiseFrameReader struct {
+	hdr  [2]byte
+	hdrN int
+	msg  []byte // nil until the header is read
+	msgN int
+}
+
+// Returns the next message, or an error, in which case it can be called again to resume.
+func (fr *noiseFrameReader) next(r io.Reader) ([]byte, error) {
+	for fr.hdrN < len(fr.hdr) {
+		n, err := r.Read(fr.hdr[fr.hdrN:])
+		fr.hdrN += n
+		if err != nil && fr.hdrN < len(fr.hdr) {
+			if fr.hdrN > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	if fr.msg == nil {
+		fr.msg = make([]byte, binary.BigEndian.Uint16(fr.hdr[:]))
+	}
+	for fr.msgN < len(fr.msg) {
+		n, err := r.Read(fr.msg[fr.msgN:])
+		fr.msgN += n
+		if err != nil && fr.msgN < len(fr.msg) {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	msg := fr.msg
+	*fr = noiseFrameReader{}
+	return msg, nil
+}
+
+// A conn encrypted with Noise transport messages. Reads and writes are each serialized.
+// Reads that fail mid-message (e.g. due to a deadline) resume where they left off, whereas a failed
+// write breaks the conn for writing, since the peer can't resync with a partial message.
+type secureConn struct {
+	net.Conn
+	r io.Reader
+
+	rmu  sync.Mutex
+	recv *noiseCipher
+	fr   noiseFrameReader
+	buf  []byte // decrypted data not yet read
+
+	wmu  sync.Mutex
+	send *noiseCipher
+	werr error // sticky write error
+}
+
+// Returns the underlying conn, like tls.Conn.
+func (c *secureConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.buf) == 0 {
+		msg, err := c.fr.next(c.r)
+		if err != nil {
+			return 0, err
+		}
+		if c.buf, err = c.recv.open(msg[:0], nil, msg); err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrProtocol, err)
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.werr != nil {
+		return 0, c.werr
+	}
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), noiseMaxMsg-noiseTagLen)]
+		msg := c.send.seal(nil, nil, chunk)
+		buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+		if _, err := c.Conn.Write(append(buf, msg...)); err != nil {
+			c.werr = err // the message may be partially written, and its nonce is used
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
@@ -0,0 +1,157 @@
+package rdv
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Runs the Noise handshake between a dialer and an acceptor over a pipe.
+func securePair(t *testing.T, dialKey, acceptKey []byte) (dc, ac *Conn, dialErr, acceptErr error) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	dc = newDirectConn(a, false, newMeta(true, "", "token"), nil)
+	ac = newDirectConn(b, true, newMeta(false, "", "token"), nil)
+	done := make(chan error)
+	go func() {
+		err := ac.secure(&SecureConfig{Key: acceptKey})
+		if err != nil {
+			b.Close() // unblock the dialer
+		}
+		done <- err
+	}()
+	dialErr = dc.secure(&SecureConfig{Key: dialKey})
+	return dc, ac, dialErr, <-done
+}
+
+// Returns the next message that the conn would send, as a frame on the wire.
+func sealFrame(conn *Conn, p []byte) []byte {
+	msg := conn.Conn.(*secureConn).send.seal(nil, nil, p)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+}
+
+func TestSecureRoundTrip(t *testing.T) {
+	for name, key := range map[string][]byte{"psk": bytes.Repeat([]byte{7}, 32), "token": nil} {
+		t.Run(name, func(t *testing.T) {
+			dc, ac, dialErr, acceptErr := securePair(t, key, key)
+			if err := errors.Join(dialErr, acceptErr); err != nil {
+				t.Fatal(err)
+			}
+			data := bytes.Repeat([]byte("secret"), 20000) // multiple messages
+			go func() {
+				dc.Write(data)
+				dc.Close()
+			}()
+			got, err := io.ReadAll(ac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("expected %d bytes, got %d", len(data), len(got))
+			}
+		})
+	}
+}
+
+func TestSecureWrongKey(t *testing.T) {
+	_, _, _, acceptErr := securePair(t, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32))
+	if !errors.Is(acceptErr, ErrBadHandshake) {
+		t.Fatalf("expected %v, got %v", ErrBadHandshake, acceptErr)
+	}
+}
+
+func TestSecureTamperedFrame(t *testing.T) {
+	dc, ac, dialErr, acceptErr := securePair(t, nil, nil)
+	if err := errors.Join(dialErr, acceptErr); err != nil {
+		t.Fatal(err)
+	}
+	frame := sealFrame(dc, []byte("hello"))
+	frame[len(frame)-1] ^= 1
+	go dc.Conn.(*secureConn).Conn.Write(frame)
+	if _, err := ac.Read(make([]byte, 5)); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected %v, got %v", ErrProtocol, err)
+	}
+}
+
+func TestSecureDeadlineMidFrame(t *testing.T) {
+	dc, ac, dialErr, acceptErr := securePair(t, nil, nil)
+	if err := errors.Join(dialErr, acceptErr); err != nil {
+		t.Fatal(err)
+	}
+	raw := dc.Conn.(*secureConn).Conn
+	frame := sealFrame(dc, []byte("hello"))
+	go raw.Write(frame[:7])
+	ac.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 5)
+	if _, err := ac.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	// The rest of the frame completes the message
+	ac.SetReadDeadline(time.Time{})
+	go raw.Write(frame[7:])
+	if n, err := ac.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestSecureRequiresHashToken(t *testing.T) {
+	cfg := &ClientConfig{Secure: &SecureConfig{}}
+	if err := cfg.Validate(nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected %v, got %v", ErrInvalidConfig, err)
+	}
+	cfg.HashToken = true
+	if err := cfg.Validate(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Noise_NNpsk0_25519_AESGCM_SHA256 with the prologue "rdv/1", ephemeral keys of 0x11 and 0x22
+// bytes, and a psk of 0x33 bytes, generated with the reference implementation flynn/noise v1.1.0.
+func TestNoiseVector(t *testing.T) {
+	const (
+		msg1  = "7b4e909bbe7ffe44c465a220037d608ee35897d31ef972f07f74892cb0f73f13536fc5f579edea1c44c7563511d376b8"
+		msg2  = "0faa684ed28867b97f4a6a2dee5df8ce974e76b7018e3f22a1c4cf2678570f2012b11264415adfa5d524a75c0d94210e"
+		hello = "c0eafacc2d137c0411a3fef9c3eb83b15e74d9302c" // first transport message of the initiator
+	)
+	key := func(b byte) *ecdh.PrivateKey {
+		k, err := ecdh.X25519().NewPrivateKey(bytes.Repeat([]byte{b}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	ie, re := key(0x11), key(0x22)
+	psk := bytes.Repeat([]byte{0x33}, 32)
+	init, resp := newNoiseState(psk), newNoiseState(psk)
+
+	if got := hex.EncodeToString(init.writeEphemeral(ie)); got != msg1 {
+		t.Fatalf("expected %v, got %v", msg1, got)
+	}
+	b, _ := hex.DecodeString(msg1)
+	if err := resp.readEphemeral(nil, b); err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(resp.writeEphemeral(re)); got != msg2 {
+		t.Fatalf("expected %v, got %v", msg2, got)
+	}
+	b, _ = hex.DecodeString(msg2)
+	if err := init.readEphemeral(ie, b); err != nil {
+		t.Fatal(err)
+	}
+	send, _ := init.split()
+	if got := hex.EncodeToString(send.seal(nil, nil, []byte("hello"))); got != hello {
+		t.Fatalf("expected %v, got %v", hello, got)
+	}
+}
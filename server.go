@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/netip"
-	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +17,11 @@ type ServerConfig struct {
 	// Amount of time that on peer can wait in the lobby for its partner. Zero means no timeout.
 	LobbyTimeout time.Duration
 
+	// Interval of updates of the remaining lobby time, which are sent to clients that want to
+	// know it (see ContextWithExpiryFunc), e.g. to keep their countdown in sync. Clients are told
+	// when they join regardless. Zero means no updates.
+	ExpiryUpdates time.Duration
+
 	// Function to serve a relay connection between dialer and server.
 	// The provided context is canceled when the server is closed.
 	// The function is responsible for closing conns.
@@ -22,6 +29,11 @@ type ServerConfig struct {
 	// connections. Defaults to `DefaultServeFunc`.
 	ServeFunc func(ctx context.Context, dc, ac *Conn)
 
+	// Serves a complete group of clients (see Client.JoinGroup), ordered by their index in the
+	// group. Like ServeFunc, the function is responsible for closing conns. Defaults to
+	// DefaultGroupServeFunc.
+	GroupServeFunc func(ctx context.Context, conns []*Conn)
+
 	// Determines the remote addr:port from the client request, and adds it to the set of
 	// candidate addrs sent to the other peer. If nil, `req.RemoteAddr` is used.
 	// If your server is behind a load balancer, reverse proxy or similar, you may need to extract
@@ -29,6 +41,90 @@ type ServerConfig struct {
 	// See the server setup guide for details.
 	ObservedAddrFunc func(req *http.Request) (netip.AddrPort, error)
 
+	// Max number of bytes that clients may send before they're matched, which are then
+	// delivered to the peer. Zero means that clients must idle until matched, which is
+	// required by the rdv protocol. Allows clients that optimistically start sending data.
+	EarlyDataLimit int
+
+	// Called with each client request before it enters the lobby, e.g. to validate bearer tokens,
+	// signed rdv tokens or client certs. If it returns an error, the client is rejected with status
+	// 403 Forbidden and the error message, or the status code of a StatusError. If nil, all
+	// clients are allowed. Control conns (see Client.Control) are called with an empty token, and
+	// then with each token they watch.
+	AuthFunc func(req *http.Request, meta *Meta) error
+
+	// If set, clients are only admitted with a ticket signed with the key as their token (see
+	// Ticket), which prevents token guessing and replays on public servers. Checked before
+	// AuthFunc. Clients must not use HashToken, since the server must see the ticket.
+	RequireTickets *TicketKey
+
+	// Returns the namespace of a client request, which scopes its token (see Meta.Namespace).
+	// Can be used to host multiple applications on one server, e.g. using a path segment. If it
+	// returns an error, the client is rejected like in AuthFunc, which is called afterwards.
+	// Defaults to DefaultNamespace.
+	NamespaceFunc func(req *http.Request) (string, error)
+
+	// Settings per namespace. Namespaces without an entry use the defaults.
+	Namespaces map[string]NamespaceConfig
+
+	// Max number of clients waiting in the lobby, across all namespaces. Additional clients are
+	// rejected with 429 Too Many Requests and a Retry-After header. Zero means no limit.
+	MaxLobbySize int
+
+	// Max number of clients from the same observed IP waiting in the lobby, so that a single
+	// misbehaving client can't fill it. Rejected like MaxLobbySize. Zero means no limit.
+	MaxConnsPerIP int
+
+	// Returns the max number of bytes that may be relayed for the token, in both directions and
+	// including the rdv header lines, e.g. for the free tier of a public relay. The relay is
+	// terminated with ErrRelayQuota once exceeded, which is reported by the RelayFinished event.
+	// Called when peers are matched, and applies to Relayer.Run. Zero or negative means no limit.
+	QuotaFunc func(token string) (maxBytes int64)
+
+	// Called on lobby and relay events, e.g. for billing, auditing or abuse detection. Lobby
+	// events are emitted from the Serve loop, so it must return quickly. May be called concurrently.
+	EventFunc func(Event)
+
+	// Shared lobby for matching peers across multiple server instances, such as RedisLobby.
+	// Requires InstanceAddr and InstanceKey. If nil, peers are only matched within this instance.
+	Lobby Lobby
+
+	// URL of this instance's rdv handler, which other instances use to forward clients to it.
+	// Forwarded clients keep their observed addr.
+	InstanceAddr string
+
+	// Shared secret of the instances, which authenticates the clients that they forward to each
+	// other. Forwarding headers of other requests are ignored. Required with Lobby.
+	InstanceKey string
+
+	// How long relays may keep running once Serve's context is canceled, before their context
+	// is canceled too. Zero means that relays are canceled immediately.
+	ShutdownTimeout time.Duration
+
+	// How long clients in the lobby may wait for their peers during Shutdown, before they're
+	// asked to try again. Zero means that they're asked immediately.
+	ShutdownGracePeriod time.Duration
+
+	// URL of the rdv handler of a standby instance, to which the sessions of resumable conns (see
+	// Client.DialResumable) are replicated when their peers are matched, so that the peers can
+	// reattach through the standby if this instance fails. Requires StandbyKey. Experimental.
+	Standby string
+
+	// Shared secret of the instances that authorizes the replication of sessions, which must be
+	// set on the standby to receive them, and on the primary to send them.
+	StandbyKey string
+
+	// Max duration for reading the request of a raw conn (see ServeListener), including the TLS
+	// handshake. Defaults to 10s.
+	HeaderTimeout time.Duration
+
+	// Max size of the request header of a raw conn (see ServeListener). Defaults to 16 KiB.
+	MaxHeaderBytes int
+
+	// Source of time for the lobby timeouts and expiry updates, e.g. a fake clock in tests (see
+	// rdvtest.FakeClock). Defaults to the system clock.
+	Clock Clock
+
 	// Logging function.
 	Logger *slog.Logger
 }
@@ -37,9 +133,24 @@ func (c *ServerConfig) setDefaults() {
 	if c.ServeFunc == nil {
 		c.ServeFunc = DefaultServeFunc
 	}
+	if c.GroupServeFunc == nil {
+		c.GroupServeFunc = DefaultGroupServeFunc
+	}
 	if c.ObservedAddrFunc == nil {
 		c.ObservedAddrFunc = DefaultObservedAddr
 	}
+	if c.NamespaceFunc == nil {
+		c.NamespaceFunc = DefaultNamespace
+	}
+	if c.HeaderTimeout == 0 {
+		c.HeaderTimeout = 10 * time.Second
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = 16 << 10
+	}
+	if c.Clock == nil {
+		c.Clock = systemClock{}
+	}
 	if c.Logger == nil {
 		c.Logger = slog.Default()
 	}
@@ -47,10 +158,30 @@ func (c *ServerConfig) setDefaults() {
 
 type Server struct {
 	cfg    ServerConfig
-	idle   map[string]*Conn
-	connCh chan *Conn // Incoming upgraded conns: request received, no response sent, no deadline
+	err    error                 // invalid config, returned by Serve
+	idle   map[string]*idleWatch // by lobby key
+	quota  lobbyQuota            // number of idle conns in total, per namespace and per IP
+	connCh chan *Conn            // Incoming upgraded conns: request received, no response sent, no deadline
+
+	monCh chan *idleWatch // sent when the monitoring of a lobby conn is complete
+
+	groups map[string]*lobbyGroup // clients waiting for their group by lobby key, see Client.JoinGroup
+
+	relayCh chan *relayEntry // relays handed off by another process, see AcceptHandoff
 
-	monCh chan string // token sent when current conn mapping is complete
+	controls  map[string]map[*controlConn]bool // control conns that watch each lobby key
+	controlCh chan controlReq                  // token updates of control conns, served by the Serve loop
+
+	adminCh chan func()   // admin requests, served by the Serve loop, see AdminHandler
+	relays  relayRegistry // active relays, see Relays
+
+	maintenance atomic.Pointer[MaintenanceError] // set during maintenance, see SetMaintenance
+	sessions    sessionStore                     // sessions of resumable conns, see Standby
+	tickets     ticketUses                       // uses of tickets, see RequireTickets
+
+	shutdownCh chan context.Context // Shutdown requests, served by the Serve loop
+	done       chan struct{}        // closed when Serve returns
+	closing    chan struct{}        // closed before connCh, which unblocks its senders
 
 	// Guards connCh because Go's HTTP server leaks handler goroutines of hijacked connections.
 	// There is *no way* to determine when those handlers are complete.
@@ -61,8 +192,18 @@ type Server struct {
 
 func NewServer(cfg *ServerConfig) *Server {
 	s := &Server{
-		monCh: make(chan string, 8),
-		idle:  make(map[string]*Conn),
+		monCh:     make(chan *idleWatch, 8),
+		idle:      make(map[string]*idleWatch),
+		groups:    make(map[string]*lobbyGroup),
+		quota:     newLobbyQuota(),
+		relayCh:   make(chan *relayEntry),
+		controls:  make(map[string]map[*controlConn]bool),
+		controlCh: make(chan controlReq),
+		adminCh:   make(chan func()),
+
+		shutdownCh: make(chan context.Context),
+		done:       make(chan struct{}),
+		closing:    make(chan struct{}),
 
 		connCh: make(chan *Conn, 8),
 	}
@@ -70,7 +211,12 @@ func NewServer(cfg *ServerConfig) *Server {
 	if cfg != nil {
 		s.cfg = *cfg
 	}
+	var warnings []*ConfigError
+	s.err = s.cfg.Validate(func(w *ConfigError) { warnings = append(warnings, w) })
 	s.cfg.setDefaults()
+	for _, w := range warnings {
+		s.cfg.Logger.Warn("rdv server: questionable config", "err", w)
+	}
 	return s
 }
 
@@ -79,29 +225,108 @@ func DefaultObservedAddr(r *http.Request) (netip.AddrPort, error) {
 }
 
 func (l *Server) addObservedAddr(conn *Conn) {
-	if observedAddr, err := l.cfg.ObservedAddrFunc(conn.req); err != nil {
+	if addr, err := l.observedAddr(conn.req); err != nil {
 		l.cfg.Logger.Warn("rdv server: could not get observed addr", "err", err)
 	} else {
-		conn.meta.ObservedAddr = &observedAddr
+		conn.meta.ObservedAddr = &addr
+	}
+}
+
+func (l *Server) observedAddr(req *http.Request) (netip.AddrPort, error) {
+	if addr, ok := forwardedAddr(req); ok && l.cfg.Lobby != nil {
+		return addr, nil
 	}
+	return l.cfg.ObservedAddrFunc(req)
 }
 
 func (l *Server) AddClient(w http.ResponseWriter, req *http.Request) error {
 	l.mu.RLock()
-	defer l.mu.RUnlock()
-	if l.closed {
+	closed := l.closed
+	l.mu.RUnlock()
+	if closed {
 		http.Error(w, "rdv is closed", http.StatusServiceUnavailable)
 		return ErrServerClosed
 	}
-	conn, err := upgradeRdv(w, req)
+	if req.Method == http.MethodPost && req.Header.Get(hSession) != "" {
+		return l.addReplicatedSession(w, req)
+	}
+	if err := l.checkMaintenance(w); err != nil {
+		return err
+	}
+	l.stripForwarded(req)
+	conn, err := upgradeRdv(w, req, l.cfg.EarlyDataLimit, l.admitClient(w))
 	if err != nil {
 		return err
 	}
 	l.addObservedAddr(conn)
-	l.connCh <- conn
+	if conn.meta.control {
+		go l.serveControl(conn)
+		return nil
+	}
+	if owner := l.claim(conn); owner != "" {
+		l.forward(conn, owner)
+		return nil
+	}
+	if err := l.addConn(conn); err != nil {
+		writeResponseErr(conn, http.StatusServiceUnavailable, "rdv server shutting down, try again")
+		return err
+	}
 	return nil
 }
 
+// Adds an already upgraded conn, e.g. from a handoff.
+func (l *Server) addConn(conn *Conn) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrServerClosed
+	}
+	select {
+	case l.connCh <- conn:
+		return nil
+	case <-l.closing: // the Serve loop may be waiting to close connCh, so don't block it
+		return ErrServerClosed
+	}
+}
+
+// Adds a relay that was handed off by another process, see AcceptHandoff.
+func (l *Server) addRelay(e *relayEntry) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrServerClosed
+	}
+	select {
+	case l.relayCh <- e:
+		return nil
+	case <-l.closing:
+		return ErrServerClosed
+	}
+}
+
+// An error with an http status code, which can be returned from AuthFunc to reject a client.
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (e *StatusError) Error() string {
+	if e.Err == nil {
+		return http.StatusText(e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// Serves rdv requests, which may pass through http middleware first. The request is parsed,
+// authenticated (see AuthFunc and ContextWithJoinFunc) and checked against quotas before the conn
+// is hijacked, so rejections are written through w, where middleware can observe them. After a
+// successful upgrade, ServeHTTP returns without writing to w, and middleware must not write to
+// it either. Middleware that wraps w must implement Unwrap (see http.ResponseController), so that
+// the conn can be hijacked.
 func (l *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := l.AddClient(w, r)
 	if err != nil {
@@ -112,6 +337,7 @@ func (l *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Closes the Server, unblocking concurrent accept calls.
 // Adding to the Server after closing will panic.
 func (l *Server) close() {
+	close(l.closing)
 	l.mu.Lock()
 	close(l.connCh) // panic intentionally if closed twice
 	l.closed = true
@@ -119,93 +345,230 @@ func (l *Server) close() {
 }
 
 func (l *Server) addIdle(conn *Conn) {
-	l.idle[conn.meta.Token] = conn
-	conn.SetDeadline(cfgDeadline(l.cfg.LobbyTimeout))
-	//l.wg.Add(1)
-	go func() {
-		//defer l.wg.Done()
-		n, err := conn.Read(make([]byte, 1))
-		if !(n == 0 && errors.Is(err, os.ErrDeadlineExceeded)) {
-			writeResponseErr(conn, http.StatusBadRequest, "conn must idle while waiting for response header")
-		}
-		l.monCh <- conn.meta.Token
-	}()
+	l.idle[conn.meta.lobbyKey()] = l.watch(conn)
 }
 
-// If there's an idle conn for the token, cancel it and await its monitoring, then return it
-func (l *Server) interruptAndGetIdle(token string) *Conn {
-	conn := l.idle[token]
-	if conn == nil {
+// Monitors a conn that enters the lobby, and counts it towards the lobby limits.
+func (l *Server) watch(conn *Conn) *idleWatch {
+	l.quota.add(conn, 1)
+	w := watchIdle(conn, l.cfg.Clock, l.cfg.LobbyTimeout, l.cfg.EarlyDataLimit, func(w *idleWatch) {
+		l.monCh <- w
+	})
+	if l.cfg.ExpiryUpdates > 0 && l.cfg.LobbyTimeout > 0 && conn.meta.Hints.Has(HintNotifyReady) && conn.meta.Hints.Has(HintExpiryUpdates) {
+		w.every(l.cfg.ExpiryUpdates, func() {
+			writeReady(conn, l.cfg.LobbyTimeout-l.cfg.Clock.Now().Sub(w.joined))
+		})
+	}
+	return w
+}
+
+// Stops counting a conn that left the lobby.
+func (l *Server) unwatch(conn *Conn) {
+	l.quota.add(conn, -1)
+}
+
+func (l *Server) removeIdle(key string) {
+	if w := l.idle[key]; w != nil {
+		delete(l.idle, key)
+		l.unwatch(w.conn)
+	}
+}
+
+// Returns the number of conns in the lobby, including group members.
+func (l *Server) lobbyLen() int {
+	n := len(l.idle)
+	for _, g := range l.groups {
+		n += len(g.members)
+	}
+	return n
+}
+
+// If there's an idle conn for the lobby key, cancel it and await its monitoring, then return it
+func (l *Server) interruptAndGetIdle(key string) *Conn {
+	w := l.idle[key]
+	if w == nil || !l.interrupt(w) {
 		return nil
 	}
+	l.removeIdle(key)
+	return w.conn
+}
+
+// Cancels the monitoring of a lobby conn and awaits it. Returns false if the conn was kicked out
+// instead.
+func (l *Server) interrupt(w *idleWatch) bool {
 	// cancel the monitoring
-	conn.SetDeadline(past())
+	w.stop()
 
 	// wait for the monitoring to complete, which must happen very quickly
-	for t := range l.monCh {
+	for mw := range l.monCh {
 		// our conn's monitoring completed
-		if t == token {
+		if mw == w {
 			break
 		}
 		// an unrelated conn's monitoring failed, kick it out until we get to ours
-		l.kickOut(t)
+		l.kickOut(mw)
+	}
+	if w.reason != errIdleInterrupted {
+		// the conn misbehaved or timed out just before being interrupted
+		l.kickOut(w)
+		return false
 	}
-	delete(l.idle, token)
-	return conn
+	w.conn.SetDeadline(time.Time{})
+	return true
 }
 
-// kick out of Server either from a timeout or breaking the protocol
-func (l *Server) kickOut(token string) {
-	conn := l.idle[token]
-	delete(l.idle, token)
-	// If there was a previous protocol error, this won't do anything because the conn is closed
+// kick out of Server either from a timeout, a disconnect or breaking the protocol
+func (l *Server) kickOut(w *idleWatch) {
+	conn := w.conn
+	if conn.meta.GroupSize > 0 {
+		l.leaveGroup(w)
+	} else {
+		l.removeIdle(conn.meta.lobbyKey())
+		l.release(conn.meta.lobbyKey())
+	}
+	if w.reason == errIdleClosed {
+		// Free the slot immediately, there's no one to respond to
+		conn.Close()
+		l.cfg.Logger.Debug("rdv server: client left", "token", conn.meta.Token, "addr", conn.meta.ObservedAddr)
+		l.emitConn(PeerTimedOut, conn, w.reason)
+		return
+	}
+	if errors.Is(w.reason, errIdleData) {
+		writeResponseErr(conn, http.StatusBadRequest, w.reason.Error())
+		l.cfg.Logger.Debug("rdv server: client sent data in lobby", "token", conn.meta.Token, "addr", conn.meta.ObservedAddr)
+		l.emitConn(PeerTimedOut, conn, w.reason)
+		return
+	}
+	// If there was a previous error, this won't do anything because the conn is closed
 	writeResponseErr(conn, http.StatusRequestTimeout, "no matching peer found")
-	l.cfg.Logger.Debug("rdv server: client timed out", "token", conn.meta.Token, "addr", conn.meta.ObservedAddr)
+	l.cfg.Logger.Debug("rdv server: client timed out", "token", conn.meta.Token, "addr", conn.meta.ObservedAddr, "reason", w.reason)
+	l.emitConn(PeerTimedOut, conn, w.reason)
 }
 
-// Runs the goroutines associated with the Server.
+// Removes all conns from the lobby and stops their monitoring.
+func (l *Server) takeIdle() (conns []*Conn) {
+	keys := make([]string, 0, len(l.idle))
+	for key := range l.idle {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		// May have been kicked out while interrupting another conn
+		if conn := l.interruptAndGetIdle(key); conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	for _, key := range slices.Collect(maps.Keys(l.groups)) {
+		conns = append(conns, l.takeGroup(key)...)
+	}
+	return
+}
+
+// Runs the goroutines associated with the Server, until ctx is canceled or Shutdown completes.
+// Returns ErrServerClosed after Shutdown, and the errors of an invalid config right away (see
+// ServerConfig.Validate).
 func (l *Server) Serve(ctx context.Context) error {
+	defer close(l.done)
+	if l.err != nil {
+		l.close() // reject clients
+		return l.err
+	}
+	// Relays are canceled after the shutdown timeout, and awaited before returning
+	relayCtx, cancelRelays := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelRelays()
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
-	ctxCh := ctx.Done()
-	for ctxCh != nil || l.connCh != nil || len(l.idle) > 0 {
+	var (
+		ctxCh      = ctx.Done()
+		shutdownCh = l.shutdownCh
+		graceCh    <-chan struct{} // closed when lobby clients should leave
+		draining   bool            // only clients that match the lobby are accepted
+	)
+	for ctxCh != nil || l.connCh != nil || l.lobbyLen() > 0 {
+		if draining && l.lobbyLen() == 0 && graceCh != nil {
+			graceCh = nil
+			l.close() // no one left to match
+		}
 		select {
 		case <-ctxCh:
-			ctxCh = nil
+			ctxCh, shutdownCh, graceCh = nil, nil, nil
+			if !l.closed {
+				l.close()
+			}
+			if l.cfg.ShutdownTimeout > 0 {
+				time.AfterFunc(l.cfg.ShutdownTimeout, cancelRelays)
+			} else {
+				cancelRelays()
+			}
+		case shutdownCtx := <-shutdownCh:
+			ctxCh, shutdownCh = nil, nil
+			context.AfterFunc(shutdownCtx, cancelRelays)
+			draining = true
+			graceCtx, cancelGrace := context.WithTimeout(shutdownCtx, l.cfg.ShutdownGracePeriod)
+			defer cancelGrace()
+			graceCh = graceCtx.Done()
+		case <-graceCh:
+			graceCh = nil
 			l.close()
 
 		//cancel() // send cancel signal to relay handlers
-		case token := <-l.monCh:
-			l.kickOut(token)
+		case w := <-l.monCh:
+			l.kickOut(w)
+		case e := <-l.relayCh:
+			l.serveRelay(relayCtx, &wg, e)
+		case req := <-l.controlCh:
+			l.watchToken(req)
+		case fn := <-l.adminCh:
+			fn()
 		case conn, ok := <-l.connCh:
 			if !ok {
-				l.cfg.Logger.Info("rdv server: shutting down", "lobby_conns", len(l.idle))
+				l.cfg.Logger.Info("rdv server: shutting down", "lobby_conns", l.lobbyLen())
 				l.connCh = nil // blocks forever, leaving monCh the only remaining channel
 				//cancel()
 				// no more conns, shutting down
-				for _, ic := range l.idle {
-					writeResponseErr(ic, http.StatusServiceUnavailable, "rdv server shutting down, try again")
+				for key, w := range l.idle {
+					l.release(key)
+					writeResponseErr(w.conn, http.StatusServiceUnavailable, "rdv server shutting down, try again")
+					l.emitConn(PeerTimedOut, w.conn, ErrServerClosed)
+				}
+				for key, g := range l.groups {
+					l.release(key)
+					for _, w := range g.members {
+						writeResponseErr(w.conn, http.StatusServiceUnavailable, "rdv server shutting down, try again")
+						l.emitConn(PeerTimedOut, w.conn, ErrServerClosed)
+					}
 				}
 				continue
 			}
-			idleConn := l.interruptAndGetIdle(conn.meta.Token)
+			if conn.meta.GroupSize > 0 {
+				l.joinGroup(relayCtx, &wg, conn, draining)
+				continue
+			}
+			key := conn.meta.lobbyKey()
+			idleConn := l.interruptAndGetIdle(key)
 			// invariant: the idle conn is removed and no longer monitored
-			if idleConn != nil && idleConn.meta.IsDialer != conn.meta.IsDialer {
+			if draining && idleConn == nil {
+				l.release(key)
+				writeResponseErr(conn, http.StatusServiceUnavailable, "rdv server shutting down, try again")
+				continue
+			}
+			if idleConn != nil && assignRoles(idleConn.meta, conn.meta) {
 				// happy path: the conn and idle conn are a match
-				idleConn.SetDeadline(time.Time{})
 				// Methods are unequal, we found a pair
+				l.release(key)
+				negotiateVersion(idleConn.meta, conn.meta)
 				dc, ac := idleConn, conn
 				if ac.meta.IsDialer {
 					dc, ac = ac, dc // swap
 				}
-				wg.Add(1)
-				go func(dc, ac *Conn) {
-					defer wg.Done()
-					l.cfg.ServeFunc(ctx, dc, ac)
-				}(dc, ac)
+				l.startSession(dc, ac)
+				l.emitMatch(PeerMatched, dc, ac, 0)
+				l.serveRelay(relayCtx, &wg, &relayEntry{dc: dc, ac: ac})
 				continue
 			}
 			// either there is no conn of the same token, or there's another of the same method
+			if conn.meta.Hints.Has(HintNotifyReady) {
+				writeReady(conn, l.cfg.LobbyTimeout)
+			}
 			l.addIdle(conn)
 			// if conn is same method, kick the old one out
 			if idleConn == nil {
@@ -213,12 +576,70 @@ func (l *Server) Serve(ctx context.Context) error {
 			} else {
 				l.cfg.Logger.Debug("rdv server: replaced", "client", conn.meta.Token, "addr", conn.meta.ObservedAddr)
 				writeResponseErr(idleConn, http.StatusConflict, "replaced by another conn")
+				l.emitConn(PeerReplaced, idleConn, nil)
 			}
+			l.emitConn(PeerJoined, conn, nil)
+			l.callControls(conn.meta)
+		}
+	}
+	if draining {
+		return ErrServerClosed
+	}
+	return ctx.Err()
+}
+
+// Serves a relay with the ServeFunc in a new goroutine. Relays that were handed off by another
+// process have a start time, and keep their quota.
+func (l *Server) serveRelay(ctx context.Context, wg *sync.WaitGroup, e *relayEntry) {
+	dc, ac := e.dc, e.ac
+	dc.handoff = newRelayHandoff()
+	handedOff := !e.started.IsZero()
+	if !handedOff {
+		e.started = time.Now()
+	}
+	serve := l.serveFunc(dc.meta.Namespace)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer l.relays.add(e)()
+		if !handedOff {
+			l.setRelayQuota(dc, ac)
 		}
+		serve(ctx, dc, ac)
+		if !dc.handoff.handedOff.Load() { // finished by the other process
+			l.emitMatch(RelayFinished, dc, ac, time.Since(e.started))
+		}
+	}()
+}
+
+// Shuts down the server gracefully: new clients are rejected, unless their peer is in the lobby,
+// and clients in the lobby have ShutdownGracePeriod to be matched before they're asked to try
+// again, or until ctx is done. Active relays are awaited until ctx is done, and then canceled.
+// Returns once Serve has returned, with ctx's error if it's done. Serve must be running.
+func (l *Server) Shutdown(ctx context.Context) error {
+	select {
+	case l.shutdownCh <- ctx:
+	case <-l.done: // already shut down
+		return nil
 	}
+	<-l.done
 	return ctx.Err()
 }
 
+// Returns true if the conns match, i.e. have different roles. Symmetric conns are assigned the
+// role opposite of the other conn. If both are symmetric, the one that arrived first accepts.
+func assignRoles(idle, conn *Meta) bool {
+	switch {
+	case idle.Symmetric && conn.Symmetric:
+		idle.IsDialer, conn.IsDialer = false, true
+	case idle.Symmetric:
+		idle.IsDialer = !conn.IsDialer
+	case conn.Symmetric:
+		conn.IsDialer = !idle.IsDialer
+	}
+	return idle.IsDialer != conn.IsDialer
+}
+
 // Handler which simply relays data without timeouts or taps.
 func DefaultServeFunc(ctx context.Context, dc, ac *Conn) {
 	new(Relayer).Run(ctx, dc, ac)
@@ -0,0 +1,225 @@
+package rdv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connects a dialer and acceptor over the relay of the server, and closes them when the test ends.
+func relayPair(t *testing.T, ctx context.Context, client *Client, addr, token string) (dc, ac *Conn) {
+	t.Helper()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := client.Accept(ctx, addr, token, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dc, _, err := client.Dial(ctx, addr, token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dc.Close() })
+	if ac = <-accepted; ac == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() { ac.Close() })
+	return dc, ac
+}
+
+// Sends a message from one conn to the other.
+func exchange(t *testing.T, from, to *Conn, msg string) {
+	t.Helper()
+	go io.WriteString(from, msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(to, buf); err != nil || string(buf) != msg {
+		t.Fatalf("expected %v, got %q, %v", msg, buf, err)
+	}
+}
+
+// Like Shutdown, but returns once the Serve loop has received the request, with a channel which
+// is closed when Serve returns.
+func startShutdown(t *testing.T, server *Server, ctx context.Context) <-chan struct{} {
+	t.Helper()
+	select {
+	case server.shutdownCh <- ctx:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to be running")
+	}
+	return server.done
+}
+
+func awaitDone(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return")
+	}
+}
+
+// During the grace period, clients in the lobby can be matched and relays keep running, while
+// other clients are rejected.
+func TestShutdownGrace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, &ServerConfig{ShutdownGracePeriod: time.Minute})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	dc, ac := relayPair(t, ctx, client, hs.URL, "relay")
+
+	lobbyConn := make(chan *Conn, 1)
+	go func() {
+		conn, _, err := client.Accept(ctx, hs.URL, "lobby", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		lobbyConn <- conn
+	}()
+	awaitLobby(t, server, 1)
+	done := startShutdown(t, server, ctx)
+
+	if _, resp, _ := client.Accept(ctx, hs.URL, "other", nil); resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %v, got %v", http.StatusServiceUnavailable, resp)
+	}
+	peer, _, err := client.Dial(ctx, hs.URL, "lobby", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	waiting := <-lobbyConn
+	if waiting == nil {
+		t.FailNow()
+	}
+	defer waiting.Close()
+	exchange(t, peer, waiting, "matched")
+	exchange(t, dc, ac, "draining")
+
+	// Serve returns once the relays are done
+	select {
+	case <-done:
+		t.Fatal("expected Serve to await the relays")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, conn := range []*Conn{dc, ac, peer, waiting} {
+		conn.Close()
+	}
+	awaitDone(t, done)
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("expected no error once shut down, got %v", err)
+	}
+}
+
+// Clients still in the lobby when the grace period expires are asked to try again.
+func TestShutdownGraceExpired(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, &ServerConfig{ShutdownGracePeriod: 50 * time.Millisecond})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+
+	rejected := make(chan *http.Response, 1)
+	go func() {
+		_, resp, _ := client.Accept(ctx, hs.URL, "lobby", nil)
+		rejected <- resp
+	}()
+	awaitLobby(t, server, 1)
+	done := startShutdown(t, server, ctx)
+	if resp := <-rejected; resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %v, got %v", http.StatusServiceUnavailable, resp)
+	}
+	awaitDone(t, done)
+}
+
+// Relays are canceled when the context of Shutdown is done.
+func TestShutdownCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, &ServerConfig{ShutdownGracePeriod: time.Minute})
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	dc, ac := relayPair(t, ctx, client, hs.URL, "relay")
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	for _, conn := range []*Conn{dc, ac} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+			t.Fatalf("expected %v, got %v", io.EOF, err)
+		}
+	}
+}
+
+// Data that an acceptor sends before it's matched is delivered to the dialer.
+func TestEarlyData(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, hs := startServer(t, &ServerConfig{EarlyDataLimit: 64})
+	hello := rdvHeader("HELLO", "token")
+	nc := rawRequest(t, hs.URL, newMeta(false, "", "token"), hello+"early")
+	awaitLobby(t, server, 1)
+
+	dc, _, err := NewClient(&ClientConfig{AddrSpaces: NoSpaces}).Dial(ctx, hs.URL, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(dc, buf); err != nil || string(buf) != "early" {
+		t.Fatalf("expected early, got %q, %v", buf, err)
+	}
+	io.WriteString(dc, "reply")
+	br := bufio.NewReader(nc)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected %v, got %v, %v", http.StatusSwitchingProtocols, resp, err)
+	}
+	if err := expectStr(br, rdvHeader("CONFIRM", "token")+"reply"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthFunc(t *testing.T) {
+	tests := map[string]struct {
+		err    error
+		status int // if rejected
+	}{
+		"allowed":     {},
+		"forbidden":   {err: errors.New("bad token"), status: http.StatusForbidden},
+		"status":      {err: &StatusError{Code: http.StatusUnauthorized, Err: errors.New("login required")}, status: http.StatusUnauthorized},
+		"status_only": {err: &StatusError{Code: http.StatusTooManyRequests}, status: http.StatusTooManyRequests},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, hs := startServer(t, &ServerConfig{AuthFunc: func(req *http.Request, meta *Meta) error {
+				if meta.Token != "token" {
+					return errors.New("unexpected token")
+				}
+				return tc.err
+			}})
+			client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+			if tc.status == 0 {
+				dc, ac := relayPair(t, ctx, client, hs.URL, "token")
+				exchange(t, dc, ac, "allowed")
+				return
+			}
+			_, resp, _ := client.Accept(ctx, hs.URL, "token", nil)
+			if resp == nil || resp.StatusCode != tc.status {
+				t.Fatalf("expected %v, got %v", tc.status, resp)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if msg := tc.err.Error(); !strings.Contains(string(body), msg) {
+				t.Fatalf("expected %v, got %q", msg, body)
+			}
+		})
+	}
+}
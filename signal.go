@@ -0,0 +1,207 @@
+package rdv
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A Signaler exchanges candidate addrs between two peers with the same token, through some
+// rendezvous point. By default, the rdv server is used (see HTTPSignaler), but it can also be
+// an existing message broker, such as an MQTT topic or Redis pub/sub.
+type Signaler interface {
+	// Makes meta.SelfAddrs (and meta.IsDialer) available to the peer with the same meta.Token,
+	// waits for the peer to do the same, and sets meta.PeerAddrs to the peer's addrs.
+	// Signalers that know the observed addr of the peer should include it in meta.PeerAddrs, and
+	// may set meta.ObservedAddr and meta.Hints.
+	//
+	// The socket can be used to dial out, e.g. so that the rendezvous point can observe its addr.
+	// Optionally, a relay conn to the peer can be returned, for use when direct conns fail. Relays
+	// must forward the rdv header lines like any other conn (see Relayer). Returns nil if there's
+	// no relay.
+	Signal(ctx context.Context, socket *Socket, meta *Meta) (relay net.Conn, err error)
+}
+
+// Signaler which uses an rdv server, which also acts as a relay. This is the default, used by
+// Dial and Accept.
+type HTTPSignaler struct {
+	// URL of the rdv server
+	Addr string
+
+	// Additional request headers, e.g. for authentication. May be nil.
+	Header http.Header
+
+	// Max number of bytes read from error response bodies. Defaults to 1024.
+	MaxErrorBody int64
+
+	// Signal over WebSocket instead of a custom http upgrade, for proxies and CDNs that only
+	// support WebSocket. The server supports both.
+	WebSocket bool
+
+	// Wraps the conn to the rdv server before anything is sent. Optional, see SignalWrapper.
+	Wrap SignalWrapper
+
+	// Network used to dial the rdv server, see ClientConfig.ServerNetwork. Defaults to "tcp4".
+	Network string
+
+	// Returns the proxy for the rdv server, see ClientConfig.ProxyFunc. Optional.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Dials the rdv server instead of the socket, see ClientConfig.DialServer. Optional.
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+
+	// Max duration until the rdv server responds, see ClientConfig.ServerResponseTimeout. Zero
+	// means no timeout.
+	ResponseTimeout time.Duration
+
+	// Set to the response of the rdv server, if it responded with an error.
+	Response *http.Response
+
+	dns       *dnsCache // resolved server addrs, shared by the client's attempts
+	v1Servers *sync.Map // addrs of servers that only support protocol version 1, shared likewise
+}
+
+// Wraps the TCP conn to the rdv server before anything is sent, e.g. to obfuscate signaling on
+// networks that fingerprint and block rdv upgrades. For https URLs, the wrapper replaces the
+// standard TLS handshake, so it must do TLS itself, e.g. with a library that mimics the TLS
+// fingerprint of a browser. Combine with WebSocket to look like a regular WebSocket over TLS.
+// The rdv protocol inside the wrapped conn is unchanged.
+type SignalWrapper func(ctx context.Context, nc net.Conn, u *url.URL) (net.Conn, error)
+
+func (s *HTTPSignaler) Signal(ctx context.Context, socket *Socket, meta *Meta) (net.Conn, error) {
+	maxBody := s.MaxErrorBody
+	if maxBody == 0 {
+		maxBody = 1024
+	}
+	meta.ServerAddr = s.Addr
+	if s.ResponseTimeout > 0 {
+		var stop func()
+		ctx, stop = withResponseTimeout(ctx, s.ResponseTimeout)
+		defer stop()
+	}
+	proxy, err := s.proxy()
+	if err != nil {
+		return nil, err
+	}
+	signal := func() (*Conn, *http.Response, error) {
+		if browser {
+			return dialRdvBrowser(ctx, meta, s.Header, maxBody)
+		}
+		return dialRdvServer(ctx, meta, s.Header, maxBody, s.WebSocket, func(ctx context.Context, u *url.URL) (net.Conn, error) {
+			return s.dial(ctx, socket, proxy, u)
+		})
+	}
+	if s.v1Servers != nil {
+		if _, ok := s.v1Servers.Load(s.Addr); ok {
+			meta.maxVersion = 1
+		}
+	}
+	relay, resp, err := signal()
+	if resp != nil && resp.StatusCode == http.StatusUpgradeRequired && meta.maxVersion > 1 {
+		// Servers that only support version 1 reject proposals of newer versions
+		meta.maxVersion = 1
+		if s.v1Servers != nil {
+			s.v1Servers.Store(s.Addr, true)
+		}
+		relay, resp, err = signal()
+	}
+	s.Response = resp
+	if err != nil && ctx.Err() != nil {
+		err = context.Cause(ctx) // e.g. ErrServerTimeout, rather than the resulting i/o error
+	}
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		meta.ObservedAddr = nil // it's the proxy's addr
+	}
+	return relay, nil
+}
+
+// Returns a context which is canceled with ErrServerTimeout unless the rdv server responds within
+// the timeout, or confirms that the client joined its lobby, which is requested by the ready func.
+func withResponseTimeout(ctx context.Context, timeout time.Duration) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() {
+		cancel(fmt.Errorf("%w after %v", ErrServerTimeout, timeout))
+	})
+	ready := readyFuncFromContext(ctx)
+	ctx = ContextWithReadyFunc(ctx, func() {
+		timer.Stop()
+		if ready != nil {
+			ready()
+		}
+	})
+	return ctx, func() {
+		timer.Stop()
+		cancel(nil)
+	}
+}
+
+// Returns the proxy URL for the rdv server, or nil if it's dialed directly.
+func (s *HTTPSignaler) proxy() (*url.URL, error) {
+	if s.Proxy == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.Proxy(&http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: make(http.Header)})
+}
+
+func (s *HTTPSignaler) network() string {
+	if s.Network == "" {
+		return "tcp4"
+	}
+	return s.Network
+}
+
+// Dials the rdv server using the DNS cache, or through the proxy if non-nil, and wraps the conn
+// if there's a wrapper.
+func (s *HTTPSignaler) dial(ctx context.Context, socket *Socket, proxy *url.URL, u *url.URL) (net.Conn, error) {
+	if s.Wrap == nil && proxy == nil && s.Dial == nil {
+		return s.dns.dial(ctx, socket, s.network(), u)
+	}
+	raw := *u
+	raw.Scheme, raw.Host = "http", net.JoinHostPort(u.Hostname(), urlPort(u)) // no TLS
+	var (
+		nc  net.Conn
+		err error
+	)
+	if proxy != nil {
+		nc, err = dialProxy(ctx, proxy, raw.Host)
+	} else if s.Dial != nil {
+		nc, err = s.Dial(ctx, raw.Host)
+	} else {
+		nc, err = s.dns.dial(ctx, socket, s.network(), &raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var wrapped net.Conn = nc
+	switch {
+	case s.Wrap != nil:
+		wrapped, err = s.Wrap(ctx, nc, u)
+	case u.Scheme == "https":
+		config := socket.TlsConfig.Clone()
+		if config == nil {
+			config = new(tls.Config)
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tc := tls.Client(nc, config)
+		wrapped, err = tc, tc.HandshakeContext(ctx)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return wrapped, nil
+}
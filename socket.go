@@ -7,8 +7,7 @@ import (
 	"net"
 	"net/netip"
 	urlpkg "net/url"
-
-	"github.com/libp2p/go-reuseport"
+	"sync"
 )
 
 // An SO_REUSEPORT TCP socket suitable for NAT traversal/hole punching, over both ipv4 and ipv6.
@@ -31,18 +30,21 @@ type Socket struct {
 	//
 	// TODO: Higher level protocols should be one layer above sockets?
 	TlsConfig *tls.Config
+
+	// NAT characteristics, if discovered by the SelfAddrFunc (see StunSelfAddrs).
+	NAT *NATInfo
 }
 
 func dialer(localIp net.IP, port uint16) *net.Dialer {
 	return &net.Dialer{
-		Control:   reuseport.Control,
+		Control:   reuseControl,
 		LocalAddr: &net.TCPAddr{IP: localIp, Port: int(port)},
 	}
 }
 
 func NewSocket(ctx context.Context, port uint16, tlsConf *tls.Config) (*Socket, error) {
 	lc := net.ListenConfig{
-		Control: reuseport.Control,
+		Control: reuseControl,
 	}
 	ln, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%v", port))
 	if err != nil {
@@ -58,6 +60,37 @@ func NewSocket(ctx context.Context, port uint16, tlsConf *tls.Config) (*Socket,
 	}, nil
 }
 
+// Returns a socket which doesn't listen, and dials from any port, for clients that only use the
+// relay.
+func newRelaySocket(tlsConf *tls.Config) *Socket {
+	return &Socket{
+		Listener:  &nopListener{closed: make(chan struct{})},
+		D4:        new(net.Dialer),
+		D6:        new(net.Dialer),
+		TlsConfig: tlsConf,
+	}
+}
+
+// A listener which never accepts any conns.
+type nopListener struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *nopListener) Accept() (net.Conn, error) {
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *nopListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *nopListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
 func (s *Socket) networkToDialer(network string) *net.Dialer {
 	if network == "tcp6" {
 		return s.D6
@@ -72,21 +105,39 @@ func (s *Socket) DialContext(ctx context.Context, network, address string) (net.
 
 func (s *Socket) DialIPContext(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
 	// TODO: Ipv4 mapped 6 addresses?
-	network := "tcp4"
-	if addr.Addr().Is6() {
-		network = "tcp6"
+	return s.DialContext(ctx, tcpNetwork(addr.Addr()), addr.String())
+}
+
+// Returns "tcp4" or "tcp6" for the addr.
+func tcpNetwork(addr netip.Addr) string {
+	if addr.Is6() {
+		return "tcp6"
 	}
-	return s.DialContext(ctx, network, addr.String())
+	return "tcp4"
 }
 
 func (s *Socket) DialURLContext(ctx context.Context, network string, url *urlpkg.URL) (net.Conn, error) {
-	hostPort := net.JoinHostPort(url.Hostname(), urlPort(url))
+	return s.dialURL(ctx, network, url, url.Hostname())
+}
+
+// Like DialURLContext, but dials host (e.g. a resolved IP) instead of the URL's host, which is
+// still used to verify the server's TLS certificate.
+func (s *Socket) dialURL(ctx context.Context, network string, url *urlpkg.URL, host string) (net.Conn, error) {
+	hostPort := net.JoinHostPort(host, urlPort(url))
 	netd := s.networkToDialer(network)
 	dialFn := netd.DialContext
 	if url.Scheme == "https" {
+		config := s.TlsConfig
+		if host != url.Hostname() && (config == nil || config.ServerName == "") {
+			config = config.Clone()
+			if config == nil {
+				config = new(tls.Config)
+			}
+			config.ServerName = url.Hostname()
+		}
 		tlsd := &tls.Dialer{
 			NetDialer: netd,
-			Config:    s.TlsConfig,
+			Config:    config,
 		}
 		dialFn = tlsd.DialContext
 	} else if url.Scheme != "http" {
@@ -0,0 +1,152 @@
+package rdv
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sessions of resumable conns (see Client.DialResumable), which are assigned by the server when
+// the peers are matched, and replicated to the standby instance (see ServerConfig.Standby). The
+// byte offsets of the session are tracked end-to-end by the peers, so that only the session id
+// and namespace need to be replicated.
+const (
+	// Id of the session of a resumable conn. Response, and request when reattaching.
+	hSession = "Rdv-Session"
+
+	// How long sessions can be resumed after they're assigned or last resumed
+	sessionTTL = 24 * time.Hour
+
+	// Max number of sessions kept per instance, beyond which the oldest are evicted
+	maxSessions = 1 << 16
+
+	// Timeout of the replication of a session to the standby
+	replicateTimeout = 5 * time.Second
+)
+
+// Returns a new random session id.
+func newSessionID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Returns the token that the server matches peers by when they reattach to the session, instead
+// of the token of the conn, so that they're only matched with each other. See Meta.lobbyKey.
+func resumeToken(session string) string {
+	return HashToken("rdv resume", session)
+}
+
+// Sessions that can be resumed on this instance, in the order that they expire.
+type sessionStore struct {
+	mu    sync.Mutex
+	m     map[string]*list.Element // of sessionEntry, by session
+	order list.List                // by expiry, since all sessions have the same ttl
+}
+
+type sessionEntry struct {
+	session   string
+	namespace string
+	expires   time.Time
+}
+
+// Adds the session, or extends it, and evicts expired sessions and the oldest beyond maxSessions.
+func (s *sessionStore) add(session, namespace string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]*list.Element)
+	}
+	now := time.Now()
+	if el, ok := s.m[session]; ok {
+		s.order.Remove(el)
+	}
+	for el := s.order.Front(); el != nil; el = s.order.Front() {
+		e := el.Value.(sessionEntry)
+		if s.order.Len() < maxSessions && now.Before(e.expires) {
+			break
+		}
+		delete(s.m, e.session)
+		s.order.Remove(el)
+	}
+	s.m[session] = s.order.PushBack(sessionEntry{session, namespace, now.Add(sessionTTL)})
+}
+
+func (s *sessionStore) has(session, namespace string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.m[session]
+	if !ok {
+		return false
+	}
+	e := el.Value.(sessionEntry)
+	return e.namespace == namespace && time.Now().Before(e.expires)
+}
+
+// Returns the session if the client is reattaching to a session that's known to this instance.
+// Such clients are authenticated like new clients, but matched by the session.
+func (l *Server) resumedSession(req *http.Request, meta *Meta) string {
+	session := req.Header.Get(hSession)
+	if session == "" || !l.sessions.has(session, meta.Namespace) {
+		return ""
+	}
+	return session
+}
+
+// Assigns a session to matched peers that are both resumable, or continues the session that they
+// reattach to, and replicates it to the standby. Called by the Serve loop.
+func (l *Server) startSession(dc, ac *Conn) {
+	if !dc.meta.Hints.Has(HintResumable) || !ac.meta.Hints.Has(HintResumable) {
+		return
+	}
+	session := dc.meta.resumed
+	if session == "" || session != ac.meta.resumed {
+		session = newSessionID()
+	}
+	dc.meta.Session, ac.meta.Session = session, session
+	l.sessions.add(session, dc.meta.Namespace)
+	if l.cfg.Standby != "" {
+		go l.replicate(session, dc.meta.Namespace)
+	}
+}
+
+// Replicates the session to the standby instance.
+func (l *Server) replicate(session, namespace string) {
+	ctx, cancel := context.WithTimeout(context.Background(), replicateTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.cfg.Standby, nil)
+	if err != nil {
+		l.cfg.Logger.Warn("rdv server: session replication failed", "err", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+l.cfg.StandbyKey)
+	req.Header.Set(hSession, session)
+	req.Header.Set(hNamespace, namespace)
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			err = &StatusError{Code: resp.StatusCode}
+		}
+	}
+	if err != nil {
+		l.cfg.Logger.Warn("rdv server: session replication failed", "standby", l.cfg.Standby, "err", err)
+	}
+}
+
+// Serves a session that's replicated from another instance.
+func (l *Server) addReplicatedSession(w http.ResponseWriter, req *http.Request) error {
+	auth := []byte(req.Header.Get("Authorization"))
+	if l.cfg.StandbyKey == "" || subtle.ConstantTimeCompare(auth, []byte("Bearer "+l.cfg.StandbyKey)) != 1 {
+		http.Error(w, "bad standby key", http.StatusForbidden)
+		return ErrUnauthorized
+	}
+	l.sessions.add(req.Header.Get(hSession), req.Header.Get(hNamespace))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
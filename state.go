@@ -0,0 +1,107 @@
+package rdv
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A goroutine-safe bag of values attached to a conn, such as user ID, tenant or limits.
+// On the server, values can be added by http middleware before the conn is upgraded, and are
+// then accessible in ServeFunc and other hooks through Conn.State.
+// Keys should be unexported types to avoid collisions, like with context.WithValue.
+type ConnState struct {
+	mu     sync.RWMutex
+	values map[any]any
+}
+
+func NewConnState() *ConnState {
+	return &ConnState{values: make(map[any]any)}
+}
+
+// Sets a value, replacing any previous value for the key.
+func (s *ConnState) Set(key, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+// Returns the value for the key, or nil if not set.
+func (s *ConnState) Value(key any) any {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values[key]
+}
+
+// Returns the value for key as a T, and whether it was set with that type.
+func StateValue[T any](s *ConnState, key any) (value T, ok bool) {
+	value, ok = s.Value(key).(T)
+	return
+}
+
+type connStateKey struct{}
+
+// Returns a context carrying the state, which is attached to the conn when a request with that
+// context is upgraded. Typically used by http middleware in front of the rdv server.
+func ContextWithConnState(ctx context.Context, state *ConnState) context.Context {
+	return context.WithValue(ctx, connStateKey{}, state)
+}
+
+// Returns the state of the context, or nil if there is none.
+func ConnStateFromContext(ctx context.Context) *ConnState {
+	state, _ := ctx.Value(connStateKey{}).(*ConnState)
+	return state
+}
+
+type joinFuncsKey struct{}
+
+// Returns a context carrying a join func, which the server calls with the parsed meta of a request
+// with that context, after AuthFunc and before the conn is upgraded. Lets http middleware veto the
+// join based on e.g. the token, by returning an error, which rejects the client like AuthFunc. The
+// meta may also be annotated, e.g. with echo headers. Join funcs of outer middleware are called
+// first.
+func ContextWithJoinFunc(ctx context.Context, fn func(meta *Meta) error) context.Context {
+	fns, _ := ctx.Value(joinFuncsKey{}).([]func(*Meta) error)
+	return context.WithValue(ctx, joinFuncsKey{}, append(fns[:len(fns):len(fns)], fn))
+}
+
+func checkJoinFuncs(ctx context.Context, meta *Meta) error {
+	fns, _ := ctx.Value(joinFuncsKey{}).([]func(*Meta) error)
+	for _, fn := range fns {
+		if err := fn(meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type readyFuncKey struct{}
+
+// Returns a context carrying a ready func, which the client calls when a Dial or Accept with that
+// context is registered in the lobby of the rdv server, i.e. once the peer can reach it, or when
+// it's matched right away. E.g. an acceptor can display its pairing code only once it's actually
+// reachable. The func is called at most once per request, and only by rdv servers that support it.
+func ContextWithReadyFunc(ctx context.Context, fn func()) context.Context {
+	return context.WithValue(ctx, readyFuncKey{}, sync.OnceFunc(fn))
+}
+
+func readyFuncFromContext(ctx context.Context) func() {
+	fn, _ := ctx.Value(readyFuncKey{}).(func())
+	return fn
+}
+
+type expiryFuncKey struct{}
+
+// Returns a context carrying an expiry func, which the client calls with the time when a Dial or
+// Accept with that context will time out of the lobby of the rdv server (see LobbyTimeout), once
+// it joins and on each update (see ServerConfig.ExpiryUpdates). E.g. an acceptor can show how long
+// its pairing code is valid, rather than guessing the server's policy. Only called by rdv servers
+// that support it, and if the lobby has a timeout.
+func ContextWithExpiryFunc(ctx context.Context, fn func(expires time.Time)) context.Context {
+	return context.WithValue(ctx, expiryFuncKey{}, fn)
+}
+
+func expiryFuncFromContext(ctx context.Context) func(time.Time) {
+	fn, _ := ctx.Value(expiryFuncKey{}).(func(time.Time))
+	return fn
+}
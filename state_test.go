@@ -0,0 +1,60 @@
+package rdv_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/betamos/rdv"
+	"github.com/betamos/rdv/rdvtest"
+)
+
+// Only clients with an expiry func get expiry updates, others are only told that they're ready.
+func TestExpiryUpdates(t *testing.T) {
+	tests := map[string]struct {
+		expiry  bool
+		updates int32
+		timers  int
+	}{
+		"ready":  {timers: 1},
+		"expiry": {expiry: true, updates: 3, timers: 2},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			s := rdvtest.NewServer(t, &rdv.ServerConfig{LobbyTimeout: time.Hour, ExpiryUpdates: time.Minute})
+			client := s.Client(nil)
+			var ready, updates atomic.Int32
+			actx := rdv.ContextWithReadyFunc(ctx, func() { ready.Add(1) })
+			if tc.expiry {
+				actx = rdv.ContextWithExpiryFunc(actx, func(time.Time) { updates.Add(1) })
+			}
+			go client.Accept(actx, s.URL, "token", nil)
+			for s.Clock.Timers() < tc.timers {
+				time.Sleep(time.Millisecond)
+			}
+			for range 2 {
+				s.Clock.Advance(time.Minute)
+			}
+			if s.Clock.Timers() != tc.timers {
+				t.Fatalf("expected %d timers, got %d", tc.timers, s.Clock.Timers())
+			}
+			for deadline := time.Now().Add(2 * time.Second); updates.Load() < tc.updates; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected %d updates, got %d", tc.updates, updates.Load())
+				}
+			}
+			conn, _, err := client.Dial(ctx, s.URL, "token", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if ready.Load() != 1 || updates.Load() != tc.updates {
+				t.Fatalf("expected to be ready once with %d updates, got %d and %d", tc.updates, ready.Load(), updates.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package rdv
+
+import "time"
+
+// Statistics of a client conn, for telemetry. See Conn.Stats.
+type ConnStats struct {
+	// Number of bytes read and written since the conn was returned, i.e. excluding the handshakes.
+	BytesRead, BytesWritten int64
+
+	// Duration from the start of the connection attempt until the chosen conn was established,
+	// i.e. dialed, accepted or, for the relay, until the rdv server responded.
+	DialDuration time.Duration
+
+	// Duration from when the chosen conn was established until it was ready, including the
+	// candidate handshake, the wait for the chooser, and the Secure handshake.
+	HandshakeDuration time.Duration
+
+	// Duration from when the conn was ready until its first byte was read. Zero if none was.
+	TimeToFirstByte time.Duration
+
+	// Path of the conn: whether it's relayed, or was accepted from the peer, and the addr space of
+	// its remote addr, which is the rdv server's for relays.
+	Relay, Inbound bool
+	Space          AddrSpace
+}
+
+// Returns the statistics of the conn. Timings are zero for conns that aren't returned by a
+// client, e.g. on the server.
+func (c *Conn) Stats() ConnStats {
+	s := ConnStats{
+		BytesRead:    c.read.Load() - c.readBase,
+		BytesWritten: c.written.Load() - c.writtenBase,
+		Relay:        c.isRelay,
+		Inbound:      c.inbound,
+	}
+	_, s.Space = FromNetAddr(c.RemoteAddr())
+	if c.ready.IsZero() {
+		return s
+	}
+	if r := c.meta.Report; r != nil {
+		for _, cand := range r.Candidates {
+			if cand.Chosen {
+				s.DialDuration = cand.DialTime
+				s.HandshakeDuration = c.ready.Sub(r.Start) - cand.DialTime
+			}
+		}
+	}
+	if first := c.firstRead.Load(); first != 0 {
+		s.TimeToFirstByte = time.Unix(0, first).Sub(c.ready)
+	}
+	return s
+}
+
+// Marks the conn as ready, once the handshakes are done, which starts its statistics.
+func (c *Conn) markReady() {
+	c.ready = time.Now()
+	c.readBase, c.writtenBase = c.read.Load(), c.written.Load()
+}
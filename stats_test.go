@@ -0,0 +1,88 @@
+package rdv
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnStats(t *testing.T) {
+	tests := map[string]struct {
+		spaces AddrSpace
+		relay  bool
+	}{
+		"direct": {spaces: SpaceLoopback},
+		"relay":  {spaces: NoSpaces, relay: true},
+	}
+
+	_, hs := startServer(t, nil)
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			client := NewClient(&ClientConfig{AddrSpaces: tc.spaces})
+			accepted := make(chan *Conn, 1)
+			go func() {
+				conn, _, err := client.Accept(ctx, hs.URL, name, nil)
+				if err != nil {
+					t.Error(err)
+				}
+				accepted <- conn
+			}()
+			dc, _, err := client.Dial(ctx, hs.URL, name, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dc.Close()
+			ac := <-accepted
+			if ac == nil {
+				t.FailNow()
+			}
+			defer ac.Close()
+
+			// The handshakes aren't counted
+			if s := dc.Stats(); s.BytesRead != 0 || s.BytesWritten != 0 || s.TimeToFirstByte != 0 {
+				t.Fatalf("expected no traffic yet, got %+v", s)
+			}
+			go io.WriteString(dc, "hello")
+			if _, err := io.ReadFull(ac, make([]byte, 5)); err != nil {
+				t.Fatal(err)
+			}
+			ds, as := dc.Stats(), ac.Stats()
+			if ds.BytesWritten != 5 || as.BytesRead != 5 || ds.BytesRead != 0 || as.BytesWritten != 0 {
+				t.Fatalf("expected 5 bytes from the dialer to the acceptor, got %+v and %+v", ds, as)
+			}
+			if as.TimeToFirstByte <= 0 || ds.TimeToFirstByte != 0 {
+				t.Fatalf("expected a time to first byte for the acceptor only, got %v and %v", as.TimeToFirstByte, ds.TimeToFirstByte)
+			}
+			for _, s := range []ConnStats{ds, as} {
+				if s.DialDuration <= 0 || s.HandshakeDuration <= 0 {
+					t.Fatalf("expected timings, got %+v", s)
+				}
+				if s.Relay != tc.relay || s.Space != SpaceLoopback {
+					t.Fatalf("expected relay %v in %v, got %v in %v", tc.relay, SpaceLoopback, s.Relay, s.Space)
+				}
+			}
+			if !tc.relay && ds.Inbound == as.Inbound {
+				t.Fatalf("expected one inbound conn, got %v and %v", ds.Inbound, as.Inbound)
+			}
+		})
+	}
+}
+
+// Conns that aren't returned by a client, e.g. on the server, only count bytes.
+func TestConnStatsNotReady(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := newDirectConn(a, true, newMeta(false, "", "token"), nil)
+	defer conn.Close()
+	go b.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if s := conn.Stats(); s.BytesRead != 5 || s.DialDuration != 0 || s.HandshakeDuration != 0 || s.TimeToFirstByte != 0 || !s.Inbound {
+		t.Fatalf("expected 5 bytes read without timings, got %+v", s)
+	}
+}
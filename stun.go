@@ -0,0 +1,217 @@
+package rdv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	// Max time spent on STUN queries in StunSelfAddrs
+	stunTimeout = 500 * time.Millisecond
+
+	// Interval between retransmissions of STUN requests, which are sent over UDP
+	stunRetransmit = 100 * time.Millisecond
+
+	stunDefaultPort = "3478"
+	stunCookie      = 0x2112A442
+
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMappedAddr      = 0x0001
+	stunXorMappedAddr   = 0x0020
+)
+
+var errNoStunResponse = errors.New("no stun response")
+
+// NAT characteristics of a client, discovered by the SelfAddrFunc (see StunSelfAddrs).
+type NATInfo struct {
+	// The public addr of the UDP mapping, as observed by the first STUN server that responded.
+	Mapped netip.AddrPort
+
+	// Number of STUN servers that responded
+	Servers int
+
+	// The mapped addr is a local addr, i.e. there's no NAT.
+	Open bool
+
+	// The NAT preserved the local port, so the TCP socket is likely mapped to the same port.
+	PortPreserved bool
+
+	// The mapping differed between STUN servers, i.e. the NAT maps each destination to a new
+	// port, which makes direct conns unlikely. Requires at least two responding servers.
+	Symmetric bool
+}
+
+// Returns a SelfAddrFunc which queries the STUN servers (host:port, port 3478 by default) over
+// UDP from the socket port, to learn the public mapping and characteristics of the NAT. If the NAT
+// preserves the port, the public addr is added to the default self addrs, which helps when the rdv
+// server can't see the observed addr, e.g. behind a proxy. The NAT info is set on the socket, and
+// then on the conn's Meta. Waits at most 500ms for the servers.
+func StunSelfAddrs(servers []string) func(ctx context.Context, socket *Socket) []netip.AddrPort {
+	return func(ctx context.Context, socket *Socket) []netip.AddrPort {
+		addrs := DefaultSelfAddrs(ctx, socket)
+		ctx, cancel := context.WithTimeout(ctx, stunTimeout)
+		defer cancel()
+		mapped, err := stunQuery(ctx, socket.Port, servers)
+		if err != nil {
+			return addrs
+		}
+		nat := &NATInfo{Mapped: mapped[0], Servers: len(mapped), PortPreserved: mapped[0].Port() == socket.Port}
+		for _, addr := range mapped[1:] {
+			nat.Symmetric = nat.Symmetric || addr != nat.Mapped
+		}
+		nat.Open = slices.ContainsFunc(addrs, func(addr netip.AddrPort) bool {
+			return addr.Addr() == nat.Mapped.Addr()
+		})
+		socket.NAT = nat
+		if nat.PortPreserved && !nat.Open {
+			// The public addr is the most useful, so it's first in case there are too many
+			public := netip.AddrPortFrom(nat.Mapped.Addr(), socket.Port)
+			addrs = append([]netip.AddrPort{public}, addrs...)
+		}
+		return addrs[:min(len(addrs), maxAddrs-1)]
+	}
+}
+
+// Sends binding requests to all servers from the local port, and returns the mapped addrs in
+// the order of the servers that responded.
+func stunQuery(ctx context.Context, port uint16, servers []string) ([]netip.AddrPort, error) {
+	lc := net.ListenConfig{Control: reuseControl}
+	pc, err := lc.ListenPacket(ctx, "udp4", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	ctx, cancel := context.WithCancel(ctx) // stops retransmissions
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { pc.SetDeadline(past()) })
+	defer stop()
+
+	type query struct {
+		dst    net.Addr
+		txID   [12]byte
+		mapped netip.AddrPort
+	}
+	var queries []*query
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, stunDefaultPort)
+		}
+		dst, err := net.ResolveUDPAddr("udp4", server)
+		if err != nil {
+			continue
+		}
+		q := &query{dst: dst}
+		rand.Read(q.txID[:])
+		queries = append(queries, q)
+	}
+	go func() {
+		for ctx.Err() == nil {
+			for _, q := range queries {
+				pc.WriteTo(stunRequest(q.txID), q.dst)
+			}
+			select {
+			case <-time.After(stunRetransmit):
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	buf := make([]byte, 1500)
+	for pending := len(queries); pending > 0; {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		txID, mapped, ok := parseStunResponse(buf[:n])
+		for _, q := range queries {
+			if ok && q.txID == txID && !q.mapped.IsValid() {
+				q.mapped = mapped
+				pending--
+			}
+		}
+	}
+	var mapped []netip.AddrPort
+	for _, q := range queries {
+		if q.mapped.IsValid() {
+			mapped = append(mapped, q.mapped)
+		}
+	}
+	if len(mapped) == 0 {
+		return nil, errNoStunResponse
+	}
+	return mapped, nil
+}
+
+// Returns a binding request without attributes, see RFC 5389.
+func stunRequest(txID [12]byte) []byte {
+	msg := make([]byte, 20)
+	binary.BigEndian.PutUint16(msg[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(msg[4:], stunCookie)
+	copy(msg[8:], txID[:])
+	return msg
+}
+
+// Parses a binding response, and returns its transaction id and mapped addr.
+func parseStunResponse(msg []byte) (txID [12]byte, mapped netip.AddrPort, ok bool) {
+	if len(msg) < 20 || binary.BigEndian.Uint16(msg) != stunBindingResponse ||
+		binary.BigEndian.Uint32(msg[4:]) != stunCookie {
+		return
+	}
+	copy(txID[:], msg[8:20])
+	attrs := msg[20:min(len(msg), 20+int(binary.BigEndian.Uint16(msg[2:])))]
+	for len(attrs) >= 4 {
+		typ, l := binary.BigEndian.Uint16(attrs), int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			break
+		}
+		val := attrs[4 : 4+l]
+		switch typ {
+		case stunXorMappedAddr:
+			// XOR'd with the cookie, followed by the transaction id for ipv6
+			key := binary.BigEndian.AppendUint32(nil, stunCookie)
+			if addr, ok := parseStunAddr(val, append(key, txID[:]...)); ok {
+				return txID, addr, true
+			}
+		case stunMappedAddr:
+			if addr, ok := parseStunAddr(val, nil); ok {
+				mapped = addr // used unless there's an xor mapped addr
+			}
+		}
+		next := 4 + (l+3)&^3 // padded to 4 bytes
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	return txID, mapped, mapped.IsValid()
+}
+
+// Parses a (xor) mapped address attribute, which is xor'd with the key if non-nil.
+func parseStunAddr(val, key []byte) (netip.AddrPort, bool) {
+	if len(val) < 4 {
+		return netip.AddrPort{}, false
+	}
+	ipLen := map[byte]int{1: 4, 2: 16}[val[1]]
+	if ipLen == 0 || len(val) < 4+ipLen {
+		return netip.AddrPort{}, false
+	}
+	port, ip := slices.Clone(val[2:4]), slices.Clone(val[4:4+ipLen])
+	if key != nil {
+		for i := range port {
+			port[i] ^= key[i]
+		}
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), binary.BigEndian.Uint16(port)), true
+}
@@ -0,0 +1,185 @@
+package rdv
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of ticket tokens, which also versions the format
+const ticketPrefix = "rdvt1."
+
+// A rendezvous ticket, i.e. a token that is signed by the server or an offline signer (see
+// TicketKey), which servers with ServerConfig.RequireTickets demand. Unlike plain tokens, tickets
+// can't be guessed, and expire. Give the same ticket to both peers, which use it as their token.
+type Ticket struct {
+	// Random ID of the ticket, which is set by Sign if empty.
+	ID string
+
+	// Namespace in which the ticket is valid, see ClientConfig.Namespace.
+	Namespace string
+
+	// When the ticket expires. Required.
+	Expires time.Time
+
+	// Max number of client requests with the ticket, e.g. 2 for one dialer and one acceptor,
+	// which prevents replays once the peers are connected. Retries count too. Uses are counted
+	// per server instance, until the ticket expires. Zero means no limit.
+	MaxUses int
+}
+
+// The encoded claims of a ticket
+type ticketClaims struct {
+	ID        string `json:"id"`
+	Namespace string `json:"ns,omitempty"`
+	Expires   int64  `json:"exp"`
+	MaxUses   int    `json:"uses,omitempty"`
+}
+
+// Key for signing and verifying tickets, either with a shared secret (HMAC-SHA256), or with an
+// Ed25519 key pair, so that servers can verify tickets without being able to sign them.
+type TicketKey struct {
+	// Shared secret of the signers and servers.
+	Secret []byte
+
+	// Private key of the signer, which is only needed for signing.
+	PrivateKey ed25519.PrivateKey
+
+	// Public key of the signer, for verifying. Defaults to the public key of PrivateKey.
+	PublicKey ed25519.PublicKey
+}
+
+// Returns the ticket as a signed token.
+func (k *TicketKey) Sign(t Ticket) (string, error) {
+	if t.Expires.IsZero() {
+		return "", fmt.Errorf("%w: missing expiry", ErrBadTicket)
+	}
+	if t.ID == "" {
+		t.ID = newSessionID()
+	}
+	claims, err := json.Marshal(ticketClaims{t.ID, t.Namespace, t.Expires.Unix(), t.MaxUses})
+	if err != nil {
+		return "", err
+	}
+	payload := ticketPrefix + base64.RawURLEncoding.EncodeToString(claims)
+	var sig []byte
+	switch {
+	case k.Secret != nil:
+		sig = k.hmac(payload)
+	case k.PrivateKey != nil:
+		sig = ed25519.Sign(k.PrivateKey, []byte(payload))
+	default:
+		return "", fmt.Errorf("%w: no signing key", ErrBadTicket)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Returns the ticket of a token if its signature is valid and it hasn't expired, or an error
+// which wraps ErrBadTicket otherwise. Doesn't check the namespace or the uses.
+func (k *TicketKey) Verify(token string, now time.Time) (*Ticket, error) {
+	i := strings.LastIndexByte(token, '.')
+	if !strings.HasPrefix(token, ticketPrefix) || i < len(ticketPrefix) {
+		return nil, fmt.Errorf("%w: not a ticket", ErrBadTicket)
+	}
+	payload := token[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !k.valid(payload, sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrBadTicket)
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(payload[len(ticketPrefix):])
+	var c ticketClaims
+	if err == nil {
+		err = json.Unmarshal(claims, &c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadTicket, err)
+	}
+	t := &Ticket{ID: c.ID, Namespace: c.Namespace, Expires: time.Unix(c.Expires, 0), MaxUses: c.MaxUses}
+	if now.After(t.Expires) {
+		return nil, fmt.Errorf("%w: expired at %v", ErrBadTicket, t.Expires)
+	}
+	return t, nil
+}
+
+func (k *TicketKey) valid(payload string, sig []byte) bool {
+	switch {
+	case k.Secret != nil:
+		return subtle.ConstantTimeCompare(sig, k.hmac(payload)) == 1
+	case k.PublicKey != nil:
+		return ed25519.Verify(k.PublicKey, []byte(payload), sig)
+	case k.PrivateKey != nil:
+		return ed25519.Verify(k.PrivateKey.Public().(ed25519.PublicKey), []byte(payload), sig)
+	}
+	return false
+}
+
+func (k *TicketKey) hmac(payload string) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Returns a ticket signed with ServerConfig.RequireTickets, e.g. from an endpoint of the
+// application that pairs its users.
+func (l *Server) IssueTicket(t Ticket) (string, error) {
+	if l.cfg.RequireTickets == nil {
+		return "", errors.New("rdv server: tickets require ServerConfig.RequireTickets")
+	}
+	return l.cfg.RequireTickets.Sign(t)
+}
+
+// Counts the uses of tickets until they expire. Checked concurrently by AddClient.
+type ticketUses struct {
+	mu      sync.Mutex
+	uses    map[string]int
+	expires map[string]time.Time
+	pruned  time.Time
+}
+
+// Verifies the ticket of a client request, and counts the use, unless the client is reattaching
+// to a session that the ticket was used for.
+func (l *Server) checkTicket(meta *Meta, resumed bool) error {
+	now := time.Now()
+	t, err := l.cfg.RequireTickets.Verify(meta.Token, now)
+	if err != nil {
+		return err
+	}
+	if t.Namespace != meta.Namespace {
+		return fmt.Errorf("%w: wrong namespace", ErrBadTicket)
+	}
+	if t.MaxUses > 0 && !resumed {
+		return l.tickets.use(t, now)
+	}
+	return nil
+}
+
+func (u *ticketUses) use(t *Ticket, now time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.uses == nil {
+		u.uses, u.expires = make(map[string]int), make(map[string]time.Time)
+	}
+	if now.Sub(u.pruned) > time.Minute {
+		for id, expires := range u.expires {
+			if now.After(expires) {
+				delete(u.uses, id)
+				delete(u.expires, id)
+			}
+		}
+		u.pruned = now
+	}
+	if u.uses[t.ID] >= t.MaxUses {
+		return fmt.Errorf("%w: used %d times", ErrBadTicket, t.MaxUses)
+	}
+	u.uses[t.ID]++
+	u.expires[t.ID] = t.Expires
+	return nil
+}
@@ -0,0 +1,133 @@
+package rdv
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a token with the claims, signed with the secret of the key.
+func signPayload(k *TicketKey, claims string) string {
+	payload := ticketPrefix + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(k.hmac(payload))
+}
+
+func TestVerifyTicket(t *testing.T) {
+	now := time.Now()
+	secret := &TicketKey{Secret: []byte("secret")}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(k *TicketKey, ticket Ticket) string {
+		token, err := k.Sign(ticket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := Ticket{ID: "id", Namespace: "ns", Expires: now.Add(time.Hour), MaxUses: 2}
+	hmacToken := sign(secret, valid)
+	edToken := sign(&TicketKey{PrivateKey: priv}, valid)
+	payload, sig, _ := strings.Cut(strings.TrimPrefix(hmacToken, ticketPrefix), ".")
+	claims, _ := base64.RawURLEncoding.DecodeString(payload)
+	tampered := ticketPrefix + base64.RawURLEncoding.EncodeToString(bytes.Replace(claims, []byte(`"uses":2`), []byte(`"uses":9`), 1)) + "." + sig
+
+	tests := map[string]struct {
+		key   *TicketKey
+		token string
+		now   time.Time
+		ok    bool
+	}{
+		"hmac":          {key: secret, token: hmacToken, now: now, ok: true},
+		"ed25519":       {key: &TicketKey{PublicKey: pub}, token: edToken, now: now, ok: true},
+		"ed25519_priv":  {key: &TicketKey{PrivateKey: priv}, token: edToken, now: now, ok: true},
+		"tampered":      {key: secret, token: tampered, now: now},
+		"tampered_sig":  {key: secret, token: hmacToken[:len(hmacToken)-2] + "AA", now: now},
+		"expired":       {key: secret, token: hmacToken, now: now.Add(2 * time.Hour)},
+		"wrong_secret":  {key: &TicketKey{Secret: []byte("other")}, token: hmacToken, now: now},
+		"wrong_pub":     {key: &TicketKey{PublicKey: otherPub}, token: edToken, now: now},
+		"wrong_kind":    {key: &TicketKey{PublicKey: pub}, token: hmacToken, now: now},
+		"no_key":        {key: &TicketKey{}, token: hmacToken, now: now},
+		"plain":         {key: secret, token: "token", now: now},
+		"no_sig":        {key: secret, token: ticketPrefix + payload, now: now},
+		"malformed_sig": {key: secret, token: ticketPrefix + payload + ".!!", now: now},
+		"empty_claims":  {key: secret, token: signPayload(secret, "{}"), now: now},
+		"not_json":      {key: secret, token: signPayload(secret, "nope"), now: now},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ticket, err := tc.key.Verify(tc.token, tc.now)
+			if (err == nil) != tc.ok {
+				t.Fatalf("expected ok %v, got %v", tc.ok, err)
+			}
+			if err != nil && !errors.Is(err, ErrBadTicket) {
+				t.Fatalf("expected %v, got %v", ErrBadTicket, err)
+			}
+			if tc.ok && tc.token == hmacToken && (ticket.ID != valid.ID || ticket.Namespace != valid.Namespace || ticket.MaxUses != valid.MaxUses || ticket.Expires.Unix() != valid.Expires.Unix()) {
+				t.Fatalf("expected %+v, got %+v", valid, ticket)
+			}
+		})
+	}
+}
+
+func TestSignTicket(t *testing.T) {
+	if _, err := (&TicketKey{Secret: []byte("secret")}).Sign(Ticket{}); !errors.Is(err, ErrBadTicket) {
+		t.Fatalf("expected %v without expiry, got %v", ErrBadTicket, err)
+	}
+	if _, err := (&TicketKey{}).Sign(Ticket{Expires: time.Now()}); !errors.Is(err, ErrBadTicket) {
+		t.Fatalf("expected %v without a key, got %v", ErrBadTicket, err)
+	}
+	key := &TicketKey{Secret: []byte("secret")}
+	a, _ := key.Sign(Ticket{Expires: time.Now().Add(time.Hour)})
+	b, _ := key.Sign(Ticket{Expires: time.Now().Add(time.Hour)})
+	if a == b {
+		t.Fatal("expected random ids")
+	}
+}
+
+func TestTicketUses(t *testing.T) {
+	key := &TicketKey{Secret: []byte("secret")}
+	server := NewServer(&ServerConfig{RequireTickets: key})
+	token, err := server.IssueTicket(Ticket{Namespace: "ns", Expires: time.Now().Add(time.Hour), MaxUses: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := newMeta(true, "", token)
+	meta.Namespace = "ns"
+	for i, tc := range []struct {
+		resumed bool
+		ok      bool
+	}{{ok: true}, {ok: true}, {resumed: true, ok: true}, {}, {}} {
+		if err := server.checkTicket(meta, tc.resumed); (err == nil) != tc.ok {
+			t.Fatalf("use %d: expected ok %v, got %v", i+1, tc.ok, err)
+		}
+	}
+
+	// Uses are counted per ticket, and in its namespace
+	other, _ := server.IssueTicket(Ticket{Namespace: "ns", Expires: time.Now().Add(time.Hour), MaxUses: 1})
+	meta.Token = other
+	if err := server.checkTicket(meta, false); err != nil {
+		t.Fatal(err)
+	}
+	meta.Namespace = "other"
+	if err := server.checkTicket(meta, false); !errors.Is(err, ErrBadTicket) {
+		t.Fatalf("expected %v, got %v", ErrBadTicket, err)
+	}
+
+	// Expired tickets are pruned
+	now := time.Now().Add(2 * time.Hour)
+	server.tickets.use(&Ticket{ID: "new", Expires: now.Add(time.Hour), MaxUses: 1}, now)
+	if n := len(server.tickets.uses); n != 1 {
+		t.Fatalf("expected 1 ticket, got %d", n)
+	}
+}
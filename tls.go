@@ -0,0 +1,155 @@
+package rdv
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Like Dial, but runs a TLS handshake over the chosen conn (including the relay) as the TLS
+// client, and returns the conn once the peer is verified by the config. The config must require a
+// peer certificate, e.g. with PinnedTLSConfig, or a ServerName and RootCAs of a private CA. With
+// TLS 1.3, an acceptor that rejects the dialer's certificate fails the conn after the handshake,
+// so the dialer sees it on its first read.
+func (c *Client) DialSecure(ctx context.Context, addr, token string, reqHeader http.Header, config *tls.Config) (*Conn, *http.Response, error) {
+	conn, resp, err := c.Dial(ctx, addr, token, reqHeader)
+	if err != nil {
+		return nil, resp, err
+	}
+	return c.handshakeTLS(ctx, conn, resp, config)
+}
+
+// Like Accept, but runs a TLS handshake over the chosen conn as the TLS server, see DialSecure.
+// For mutual TLS, the config must require client certificates, e.g. with PinnedTLSConfig.
+func (c *Client) AcceptSecure(ctx context.Context, addr, token string, reqHeader http.Header, config *tls.Config) (*Conn, *http.Response, error) {
+	conn, resp, err := c.Accept(ctx, addr, token, reqHeader)
+	if err != nil {
+		return nil, resp, err
+	}
+	return c.handshakeTLS(ctx, conn, resp, config)
+}
+
+func (c *Client) handshakeTLS(ctx context.Context, conn *Conn, resp *http.Response, config *tls.Config) (*Conn, *http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.HandshakeTimeout)
+	defer cancel()
+	if err := conn.handshakeTLS(ctx, config); err != nil {
+		conn.Close()
+		return nil, resp, err
+	}
+	return conn, resp, nil
+}
+
+// Runs a TLS handshake on the conn, with the dialer as the TLS client, and replaces the conn with
+// the TLS conn.
+func (c *Conn) handshakeTLS(ctx context.Context, config *tls.Config) error {
+	nc := &readerConn{Conn: c.Conn, r: c.r}
+	var tc *tls.Conn
+	if c.meta.IsDialer {
+		tc = tls.Client(nc, config)
+	} else {
+		tc = tls.Server(nc, config)
+	}
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	c.Conn, c.r = tc, tc
+	return nil
+}
+
+// Returns the TLS state of a conn from DialSecure or AcceptSecure, e.g. with the certificates of
+// the peer, or nil for other conns.
+func (c *Conn) TLS() *tls.ConnectionState {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	return &state
+}
+
+// A conn which reads from the reader of a Conn, which may have buffered data.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *readerConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Returns a TLS config for DialSecure and AcceptSecure, which presents the certificate and only
+// accepts peers that present a certificate with a key that has one of the fingerprints (see
+// KeyFingerprint). The certificates are otherwise not verified, so self-signed certificates from
+// GenerateCert can be used, with fingerprints that are exchanged out of band, e.g. by QR code.
+func PinnedTLSConfig(cert tls.Certificate, peers ...[32]byte) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true, // verified by fingerprint below
+		MinVersion:         tls.VersionTLS13,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrUntrustedPeer
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if !slices.Contains(peers, KeyFingerprint(leaf)) {
+				return ErrUntrustedPeer
+			}
+			return nil
+		},
+	}
+}
+
+// Returns the SHA-256 fingerprint of the public key of the certificate (its SubjectPublicKeyInfo),
+// which stays the same if the certificate is renewed with the same key.
+func KeyFingerprint(cert *x509.Certificate) [32]byte {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// Generates a self-signed certificate with a new Ed25519 key, for PinnedTLSConfig. The certificate
+// is valid for 100 years, since it's only trusted by the fingerprint of its key.
+func GenerateCert() (tls.Certificate, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "rdv peer"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(100, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, nil
+}
@@ -0,0 +1,92 @@
+package rdv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestGenerateCert(t *testing.T) {
+	a, err := GenerateCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Leaf == nil || time.Until(a.Leaf.NotAfter) < 50*365*24*time.Hour {
+		t.Fatalf("expected a long-lived leaf, got %v", a.Leaf)
+	}
+	if KeyFingerprint(a.Leaf) == KeyFingerprint(b.Leaf) {
+		t.Fatal("expected distinct fingerprints")
+	}
+}
+
+// Dials and accepts with TLS through a server, and returns the conns of both peers.
+func securePairTLS(t *testing.T, dialCfg, acceptCfg *tls.Config) (dc, ac *Conn, dialErr, acceptErr error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, nil)
+	client := NewClient(&ClientConfig{AddrSpaces: NoSpaces})
+	done := make(chan error, 1)
+	go func() {
+		ac, _, acceptErr = client.AcceptSecure(ctx, hs.URL, "token", nil, acceptCfg)
+		done <- acceptErr
+	}()
+	dc, _, dialErr = client.DialSecure(ctx, hs.URL, "token", nil, dialCfg)
+	<-done
+	for _, conn := range []*Conn{dc, ac} {
+		if conn != nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+	}
+	return dc, ac, dialErr, acceptErr
+}
+
+func TestPinnedTLS(t *testing.T) {
+	dialCert, _ := GenerateCert()
+	acceptCert, _ := GenerateCert()
+	otherCert, _ := GenerateCert()
+	dialFp, acceptFp, otherFp := KeyFingerprint(dialCert.Leaf), KeyFingerprint(acceptCert.Leaf), KeyFingerprint(otherCert.Leaf)
+
+	t.Run("pinned", func(t *testing.T) {
+		dc, ac, dialErr, acceptErr := securePairTLS(t, PinnedTLSConfig(dialCert, acceptFp), PinnedTLSConfig(acceptCert, dialFp))
+		if err := errors.Join(dialErr, acceptErr); err != nil {
+			t.Fatal(err)
+		}
+		if state := dc.TLS(); state == nil || KeyFingerprint(state.PeerCertificates[0]) != acceptFp {
+			t.Fatalf("expected the acceptor's cert, got %v", state)
+		}
+		if state := ac.TLS(); state == nil || KeyFingerprint(state.PeerCertificates[0]) != dialFp {
+			t.Fatalf("expected the dialer's cert, got %v", state)
+		}
+		go io.WriteString(dc, "hello")
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(ac, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("expected hello, got %q, %v", buf, err)
+		}
+	})
+	t.Run("acceptor_mismatch", func(t *testing.T) {
+		_, _, dialErr, _ := securePairTLS(t, PinnedTLSConfig(dialCert, otherFp), PinnedTLSConfig(acceptCert, dialFp))
+		if !errors.Is(dialErr, ErrUntrustedPeer) {
+			t.Fatalf("expected %v, got %v", ErrUntrustedPeer, dialErr)
+		}
+	})
+	t.Run("dialer_mismatch", func(t *testing.T) {
+		dc, _, _, acceptErr := securePairTLS(t, PinnedTLSConfig(dialCert, acceptFp), PinnedTLSConfig(acceptCert, otherFp))
+		if !errors.Is(acceptErr, ErrUntrustedPeer) {
+			t.Fatalf("expected %v, got %v", ErrUntrustedPeer, acceptErr)
+		}
+		if dc != nil {
+			dc.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := dc.Read(make([]byte, 1)); err == nil {
+				t.Fatal("expected the dialer's conn to fail")
+			}
+		}
+	})
+}
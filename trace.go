@@ -0,0 +1,161 @@
+package rdv
+
+import (
+	"encoding/json"
+	"io"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A single event in a client trace, written as a JSON line. See ClientConfig.Trace.
+type TraceEvent struct {
+	Time time.Time `json:"time"`
+
+	// What happened, e.g. "dial" or "shake_err". See the trace* constants.
+	Kind string `json:"kind"`
+
+	Addr  *netip.AddrPort `json:"addr,omitempty"`
+	Space string          `json:"space,omitempty"`
+	Err   string          `json:"err,omitempty"`
+
+	// Whether the candidate was accepted from the peer, rather than dialed.
+	Inbound bool `json:"inbound,omitempty"`
+
+	// Whether the candidate is the relay conn.
+	Relay bool `json:"relay,omitempty"`
+
+	// Handshake bytes, with the token redacted.
+	Data string `json:"data,omitempty"`
+}
+
+// An event of a connection attempt, for showing its progress, e.g. "trying LAN" or "using relay"
+// in a UI. See ClientConfig.ObserverFunc.
+type CandidateEvent struct {
+	Time time.Time
+
+	// What happened, one of the trace event kinds, e.g. TraceDial or TraceChosen.
+	Kind string
+
+	// Token of the attempt, for observers of concurrent attempts.
+	Token string
+
+	// Addr of the candidate and its addr space, if known.
+	Addr  netip.AddrPort
+	Space AddrSpace
+
+	// Whether the candidate was accepted from the peer, or is the relay conn.
+	Inbound, Relay bool
+
+	// Why the dial or handshake failed, for the error kinds.
+	Err error
+}
+
+// Kinds of trace events.
+const (
+	TraceServerDial = "server_dial" // request sent to the rdv server
+	TraceServerResp = "server_resp" // response received, or failed
+	TraceDial       = "dial"        // candidate dial started
+	TraceDialOk     = "dial_ok"     // candidate dial connected
+	TraceDialErr    = "dial_err"    // candidate dial failed
+	TraceSkip       = "skip"        // candidate addr not dialed due to addr space or pairing
+	TraceAccept     = "accept"      // inbound candidate accepted
+	TraceReject     = "reject"      // inbound candidate rejected due to addr space
+	TraceShakeOk    = "shake_ok"    // candidate handshake succeeded
+	TraceShakeErr   = "shake_err"   // candidate handshake failed
+	TraceChosen     = "chosen"      // candidate chosen
+	TraceDiscard    = "discard"     // candidate not chosen
+	TraceHoldDown   = "hold_down"   // direct candidate after the relay was chosen, or none (without addr)
+	TraceDowngrade  = "downgrade"   // chosen candidate is downgraded, see Downgrade
+)
+
+const redacted = "<redacted>"
+
+// Records trace events in a report, and writes them as JSON lines if there's a writer.
+type tracer struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	observe func(CandidateEvent)
+	tokens  []string // the first is the token of the attempt
+	report  ConnReport
+}
+
+func newTracer(w io.Writer, observe func(CandidateEvent), tokens ...string) *tracer {
+	t := &tracer{observe: observe, tokens: tokens, report: ConnReport{Start: time.Now()}}
+	if w != nil {
+		t.enc = json.NewEncoder(w)
+	}
+	return t
+}
+
+func (t *tracer) event(kind string, addr netip.AddrPort, err error) {
+	t.write(TraceEvent{Kind: kind}, addr, err)
+}
+
+// Records an event of a candidate conn.
+func (t *tracer) connEvent(kind string, conn *Conn, err error) {
+	t.write(TraceEvent{Kind: kind, Inbound: conn.inbound, Relay: conn.isRelay}, connAddr(conn), err)
+}
+
+// Records handshake bytes, with the token redacted.
+func (t *tracer) data(kind string, addr netip.AddrPort, data string) {
+	t.write(TraceEvent{Kind: kind, Data: t.redact(data)}, addr, nil)
+}
+
+// Like data, for a candidate conn.
+func (t *tracer) connData(kind string, conn *Conn, data string) {
+	t.write(TraceEvent{Kind: kind, Inbound: conn.inbound, Relay: conn.isRelay, Data: t.redact(data)}, connAddr(conn), nil)
+}
+
+func (t *tracer) redact(data string) string {
+	for _, token := range t.tokens {
+		if token != "" {
+			data = strings.ReplaceAll(data, token, redacted)
+		}
+	}
+	return strings.TrimSpace(data)
+}
+
+func (t *tracer) write(ev TraceEvent, addr netip.AddrPort, err error) {
+	ev.Time = time.Now()
+	if addr.IsValid() {
+		ev.Addr = &addr
+		ev.Space = GetAddrSpace(addr.Addr()).String()
+	}
+	if err != nil {
+		err = unwrapOp(err)
+		ev.Err = err.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.report.record(ev, addr, err)
+	if t.enc != nil {
+		t.enc.Encode(ev)
+	}
+	if t.observe != nil {
+		t.observe(CandidateEvent{Time: ev.Time, Kind: ev.Kind, Token: t.tokens[0], Addr: addr, Space: GetAddrSpace(addr.Addr()), Inbound: ev.Inbound, Relay: ev.Relay, Err: err})
+	}
+}
+
+// Returns a snapshot of the report.
+func (t *tracer) snapshot() *ConnReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.report.clone()
+}
+
+// Reads trace events written by a client, e.g. for rendering a timeline.
+func ReadTrace(r io.Reader) (events []TraceEvent, err error) {
+	dec := json.NewDecoder(r)
+	for {
+		var ev TraceEvent
+		err = dec.Decode(&ev)
+		if err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return
+		}
+		events = append(events, ev)
+	}
+}
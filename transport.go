@@ -0,0 +1,44 @@
+package rdv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+)
+
+// Dials a peer addr for a candidate conn, instead of dialing from the socket. Custom transports
+// are set per addr space with ClientConfig.Transports. Their conns are handshaked and chosen like
+// other candidates, so they must be byte streams that reach the peer addr.
+type Transport func(ctx context.Context, socket *Socket, addr netip.AddrPort) (net.Conn, error)
+
+// Returns a transport that dials from an addr of the named network interface, in the same IP
+// family as the peer addr, e.g. to dial private addrs over the physical interface rather than
+// a VPN. On Linux, the conn is also bound to the interface (SO_BINDTODEVICE), so that it's routed
+// through it even if the routing table prefers another interface. Elsewhere, only the source addr
+// is set, which the routing table may not honor. Note that the port is not shared with the socket.
+func InterfaceTransport(name string) Transport {
+	return func(ctx context.Context, socket *Socket, addr netip.AddrPort) (net.Conn, error) {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range (Interfaces{*ifi}).All() {
+			if ip.Is4() != addr.Addr().Is4() || (ip.IsLinkLocalUnicast() && !addr.Addr().IsLinkLocalUnicast()) {
+				continue
+			}
+			d := net.Dialer{LocalAddr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)), Control: bindToDevice(name)}
+			return d.DialContext(ctx, tcpNetwork(addr.Addr()), addr.String())
+		}
+		return nil, fmt.Errorf("%w: no addr on interface [%s] for %v", ErrDontUse, name, addr)
+	}
+}
+
+// Returns a transport that dials through a proxy, which is an http(s) proxy that supports
+// CONNECT or a socks5 proxy, e.g. as a fallback for public addrs that can't be reached directly.
+func ProxyTransport(proxy *url.URL) Transport {
+	return func(ctx context.Context, socket *Socket, addr netip.AddrPort) (net.Conn, error) {
+		return dialProxy(ctx, proxy, addr.String())
+	}
+}
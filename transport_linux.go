@@ -0,0 +1,26 @@
+package rdv
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns a dialer control func that binds the socket to the named interface. Kernels before 5.7
+// require CAP_NET_RAW for that, so without it, the socket is left unbound.
+func bindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var optErr error
+		err := c.Control(func(fd uintptr) {
+			optErr = unix.BindToDevice(int(fd), name)
+		})
+		if err != nil {
+			return err
+		}
+		if errors.Is(optErr, unix.EPERM) {
+			return nil
+		}
+		return optErr
+	}
+}
@@ -0,0 +1,31 @@
+package rdv
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Checks that the conn is bound to the interface, if binding was permitted.
+func checkBoundDevice(t *testing.T, nc net.Conn, name string) {
+	t.Helper()
+	rc, err := nc.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dev string
+	var optErr error
+	rc.Control(func(fd uintptr) {
+		dev, optErr = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	})
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	if dev == "" {
+		t.Log("binding to the interface not permitted")
+	} else if dev != name {
+		t.Fatalf("expected the conn to be bound to %s, got %q", name, dev)
+	}
+}
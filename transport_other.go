@@ -0,0 +1,10 @@
+//go:build !linux
+
+package rdv
+
+import "syscall"
+
+// Binding sockets to interfaces is only supported on Linux.
+func bindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package rdv
+
+import (
+	"net"
+	"testing"
+)
+
+func checkBoundDevice(t *testing.T, nc net.Conn, name string) {}
@@ -0,0 +1,63 @@
+package rdv
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// Returns the name of the loopback interface.
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			return ifi.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestInterfaceTransport(t *testing.T) {
+	lo := loopbackInterface(t)
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr).AddrPort()
+	tests := map[string]struct {
+		name string
+		addr netip.AddrPort
+		ok   bool
+	}{
+		"loopback": {name: lo, addr: addr, ok: true},
+		"unknown":  {name: "rdv-nonexistent0", addr: addr},
+		"closed":   {name: lo, addr: netip.AddrPortFrom(addr.Addr(), 1)},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			nc, err := InterfaceTransport(tc.name)(ctx, nil, tc.addr)
+			if (err == nil) != tc.ok {
+				t.Fatalf("expected ok %v, got %v", tc.ok, err)
+			}
+			if nc == nil {
+				return
+			}
+			defer nc.Close()
+			if local := nc.LocalAddr().(*net.TCPAddr).AddrPort().Addr(); !local.IsLoopback() {
+				t.Fatalf("expected a loopback source addr, got %v", local)
+			}
+			checkBoundDevice(t, nc, tc.name)
+		})
+	}
+}
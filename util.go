@@ -86,6 +86,28 @@ func closeAll(closers *[]io.Closer) {
 	}
 }
 
+// Makes the conn (or the TCP conn that it wraps) close with a reset, which skips TIME_WAIT, so
+// that its port can dial the same addr again right away.
+func resetOnClose(nc net.Conn) {
+	if tc := tcpConn(nc); tc != nil {
+		tc.SetLinger(0)
+	}
+}
+
+// Returns the TCP conn, or the TCP conn that it wraps (e.g. with TLS), or nil if there is none.
+func tcpConn(nc net.Conn) *net.TCPConn {
+	for {
+		if tc, ok := nc.(*net.TCPConn); ok {
+			return tc
+		}
+		wrapper, ok := nc.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		nc = wrapper.NetConn()
+	}
+}
+
 func cfgDeadline(d time.Duration) (t time.Time) {
 	if d > 0 {
 		t = time.Now().Add(d)
@@ -114,25 +136,6 @@ func expectStr(r io.Reader, str string) error {
 	return nil
 }
 
-type idleTimer struct {
-	timeout time.Duration
-	timer   *time.Timer
-}
-
-func newIdleTimer(timeout time.Duration, cb func()) *idleTimer {
-	return &idleTimer{timeout, time.AfterFunc(timeout, cb)}
-}
-
-// Registers activity and prolongs the deadline
-func (t *idleTimer) Write(p []byte) (int, error) {
-	t.timer.Reset(t.timeout)
-	return len(p), nil
-}
-
-func (t *idleTimer) Stop() {
-	t.timer.Stop()
-}
-
 // Unwraps any net.OpError to prevent address noise
 func unwrapOp(err error) error {
 	var opErr *net.OpError
@@ -142,6 +145,12 @@ func unwrapOp(err error) error {
 	return err
 }
 
+// Returns the remote addr of a conn, or the zero value if not an IP addr
+func connAddr(conn *Conn) netip.AddrPort {
+	addr, _ := FromNetAddr(conn.RemoteAddr())
+	return addr
+}
+
 // Filters and returns a new slice where fn returns true
 func filter[T any](ts []T, fn func(t T) bool) (ret []T) {
 	for _, t := range ts {
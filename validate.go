@@ -0,0 +1,177 @@
+package rdv
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// A field of a ClientConfig or ServerConfig which is invalid, or questionable in case of
+// warnings. See ClientConfig.Validate.
+type ConfigError struct {
+	// Name of the field, e.g. "Retry.MaxAttempts"
+	Field string
+
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("rdv config: %s %s", e.Field, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return ErrInvalidConfig
+}
+
+// Addr spaces that are dialed and listened on, i.e. all but NoSpaces and unknown bits
+const knownSpaces = SpacePublic4 | SpacePublic6 | SpacePrivate4 | SpacePrivate6 | SpaceLink4 | SpaceLink6 | SpaceLoopback | SpaceCGNAT
+
+// Collects the errors of a config, and reports its warnings.
+type configCheck struct {
+	errs []error
+	warn func(*ConfigError)
+}
+
+func (v *configCheck) fail(field, reason string, args ...any) {
+	v.errs = append(v.errs, &ConfigError{Field: field, Reason: fmt.Sprintf(reason, args...)})
+}
+
+func (v *configCheck) warning(field, reason string, args ...any) {
+	if v.warn != nil {
+		v.warn(&ConfigError{Field: field, Reason: fmt.Sprintf(reason, args...)})
+	}
+}
+
+func nonNegative[T ~int | ~int64](v *configCheck, field string, x T) {
+	if x < 0 {
+		v.fail(field, "must not be negative, got %v", x)
+	}
+}
+
+// Checks the config for nonsensical values and conflicting fields, and returns the errors as a
+// join of ConfigErrors, which wrap ErrInvalidConfig. Questionable but usable settings, such as
+// fields that have no effect, are reported to warn, which may be nil. NewClient validates the
+// config too, and logs the warnings. Zero values are valid, since they mean the defaults.
+func (c *ClientConfig) Validate(warn func(*ConfigError)) error {
+	v := &configCheck{warn: warn}
+	nonNegative(v, "MaxErrorBody", c.MaxErrorBody)
+	nonNegative(v, "DialAttempts", c.DialAttempts)
+	nonNegative(v, "DialSpacing", c.DialSpacing)
+	nonNegative(v, "ConnTimeout", c.ConnTimeout)
+	nonNegative(v, "ServerResponseTimeout", c.ServerResponseTimeout)
+	nonNegative(v, "HandshakeTimeout", c.HandshakeTimeout)
+	nonNegative(v, "MaxPunchWindow", c.MaxPunchWindow)
+	nonNegative(v, "RelayHoldDown", c.RelayHoldDown)
+	nonNegative(v, "WriteBuffer", c.WriteBuffer)
+	nonNegative(v, "ResumeTimeout", c.ResumeTimeout)
+	if c.ProtocolVersion < 0 || c.ProtocolVersion > maxProtocolVersion {
+		v.fail("ProtocolVersion", "must be between 1 and %d, got %d", maxProtocolVersion, c.ProtocolVersion)
+	}
+	if c.AddrSpaces != 0 && c.AddrSpaces != NoSpaces && !c.AddrSpaces.Includes(knownSpaces) {
+		v.fail("AddrSpaces", "includes no addr spaces, use NoSpaces to only use the relay")
+	}
+	for _, space := range c.DialOrder {
+		if space&knownSpaces == 0 || space&(space-1) != 0 {
+			v.fail("DialOrder", "must only have single addr spaces, got %d", uint32(space))
+			break
+		}
+	}
+	if !slices.Contains([]string{"", "tcp", "tcp4", "tcp6"}, c.ServerNetwork) {
+		v.fail("ServerNetwork", "must be tcp, tcp4 or tcp6, got %q", c.ServerNetwork)
+	}
+	if c.ProxyFunc != nil && c.DialServer != nil {
+		v.fail("ProxyFunc", "conflicts with DialServer, which dials the rdv server instead")
+	}
+	if len(c.Banner) > maxBannerSize {
+		v.fail("Banner", "must not exceed %d bytes, got %d", maxBannerSize, len(c.Banner))
+	}
+	if c.Secure != nil && c.Secure.Key != nil && len(c.Secure.Key) != 32 {
+		v.fail("Secure.Key", "must be 32 bytes, got %d", len(c.Secure.Key))
+	}
+	if c.Secure != nil && c.Secure.Key == nil && !c.HashToken {
+		v.fail("Secure", "without a Key requires HashToken, since the key is derived from the token")
+	}
+	if r := c.Retry; r != nil {
+		nonNegative(v, "Retry.MaxAttempts", r.MaxAttempts)
+		nonNegative(v, "Retry.MinBackoff", r.MinBackoff)
+		nonNegative(v, "Retry.MaxBackoff", r.MaxBackoff)
+		if r.MinBackoff > 0 && r.MaxBackoff > 0 && r.MinBackoff > r.MaxBackoff {
+			v.fail("Retry.MinBackoff", "must not exceed MaxBackoff, got %v > %v", r.MinBackoff, r.MaxBackoff)
+		}
+		if r.Jitter > 1 {
+			v.fail("Retry.Jitter", "must not exceed 1, got %v", r.Jitter)
+		}
+	}
+	if c.TokenSalt != "" && !c.HashToken {
+		v.warning("TokenSalt", "has no effect without HashToken")
+	}
+	if c.DialChooser != nil && c.DialChooserFunc != nil {
+		v.warning("DialChooser", "has no effect with DialChooserFunc")
+	}
+	if c.FastOpen && c.AddrSpaces == NoSpaces {
+		v.warning("FastOpen", "has no effect with NoSpaces, since there are no direct conns")
+	}
+	if c.FlushDelay != 0 && c.WriteBuffer == 0 {
+		v.warning("FlushDelay", "has no effect without WriteBuffer")
+	}
+	if c.RelayHoldDown > 0 && c.AddrSpaces == NoSpaces {
+		v.warning("RelayHoldDown", "has no effect with NoSpaces, since there are no direct conns")
+	}
+	if c.ConnTimeout > 0 && c.ServerResponseTimeout >= c.ConnTimeout {
+		v.warning("ServerResponseTimeout", "has no effect unless shorter than ConnTimeout")
+	}
+	if c.ConnTimeout > 0 && c.ConnTimeout < time.Second {
+		v.warning("ConnTimeout", "of %v leaves little time to reach the peer", c.ConnTimeout)
+	}
+	return errors.Join(v.errs...)
+}
+
+// Checks the config like ClientConfig.Validate. NewServer validates the config too, and logs the
+// warnings.
+func (c *ServerConfig) Validate(warn func(*ConfigError)) error {
+	v := &configCheck{warn: warn}
+	nonNegative(v, "LobbyTimeout", c.LobbyTimeout)
+	nonNegative(v, "ExpiryUpdates", c.ExpiryUpdates)
+	nonNegative(v, "EarlyDataLimit", c.EarlyDataLimit)
+	nonNegative(v, "MaxLobbySize", c.MaxLobbySize)
+	nonNegative(v, "MaxConnsPerIP", c.MaxConnsPerIP)
+	nonNegative(v, "ShutdownTimeout", c.ShutdownTimeout)
+	nonNegative(v, "ShutdownGracePeriod", c.ShutdownGracePeriod)
+	nonNegative(v, "HeaderTimeout", c.HeaderTimeout)
+	nonNegative(v, "MaxHeaderBytes", c.MaxHeaderBytes)
+	for name, ns := range c.Namespaces {
+		nonNegative(v, fmt.Sprintf("Namespaces[%q].MaxLobby", name), ns.MaxLobby)
+	}
+	if c.Lobby != nil && c.InstanceAddr == "" {
+		v.fail("Lobby", "requires InstanceAddr, so that other instances can forward clients")
+	}
+	if c.Lobby != nil && c.InstanceKey == "" {
+		v.fail("Lobby", "requires InstanceKey, so that other instances can authenticate forwarded clients")
+	}
+	if c.Standby != "" && c.StandbyKey == "" {
+		v.fail("Standby", "requires StandbyKey")
+	}
+	if k := c.RequireTickets; k != nil {
+		if k.Secret == nil && k.PublicKey == nil && k.PrivateKey == nil {
+			v.fail("RequireTickets", "requires a Secret or a PublicKey")
+		}
+		if k.PublicKey != nil && len(k.PublicKey) != ed25519.PublicKeySize {
+			v.fail("RequireTickets.PublicKey", "must be %d bytes, got %d", ed25519.PublicKeySize, len(k.PublicKey))
+		}
+		if k.PrivateKey != nil && len(k.PrivateKey) != ed25519.PrivateKeySize {
+			v.fail("RequireTickets.PrivateKey", "must be %d bytes, got %d", ed25519.PrivateKeySize, len(k.PrivateKey))
+		}
+	}
+	if c.ExpiryUpdates > 0 && c.LobbyTimeout == 0 {
+		v.warning("ExpiryUpdates", "has no effect without LobbyTimeout")
+	}
+	if c.InstanceAddr != "" && c.Lobby == nil {
+		v.warning("InstanceAddr", "has no effect without Lobby")
+	}
+	if c.MaxConnsPerIP > 0 && c.MaxLobbySize > 0 && c.MaxConnsPerIP > c.MaxLobbySize {
+		v.warning("MaxConnsPerIP", "has no effect unless less than MaxLobbySize")
+	}
+	return errors.Join(v.errs...)
+}
@@ -0,0 +1,115 @@
+package rdv
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Returns the fields of the errors and warnings of a Validate call.
+func validateFields(t *testing.T, validate func(warn func(*ConfigError)) error) (errs, warnings []string) {
+	t.Helper()
+	err := validate(func(w *ConfigError) { warnings = append(warnings, w.Field) })
+	if err == nil {
+		return nil, warnings
+	}
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected %v, got %v", ErrInvalidConfig, err)
+	}
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var ce *ConfigError
+		if !errors.As(e, &ce) {
+			t.Fatalf("expected a ConfigError, got %v", e)
+		}
+		errs = append(errs, ce.Field)
+	}
+	return errs, warnings
+}
+
+func TestClientConfigValidate(t *testing.T) {
+	tests := map[string]struct {
+		cfg      ClientConfig
+		errs     []string
+		warnings []string
+	}{
+		"zero":              {},
+		"profile":           {cfg: *ProfileInternet()},
+		"negative":          {cfg: ClientConfig{DialAttempts: -1, ConnTimeout: -time.Second}, errs: []string{"DialAttempts", "ConnTimeout"}},
+		"protocol":          {cfg: ClientConfig{ProtocolVersion: maxProtocolVersion + 1}, errs: []string{"ProtocolVersion"}},
+		"no_known_spaces":   {cfg: ClientConfig{AddrSpaces: 1 << 30}, errs: []string{"AddrSpaces"}},
+		"no_spaces":         {cfg: ClientConfig{AddrSpaces: NoSpaces}},
+		"dial_order":        {cfg: ClientConfig{DialOrder: []AddrSpace{SpacePrivate4 | SpacePublic4}}, errs: []string{"DialOrder"}},
+		"server_network":    {cfg: ClientConfig{ServerNetwork: "udp"}, errs: []string{"ServerNetwork"}},
+		"banner":            {cfg: ClientConfig{Banner: make([]byte, maxBannerSize+1)}, errs: []string{"Banner"}},
+		"secure_key":        {cfg: ClientConfig{Secure: &SecureConfig{Key: make([]byte, 16)}}, errs: []string{"Secure.Key"}},
+		"secure_token":      {cfg: ClientConfig{Secure: &SecureConfig{}, HashToken: true}},
+		"retry":             {cfg: ClientConfig{Retry: &RetryConfig{MinBackoff: time.Minute, MaxBackoff: time.Second, Jitter: 2}}, errs: []string{"Retry.MinBackoff", "Retry.Jitter"}},
+		"token_salt":        {cfg: ClientConfig{TokenSalt: "salt"}, warnings: []string{"TokenSalt"}},
+		"flush_delay":       {cfg: ClientConfig{FlushDelay: time.Millisecond}, warnings: []string{"FlushDelay"}},
+		"fast_open":         {cfg: ClientConfig{FastOpen: true, AddrSpaces: NoSpaces}, warnings: []string{"FastOpen"}},
+		"response_timeout":  {cfg: ClientConfig{ConnTimeout: 5 * time.Second, ServerResponseTimeout: 5 * time.Second}, warnings: []string{"ServerResponseTimeout"}},
+		"short_timeout":     {cfg: ClientConfig{ConnTimeout: 100 * time.Millisecond}, warnings: []string{"ConnTimeout"}},
+		"errs_and_warnings": {cfg: ClientConfig{DialAttempts: -1, FlushDelay: time.Millisecond}, errs: []string{"DialAttempts"}, warnings: []string{"FlushDelay"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			errs, warnings := validateFields(t, tc.cfg.Validate)
+			if !slices.Equal(errs, tc.errs) {
+				t.Fatalf("expected errors %v, got %v", tc.errs, errs)
+			}
+			if !slices.Equal(warnings, tc.warnings) {
+				t.Fatalf("expected warnings %v, got %v", tc.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	tests := map[string]struct {
+		cfg      ServerConfig
+		errs     []string
+		warnings []string
+	}{
+		"zero":            {},
+		"profile":         {cfg: *ProfileRelayServerLarge()},
+		"negative":        {cfg: ServerConfig{LobbyTimeout: -time.Second, MaxLobbySize: -1}, errs: []string{"LobbyTimeout", "MaxLobbySize"}},
+		"namespace":       {cfg: ServerConfig{Namespaces: map[string]NamespaceConfig{"ns": {MaxLobby: -1}}}, errs: []string{`Namespaces["ns"].MaxLobby`}},
+		"lobby":           {cfg: ServerConfig{Lobby: new(memLobby)}, errs: []string{"Lobby", "Lobby"}},
+		"standby":         {cfg: ServerConfig{Standby: "http://standby.test/"}, errs: []string{"Standby"}},
+		"tickets":         {cfg: ServerConfig{RequireTickets: &TicketKey{}}, errs: []string{"RequireTickets"}},
+		"ticket_key":      {cfg: ServerConfig{RequireTickets: &TicketKey{PublicKey: make([]byte, 16)}}, errs: []string{"RequireTickets.PublicKey"}},
+		"expiry_updates":  {cfg: ServerConfig{ExpiryUpdates: time.Minute}, warnings: []string{"ExpiryUpdates"}},
+		"instance_addr":   {cfg: ServerConfig{InstanceAddr: "http://rdv.test/"}, warnings: []string{"InstanceAddr"}},
+		"conns_per_ip":    {cfg: ServerConfig{MaxConnsPerIP: 10, MaxLobbySize: 5}, warnings: []string{"MaxConnsPerIP"}},
+		"conns_per_ip_ok": {cfg: ServerConfig{MaxConnsPerIP: 5, MaxLobbySize: 10}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			errs, warnings := validateFields(t, tc.cfg.Validate)
+			if !slices.Equal(errs, tc.errs) {
+				t.Fatalf("expected errors %v, got %v", tc.errs, errs)
+			}
+			if !slices.Equal(warnings, tc.warnings) {
+				t.Fatalf("expected warnings %v, got %v", tc.warnings, warnings)
+			}
+		})
+	}
+}
+
+// Invalid configs fail fast, instead of misbehaving at rendezvous time.
+func TestInvalidConfig(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := NewClient(&ClientConfig{DialAttempts: -1})
+	if _, _, err := client.Dial(ctx, "http://rdv.test/", "token", nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected %v, got %v", ErrInvalidConfig, err)
+	}
+	server := NewServer(&ServerConfig{LobbyTimeout: -1})
+	if err := server.Serve(ctx); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected %v, got %v", ErrInvalidConfig, err)
+	}
+}
@@ -0,0 +1,164 @@
+package rdv
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Reasons for a lobby conn to stop idling.
+var (
+	errIdleInterrupted = errors.New("lobby monitoring interrupted")
+	errIdleTimeout     = errors.New("lobby timeout")
+	errIdleData        = errors.New("conn must idle while waiting for response header")
+	errIdleClosed      = errors.New("client disconnected")
+)
+
+// A source of time for the lobby timers of a server, see ServerConfig.Clock.
+type Clock interface {
+	Now() time.Time
+
+	// Calls f once d has passed, like time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// A timer of a Clock, like time.Timer.
+type ClockTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer { return time.AfterFunc(d, f) }
+
+// Monitors a conn waiting in the lobby for readability, without consuming any data.
+// Client data, errors and the lobby timeout all end the monitoring, as does stop. The lobby timeout
+// is tracked by a timer, so the deadline of the conn is only used to wake up the monitoring.
+type idleWatch struct {
+	conn   *Conn
+	clock  Clock
+	joined time.Time
+
+	// Why the monitoring ended, set before the watch is reported.
+	reason error
+
+	timer    ClockTimer
+	stopped  atomic.Bool
+	timedOut atomic.Bool
+
+	mu      sync.Mutex
+	ended   bool       // guards against waking up the conn after monitoring
+	updates ClockTimer // of the remaining lobby time, see every
+}
+
+// Starts monitoring the conn. Report is called exactly once, from another goroutine, when the
+// monitoring has ended. Zero timeout means no timeout. If earlyLimit is positive, up to that many
+// bytes of client data are read into the conn, and only more data ends the monitoring.
+func watchIdle(conn *Conn, clock Clock, timeout time.Duration, earlyLimit int, report func(w *idleWatch)) *idleWatch {
+	w := &idleWatch{conn: conn, clock: clock, joined: clock.Now()}
+	if timeout > 0 {
+		w.timer = clock.AfterFunc(timeout, func() {
+			w.timedOut.Store(true)
+			w.wake()
+		})
+	}
+	go func() {
+		var err error
+		if earlyLimit > 0 {
+			err = readEarly(conn, earlyLimit)
+		} else {
+			err = waitReadable(conn)
+		}
+		w.mu.Lock()
+		w.ended = true
+		if w.updates != nil {
+			w.updates.Stop()
+		}
+		w.mu.Unlock()
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		switch {
+		case err == nil:
+			w.reason = errIdleData
+		case errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET):
+			w.reason = errIdleClosed
+		case !errors.Is(err, os.ErrDeadlineExceeded):
+			w.reason = err
+		case w.stopped.Load():
+			w.reason = errIdleInterrupted
+		case w.timedOut.Load():
+			w.reason = errIdleTimeout
+		default:
+			w.reason = err
+		}
+		report(w)
+	}()
+	return w
+}
+
+// Ends the monitoring. The watch is still reported, with errIdleInterrupted.
+func (w *idleWatch) stop() {
+	w.stopped.Store(true)
+	w.wake()
+}
+
+// Calls fn at the interval until the monitoring ends, e.g. to write updates to the conn. Calls are
+// done before the watch is reported.
+func (w *idleWatch) every(d time.Duration, fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ended {
+		return
+	}
+	w.updates = w.clock.AfterFunc(d, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if !w.ended {
+			fn()
+			w.updates.Reset(d)
+		}
+	})
+}
+
+func (w *idleWatch) wake() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.ended {
+		w.conn.SetReadDeadline(past())
+	}
+}
+
+// Reads early data into the conn, until an error occurs. Returns nil if the limit is exceeded.
+func readEarly(conn *Conn, limit int) error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.r.Read(buf)
+		conn.early = append(conn.early, buf[:n]...)
+		if len(conn.early) > limit {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Waits for readability by reading a single byte, which is pushed back as early data of the conn.
+// Used for conns without fd access, such as TLS and WebSocket conns.
+func waitReadableFallback(conn *Conn) error {
+	var b [1]byte
+	n, err := conn.r.Read(b[:])
+	if n > 0 {
+		conn.early = append(conn.early, b[0])
+		return nil
+	}
+	return err
+}
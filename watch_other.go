@@ -0,0 +1,7 @@
+//go:build !unix
+
+package rdv
+
+func waitReadable(conn *Conn) error {
+	return waitReadableFallback(conn)
+}
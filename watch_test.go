@@ -0,0 +1,167 @@
+package rdv
+
+import (
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock which only moves, and whose timers only fire, when told to.
+type manualClock struct {
+	mu      sync.Mutex
+	elapsed time.Duration
+	timers  []*manualTimer
+}
+
+type manualTimer struct {
+	c      *manualClock
+	f      func()
+	active bool
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Unix(0, 0).Add(c.elapsed)
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{c: c, f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Fires the active timers.
+func (c *manualClock) fire() {
+	c.mu.Lock()
+	var due []*manualTimer
+	for _, t := range c.timers {
+		if t.active {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// Moves the clock forward, and fires the active timers.
+func (c *manualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.elapsed += d
+	c.mu.Unlock()
+	c.fire()
+}
+
+// Waits until a timer is active, e.g. of a goroutine that is waiting for the clock.
+func (c *manualClock) awaitTimer(t *testing.T) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		active := slices.ContainsFunc(c.timers, func(t *manualTimer) bool { return t.active })
+		c.mu.Unlock()
+		if active {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected an active timer")
+		}
+	}
+}
+
+func (t *manualTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	active := t.active
+	t.active = true
+	return active
+}
+
+// Hides the SyscallConn of a conn, like TLS and WebSocket conns.
+type opaqueConn struct {
+	net.Conn
+}
+
+// Returns a lobby conn over loopback TCP and the client end, which are closed when the test ends.
+func tcpPair(t *testing.T) (server net.Conn, client net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+func TestWatchIdle(t *testing.T) {
+	tests := map[string]struct {
+		act    func(w *idleWatch, clock *manualClock, client net.Conn)
+		reason error
+	}{
+		"timeout":     {act: func(w *idleWatch, clock *manualClock, client net.Conn) { clock.fire() }, reason: errIdleTimeout},
+		"interrupted": {act: func(w *idleWatch, clock *manualClock, client net.Conn) { w.stop() }, reason: errIdleInterrupted},
+		"data":        {act: func(w *idleWatch, clock *manualClock, client net.Conn) { io.WriteString(client, "x") }, reason: errIdleData},
+		"closed":      {act: func(w *idleWatch, clock *manualClock, client net.Conn) { client.Close() }, reason: errIdleClosed},
+	}
+
+	for _, path := range []string{"tcp", "fallback"} {
+		for name, tc := range tests {
+			t.Run(path+"_"+name, func(t *testing.T) {
+				nc, client := tcpPair(t)
+				if path == "fallback" {
+					nc = opaqueConn{nc}
+				}
+				conn := newRelayConn(nc, nc, newMeta(false, "", "token"), nil)
+				clock := new(manualClock)
+				reported := make(chan *idleWatch, 1)
+				w := watchIdle(conn, clock, time.Minute, 0, func(w *idleWatch) { reported <- w })
+				tc.act(w, clock, client)
+				select {
+				case <-reported:
+				case <-time.After(2 * time.Second):
+					t.Fatal("expected the watch to be reported")
+				}
+				if w.reason != tc.reason {
+					t.Fatalf("expected %v, got %v", tc.reason, w.reason)
+				}
+				if tc.reason != errIdleData {
+					return
+				}
+
+				// The data is not consumed by the monitoring
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 1)
+				if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "x" {
+					t.Fatalf("expected x, got %q, %v", buf, err)
+				}
+			})
+		}
+	}
+}
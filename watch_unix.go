@@ -0,0 +1,40 @@
+//go:build unix
+
+package rdv
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// Blocks until the conn is readable, without consuming data. Returns nil if data is available.
+func waitReadable(conn *Conn) error {
+	sc, ok := conn.Conn.(syscall.Conn)
+	if !ok {
+		return waitReadableFallback(conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		n       int
+		peekErr error
+		buf     [1]byte
+	)
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, peekErr = syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK)
+		return !errors.Is(peekErr, syscall.EAGAIN)
+	})
+	if err != nil {
+		return err
+	}
+	if peekErr != nil {
+		return peekErr
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	return nil
+}
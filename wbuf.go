@@ -0,0 +1,113 @@
+package rdv
+
+import (
+	"sync"
+	"time"
+)
+
+// Buffers small writes of a conn, so that chatty protocols don't cost a syscall and a packet per
+// message, see ClientConfig.WriteBuffer. The buffer is flushed once full, after the flush delay,
+// on Flush and on Close.
+type writeBuffer struct {
+	write func([]byte) (int, error)
+	size  int
+	delay time.Duration // or negative for no auto flush
+	timer *time.Timer   // of the auto flush, which is reused so that at most one is running
+
+	mu      sync.Mutex // held during writes, which may block
+	buf     []byte
+	pending bool  // whether the auto flush is scheduled
+	err     error // of a failed auto flush, returned by the next write
+}
+
+func newWriteBuffer(write func([]byte) (int, error), size int, delay time.Duration) *writeBuffer {
+	b := &writeBuffer{write: write, size: size, delay: delay, buf: make([]byte, 0, size)}
+	if delay >= 0 {
+		b.timer = time.AfterFunc(time.Hour, b.autoFlush)
+		b.timer.Stop()
+	}
+	return b
+}
+
+func (b *writeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(b.buf)+len(p) > b.size {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) >= b.size {
+		return b.write(p) // nothing to gain from copying it
+	}
+	b.buf = append(b.buf, p...)
+	if !b.pending && b.timer != nil {
+		b.pending = true
+		b.timer.Reset(b.delay)
+	}
+	return len(p), nil
+}
+
+func (b *writeBuffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	return b.flush()
+}
+
+// Flushes the buffer, or tries again after the delay if a write is in progress, instead of
+// waiting for it.
+func (b *writeBuffer) autoFlush() {
+	if !b.mu.TryLock() {
+		b.timer.Reset(b.delay)
+		return
+	}
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = b.flush()
+	}
+}
+
+// Writes the buffered data. Called with the lock held.
+func (b *writeBuffer) flush() error {
+	if b.pending {
+		b.timer.Stop()
+		b.pending = false
+	}
+	if len(b.buf) == 0 {
+		return nil
+	}
+	n, err := b.write(b.buf)
+	b.buf = b.buf[:copy(b.buf, b.buf[n:])] // keep the rest, e.g. after a write timeout
+	return err
+}
+
+// Writes the buffered data, if the conn buffers writes (see ClientConfig.WriteBuffer). Writes of
+// request-response protocols should be flushed before waiting for the response, rather than
+// waiting for the flush delay.
+func (c *Conn) Flush() error {
+	if c.wbuf == nil {
+		return nil
+	}
+	return c.wbuf.Flush()
+}
+
+// Flushes the buffered data, unless a write is in progress, and closes the conn. The flush is
+// given little time, since the peer may not be reading.
+func (c *Conn) Close() error {
+	if b := c.wbuf; b != nil {
+		c.Conn.SetWriteDeadline(verySoon()) // also ends a blocked write
+		if b.mu.TryLock() {
+			if b.err == nil {
+				b.flush()
+			}
+			b.mu.Unlock()
+		}
+	}
+	return c.Conn.Close()
+}
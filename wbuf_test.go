@@ -0,0 +1,172 @@
+package rdv
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the writes of a write buffer, and fails them with err, if set.
+type recordWriter struct {
+	mu     sync.Mutex
+	writes []string
+	err    error
+	block  chan struct{} // if set, writes block until it's closed
+}
+
+func (w *recordWriter) write(p []byte) (int, error) {
+	if w.block != nil {
+		<-w.block
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func (w *recordWriter) get() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.writes)
+}
+
+// Waits until the writes are as expected.
+func (w *recordWriter) await(t *testing.T, want ...string) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !slices.Equal(w.get(), want); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q, got %q", want, w.get())
+		}
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	tests := map[string]struct {
+		delay  time.Duration
+		writes []string
+		flush  bool
+		want   []string
+	}{
+		"size":      {delay: time.Hour, writes: []string{"abc", "def", "ghi"}, want: []string{"abcdef"}},
+		"large":     {delay: time.Hour, writes: []string{"ab", "0123456789"}, want: []string{"ab", "0123456789"}},
+		"delay":     {delay: 10 * time.Millisecond, writes: []string{"ab", "cd"}, want: []string{"abcd"}},
+		"flush":     {delay: time.Hour, writes: []string{"ab", "cd"}, flush: true, want: []string{"abcd"}},
+		"no_delay":  {delay: -1, writes: []string{"ab", "cd"}, flush: true, want: []string{"abcd"}},
+		"no_writes": {delay: time.Hour, flush: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := new(recordWriter)
+			b := newWriteBuffer(w.write, 8, tc.delay)
+			for _, p := range tc.writes {
+				if n, err := b.Write([]byte(p)); err != nil || n != len(p) {
+					t.Fatalf("expected %d bytes, got %d, %v", len(p), n, err)
+				}
+			}
+			if tc.flush {
+				if err := b.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.await(t, tc.want...)
+		})
+	}
+}
+
+// A failed auto flush fails the next writes and flushes.
+func TestWriteBufferStickyErr(t *testing.T) {
+	errWrite := errors.New("write failed")
+	w := &recordWriter{err: errWrite}
+	b := newWriteBuffer(w.write, 8, time.Millisecond)
+	if _, err := b.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		err := b.err
+		b.mu.Unlock()
+		if err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the auto flush to fail")
+		}
+	}
+	w.mu.Lock()
+	w.err = nil
+	w.mu.Unlock()
+	if _, err := b.Write([]byte("cd")); !errors.Is(err, errWrite) {
+		t.Fatalf("expected %v, got %v", errWrite, err)
+	}
+	if err := b.Flush(); !errors.Is(err, errWrite) {
+		t.Fatalf("expected %v, got %v", errWrite, err)
+	}
+}
+
+// Auto flushes don't wait for a write in progress, which may block, and try again later.
+func TestWriteBufferBusy(t *testing.T) {
+	w := new(recordWriter)
+	b := newWriteBuffer(w.write, 8, time.Millisecond)
+	if _, err := b.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()                       // like a blocked write
+	time.Sleep(20 * time.Millisecond) // many flush delays
+	for _, stack := range goroutines() {
+		if strings.Contains(stack, "(*writeBuffer).autoFlush") && strings.Contains(stack, "(*Mutex).Lock") {
+			t.Fatalf("expected no waiting auto flush, got:\n%s", stack)
+		}
+	}
+	b.mu.Unlock()
+	w.await(t, "ab")
+}
+
+// Close flushes the buffer, and doesn't wait for a peer that doesn't read.
+func TestWriteBufferClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := newDirectConn(a, false, newMeta(true, "", "token"), nil)
+	conn.wbuf = newWriteBuffer(conn.write, 8, time.Hour)
+	conn.Write([]byte("ab"))
+	got := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(b)
+		got <- string(data)
+	}()
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-got; data != "ab" {
+		t.Fatalf("expected ab, got %q", data)
+	}
+
+	// Without a reader, the flush times out
+	a, b = net.Pipe()
+	defer b.Close()
+	conn = newDirectConn(a, false, newMeta(true, "", "token"), nil)
+	conn.wbuf = newWriteBuffer(conn.write, 8, time.Hour)
+	conn.Write([]byte("ab"))
+	closed := make(chan error)
+	go func() { closed <- conn.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close not to block")
+	}
+	if _, err := conn.wbuf.Write([]byte("cd")); err != nil {
+		t.Fatal(err) // the flush error isn't sticky, only auto flush errors are
+	}
+	if err := conn.wbuf.Flush(); !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected the write to fail, got %v", err)
+	}
+}
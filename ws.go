@@ -0,0 +1,292 @@
+package rdv
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The rdv protocol can also run over WebSocket, for proxies and CDNs that only support WebSocket
+// upgrades. The request is a GET with the rdv method in the Rdv-Method header, and the server
+// accepts the WebSocket right away. Once matched, the server sends the rdv response (same as
+// without WebSocket) as the first bytes of the WebSocket stream. Data is sent in binary messages.
+const (
+	// WebSocket subprotocol of rdv. The rdv protocol name isn't a valid subprotocol token.
+	wsProtocol = "rdv-1"
+
+	// RFC 6455 magic value, for computing Sec-WebSocket-Accept
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// Max payload size of control frames
+	wsMaxControl = 125
+)
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+func isWebSocketReq(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+func checkWebSocketRequest(req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return fmt.Errorf("%w: bad http method for websocket %v", ErrUpgrade, req.Method)
+	}
+	if !headerHasToken(req.Header, "Connection", "upgrade") {
+		return fmt.Errorf("%w: requires connection upgrade", ErrUpgrade)
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" || req.Header.Get("Sec-WebSocket-Key") == "" {
+		return fmt.Errorf("%w: bad websocket handshake", ErrUpgrade)
+	}
+	if !headerHasToken(req.Header, "Sec-WebSocket-Protocol", wsProtocol) {
+		return fmt.Errorf("%w: missing websocket subprotocol %s", ErrUpgrade, wsProtocol)
+	}
+	return nil
+}
+
+// Turns an rdv request into a WebSocket request. Returns the expected Sec-WebSocket-Accept value.
+func toWebSocketReq(req *http.Request) string {
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req.Header.Set(hMethod, req.Method)
+	req.Header.Set(hUpgrade, req.Header.Get("Upgrade"))
+	req.Method = http.MethodGet
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", wsProtocol)
+	return wsAccept(key)
+}
+
+func checkWebSocketResponse(resp *http.Response, accept string) error {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("unexpected http status %v", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != accept {
+		return fmt.Errorf("%w: bad websocket handshake", ErrUpgrade)
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != wsProtocol {
+		return fmt.Errorf("%w: bad websocket subprotocol %s", ErrUpgrade, resp.Header.Get("Sec-WebSocket-Protocol"))
+	}
+	return nil
+}
+
+// Hijacks the conn and accepts the WebSocket immediately.
+func upgradeWebSocket(w http.ResponseWriter, req *http.Request) (*wsConn, error) {
+	nc, brw, err := upgradeHttp(w, req, "websocket")
+	if err != nil {
+		return nil, err
+	}
+	resp := newUpgradeResponse(http.StatusSwitchingProtocols, "websocket")
+	resp.Header.Set("Sec-WebSocket-Accept", wsAccept(req.Header.Get("Sec-WebSocket-Key")))
+	resp.Header.Set("Sec-WebSocket-Protocol", wsProtocol)
+	nc.SetWriteDeadline(verySoon())
+	if err := resp.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetWriteDeadline(time.Time{})
+	return newWSConn(nc, brw.Reader, false), nil
+}
+
+// Returns the rdv header of the request. For WebSocket requests without the header, the query
+// param of the same name (in lower case) is used instead, since browsers can't set headers.
+func rdvParam(req *http.Request, name string) string {
+	if v := req.Header.Get(name); v != "" || !isWebSocketReq(req) {
+		return v
+	}
+	return req.URL.Query().Get(strings.ToLower(name))
+}
+
+// Returns the ws(s) URL of an rdv request for the browser's WebSocket API, with the rdv headers
+// as query params. Other headers are dropped.
+func browserWebSocketURL(req *http.Request) string {
+	u := *req.URL
+	u.Scheme = map[string]string{"http": "ws", "https": "wss"}[u.Scheme]
+	q := u.Query()
+	q.Set(strings.ToLower(hMethod), req.Method)
+	q.Set(strings.ToLower(hUpgrade), req.Header.Get("Upgrade"))
+	for _, name := range []string{hToken, hSelfAddrs, hNamespace, hHints, hCaps, hBanner, hGroupSize} {
+		if v := req.Header.Get(name); v != "" {
+			q.Set(strings.ToLower(name), v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range splitAndTrim(v, ",") {
+			if strings.EqualFold(part, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A minimal WebSocket conn, which sends each write as a binary message and reads the payload
+// of all data messages as a stream. Pings are answered while reading.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool // clients mask their frames, servers don't
+
+	// Read state of the current frame
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	wmu sync.Mutex
+}
+
+func newWSConn(nc net.Conn, r *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: nc, r: r, client: client}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// Reads frame headers until a data frame, and handles control frames.
+func (c *wsConn) nextFrame() error {
+	var hdr [14]byte
+	if _, err := io.ReadFull(c.r, hdr[:2]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0f
+	c.masked = hdr[1]&0x80 != 0
+	if c.masked == c.client {
+		return fmt.Errorf("%w: bad websocket frame masking", ErrProtocol)
+	}
+	size := int64(hdr[1] & 0x7f)
+	switch size {
+	case 126:
+		if _, err := io.ReadFull(c.r, hdr[2:4]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint16(hdr[2:4]))
+	case 127:
+		if _, err := io.ReadFull(c.r, hdr[2:10]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint64(hdr[2:10]) & (1<<63 - 1))
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remaining = size
+		return nil
+	case wsClose, wsPing, wsPong:
+		if size > wsMaxControl {
+			return fmt.Errorf("%w: websocket control frame too large", ErrProtocol)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		if opcode == wsClose {
+			return io.EOF
+		}
+		if opcode == wsPing {
+			return c.writeFrame(wsPong, payload)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: bad websocket opcode %d", ErrProtocol, opcode)
+}
+
+func (c *wsConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode) // FIN
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		for i, b := range payload {
+			buf = append(buf, b^mask[i%4])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(buf)
+	return err
+}
@@ -0,0 +1,129 @@
+package rdv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the client and server ends of a WebSocket conn over a pipe.
+func wsPair(t *testing.T) (client, server *wsConn) {
+	cnc, snc := net.Pipe()
+	t.Cleanup(func() {
+		cnc.Close()
+		snc.Close()
+	})
+	return newWSConn(cnc, bufio.NewReader(cnc), true), newWSConn(snc, bufio.NewReader(snc), false)
+}
+
+func TestWSConn(t *testing.T) {
+	// Payload lengths around the boundaries of the length encodings
+	for _, size := range []int{1, 125, 126, 0xffff, 0x10000} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			client, server := wsPair(t)
+			msg := bytes.Repeat([]byte{0xa5}, size)
+			for _, pair := range [][2]*wsConn{{client, server}, {server, client}} {
+				go pair[0].Write(msg)
+				buf := make([]byte, size)
+				if _, err := io.ReadFull(pair[1], buf); err != nil || !bytes.Equal(buf, msg) {
+					t.Fatalf("expected %d bytes, got %v", size, err)
+				}
+			}
+		})
+	}
+}
+
+// Pings are answered while reading, and don't interrupt the data.
+func TestWSConnPing(t *testing.T) {
+	client, server := wsPair(t)
+	go func() {
+		server.writeFrame(wsPing, []byte("ping"))
+		server.Write([]byte("data"))
+	}()
+	read := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(client, buf)
+		read <- string(buf)
+	}()
+	// The pong is sent while the client reads, masked
+	frame := make([]byte, 2+4+4)
+	if _, err := io.ReadFull(server.r, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != 0x80|wsPong || frame[1] != 0x80|4 {
+		t.Fatalf("expected a pong, got %x", frame[:2])
+	}
+	for i := range 4 {
+		frame[6+i] ^= frame[2+i]
+	}
+	if pong := string(frame[6:]); pong != "ping" {
+		t.Fatalf("expected ping, got %q", pong)
+	}
+	if data := <-read; data != "data" {
+		t.Fatalf("expected data, got %q", data)
+	}
+}
+
+// Servers require masked frames, and clients unmasked ones.
+func TestWSConnMasking(t *testing.T) {
+	client, server := wsPair(t)
+	unmasked := newWSConn(client.Conn, client.r, false)
+	go unmasked.Write([]byte("data"))
+	if _, err := server.Read(make([]byte, 4)); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected %v, got %v", ErrProtocol, err)
+	}
+}
+
+// Peers relay over WebSocket, also with a peer that doesn't use it.
+func TestWebSocket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hs := startServer(t, nil)
+	tests := map[string]struct {
+		cfg  *ClientConfig
+		addr string
+	}{
+		"config": {cfg: &ClientConfig{AddrSpaces: NoSpaces, WebSocket: true}, addr: hs.URL},
+		"scheme": {cfg: &ClientConfig{AddrSpaces: NoSpaces}, addr: "ws" + strings.TrimPrefix(hs.URL, "http")},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := NewClient(tc.cfg)
+			dc, ac := relayPair(t, ctx, client, tc.addr, name)
+			if _, ok := dc.Conn.(*wsConn); !ok {
+				t.Fatalf("expected a websocket conn, got %T", dc.Conn)
+			}
+			msg := strings.Repeat("x", 100<<10)
+			exchange(t, dc, ac, msg)
+			exchange(t, ac, dc, msg)
+
+			// A plain peer
+			accepted := make(chan *Conn, 1)
+			go func() {
+				conn, _, _ := NewClient(&ClientConfig{AddrSpaces: NoSpaces}).Accept(ctx, hs.URL, name+"_plain", nil)
+				accepted <- conn
+			}()
+			dc, _, err := client.Dial(ctx, tc.addr, name+"_plain", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dc.Close()
+			ac = <-accepted
+			if ac == nil {
+				t.FailNow()
+			}
+			defer ac.Close()
+			exchange(t, dc, ac, "mixed")
+			exchange(t, ac, dc, "mixed")
+		})
+	}
+}